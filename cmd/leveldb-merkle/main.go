@@ -0,0 +1,111 @@
+// Command leveldb-merkle checks the Merkle trees of the tables of a DB
+// against their data blocks, and rewrites the tables without a sound tree,
+// e.g. written by an upstream goleveldb, see leveldb.DB.RebuildMerkle.
+//
+// The DB is opened exclusively, it must not be in use; with -list, it is
+// opened read-only. Only the DBs of the default comparer are supported,
+// the key format being read from the manifest: the tables of a DB of a
+// custom comparer are checked by opening it with that comparer and calling
+// leveldb.DB.RebuildMerkle.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/errors"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+var (
+	dbPath string
+	levels arrayInt
+	list   bool
+)
+
+type arrayInt []int
+
+func (a arrayInt) String() string {
+	var str string
+	for i, n := range a {
+		if i > 0 {
+			str += ","
+		}
+		str += strconv.Itoa(n)
+	}
+	return str
+}
+
+func (a *arrayInt) Set(str string) error {
+	var na arrayInt
+	for _, s := range strings.Split(str, ",") {
+		s = strings.TrimSpace(s)
+		if s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				return err
+			}
+			na = append(na, n)
+		}
+	}
+	*a = na
+	return nil
+}
+
+func init() {
+	flag.StringVar(&dbPath, "db", "", "Path of the DB")
+	flag.Var(&levels, "levels", "Levels to check, comma separated (default all)")
+	flag.BoolVar(&list, "list", false, "List the recorded checks without checking")
+}
+
+func run() error {
+	db, err := leveldb.OpenFile(dbPath, &opt.Options{ErrorIfMissing: true, ReadOnly: list})
+	if err != nil {
+		if cerr, ok := err.(*errors.ErrCorrupted); ok {
+			if merr, ok := cerr.Err.(*leveldb.ErrManifestCorrupted); ok && merr.Field == "comparer" {
+				return fmt.Errorf("%v; only the DBs of the default comparer are supported", err)
+			}
+		}
+		return err
+	}
+	defer db.Close()
+
+	var checks []leveldb.MerkleTableCheck
+	if list {
+		checks, err = db.MerkleChecks()
+	} else {
+		checks, err = db.RebuildMerkle(levels...)
+	}
+	if err != nil {
+		return err
+	}
+
+	counts := make(map[leveldb.MerkleStatus]int)
+	for _, c := range checks {
+		fmt.Printf("L%d @%d %-10s %s\n", c.Level, c.Num, c.Status, c.Root)
+		counts[c.Status]++
+	}
+	fmt.Printf("%d tables: %d verified, %d rebuilt, %d repaired, %d unreadable\n", len(checks),
+		counts[leveldb.MerkleVerified], counts[leveldb.MerkleRebuilt], counts[leveldb.MerkleRepaired], counts[leveldb.MerkleUnreadable])
+	if counts[leveldb.MerkleUnreadable] > 0 {
+		return fmt.Errorf("%d unreadable tables", counts[leveldb.MerkleUnreadable])
+	}
+	return nil
+}
+
+func main() {
+	flag.Parse()
+	if dbPath == "" {
+		fmt.Fprintln(os.Stderr, "leveldb-merkle: missing -db")
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := run(); err != nil {
+		fmt.Fprintf(os.Stderr, "leveldb-merkle: %v\n", err)
+		os.Exit(1)
+	}
+}
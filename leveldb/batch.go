@@ -7,14 +7,17 @@
 package leveldb
 
 import (
+	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"sort"
 
 	"github.com/syndtr/goleveldb/leveldb/dbkey"
 
 	"github.com/syndtr/goleveldb/leveldb/errors"
 	"github.com/syndtr/goleveldb/leveldb/memdb"
+	"github.com/syndtr/goleveldb/leveldb/merkle"
 	"github.com/syndtr/goleveldb/leveldb/storage"
 )
 
@@ -35,6 +38,19 @@ func newErrBatchCorrupted(reason string) error {
 const (
 	batchHeaderLen = 8 + 4
 	batchGrowLimit = 3000
+
+	// batchRecVersioned is set on the key type byte of a record that
+	// carries a version number.
+	batchRecVersioned = 0x80
+
+	// batchRecVersionTime is the type byte of a meta record mapping a
+	// version to its commit time. Meta records are not counted as batch
+	// records and don't consume sequence numbers.
+	batchRecVersionTime = 0x40
+
+	// batchHashDomain separates the batch hashes from any other hash of
+	// the DB.
+	batchHashDomain = "leveldb/batch/v1\x00"
 )
 
 // BatchReplay wraps basic batch operations.
@@ -69,6 +85,9 @@ type Batch struct {
 	// internalLen is sums of key/value pair length plus 8-bytes internal key.
 	internalLen int
 
+	// versionTimes holds the version timestamp meta records.
+	versionTimes []versionTime
+
 	// growLimit is the threshold in order to slow down the memory allocation
 	// for batch when the number of accumulated entries exceeds value.
 	//
@@ -115,6 +134,7 @@ func (b *Batch) appendRecWithVersion(kt dbkey.KeyType, key, value []byte, versio
 	o++
 	// Write version if present
 	if version > 0 {
+		data[o-1] |= batchRecVersioned
 		o += binary.PutUvarint(data[o:], version)
 	}
 	o += binary.PutUvarint(data[o:], uint64(len(key)))
@@ -137,6 +157,20 @@ func (b *Batch) appendRecWithVersion(kt dbkey.KeyType, key, value []byte, versio
 	}
 }
 
+// appendVersionTime appends a version timestamp meta record.
+func (b *Batch) appendVersionTime(vt versionTime) {
+	n := 1 + 2*binary.MaxVarintLen64
+	b.grow(n)
+	o := len(b.data)
+	data := b.data[:o+n]
+	data[o] = batchRecVersionTime
+	o++
+	o += binary.PutUvarint(data[o:], vt.version)
+	o += binary.PutUvarint(data[o:], uint64(vt.time))
+	b.data = data[:o]
+	b.versionTimes = append(b.versionTimes, vt)
+}
+
 // Put appends 'put operation' of the given key/value pair to the batch.
 // It is safe to modify the contents of the argument after Put returns but not
 // before.
@@ -156,6 +190,12 @@ func (b *Batch) Delete(key []byte) {
 	b.appendRec(dbkey.KeyTypeDel, key, nil)
 }
 
+// DeleteWithVersion appends 'delete operation' with version number. The
+// key reads as absent from that version on.
+func (b *Batch) DeleteWithVersion(key []byte, version uint64) {
+	b.appendRecWithVersion(dbkey.KeyTypeDel, key, nil, version)
+}
+
 // Dump dumps batch contents. The returned slice can be loaded into the
 // batch using Load method.
 // The returned slice is not its own copy, so the contents should not be
@@ -195,6 +235,7 @@ func (b *Batch) Reset() {
 	b.data = b.data[:0]
 	b.index = b.index[:0]
 	b.internalLen = 0
+	b.versionTimes = b.versionTimes[:0]
 }
 
 func (b *Batch) replayInternal(fn func(i int, kt dbkey.KeyType, k, v []byte) error) error {
@@ -206,12 +247,62 @@ func (b *Batch) replayInternal(fn func(i int, kt dbkey.KeyType, k, v []byte) err
 	return nil
 }
 
+// maxVersion returns the highest version of the batch records.
+func (b *Batch) maxVersion() (version uint64) {
+	for _, index := range b.index {
+		if index.version > version {
+			version = index.version
+		}
+	}
+	return
+}
+
+// inOrder reports whether the versions of the batch records, in order,
+// never go below the given version nor below each other.
+func (b *Batch) inOrder(version uint64) bool {
+	for _, index := range b.index {
+		if index.version < version {
+			return false
+		}
+		version = index.version
+	}
+	return true
+}
+
+// versions returns the distinct versions of the batch records, in
+// ascending order, 0 standing for the unversioned records.
+func (b *Batch) versions() []uint64 {
+	var versions []uint64
+	seen := make(map[uint64]bool)
+	for _, index := range b.index {
+		if !seen[index.version] {
+			seen[index.version] = true
+			versions = append(versions, index.version)
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i] < versions[j]
+	})
+	return versions
+}
+
+// Hash returns the SHA-256 hash of the batch contents, as dumped by Dump,
+// prefixed by a domain tag.
+func (b *Batch) Hash() (h merkle.Hash) {
+	d := sha256.New()
+	d.Write([]byte(batchHashDomain))
+	d.Write(b.data)
+	d.Sum(h[:0])
+	return
+}
+
 func (b *Batch) append(p *Batch) {
 	ob := len(b.data)
 	oi := len(b.index)
 	b.data = append(b.data, p.data...)
 	b.index = append(b.index, p.index...)
 	b.internalLen += p.internalLen
+	b.versionTimes = append(b.versionTimes, p.versionTimes...)
 
 	// Updating index offset.
 	if ob != 0 {
@@ -229,9 +320,17 @@ func (b *Batch) decode(data []byte, expectedLen int) error {
 	b.data = data
 	b.index = b.index[:0]
 	b.internalLen = 0
+	b.versionTimes = b.versionTimes[:0]
 	err := decodeBatch(data, func(i int, index batchIndex) error {
 		b.index = append(b.index, index)
-		b.internalLen += index.keyLen + index.valueLen + 8
+		if index.version > 0 {
+			b.internalLen += index.keyLen + index.valueLen + 16
+		} else {
+			b.internalLen += index.keyLen + index.valueLen + 8
+		}
+		return nil
+	}, func(vt versionTime) error {
+		b.versionTimes = append(b.versionTimes, vt)
 		return nil
 	})
 	if err != nil {
@@ -245,11 +344,12 @@ func (b *Batch) decode(data []byte, expectedLen int) error {
 
 func (b *Batch) putMem(seq uint64, mdb *memdb.DB) error {
 	var ik []byte
+	kf := mdb.KeyFormat()
 	for i, index := range b.index {
 		if index.version > 0 {
-			ik = dbkey.MakeInternalKeyWithVersion(ik, index.k(b.data), index.version, seq+uint64(i), index.KeyType)
+			ik = kf.MakeInternalKeyWithVersion(ik, index.k(b.data), index.version, seq+uint64(i), index.KeyType)
 		} else {
-			ik = dbkey.MakeInternalKey(ik, index.k(b.data), seq+uint64(i), index.KeyType)
+			ik = kf.MakeInternalKey(ik, index.k(b.data), seq+uint64(i), index.KeyType)
 		}
 		if err := mdb.Put(ik, index.v(b.data)); err != nil {
 			return err
@@ -303,16 +403,51 @@ func MakeBatchWithConfig(config *BatchConfig) *Batch {
 	return batch
 }
 
-func decodeBatch(data []byte, fn func(i int, index batchIndex) error) error {
+// decodeBatch decodes the batch records, calling fn for each of them. The
+// meta records are passed to metaFn, or skipped if it is nil.
+func decodeBatch(data []byte, fn func(i int, index batchIndex) error, metaFn func(vt versionTime) error) error {
 	var index batchIndex
-	for i, o := 0, 0; o < len(data); i++ {
+	for i, o := 0, 0; o < len(data); {
+		// Version timestamp.
+		if data[o] == batchRecVersionTime {
+			o++
+			version, n := binary.Uvarint(data[o:])
+			if n <= 0 || version == 0 {
+				return newErrBatchCorrupted("bad meta record: invalid version")
+			}
+			o += n
+			t, n := binary.Uvarint(data[o:])
+			if n <= 0 {
+				return newErrBatchCorrupted("bad meta record: invalid time")
+			}
+			o += n
+			if metaFn != nil {
+				if err := metaFn(versionTime{version, int64(t)}); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
 		// Key type.
-		index.KeyType = dbkey.KeyType(data[o])
+		versioned := data[o]&batchRecVersioned != 0
+		index.KeyType = dbkey.KeyType(data[o] &^ batchRecVersioned)
 		if index.KeyType > dbkey.KeyTypeVal {
 			return newErrBatchCorrupted(fmt.Sprintf("bad record: invalid type %#x", uint(index.KeyType)))
 		}
 		o++
 
+		// Version.
+		index.version = 0
+		if versioned {
+			x, n := binary.Uvarint(data[o:])
+			if n <= 0 || x == 0 {
+				return newErrBatchCorrupted("bad record: invalid version")
+			}
+			o += n
+			index.version = x
+		}
+
 		// Key.
 		x, n := binary.Uvarint(data[o:])
 		o += n
@@ -341,6 +476,7 @@ func decodeBatch(data []byte, fn func(i int, index batchIndex) error) error {
 		if err := fn(i, index); err != nil {
 			return err
 		}
+		i++
 	}
 	return nil
 }
@@ -356,17 +492,22 @@ func decodeBatchToMem(data []byte, expectSeq uint64, mdb *memdb.DB) (seq uint64,
 	data = data[batchHeaderLen:]
 	var ik []byte
 	var decodedLen int
+	kf := mdb.KeyFormat()
 	err = decodeBatch(data, func(i int, index batchIndex) error {
 		if i >= batchLen {
 			return newErrBatchCorrupted("invalid records length")
 		}
-		ik = dbkey.MakeInternalKey(ik, index.k(data), seq+uint64(i), index.KeyType)
+		if index.version > 0 {
+			ik = kf.MakeInternalKeyWithVersion(ik, index.k(data), index.version, seq+uint64(i), index.KeyType)
+		} else {
+			ik = kf.MakeInternalKey(ik, index.k(data), seq+uint64(i), index.KeyType)
+		}
 		if err := mdb.Put(ik, index.v(data)); err != nil {
 			return err
 		}
 		decodedLen++
 		return nil
-	})
+	}, nil)
 	if err == nil && decodedLen != batchLen {
 		err = newErrBatchCorrupted(fmt.Sprintf("invalid records length: %d vs %d", batchLen, decodedLen))
 	}
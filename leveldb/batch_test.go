@@ -13,8 +13,10 @@ import (
 	"testing"
 	"testing/quick"
 
+	"github.com/syndtr/goleveldb/leveldb/comparer"
 	"github.com/syndtr/goleveldb/leveldb/dbkey"
 
+	"github.com/syndtr/goleveldb/leveldb/memdb"
 	"github.com/syndtr/goleveldb/leveldb/testutil"
 )
 
@@ -149,6 +151,49 @@ func TestBatch(t *testing.T) {
 	t.Logf("length=%d internalLen=%d", len(kvs), internalLen)
 }
 
+func TestBatchVersioned(t *testing.T) {
+	batch := new(Batch)
+	batch.PutWithVersion([]byte("a"), []byte("a1"), 1)
+	batch.Put([]byte("b"), []byte("b0"))
+	// Meta records don't count as batch records.
+	batch.appendVersionTime(versionTime{300, -5})
+	batch.DeleteWithVersion([]byte("c"), 300)
+	if batch.Len() != 3 {
+		t.Errorf("Len: %d, want 3", batch.Len())
+	}
+
+	loaded := new(Batch)
+	if err := loaded.Load(batch.Dump()); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if loaded.internalLen != batch.internalLen {
+		t.Errorf("internalLen: %d vs %d", batch.internalLen, loaded.internalLen)
+	}
+	for i, index := range batch.index {
+		if loaded.index[i] != index {
+			t.Errorf("index %d: %+v vs %+v", i, index, loaded.index[i])
+		}
+	}
+	if len(loaded.versionTimes) != 1 || loaded.versionTimes[0] != (versionTime{300, -5}) {
+		t.Errorf("versionTimes: %v", loaded.versionTimes)
+	}
+
+	data := append(encodeBatchHeader(nil, 10, batch.Len()), batch.Dump()...)
+	mdb := memdb.New(&iComparer{ucmp: comparer.DefaultComparer}, 0)
+	if _, _, err := decodeBatchToMem(data, 0, mdb); err != nil {
+		t.Fatalf("decodeBatchToMem: %v", err)
+	}
+	for _, ikey := range [][]byte{
+		dbkey.MakeInternalKeyWithVersion(nil, []byte("a"), 1, 10, dbkey.KeyTypeVal),
+		dbkey.MakeInternalKey(nil, []byte("b"), 11, dbkey.KeyTypeVal),
+		dbkey.MakeInternalKeyWithVersion(nil, []byte("c"), 300, 12, dbkey.KeyTypeDel),
+	} {
+		if !mdb.Contains(ikey) {
+			t.Errorf("memdb is missing %v", dbkey.InternalKey(ikey))
+		}
+	}
+}
+
 func BenchmarkDefaultBatchWrite(b *testing.B) {
 	benchmarkBatchWrite(b, nil)
 }
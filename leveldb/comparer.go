@@ -7,13 +7,24 @@
 package leveldb
 
 import (
+	"bytes"
+
 	"github.com/syndtr/goleveldb/leveldb/dbkey"
 
 	"github.com/syndtr/goleveldb/leveldb/comparer"
 )
 
+// iComparer is the internal comparer, ordering the internal keys by user
+// key with the user comparer, and then the records of a user key by version
+// and sequence number, the newest first, whatever the user comparer.
+//
+// The user comparer never sees the version and sequence number suffixes.
+// The separators and successors it returns are only used if they sort as
+// the comparer.Comparer contract says, the suffixes appended to them don't
+// matter as their user keys sort strictly between the given ones.
 type iComparer struct {
 	ucmp comparer.Comparer
+	kf   dbkey.Format
 }
 
 func (icmp *iComparer) uName() string {
@@ -38,6 +49,9 @@ func (icmp *iComparer) Name() string {
 
 // Compare compares two internal keys with version support.
 func (icmp *iComparer) Compare(a, b []byte) int {
+	if icmp.kf == dbkey.FormatBytewise {
+		return icmp.compareBytewise(a, b)
+	}
 	ukeyA, versionA, _, ikA, _ := dbkey.ParseInternalKeyWithVersion(a)
 	ukeyB, versionB, _, ikB, _ := dbkey.ParseInternalKeyWithVersion(b)
 	x := icmp.uCompare(ukeyA, ukeyB)
@@ -57,31 +71,85 @@ func (icmp *iComparer) Compare(a, b []byte) int {
 	return x
 }
 
+// bytewiseZeroSuffix is the suffix of zero version and sequence number in
+// the bytewise format.
+var bytewiseZeroSuffix = bytes.Repeat([]byte{0xff}, 16)
+
+// compareBytewise compares two internal keys in the bytewise format. The
+// user keys are escaped and terminated, so that the internal keys are
+// ordered by bytes.Compare under the default comparer. Otherwise they are
+// split, the user keys compared by the user comparer and the suffixes as
+// is.
+func (icmp *iComparer) compareBytewise(a, b []byte) int {
+	if icmp.ucmp == comparer.DefaultComparer {
+		return bytes.Compare(a, b)
+	}
+	// Malformed keys compare as the legacy ones too short to carry a
+	// version, with no user key and zero version and sequence number.
+	ukeyA, suffixA, ok := dbkey.SplitBytewise(a)
+	if !ok {
+		ukeyA, suffixA = nil, bytewiseZeroSuffix
+	}
+	ukeyB, suffixB, ok := dbkey.SplitBytewise(b)
+	if !ok {
+		ukeyB, suffixB = nil, bytewiseZeroSuffix
+	}
+	if x := icmp.uCompare(ukeyA, ukeyB); x != 0 {
+		return x
+	}
+	return bytes.Compare(suffixA, suffixB)
+}
+
+// ukey returns the pure user key of the internal key, or nil if it is too
+// short to carry a version.
+func (icmp *iComparer) ukey(ik []byte) []byte {
+	if icmp.kf == dbkey.FormatBytewise {
+		if ukey, suffix, ok := dbkey.SplitBytewise(ik); ok && len(suffix) == 16 {
+			return ukey
+		}
+		return nil
+	}
+	if len(ik) < 16 {
+		return nil
+	}
+	return ik[:len(ik)-16]
+}
+
+// maxKey returns the internal key of the given user key sorting before its
+// records, the version and the sequence number both encoded as KeyMaxNum.
+func (icmp *iComparer) maxKey(dst, ukey []byte) []byte {
+	return icmp.kf.MakeInternalKeyWithVersion(dst, ukey, dbkey.KeyMaxNum, dbkey.KeyMaxSeq, dbkey.KeyTypeSeek)
+}
+
 func (icmp *iComparer) Separator(dst, a, b []byte) []byte {
-	if len(a) < 16 || len(b) < 16 {
+	ukeyA, ukeyB := icmp.ukey(a), icmp.ukey(b)
+	if ukeyA == nil || ukeyB == nil {
 		return nil
 	}
-	ukeyA := a[:len(a)-16]
-	ukeyB := b[:len(b)-16]
-	dst = icmp.uSeparator(dst, ukeyA, ukeyB)
-	if dst != nil && len(dst) < len(ukeyA) && icmp.uCompare(ukeyA, dst) < 0 {
-		// Append highest possible version and seq for the separator
-		dst = append(dst, dbkey.KeyMaxNumBytes...)  // version = max
-		return append(dst, dbkey.KeyMaxNumBytes...) // seq = max
+	// The bytewise user keys can't be escaped in place.
+	var buf []byte
+	if icmp.kf != dbkey.FormatBytewise {
+		buf = dst[:0]
+	}
+	sep := icmp.uSeparator(buf, ukeyA, ukeyB)
+	if sep != nil && len(sep) < len(ukeyA) && icmp.uCompare(ukeyA, sep) < 0 && icmp.uCompare(sep, ukeyB) < 0 {
+		return icmp.maxKey(dst, sep)
 	}
 	return nil
 }
 
 func (icmp *iComparer) Successor(dst, b []byte) []byte {
-	if len(b) < 16 {
+	ukeyB := icmp.ukey(b)
+	if ukeyB == nil {
 		return nil
 	}
-	ukeyB := b[:len(b)-16]
-	dst = icmp.uSuccessor(dst, ukeyB)
-	if dst != nil && len(dst) < len(ukeyB) && icmp.uCompare(ukeyB, dst) < 0 {
-		// Append highest possible version and seq
-		dst = append(dst, dbkey.KeyMaxNumBytes...)
-		return append(dst, dbkey.KeyMaxNumBytes...)
+	var buf []byte
+	if icmp.kf != dbkey.FormatBytewise {
+		buf = dst[:0]
+	}
+	succ := icmp.uSuccessor(buf, ukeyB)
+	if succ != nil && len(succ) < len(ukeyB) && icmp.uCompare(ukeyB, succ) < 0 {
+		return icmp.maxKey(dst, succ)
 	}
 	return nil
 }
@@ -1,6 +1,8 @@
 package leveldb
 
 import (
+	"bytes"
+	"strings"
 	"testing"
 
 	"github.com/syndtr/goleveldb/leveldb/dbkey"
@@ -49,3 +51,100 @@ func TestComparerWithKeyMaxSeq(t *testing.T) {
 		t.Errorf("Lower seq should sort after higher seq, got %d", cmpSeq)
 	}
 }
+
+func TestComparerBytewise(t *testing.T) {
+	icmp := &iComparer{ucmp: comparer.DefaultComparer, kf: dbkey.FormatBytewise}
+	// The same ordering, through another comparer, splits the keys.
+	splitIcmp := &iComparer{ucmp: struct{ comparer.Comparer }{comparer.DefaultComparer}, kf: dbkey.FormatBytewise}
+
+	type rec struct {
+		ukey         string
+		version, seq uint64
+		kt           dbkey.KeyType
+	}
+	var recs []rec
+	for _, ukey := range []string{"", "\x00", "\x00\x00", "a", "a\x00", "a\x00\x01", "a\x01", "ab", "b\xff"} {
+		for _, version := range []uint64{0, 1, 255, 256, 1 << 40, dbkey.LastestVersion} {
+			for _, seq := range []uint64{0, 1, 256, dbkey.KeyMaxSeq} {
+				recs = append(recs, rec{ukey, version, seq, dbkey.KeyTypeDel}, rec{ukey, version, seq, dbkey.KeyTypeVal})
+			}
+		}
+	}
+	// The user keys ascending, then the versions, sequence numbers and
+	// types descending.
+	expected := func(a, b rec) int {
+		switch {
+		case a.ukey != b.ukey:
+			return strings.Compare(a.ukey, b.ukey)
+		case a.version != b.version:
+			if a.version > b.version {
+				return -1
+			}
+			return 1
+		case a.seq != b.seq:
+			if a.seq > b.seq {
+				return -1
+			}
+			return 1
+		case a.kt != b.kt:
+			if a.kt > b.kt {
+				return -1
+			}
+			return 1
+		}
+		return 0
+	}
+	sign := func(x int) int {
+		if x < 0 {
+			return -1
+		} else if x > 0 {
+			return 1
+		}
+		return 0
+	}
+	for _, a := range recs {
+		ka := dbkey.FormatBytewise.MakeInternalKeyWithVersion(nil, []byte(a.ukey), a.version, a.seq, a.kt)
+		if ukey, version, seq, kt, err := dbkey.FormatBytewise.ParseInternalKeyWithVersion(ka); err != nil || string(ukey) != a.ukey || version != a.version || seq != a.seq || kt != a.kt {
+			t.Fatalf("%+v: parsed as %q@%d,%d,%v (%v)", a, ukey, version, seq, kt, err)
+		}
+		for _, b := range recs {
+			kb := dbkey.FormatBytewise.MakeInternalKeyWithVersion(nil, []byte(b.ukey), b.version, b.seq, b.kt)
+			if x, y := expected(a, b), sign(icmp.Compare(ka, kb)); x != y {
+				t.Fatalf("%+v vs %+v: expected %d, got %d", a, b, x, y)
+			}
+			if x, y := expected(a, b), sign(bytes.Compare(ka, kb)); x != y {
+				t.Fatalf("%+v vs %+v: the keys are not bytewise ordered, expected %d, got %d", a, b, x, y)
+			}
+			if x, y := expected(a, b), sign(splitIcmp.Compare(ka, kb)); x != y {
+				t.Fatalf("%+v vs %+v: split keys: expected %d, got %d", a, b, x, y)
+			}
+		}
+	}
+}
+
+// overshootComparer returns separators breaking the comparer contract.
+type overshootComparer struct{ reverseComparer }
+
+func (overshootComparer) Separator(dst, a, b []byte) []byte { return append(dst, b[:1]...) }
+
+func TestComparerSeparator(t *testing.T) {
+	for _, kf := range []dbkey.Format{dbkey.FormatLegacy, dbkey.FormatBytewise} {
+		icmp := &iComparer{ucmp: reverseComparer{}, kf: kf}
+		a := kf.MakeInternalKeyWithVersion(nil, []byte("zebra"), 1, 10, dbkey.KeyTypeVal)
+		b := kf.MakeInternalKeyWithVersion(nil, []byte("apple"), dbkey.LastestVersion, 20, dbkey.KeyTypeVal)
+		x := icmp.Separator(nil, a, b)
+		if ukey, _, _, _, err := kf.ParseInternalKeyWithVersion(x); err != nil || string(ukey) != "z" {
+			t.Fatalf("%s: Separator(zebra, apple): unexpected %x (%v)", kf, x, err)
+		}
+		if icmp.Compare(a, x) >= 0 || icmp.Compare(x, b) >= 0 {
+			t.Errorf("%s: Separator(zebra, apple): %x does not sort between", kf, x)
+		}
+
+		// The separator z sorts after zz, it must not be used.
+		b = kf.MakeInternalKeyWithVersion(nil, []byte("zz"), 1, 20, dbkey.KeyTypeVal)
+		icmp.ucmp = overshootComparer{}
+		if x := icmp.Separator(nil, kf.MakeInternalKeyWithVersion(nil, []byte("zzz"), 1, 10, dbkey.KeyTypeVal), b); x != nil {
+			t.Errorf("%s: Separator: the shortened key %x breaking the contract is used", kf, x)
+		}
+	}
+}
@@ -36,7 +36,9 @@ import (
 // DB is a LevelDB database.
 type DB struct {
 	// Need 64-bit alignment.
-	seq uint64
+	seq            uint64
+	maxVersion     uint64
+	pruneWatermark uint64
 
 	// Stats. Need 64-bit alignment.
 	cWriteDelay            int64 // The cumulative duration of write delays
@@ -55,6 +57,7 @@ type DB struct {
 
 	// MemDB.
 	memMu           sync.RWMutex
+	memStateMu      sync.RWMutex // see getMemsVersion
 	memPool         chan *memdb.DB
 	mem, frozenMem  *memDB
 	journal         *journal.Writer
@@ -63,6 +66,10 @@ type DB struct {
 	frozenJournalFd storage.FileDesc
 	frozenSeq       uint64
 
+	// Journal hash chain.
+	jchainMu sync.Mutex
+	jchain   JournalChain
+
 	// Snapshot.
 	snapsMu   sync.Mutex
 	snapsList *list.List
@@ -87,8 +94,20 @@ type DB struct {
 	compErrSetC      chan error
 	compWriteLocking bool
 	compStats        cStats
+	pruneStats       pruneStats
 	memdbMaxLevel    int // For testing.
 
+	// Scrubber.
+	scrubMu     sync.Mutex
+	scrubReport *IntegrityReport
+
+	// Root signing.
+	srMu      sync.Mutex
+	srPending []SignedRoot // captured roots, not signed yet
+	srGen     uint64       // bumped by a rollback
+	srSignMu  sync.Mutex   // serializes the signing of the captured roots
+	srSignC   chan struct{}
+
 	//// mLSM MasterRoot: aggregates Merkle Roots from all levels
 	//masterRootMu sync.RWMutex
 	//masterRoot   merkle.Hash // Aggregated root hash of all levels
@@ -107,6 +126,10 @@ func openDB(s *session) (*DB, error) {
 		s: s,
 		// Initial sequence
 		seq: s.stSeqNum,
+		// Highest written version
+		maxVersion: s.stMaxVersion,
+		// Retention
+		pruneWatermark: s.stPruneWatermark,
 		// MemDB
 		memPool: make(chan *memdb.DB, 1),
 		// Snapshot
@@ -117,6 +140,8 @@ func openDB(s *session) (*DB, error) {
 		writeMergedC: make(chan bool),
 		writeLockC:   make(chan struct{}, 1),
 		writeAckC:    make(chan error),
+		// Root signing
+		srSignC: make(chan struct{}, 1),
 		// Compaction
 		tcompCmdC:   make(chan cCmd),
 		tcompPauseC: make(chan chan<- struct{}),
@@ -127,11 +152,19 @@ func openDB(s *session) (*DB, error) {
 		// Close
 		closeC: make(chan struct{}),
 	}
+	// Manifests of older releases lack the highest version, which the
+	// version ranges of the tables tell as well.
+	db.updateMaxVersion(atomic.LoadUint64(&s.stTableVersion))
 
 	// Read-only mode.
 	readOnly := s.o.GetReadOnly()
 
 	if readOnly {
+		// An interrupted rollback can only be completed in read-write mode.
+		if s.stRollbackPending {
+			return nil, ErrRollbackPending
+		}
+
 		// Recover journals (read-only mode).
 		if err := db.recoverJournalRO(); err != nil {
 			return nil, err
@@ -166,6 +199,22 @@ func openDB(s *session) (*DB, error) {
 		go db.tCompaction()
 		go db.mCompaction()
 		// go db.jWriter()
+
+		// Complete an interrupted rollback.
+		if err := db.resumeRollback(); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	if db.s.o.GetScrubInterval() > 0 {
+		db.closeW.Add(1)
+		go db.scrubber()
+	}
+
+	if db.s.o.GetRootSigner() != nil && !readOnly {
+		db.closeW.Add(1)
+		go db.rootSigning()
 	}
 
 	//// Initialize MasterRoot after opening
@@ -318,7 +367,9 @@ func recoverTable(s *session, o *opt.Options) error {
 		rec   = &sessionRecord{}
 		bpool = util.NewBufferPool(o.GetBlockSize() + 5)
 	)
-	buildTable := func(iter iterator.Iterator) (tmpFd storage.FileDesc, size int64, err error) {
+	// The entries are copied raw, keeping the value pointers of the tables
+	// pointing to value log files.
+	buildTable := func(iter iterator.Iterator, valuePointers bool) (tmpFd storage.FileDesc, size int64, err error) {
 		tmpFd = s.newTemp()
 		writer, err := s.stor.Create(tmpFd)
 		if err != nil {
@@ -342,10 +393,13 @@ func recoverTable(s *session, o *opt.Options) error {
 
 		// Copy entries.
 		tw := table.NewWriter(writer, o, nil, 0)
+		if valuePointers {
+			tw.SetValueLog(nil, 0)
+		}
 		for iter.Next() {
 			key := iter.Key()
-			if dbkey.ValidInternalKey(key) {
-				err = tw.Append(key, iter.Value())
+			if s.icmp.kf.ValidInternalKey(key) {
+				err = tw.AppendRaw(key, iter.Value())
 				if err != nil {
 					return
 				}
@@ -391,12 +445,15 @@ func recoverTable(s *session, o *opt.Options) error {
 			tSeq                                     uint64
 			tgoodKey, tcorruptedKey, tcorruptedBlock int
 			imin, imax                               []byte
+			tversions                                table.VersionRange
+			tversioned                               = true
 		)
 		tr, err := table.NewReader(reader, size, fd, nil, bpool, o)
 		if err != nil {
 			return err
 		}
-		iter := tr.NewIterator(nil, nil)
+		noMerkle := !tr.HasMerkle()
+		iter := tr.NewRawIterator(nil, nil)
 		if itererr, ok := iter.(iterator.ErrorCallbackSetter); ok {
 			itererr.SetErrorCallback(func(err error) {
 				if errors.IsCorrupted(err) {
@@ -410,14 +467,25 @@ func recoverTable(s *session, o *opt.Options) error {
 		for iter.Next() {
 			key := iter.Key()
 			// Try versioned key first (default), fall back to non-versioned for recovery
-			_, _, seq, _, kerr := dbkey.ParseInternalKeyWithVersion(key)
+			_, version, seq, _, kerr := s.icmp.kf.ParseInternalKeyWithVersion(key)
 			if kerr != nil {
 				// Fall back to non-versioned key for recovery compatibility
-				_, seq, _, kerr = dbkey.ParseInternalKey(key)
+				_, seq, _, kerr = s.icmp.kf.ParseInternalKey(key)
 				if kerr != nil {
 					tcorruptedKey++
 					continue
 				}
+				tversioned = false
+			} else {
+				if tgoodKey == 0 || version < tversions.MinVersion {
+					tversions.MinVersion = version
+				}
+				if tgoodKey == 0 || version > tversions.MaxVersion {
+					tversions.MaxVersion = version
+				}
+				if tgoodKey == 0 || seq > tversions.MaxSeq {
+					tversions.MaxSeq = seq
+				}
 			}
 			tgoodKey++
 			if seq > tSeq {
@@ -448,8 +516,8 @@ func recoverTable(s *session, o *opt.Options) error {
 			if tcorruptedKey > 0 || tcorruptedBlock > 0 {
 				// Rebuild the table.
 				s.logf("table@recovery rebuilding @%d", fd.Num)
-				iter := tr.NewIterator(nil, nil)
-				tmpFd, newSize, err := buildTable(iter)
+				iter := tr.NewRawIterator(nil, nil)
+				tmpFd, newSize, err := buildTable(iter, len(tr.ValueLogs()) > 0)
 				iter.Release()
 				if err != nil {
 					return err
@@ -460,6 +528,7 @@ func recoverTable(s *session, o *opt.Options) error {
 					return err
 				}
 				size = newSize
+				noMerkle = o.GetMerkleMode() != opt.MerkleEager
 			}
 			if tSeq > maxSeq {
 				maxSeq = tSeq
@@ -467,6 +536,15 @@ func recoverTable(s *session, o *opt.Options) error {
 			recoveredKey += tgoodKey
 			// Add table to level 0.
 			rec.addTable(0, fd.Num, size, imin, imax)
+			if tversioned {
+				rec.setTableVersions(fd.Num, tversions)
+			}
+			if nums := tr.ValueLogs(); len(nums) > 0 {
+				rec.setTableValueLogs(fd.Num, nums)
+			}
+			if noMerkle {
+				rec.setTableNoMerkle(fd.Num)
+			}
 			s.logf("table@recovery recovered @%d Gk·%d Ck·%d Cb·%d S·%d Q·%d", fd.Num, tgoodKey, tcorruptedKey, tcorruptedBlock, size, tSeq)
 		} else {
 			droppedTable++
@@ -523,7 +601,11 @@ func (db *DB) recoverJournal() error {
 	var (
 		ofd storage.FileDesc // Obsolete file.
 		rec = &sessionRecord{}
+		cv  = newJournalChainVerifier(db.s)
 	)
+	if err := cv.checkFiles(fds); err != nil {
+		return err
+	}
 
 	// Recover journals.
 	if len(fds) > 0 {
@@ -540,10 +622,20 @@ func (db *DB) recoverJournal() error {
 
 			jr       *journal.Reader
 			mdb      = memdb.New(db.s.icmp, writeBuffer)
+			ordered  = true // whether mdb was written in version order
 			buf      = &util.Buffer{}
+			batch    = &Batch{}
 			batchSeq uint64
 			batchLen int
+
+			// Journal records are checked against the tables, which
+			// don't change during recovery, plus the records replayed
+			// so far.
+			v  = db.s.version()
+			vc = db.newVersionChecker(nil, v)
 		)
+		defer v.release()
+		mdb.SetKeyFormat(db.s.icmp.kf)
 
 		for _, fd := range fds {
 			db.logf("journal@recovery recovering @%d", fd.Num)
@@ -560,11 +652,15 @@ func (db *DB) recoverJournal() error {
 				// Ignore the error here
 				_ = jr.Reset(fr, dropper{db.s, fd}, strict, checksum)
 			}
+			if err := cv.startJournal(fd); err != nil {
+				fr.Close()
+				return err
+			}
 
 			// Flush memdb and remove obsolete journal file.
 			if !ofd.Zero() {
 				if mdb.Len() > 0 {
-					if _, err := db.s.flushMemdb(rec, mdb, 0); err != nil {
+					if _, err := db.s.flushMemdb(rec, mdb, 0, ordered); err != nil {
 						fr.Close()
 						return err
 					}
@@ -572,11 +668,14 @@ func (db *DB) recoverJournal() error {
 
 				rec.setJournalNum(fd.Num)
 				rec.setSeqNum(db.seq)
+				rec.setMaxVersion(db.MaxVersion())
+				db.takeVersionTimes(rec)
 				if err := db.s.commit(rec, false); err != nil {
 					fr.Close()
 					return err
 				}
 				rec.resetAddedTables()
+				rec.resetVersionTimes()
 
 				if err := db.s.stor.Remove(ofd); err != nil {
 					fr.Close()
@@ -587,6 +686,7 @@ func (db *DB) recoverJournal() error {
 
 			// Replay journal to memdb.
 			mdb.Reset()
+			ordered = true
 			for {
 				r, err := jr.Next()
 				if err != nil {
@@ -608,7 +708,12 @@ func (db *DB) recoverJournal() error {
 					fr.Close()
 					return errors.SetFd(err, fd)
 				}
-				batchSeq, batchLen, err = decodeBatchToMem(buf.Bytes(), db.seq, mdb)
+				record, err := cv.record(buf.Bytes())
+				if err != nil {
+					fr.Close()
+					return err
+				}
+				batchSeq, batchLen, err = decodeBatchToMem(record, db.seq, mdb)
 				if err != nil {
 					if !strict && errors.IsCorrupted(err) {
 						db.s.logf("journal error: %v (skipped)", err)
@@ -623,14 +728,33 @@ func (db *DB) recoverJournal() error {
 				// Save sequence number.
 				db.seq = batchSeq + uint64(batchLen)
 
+				// Check version policy and track the highest version.
+				if err := batch.decode(record[batchHeaderLen:], batchLen); err != nil {
+					fr.Close()
+					return errors.SetFd(err, fd)
+				}
+				if vc != nil {
+					if err := vc.check(batch); err != nil {
+						fr.Close()
+						return errors.SetFd(err, fd)
+					}
+				}
+				maxVersion, known := db.orderVersion()
+				ordered = ordered && known && batch.inOrder(maxVersion)
+				db.updateMaxVersion(batch.maxVersion())
+				for _, vt := range batch.versionTimes {
+					db.s.vtIndex.add(vt, true)
+				}
+
 				// Flush it if large enough.
 				if mdb.Size() >= writeBuffer {
-					if _, err := db.s.flushMemdb(rec, mdb, 0); err != nil {
+					if _, err := db.s.flushMemdb(rec, mdb, 0, ordered); err != nil {
 						fr.Close()
 						return err
 					}
 
 					mdb.Reset()
+					ordered = true
 				}
 			}
 
@@ -640,20 +764,26 @@ func (db *DB) recoverJournal() error {
 
 		// Flush the last memdb.
 		if mdb.Len() > 0 {
-			if _, err := db.s.flushMemdb(rec, mdb, 0); err != nil {
+			if _, err := db.s.flushMemdb(rec, mdb, 0, ordered); err != nil {
 				return err
 			}
 		}
 	}
 
-	// Create a new journal.
+	// Create a new journal, chained from the replayed ones.
+	db.setJournalChain(cv.c)
 	if _, err := db.newMem(0); err != nil {
 		return err
 	}
+	if c, ok := db.journalChainStart(); ok {
+		rec.addJournalChain(c)
+	}
 
 	// Commit.
 	rec.setJournalNum(db.journalFd.Num)
 	rec.setSeqNum(db.seq)
+	rec.setMaxVersion(db.MaxVersion())
+	db.takeVersionTimes(rec)
 	if err := db.s.commit(rec, false); err != nil {
 		// Close journal on error.
 		if db.journal != nil {
@@ -696,7 +826,14 @@ func (db *DB) recoverJournalRO() error {
 		writeBuffer = db.s.o.GetWriteBuffer()
 
 		mdb = memdb.New(db.s.icmp, writeBuffer)
+		cv  = newJournalChainVerifier(db.s)
 	)
+	mdb.SetLeafFormat(db.merkleLeafFormat())
+	mdb.SetKeyFormat(db.s.icmp.kf)
+	mdb.SetMerklePool(db.s.merklePool)
+	if err := cv.checkFiles(fds); err != nil {
+		return err
+	}
 
 	// Recover journals.
 	if len(fds) > 0 {
@@ -725,6 +862,10 @@ func (db *DB) recoverJournalRO() error {
 					return err
 				}
 			}
+			if err := cv.startJournal(fd); err != nil {
+				fr.Close()
+				return err
+			}
 
 			// Replay journal to memdb.
 			for {
@@ -748,7 +889,12 @@ func (db *DB) recoverJournalRO() error {
 					fr.Close()
 					return errors.SetFd(err, fd)
 				}
-				batchSeq, batchLen, err = decodeBatchToMem(buf.Bytes(), db.seq, mdb)
+				record, err := cv.record(buf.Bytes())
+				if err != nil {
+					fr.Close()
+					return err
+				}
+				batchSeq, batchLen, err = decodeBatchToMem(record, db.seq, mdb)
 				if err != nil {
 					if !strict && errors.IsCorrupted(err) {
 						db.s.logf("journal error: %v (skipped)", err)
@@ -762,6 +908,12 @@ func (db *DB) recoverJournalRO() error {
 
 				// Save sequence number.
 				db.seq = batchSeq + uint64(batchLen)
+
+				// Load version timestamps.
+				if err := db.loadVersionTimes(record[batchHeaderLen:]); err != nil {
+					fr.Close()
+					return errors.SetFd(err, fd)
+				}
 			}
 
 			fr.Close()
@@ -770,19 +922,29 @@ func (db *DB) recoverJournalRO() error {
 
 	// Set memDB.
 	db.mem = &memDB{db: db, DB: mdb, ref: 1}
+	db.setJournalChain(cv.c)
 
 	return nil
 }
 
+// memFoundKey returns the internal key of the record found by seeking the
+// given key, which the memdb proof has to be generated for.
+func memFoundKey(mdb *memdb.DB, ikey dbkey.InternalKey) []byte {
+	if mk, _, err := mdb.Find(ikey); err == nil {
+		return mk
+	}
+	return ikey
+}
+
 func memGet(mdb *memdb.DB, ikey dbkey.InternalKey, icmp *iComparer) (ok bool, mv []byte, err error) {
 	mk, mv, err := mdb.Find(ikey)
 	if err == nil {
 		// Try to parse as versioned key first
 		if len(mk) >= 16 {
-			ukey, _, _, kt, kerr := dbkey.ParseInternalKeyWithVersion(mk)
+			ukey, _, _, kt, kerr := icmp.kf.ParseInternalKeyWithVersion(mk)
 			if kerr == nil {
 				// Parse query key to get its ukey
-				qUkey, _, _, _, qErr := dbkey.ParseInternalKeyWithVersion(ikey)
+				qUkey, _, _, _, qErr := icmp.kf.ParseInternalKeyWithVersion(ikey)
 				if qErr == nil && icmp.uCompare(ukey, qUkey) == 0 {
 					if kt == dbkey.KeyTypeDel {
 						return true, nil, ErrNotFound
@@ -792,7 +954,7 @@ func memGet(mdb *memdb.DB, ikey dbkey.InternalKey, icmp *iComparer) (ok bool, mv
 			}
 		}
 		// Fallback to non-versioned key parsing
-		uvkey, _, kt, kerr := dbkey.ParseInternalKey(mk)
+		uvkey, _, kt, kerr := icmp.kf.ParseInternalKey(mk)
 		if kerr != nil {
 			// Shouldn't have had happen.
 			panic(kerr)
@@ -810,7 +972,7 @@ func memGet(mdb *memdb.DB, ikey dbkey.InternalKey, icmp *iComparer) (ok bool, mv
 }
 
 func (db *DB) get(auxm *memdb.DB, auxt tFiles, key []byte, version, seq uint64, ro *opt.ReadOptions) (value []byte, err error) {
-	ikey := dbkey.MakeInternalKeyWithVersion(nil, key, version, seq, dbkey.KeyTypeSeek)
+	ikey := db.s.icmp.kf.MakeInternalKeyWithVersion(nil, key, version, seq, dbkey.KeyTypeSeek)
 	if auxm != nil {
 		if ok, mv, me := memGet(auxm, ikey, db.s.icmp); ok {
 			return append([]byte(nil), mv...), me
@@ -839,45 +1001,71 @@ func (db *DB) get(auxm *memdb.DB, auxt tFiles, key []byte, version, seq uint64,
 	return
 }
 
+// memTargetErr returns the error of a record found by memGet, when looking
+// for a value or, with tombstone, for a tombstone.
+func memTargetErr(me error, tombstone bool) error {
+	switch {
+	case !tombstone:
+		return me
+	case me == ErrNotFound:
+		return nil
+	case me == nil:
+		return ErrNotFound
+	}
+	return me
+}
+
 // getWithProof gets value and Merkle proof for a key at specified version across all layers
 // If version is 0, it searches for the latest version
 // Returns: value, actualVersion, proof, error
-func (db *DB) getWithProof(auxm *memdb.DB, auxt tFiles, key []byte, version, seq uint64, ro *opt.ReadOptions) (value []byte, actualVersion uint64, proof *DBProof, err error) {
-	ikey := dbkey.MakeInternalKeyWithVersion(nil, key, version, seq, dbkey.KeyTypeSeek)
+// In strict proof mode, a value found without a complete proof fails with
+// an *ErrProofUnavailable error.
+//
+// With tombstone, it proves the tombstone found for the key instead, and a
+// value found for it is ErrNotFound.
+func (db *DB) getWithProof(auxm *memdb.DB, auxt tFiles, key []byte, version, seq uint64, ro *opt.ReadOptions, tombstone bool) (value []byte, actualVersion uint64, proof *DBProof, err error) {
+	ikey := db.s.icmp.kf.MakeInternalKeyWithVersion(nil, key, version, seq, dbkey.KeyTypeSeek)
+	strict := db.strictProof(ro)
+
+	// Pin the state: the memdbs with their Merkle trees and the version.
+	em, fm, v := db.getMemsVersion()
+	defer v.release()
+	memDBs := [...]*memDB{em, fm}
+	for _, m := range memDBs {
+		if m != nil {
+			defer m.decref()
+		}
+	}
+	snapshots := memSnapshotsOf(em, fm)
 
 	// Try auxiliary memdb first
 	if auxm != nil {
 		if ok, _, me := memGet(auxm, ikey, db.s.icmp); ok {
-			if me != nil {
+			if me = memTargetErr(me, tombstone); me != nil {
 				return nil, 0, nil, me
 			}
 			// Generate MemDB proof
-			value, memProof, memRoot, _ := auxm.GetWithProof(ikey)
+			value, memProof, memRoot, _ := auxm.GetWithProof(memFoundKey(auxm, ikey))
 			actualVersion = version
-			if memProof != nil {
-				v := db.s.version()
-				proof = db.buildMemDBProof(memProof, memRoot, v)
-				v.release()
+			if proof, err = db.memDBProof(memProof, memRoot, snapshots, v, strict); err != nil {
+				return nil, 0, nil, err
 			}
 			return append([]byte(nil), value...), actualVersion, proof, nil
 		}
 	}
 
 	// Try effective and frozen memdb
-	em, fm := db.getMems()
-	memDBs := [...]*memDB{em, fm}
-	for _, m := range memDBs {
+	for i, m := range memDBs {
 		if m == nil {
 			continue
 		}
-		defer m.decref()
 
 		if ok, mv, me := memGet(m.DB, ikey, db.s.icmp); ok {
-			if me != nil {
+			if me = memTargetErr(me, tombstone); me != nil {
 				return nil, 0, nil, me
 			}
-			// Generate MemDB proof
-			_, memProof, memRoot, _ := m.DB.GetWithProof(ikey)
+			// Generate MemDB proof from the pinned snapshot
+			memProof, _, _ := snapshots[i].GenerateProof(memFoundKey(m.DB, ikey))
 			actualVersion = version
 
 			// Get version from the found value if querying latest
@@ -886,19 +1074,15 @@ func (db *DB) getWithProof(auxm *memdb.DB, auxt tFiles, key []byte, version, seq
 				actualVersion = db.ExtractVersionFromMemDB(m.DB, key)
 			}
 
-			if memProof != nil {
-				v := db.s.version()
-				proof = db.buildMemDBProof(memProof, memRoot, v)
-				v.release()
+			if proof, err = db.memDBProof(memProof, snapshots[i].GetRoot(), snapshots, v, strict); err != nil {
+				return nil, 0, nil, err
 			}
 			return append([]byte(nil), mv...), actualVersion, proof, nil
 		}
 	}
 
 	// Try SST files
-	v := db.s.version()
-	defer v.release()
-	value, actualVersion, sstProof, layerProof, cSched, err := v.getWithProof(auxt, ikey, ro)
+	value, actualVersion, proof, cSched, err := v.getWithProof(auxt, ikey, ro, strict, tombstone)
 	if cSched {
 		// Trigger table compaction.
 		db.compTrigger(db.tcompCmdC)
@@ -907,80 +1091,62 @@ func (db *DB) getWithProof(auxm *memdb.DB, auxt tFiles, key []byte, version, seq
 	if err != nil {
 		return nil, 0, nil, err
 	}
-	// Combine SST proof with layer proof and MasterRoot
-	if sstProof != nil && layerProof != nil {
+	// Complete the SST and layer proofs with the master proof
+	if proof != nil {
 		// Generate master proof for the layer
-		masterProof, err := db.generateMasterProof(v, layerProof.Root)
+		masterProof, _, err := db.generateMasterProof(snapshots, v, merkle.LayerKindLevel, proof.Level, proof.LayerProof.Root, strict)
 		if err != nil {
+			if strict {
+				return nil, 0, nil, err
+			}
 			// Log error but don't fail the query
 			db.logf("generate master proof error: %v", err)
 		}
-		proof = &DBProof{
-			DataProof:   sstProof,
-			LayerProof:  layerProof,
-			MasterProof: masterProof,
-		}
+		proof.MasterProof = masterProof
 	}
 	return value, actualVersion, proof, nil
 }
 
-// buildMemDBProof builds a complete proof for data found in MemDB
-func (db *DB) buildMemDBProof(memProof *merkle.MerkleProof, memRoot merkle.Hash, v *version) *DBProof {
-	// Get all layer roots for master proof
-	// Layers: [MemDB root, Level0 root, Level1 root, ...]
-	layerRoots := []merkle.Hash{memRoot}
-
-	if v != nil {
-		for level, tables := range v.levels {
-			if len(tables) == 0 {
-				continue
-			}
-			// Collect all SST roots in this level
-			var sstRoots []merkle.Hash
-			for _, t := range tables {
-				if root, err := db.s.tops.getMerkleRoot(t); err == nil {
-					sstRoots = append(sstRoots, root)
-				}
-			}
-			if len(sstRoots) > 0 {
-				levelRoot := merkle.BuildTreeFromHashes(sstRoots)
-				layerRoots = append(layerRoots, levelRoot)
-			}
-			_ = level // Suppress unused warning
+// memDBProof builds the complete proof of data found in a MemDB from its
+// MemDB proof, nil if the MemDB gave none, against the given memdb
+// snapshots and version, pinned together. In strict mode, a missing or
+// incomplete proof is an *ErrProofUnavailable error.
+func (db *DB) memDBProof(memProof *merkle.MerkleProof, memRoot merkle.Hash, snapshots []*memdb.MerkleSnapshot, v *version, strict bool) (*DBProof, error) {
+	if memProof == nil {
+		if strict {
+			return nil, &ErrProofUnavailable{ProofLinkData, "memdb gave no proof"}
 		}
+		return nil, nil
 	}
+	return db.buildMemDBProof(memProof, memRoot, snapshots, v, strict)
+}
 
-	// Build layer proof: MemDB root is at index 0
-	var layerProof *merkle.MerkleProof
-	var masterProof *merkle.MerkleProof
-
-	if len(layerRoots) > 1 {
-		// Build tree from layer roots
-		layerTree := merkle.NewMerkleTree(layerRoots)
-		// MemDB is at index 0
-		layerProof, _ = layerTree.GenerateProof(0)
-
-		// Master proof is trivial when we have the master root
-		masterProof = &merkle.MerkleProof{
-			Root:   layerTree.GetRoot(),
-			Exists: true,
-			Path:   nil, // Empty path, root is the master
-		}
-	} else {
-		// Only MemDB, it is the master
-		layerProof = &merkle.MerkleProof{
-			Root:   memRoot,
-			Exists: true,
-			Path:   nil,
-		}
-		masterProof = layerProof
+// buildMemDBProof builds a complete proof for data found in MemDB, against
+// the master tree of the given memdb snapshots and version.
+func (db *DB) buildMemDBProof(memProof *merkle.MerkleProof, memRoot merkle.Hash, snapshots []*memdb.MerkleSnapshot, v *version, strict bool) (*DBProof, error) {
+	// A memdb is a layer of its own, its root is the layer root
+	proof := &DBProof{
+		DataProof: memProof,
+		LayerProof: &merkle.MerkleProof{
+			Root:     memRoot,
+			Exists:   true,
+			TreeSize: 1,
+		},
+		LayerKind: merkle.LayerKindMemDB,
 	}
-
-	return &DBProof{
-		DataProof:   memProof,
-		LayerProof:  layerProof,
-		MasterProof: masterProof,
+	if v != nil {
+		// The memdb is identified by its root, which gives its level
+		masterProof, level, err := db.generateMasterProof(snapshots, v, merkle.LayerKindMemDB, -1, memRoot, strict)
+		if err != nil {
+			if strict {
+				return nil, err
+			}
+			db.logf("generate master proof error: %v", err)
+		}
+		proof.MasterProof = masterProof
+		proof.Level = level
 	}
+	return proof, nil
 }
 
 // ExtractVersionFromMemDB extracts the actual version for a key from MemDB
@@ -988,10 +1154,10 @@ func (db *DB) ExtractVersionFromMemDB(mdb *memdb.DB, key []byte) uint64 {
 	iter := mdb.NewIterator(nil)
 	defer iter.Release()
 
-	seekKey := dbkey.MakeInternalKeyWithVersion(nil, key, dbkey.LastestVersion, dbkey.KeyMaxSeq, dbkey.KeyTypeSeek)
+	seekKey := db.s.icmp.kf.MakeInternalKeyWithVersion(nil, key, dbkey.LastestVersion, dbkey.KeyMaxSeq, dbkey.KeyTypeSeek)
 	if iter.Seek(seekKey) {
 		ikey := iter.Key()
-		ukey, version, _, _, err := dbkey.ParseInternalKeyWithVersion(ikey)
+		ukey, version, _, _, err := db.s.icmp.kf.ParseInternalKeyWithVersion(ikey)
 		if err == nil && db.s.icmp.uCompare(ukey, key) == 0 {
 			return version
 		}
@@ -999,8 +1165,11 @@ func (db *DB) ExtractVersionFromMemDB(mdb *memdb.DB, key []byte) uint64 {
 	return 0
 }
 
-// getVersionHistory gets all versions of a key within a version range
+// getVersionHistory gets all versions of a key within a version range. In
+// strict proof mode, a version that can't be completely proven fails with
+// an *ErrProofUnavailable error.
 func (db *DB) getVersionHistory(auxm *memdb.DB, auxt tFiles, key []byte, minVersion, maxVersion uint64, seq uint64, ro *opt.ReadOptions, withProof bool) (entries []VersionEntry, err error) {
+	strict := withProof && db.strictProof(ro)
 	// Collect all matching versions from MemDB and SST files
 	// versionMap stores version -> (value, source) where source indicates MemDB or SST
 	type versionInfo struct {
@@ -1016,14 +1185,14 @@ func (db *DB) getVersionHistory(auxm *memdb.DB, auxt tFiles, key []byte, minVers
 		iter := mdb.NewIterator(nil)
 		defer iter.Release()
 
-		seekKey := dbkey.MakeInternalKeyWithVersion(nil, key, dbkey.LastestVersion, seq, dbkey.KeyTypeSeek)
+		seekKey := db.s.icmp.kf.MakeInternalKeyWithVersion(nil, key, dbkey.LastestVersion, seq, dbkey.KeyTypeSeek)
 		if !iter.Seek(seekKey) {
 			return
 		}
 
 		for ; iter.Valid(); iter.Next() {
 			ikey := iter.Key()
-			ukey, version, _, kt, kerr := dbkey.ParseInternalKeyWithVersion(ikey)
+			ukey, version, _, kt, kerr := db.s.icmp.kf.ParseInternalKeyWithVersion(ikey)
 			if kerr != nil {
 				break
 			}
@@ -1055,8 +1224,14 @@ func (db *DB) getVersionHistory(auxm *memdb.DB, auxt tFiles, key []byte, minVers
 		collectFromMemDB(auxm)
 	}
 
-	// Search in effective and frozen memdb
-	em, fm := db.getMems()
+	// Search in effective and frozen memdb, pinned with the version and
+	// their Merkle trees for the proofs.
+	em, fm, v := db.getMemsVersion()
+	defer v.release()
+	var snapshots []*memdb.MerkleSnapshot
+	if withProof {
+		snapshots = memSnapshotsOf(em, fm)
+	}
 	for _, m := range [...]*memDB{em, fm} {
 		if m == nil {
 			continue
@@ -1066,9 +1241,6 @@ func (db *DB) getVersionHistory(auxm *memdb.DB, auxt tFiles, key []byte, minVers
 	}
 
 	// Search in SST files
-	v := db.s.version()
-	defer v.release()
-
 	sstEntries, cSched, err := v.getVersionHistory(auxt, key, minVersion, maxVersion, ro)
 	if cSched {
 		db.compTrigger(db.tcompCmdC)
@@ -1103,16 +1275,40 @@ func (db *DB) getVersionHistory(auxm *memdb.DB, auxt tFiles, key []byte, minVers
 		// Get proof if requested
 		if withProof {
 			if info.fromMem && info.memDB != nil {
-				// Generate proof directly from MemDB using the exact internal key
-				_, memProof, memRoot, _ := info.memDB.GetWithProof(info.internalKey)
-				if memProof != nil {
-					entry.Proof = db.buildMemDBProof(memProof, memRoot, v)
+				// Generate proof directly from MemDB using the exact internal
+				// key, from its pinned snapshot unless auxiliary.
+				var (
+					memProof *merkle.MerkleProof
+					memRoot  merkle.Hash
+				)
+				for i, m := range [...]*memDB{em, fm} {
+					if m != nil && m.DB == info.memDB {
+						memProof, _, _ = snapshots[i].GenerateProof(info.internalKey)
+						memRoot = snapshots[i].GetRoot()
+					}
+				}
+				if info.memDB == auxm {
+					_, memProof, memRoot, _ = info.memDB.GetWithProof(info.internalKey)
+				}
+				switch {
+				case memProof != nil:
+					if entry.Proof, err = db.buildMemDBProof(memProof, memRoot, snapshots, v, strict); err != nil {
+						return nil, err
+					}
+				case strict:
+					return nil, &ErrProofUnavailable{ProofLinkData, fmt.Sprintf("memdb gave no proof of version %d", version)}
 				}
 			} else {
 				// Get proof from SST
-				_, actualVersion, proof, proofErr := db.getWithProof(auxm, auxt, key, version, seq, ro)
-				if proofErr == nil && actualVersion == version {
+				_, actualVersion, proof, proofErr := db.getWithProof(auxm, auxt, key, version, seq, ro, false)
+				switch {
+				case proofErr == nil && actualVersion == version:
 					entry.Proof = proof
+				case !strict:
+				case proofErr != nil:
+					return nil, proofErr
+				default:
+					return nil, &ErrProofUnavailable{ProofLinkData, fmt.Sprintf("version %d resolves to version %d", version, actualVersion)}
 				}
 			}
 		}
@@ -1135,7 +1331,7 @@ func (db *DB) collectVersionsFromMemDB(mdb *memdb.DB, key []byte, minVersion, ma
 	defer iter.Release()
 
 	// Seek to the first possible version of this key
-	seekKey := dbkey.MakeInternalKeyWithVersion(nil, key, dbkey.LastestVersion, seq, dbkey.KeyTypeSeek)
+	seekKey := db.s.icmp.kf.MakeInternalKeyWithVersion(nil, key, dbkey.LastestVersion, seq, dbkey.KeyTypeSeek)
 	if !iter.Seek(seekKey) {
 		return
 	}
@@ -1145,7 +1341,7 @@ func (db *DB) collectVersionsFromMemDB(mdb *memdb.DB, key []byte, minVersion, ma
 		ikey := iter.Key()
 
 		// Parse as versioned key (all keys must be versioned)
-		ukey, version, _, kt, err := dbkey.ParseInternalKeyWithVersion(ikey)
+		ukey, version, _, kt, err := db.s.icmp.kf.ParseInternalKeyWithVersion(ikey)
 		if err != nil {
 			break
 		}
@@ -1183,7 +1379,7 @@ func nilIfNotFound(err error) error {
 }
 
 func (db *DB) has(auxm *memdb.DB, auxt tFiles, key []byte, version, seq uint64, ro *opt.ReadOptions) (ret bool, err error) {
-	ikey := dbkey.MakeInternalKeyWithVersion(nil, key, version, seq, dbkey.KeyTypeSeek)
+	ikey := db.s.icmp.kf.MakeInternalKeyWithVersion(nil, key, version, seq, dbkey.KeyTypeSeek)
 
 	if auxm != nil {
 		if ok, _, me := memGet(auxm, ikey, db.s.icmp); ok {
@@ -1259,6 +1455,9 @@ func (db *DB) GetWithVersion(key []byte, version uint64, ro *opt.ReadOptions) (v
 // trusting the database. The proof contains the Merkle path from the
 // leaf node (containing the key-value pair) to the root hash.
 //
+// With opt.MerkleDeferred, GetWithProof first waits for the Merkle trees
+// of the tables written without, as do the other proof reads.
+//
 // The returned slices are their own copies, it is safe to modify them.
 // It is safe to modify the contents of the argument after GetWithProof returns.
 //
@@ -1272,11 +1471,54 @@ func (db *DB) GetWithProof(key []byte, version uint64, ro *opt.ReadOptions) (val
 	if err != nil {
 		return
 	}
+	if err = db.merkleReady(); err != nil {
+		return
+	}
+
+	se := db.acquireSnapshot()
+	defer db.releaseSnapshot(se)
+
+	return db.getWithProof(nil, nil, key, version, se.seq, ro, false)
+}
+
+// GetDeletionWithProof gets the Merkle proof of the tombstone of the given
+// key at the specified version, which can be verified with
+// DBProof.VerifyDeletion. If version is dbkey.LastestVersion, it proves the
+// latest record of the key to be a tombstone.
+// It returns ErrNotFound if the record of the key at the specified version
+// is not a tombstone, or if there is no such record.
+//
+// Returns:
+//   - actualVersion: the version of the tombstone
+//   - proof: the Merkle proof
+//   - err: error if any
+func (db *DB) GetDeletionWithProof(key []byte, version uint64, ro *opt.ReadOptions) (actualVersion uint64, proof *DBProof, err error) {
+	err = db.ok()
+	if err != nil {
+		return
+	}
+	if err = db.merkleReady(); err != nil {
+		return
+	}
 
 	se := db.acquireSnapshot()
 	defer db.releaseSnapshot(se)
 
-	return db.getWithProof(nil, nil, key, version, se.seq, ro)
+	_, actualVersion, proof, err = db.getWithProof(nil, nil, key, version, se.seq, ro, true)
+	return
+}
+
+// GetValueHashWithProof is like GetWithProof, but returns the hash of the
+// value, see merkle.HashValue, in place of the value. The proof can be
+// verified with DBProof.VerifyValueHash if the value was written with
+// opt.Options.MerkleValueHash or opt.Options.DedupValues, or stored in a
+// value log, otherwise it commits to the value itself.
+func (db *DB) GetValueHashWithProof(key []byte, version uint64, ro *opt.ReadOptions) (valueHash merkle.Hash, actualVersion uint64, proof *DBProof, err error) {
+	value, actualVersion, proof, err := db.GetWithProof(key, version, ro)
+	if err != nil {
+		return merkle.Hash{}, 0, nil, err
+	}
+	return merkle.HashValue(value), actualVersion, proof, nil
 }
 
 // VersionEntry represents a single version entry for a key.
@@ -1307,6 +1549,9 @@ func (db *DB) GetVersionHistoryWithProof(key []byte, minVersion, maxVersion uint
 	if err != nil {
 		return
 	}
+	if err = db.merkleReady(); err != nil {
+		return
+	}
 
 	se := db.acquireSnapshot()
 	defer db.releaseSnapshot(se)
@@ -1385,7 +1630,8 @@ func (db *DB) GetSnapshot() (*Snapshot, error) {
 //	leveldb.writedelay
 //		Returns cumulative write delay caused by compaction.
 //	leveldb.sstables
-//		Returns sstables list for each level.
+//		Returns sstables list for each level, with the range of the
+//		versions and the highest sequence number of their records.
 //	leveldb.blockpool
 //		Returns block pool stats.
 //	leveldb.cachedblock
@@ -1396,6 +1642,12 @@ func (db *DB) GetSnapshot() (*Snapshot, error) {
 //		Returns number of alive snapshots.
 //	leveldb.aliveiters
 //		Returns number of alive iterators.
+//	leveldb.pruned
+//		Returns per-level statistics of versions pruned by the retention
+//		policy, including the range of pruned versions.
+//	leveldb.valuelogs
+//		Returns the number of value log files, and the number and size of
+//		the values deduplicated since the DB was opened.
 func (db *DB) GetProperty(name string) (value string, err error) {
 	err = db.ok()
 	if err != nil {
@@ -1461,7 +1713,11 @@ func (db *DB) GetProperty(name string) (value string, err error) {
 		for level, tables := range v.levels {
 			value += fmt.Sprintf("--- level %d ---\n", level)
 			for _, t := range tables {
-				value += fmt.Sprintf("%d:%d[%q .. %q]\n", t.fd.Num, t.size, t.imin, t.imax)
+				value += fmt.Sprintf("%d:%d[%q .. %q]", t.fd.Num, t.size, t.imin, t.imax)
+				if t.hasVersions {
+					value += fmt.Sprintf(" V·[%d .. %d] Q·%d", t.versions.MinVersion, t.versions.MaxVersion, t.versions.MaxSeq)
+				}
+				value += "\n"
 			}
 		}
 	case p == "blockpool":
@@ -1478,6 +1734,30 @@ func (db *DB) GetProperty(name string) (value string, err error) {
 		value = fmt.Sprintf("%d", atomic.LoadInt32(&db.aliveSnaps))
 	case p == "aliveiters":
 		value = fmt.Sprintf("%d", atomic.LoadInt32(&db.aliveIters))
+	case p == "pruned":
+		value = fmt.Sprintf("Pruned Policy:%s Watermark:%d\n", db.s.o.GetRetention(), db.PruneWatermark()) +
+			" Level |   Records  |    Size(MB)   |  Versions\n" +
+			"-------+------------+---------------+-------------------------\n"
+		var total pruneStat
+		for level := range v.levels {
+			stat := db.pruneStats.getStat(level)
+			if stat.records == 0 {
+				continue
+			}
+			total.add(&stat)
+			value += fmt.Sprintf(" %3d   | %10d | %13.5f | %d .. %d\n",
+				level, stat.records, float64(stat.size)/1048576.0, stat.minVersion, stat.maxVersion)
+		}
+		value += "-------+------------+---------------+-------------------------\n"
+		if total.records > 0 {
+			value += fmt.Sprintf(" Total | %10d | %13.5f | %d .. %d\n",
+				total.records, float64(total.size)/1048576.0, total.minVersion, total.maxVersion)
+		} else {
+			value += fmt.Sprintf(" Total | %10d | %13.5f | -\n", 0, 0.0)
+		}
+	case p == "valuelogs":
+		files, dedupN, dedupSize := db.s.tops.vlog.stats()
+		value = fmt.Sprintf("Files:%d Dedup:%d DedupSize(MB):%.5f", files, dedupN, float64(dedupSize)/1048576.0)
 	default:
 		err = ErrNotFound
 	}
@@ -1586,8 +1866,8 @@ func (db *DB) SizeOf(ranges []util.Range) (Sizes, error) {
 
 	sizes := make(Sizes, 0, len(ranges))
 	for _, r := range ranges {
-		imin := dbkey.MakeInternalKey(nil, r.Start, dbkey.KeyMaxSeq, dbkey.KeyTypeSeek)
-		imax := dbkey.MakeInternalKey(nil, r.Limit, dbkey.KeyMaxSeq, dbkey.KeyTypeSeek)
+		imin := db.s.icmp.kf.MakeInternalKey(nil, r.Start, dbkey.KeyMaxSeq, dbkey.KeyTypeSeek)
+		imax := db.s.icmp.kf.MakeInternalKey(nil, r.Limit, dbkey.KeyMaxSeq, dbkey.KeyTypeSeek)
 		start, err := v.offsetOf(imin)
 		if err != nil {
 			return nil, err
@@ -1606,147 +1886,168 @@ func (db *DB) SizeOf(ranges []util.Range) (Sizes, error) {
 	return sizes, nil
 }
 
-func (db *DB) ComputeMasterRoot(v *version) merkle.Hash {
-	defer v.release()
+// masterLayer is a leaf of the master tree.
+type masterLayer struct {
+	kind  merkle.LayerKind
+	level int
+	root  merkle.Hash
+}
 
-	// Collect layer roots from all layers
-	// Order: [MemDB root, Level0 root, Level1 root, ...]
-	// Same order as buildMemDBProof and generateMasterProof
-	var layerRoots []merkle.Hash
+func (l masterLayer) hash() merkle.Hash {
+	return merkle.HashMasterLeaf(l.kind, l.level, l.root)
+}
 
-	// Add MemDB root if available (same as buildMemDBProof and generateMasterProof)
+// masterLayers returns the layers of the master tree of the current memdbs
+// and the given version, see stateLayers.
+func (db *DB) masterLayers(v *version) ([]masterLayer, error) {
+	return stateLayers(db.memSnapshots(), v)
+}
+
+// memSnapshots returns the Merkle snapshots of the current memdbs, see
+// memSnapshotsOf.
+func (db *DB) memSnapshots() []*memdb.MerkleSnapshot {
 	em, fm := db.getMems()
+	snapshots := memSnapshotsOf(em, fm)
 	for _, m := range [...]*memDB{em, fm} {
-		if m == nil {
-			continue
+		if m != nil {
+			m.decref()
 		}
-		defer m.decref()
+	}
+	return snapshots
+}
 
-		if m.Len() > 0 {
-			// Build MemDB snapshot to get root
-			memRoot := m.DB.GetMerkleRoot()
-			layerRoots = append(layerRoots, memRoot)
-			db.logf("master@root memdb layer_root=%x num_entries=%d", memRoot[:8], m.Len())
-			break // Only use the first non-empty memdb
+// memSnapshotsOf returns the Merkle snapshots of the given effective and
+// frozen memdbs, in this order, nil if absent or empty. The master proofs
+// of data read from memdbs must be generated from the snapshots of these
+// memdbs, which a memdb compaction may have dropped from the DB since.
+func memSnapshotsOf(em, fm *memDB) []*memdb.MerkleSnapshot {
+	snapshots := make([]*memdb.MerkleSnapshot, 2)
+	for i, m := range [...]*memDB{em, fm} {
+		if m != nil && m.Len() > 0 {
+			snapshots[i] = m.DB.BuildMerkleSnapshot()
 		}
 	}
+	return snapshots
+}
+
+// stateLayers returns the layers of the master tree, in order: the
+// non-empty memdbs, the active one first, then the non-empty levels.
+// The layer of a level is the tree of its layer leaves. The layers are
+// complete even on error, which reports the first level whose layer leaves
+// are degraded, see version.layerLeaves.
+func stateLayers(snapshots []*memdb.MerkleSnapshot, v *version) (layers []masterLayer, err error) {
+	return stateLayersWith(snapshots, v, v.s.tops.getMerkleRoot)
+}
 
-	// Process each level to collect layer roots
+// stateLayersWith is like stateLayers, with the table roots given by
+// rootOf.
+func stateLayersWith(snapshots []*memdb.MerkleSnapshot, v *version, rootOf func(t *tFile) (merkle.Hash, error)) (layers []masterLayer, err error) {
+	for i, snapshot := range snapshots {
+		if root := snapshot.GetRoot(); !root.IsZero() {
+			layers = append(layers, masterLayer{merkle.LayerKindMemDB, i, root})
+		}
+	}
 	for level, tables := range v.levels {
 		if len(tables) == 0 {
 			continue
 		}
-
-		// Collect all SST roots in this level
-		var sstRoots []merkle.Hash
-		for _, t := range tables {
-			// Try to get Merkle root from table
-			if root, err := db.s.tops.getMerkleRoot(t); err == nil {
-				sstRoots = append(sstRoots, root)
-				// db.logf("master@root level=%d file=%d root=%x", level, t.fd.Num, root[:8])
-			}
-		}
-
-		if len(sstRoots) > 0 {
-			// Build Merkle tree from SST roots to create this layer's root
-			// This is the KEY change: use BuildTreeFromHashes instead of AggregateRoots
-			layerRoot := merkle.BuildTreeFromHashes(sstRoots)
-			layerRoots = append(layerRoots, layerRoot)
-			db.logf("master@root level=%d layer_root=%x num_ssts=%d", level, layerRoot[:8], len(sstRoots))
+		leaves, lerr := v.layerLeavesWith(level, rootOf)
+		if lerr != nil && err == nil {
+			err = fmt.Errorf("level %d: %v", level, lerr)
 		}
+		layers = append(layers, masterLayer{merkle.LayerKindLevel, level, merkle.BuildTreeFromHashesWithPool(leaves, v.s.merklePool)})
 	}
-	if len(layerRoots) == 0 {
+	return layers, err
+}
+
+// masterRootOf returns the root of the master tree of the given layers.
+func masterRootOf(layers []masterLayer) merkle.Hash {
+	if len(layers) == 0 {
 		return merkle.Hash{} // Empty hash
 	}
-	// Build final Merkle tree from all layer roots to create MasterRoot
+	leaves := make([]merkle.Hash, len(layers))
+	for i, l := range layers {
+		leaves[i] = l.hash()
+	}
+	// Build final Merkle tree from all layer leaves to create MasterRoot
 	// This is the top-level aggregation
-	masterRoot := merkle.BuildTreeFromHashes(layerRoots)
-	db.logf("master@root final master_root=%x num_layers=%d", masterRoot[:8], len(layerRoots))
-	return masterRoot
+	return merkle.BuildTreeFromHashes(leaves)
 }
 
-// generateMasterProof generates a Merkle proof for a layer within the master tree.
-// The proof shows that a specific layer's root is part of the master tree.
-// layerProof.Root is used to identify which layer we're proving.
-func (db *DB) generateMasterProof(v *version, currentLayerRoot merkle.Hash) (*merkle.MerkleProof, error) {
-	// Collect all layer roots in the same order as buildMemDBProof
-	// Order: [MemDB root, Level0 root, Level1 root, ...]
-	var layerRoots []merkle.Hash
-	targetIndex := -1
-
-	// Add MemDB root if available (same as buildMemDBProof)
-	em, fm := db.getMems()
-	for _, m := range [...]*memDB{em, fm} {
-		if m == nil {
-			continue
-		}
-		defer m.decref()
-
-		if m.Len() > 0 {
-			// Build MemDB snapshot to get root
-			memRoot := m.DB.GetMerkleRoot()
-
-			// Check if memdb is the target layer
-			if memRoot.Equal(currentLayerRoot) {
-				targetIndex = len(layerRoots)
-			}
+// ComputeMasterRoot computes the master root of the DB state made of the
+// memdbs and the given version, which it releases.
+func (db *DB) ComputeMasterRoot(v *version) merkle.Hash {
+	defer v.release()
 
-			layerRoots = append(layerRoots, memRoot)
-			db.logf("master@proof memdb layer_root=%x num_entries=%d", memRoot[:8], m.Len())
-			break // Only use the first non-empty memdb
-		}
+	layers, err := db.masterLayers(v)
+	if err != nil {
+		db.logf("master@root degraded: %v", err)
 	}
+	masterRoot := masterRootOf(layers)
+	db.logf("master@root final master_root=%x num_layers=%d", masterRoot[:8], len(layers))
+	return masterRoot
+}
 
-	// Process each level to collect layer roots (same order as buildMemDBProof)
-	for level, tables := range v.levels {
-		if len(tables) == 0 {
-			continue
-		}
-
-		// Collect all SST roots in this level
-		var sstRoots []merkle.Hash
-		for _, t := range tables {
-			if root, err := db.s.tops.getMerkleRoot(t); err == nil {
-				sstRoots = append(sstRoots, root)
-			}
-		}
-
-		if len(sstRoots) > 0 {
-			// Build Merkle tree from SST roots to create this layer's root
-			layerRoot := merkle.BuildTreeFromHashes(sstRoots)
-
-			// Check if this is the target layer
-			if layerRoot.Equal(currentLayerRoot) {
-				targetIndex = len(layerRoots)
-			}
-
-			layerRoots = append(layerRoots, layerRoot)
-			db.logf("master@proof level=%d layer_root=%x num_ssts=%d", level, layerRoot[:8], len(sstRoots))
+// currentMasterRoot returns the master root of the current DB state, with
+// the memdbs and the version pinned together, see getMemsVersion.
+func (db *DB) currentMasterRoot() merkle.Hash {
+	em, fm, v := db.getMemsVersion()
+	defer v.release()
+	snapshots := memSnapshotsOf(em, fm)
+	for _, m := range [...]*memDB{em, fm} {
+		if m != nil {
+			m.decref()
 		}
 	}
+	layers, err := stateLayers(snapshots, v)
+	if err != nil {
+		db.logf("master@root degraded: %v", err)
+	}
+	return masterRootOf(layers)
+}
 
-	if len(layerRoots) == 0 {
-		return nil, nil
+// generateMasterProof generates a Merkle proof for a layer within the master tree.
+// The proof shows that a specific layer's root is part of the master tree.
+// The layer is identified by its kind, level and root, a negative level
+// matches any level of the kind; the level of the proven layer is returned.
+// The master tree is the one of the given memdb snapshots and version, see
+// stateLayers. In strict mode, a degraded master tree or a layer not found
+// in it fails the proof with an *ErrProofUnavailable error.
+func (db *DB) generateMasterProof(snapshots []*memdb.MerkleSnapshot, v *version, kind merkle.LayerKind, level int, layerRoot merkle.Hash, strict bool) (*merkle.MerkleProof, int, error) {
+	layers, err := stateLayers(snapshots, v)
+	if err != nil && strict {
+		return nil, level, &ErrProofUnavailable{ProofLinkMaster, err.Error()}
+	}
+	targetIndex := -1
+	leaves := make([]merkle.Hash, len(layers))
+	for i, l := range layers {
+		leaves[i] = l.hash()
+		if targetIndex < 0 && l.kind == kind && (level < 0 || l.level == level) && l.root.Equal(layerRoot) {
+			targetIndex = i
+		}
 	}
 
 	if targetIndex < 0 {
-		// Layer root not found in current version
+		// Layer not found in current state
 		// This can happen if the version changed between queries
-		db.logf("master@proof layer root not found: %x", currentLayerRoot)
-		return nil, nil
+		db.logf("master@proof layer not found: kind=%d level=%d root=%x", kind, level, layerRoot)
+		if strict {
+			return nil, level, &ErrProofUnavailable{ProofLinkMaster, "layer not found in the master tree"}
+		}
+		return nil, level, nil
 	}
 
-	// Build master tree from layer roots
-	masterTree := merkle.NewMerkleTree(layerRoots)
+	// Build master tree from layer leaves
+	masterTree := merkle.NewMerkleTreeWithPool(leaves, db.s.merklePool)
 
 	// Generate proof for the target layer
 	masterProof, err := masterTree.GenerateProof(targetIndex)
 	if err != nil {
-		return nil, err
+		return nil, level, err
 	}
 
-	db.logf("master@proof generated for layer_index=%d total_layers=%d", targetIndex, len(layerRoots))
-	return masterProof, nil
+	db.logf("master@proof generated for layer_index=%d total_layers=%d", targetIndex, len(layers))
+	return masterProof, layers[targetIndex].level, nil
 }
 
 // Close closes the DB. This will also releases any outstanding snapshot,
@@ -267,6 +267,15 @@ func (db *DB) compactionCommit(name string, rec *sessionRecord) {
 	}, nil)
 }
 
+// memCompactionCommit commits the memdb compaction record and drops the
+// frozen memdb, atomically for getMemsVersion.
+func (db *DB) memCompactionCommit(rec *sessionRecord) {
+	db.memStateMu.Lock()
+	defer db.memStateMu.Unlock()
+	db.compactionCommit("memdb", rec)
+	db.dropFrozenMem()
+}
+
 func (db *DB) memCompaction() {
 	mdb := db.getFrozenMem()
 	if mdb == nil {
@@ -304,13 +313,13 @@ func (db *DB) memCompaction() {
 	// Generate tables.
 	db.compactionTransactFunc("memdb@flush", func(cnt *compactionTransactCounter) (err error) {
 		stats.startTimer()
-		flushLevel, err = db.s.flushMemdb(rec, mdb.DB, db.memdbMaxLevel)
+		flushLevel, err = db.s.flushMemdb(rec, mdb.DB, db.memdbMaxLevel, !mdb.unordered)
 		stats.stopTimer()
 		return
 	}, func() error {
 		for _, r := range rec.addedTables {
 			db.logf("memdb@flush revert @%d", r.num)
-			if err := db.s.stor.Remove(storage.FileDesc{Type: storage.TypeTable, Num: r.num}); err != nil {
+			if err := db.s.tops.revert(storage.FileDesc{Type: storage.TypeTable, Num: r.num}); err != nil {
 				return err
 			}
 		}
@@ -319,10 +328,16 @@ func (db *DB) memCompaction() {
 
 	rec.setJournalNum(db.journalFd.Num)
 	rec.setSeqNum(db.frozenSeq)
+	db.compCommitLk.Lock()
+	if mdb.maxVersion > db.s.stMaxVersion {
+		rec.setMaxVersion(mdb.maxVersion)
+	}
+	db.takeVersionTimes(rec)
+	db.compCommitLk.Unlock()
 
-	// Commit.
+	// Commit, and drop the frozen memdb at once, see getMemsVersion.
 	stats.startTimer()
-	db.compactionCommit("memdb", rec)
+	db.memCompactionCommit(rec)
 	stats.stopTimer()
 
 	db.logf("memdb@flush committed F·%d T·%v", len(rec.addedTables), stats.duration)
@@ -334,9 +349,6 @@ func (db *DB) memCompaction() {
 	db.compStats.addStat(flushLevel, stats)
 	atomic.AddUint32(&db.memComp, 1)
 
-	// Drop frozen memdb.
-	db.dropFrozenMem()
-
 	//// Update MasterRoot after flush
 	//db.updateMasterRoot()
 
@@ -367,9 +379,12 @@ type tableCompactionBuilder struct {
 	snapIter        int
 	snapKerrCnt     int
 	snapDropCnt     int
+	snapPrune       pruneStat
 
 	kerrCnt int
 	dropCnt int
+	prune   pruneStat
+	pruner  versionPruner
 
 	minSeq    uint64
 	strict    bool
@@ -400,8 +415,8 @@ func (b *tableCompactionBuilder) appendKV(key, value []byte) error {
 		}
 	}
 
-	// Write key/value into table.
-	return b.tw.append(key, value)
+	// Write key/value into table, the value being raw.
+	return b.tw.appendRaw(key, value)
 }
 
 func (b *tableCompactionBuilder) needFlush() bool {
@@ -413,6 +428,7 @@ func (b *tableCompactionBuilder) flush() error {
 	if err != nil {
 		return err
 	}
+	t.ordered = b.c.levels[0].ordered() && b.c.levels[1].ordered()
 	b.rec.addTableFile(b.c.sourceLevel+1, t)
 	b.stat1.write += t.size
 	b.s.logf("table@build created L%d@%d N·%d S·%s %q:%q", b.c.sourceLevel+1, t.fd.Num, b.tw.tw.EntriesLen(), shortenb(t.size), t.imin, t.imax)
@@ -437,6 +453,7 @@ func (b *tableCompactionBuilder) run(cnt *compactionTransactCounter) (err error)
 	lastSeq := b.snapLastSeq
 	b.kerrCnt = b.snapKerrCnt
 	b.dropCnt = b.snapDropCnt
+	b.prune = b.snapPrune
 	// Restore compaction state.
 	b.c.restore()
 
@@ -471,7 +488,7 @@ func (b *tableCompactionBuilder) run(cnt *compactionTransactCounter) (err error)
 		}
 
 		ikey := iter.Key()
-		ukey, _, seq, kt, kerr := dbkey.ParseInternalKeyWithVersion(ikey)
+		ukey, version, seq, kt, kerr := b.s.icmp.kf.ParseInternalKeyWithVersion(ikey)
 
 		if kerr == nil {
 			shouldStop := !resumed && b.c.shouldStopBefore(ikey)
@@ -493,11 +510,21 @@ func (b *tableCompactionBuilder) run(cnt *compactionTransactCounter) (err error)
 					b.snapIter = i
 					b.snapKerrCnt = b.kerrCnt
 					b.snapDropCnt = b.dropCnt
+					b.snapPrune = b.prune
 				}
 
 				hasLastUkey = true
 				lastUkey = append(lastUkey[:0], ukey...)
 				lastSeq = dbkey.KeyMaxSeq
+				b.pruner.reset()
+			}
+
+			if b.pruner.drop(version, seq, kt) {
+				// Pruned by the retention policy.
+				lastSeq = seq
+				b.dropCnt++
+				b.prune.record(version, len(ikey)+len(iter.Value()))
+				continue
 			}
 
 			switch {
@@ -549,7 +576,7 @@ func (b *tableCompactionBuilder) run(cnt *compactionTransactCounter) (err error)
 func (b *tableCompactionBuilder) revert() error {
 	for _, at := range b.rec.addedTables {
 		b.s.logf("table@build revert @%d", at.num)
-		if err := b.s.stor.Remove(storage.FileDesc{Type: storage.TypeTable, Num: at.num}); err != nil {
+		if err := b.s.tops.revert(storage.FileDesc{Type: storage.TypeTable, Num: at.num}); err != nil {
 			return err
 		}
 	}
@@ -592,6 +619,7 @@ func (db *DB) tableCompaction(c *compaction, noTrivial bool) {
 		minSeq:    minSeq,
 		strict:    db.s.o.GetStrict(opt.StrictCompaction),
 		tableSize: db.s.o.GetCompactionTableSize(c.sourceLevel + 1),
+		pruner:    db.newVersionPruner(minSeq),
 	}
 	db.compactionTransact("table@build", b)
 
@@ -607,6 +635,10 @@ func (db *DB) tableCompaction(c *compaction, noTrivial bool) {
 	for i := range stats {
 		db.compStats.addStat(c.sourceLevel+1, &stats[i])
 	}
+	if b.prune.records > 0 {
+		db.logf("table@compaction pruned N·%d S·%s V·%d:%d", b.prune.records, shortenb(b.prune.size), b.prune.minVersion, b.prune.maxVersion)
+		db.pruneStats.addStat(c.sourceLevel+1, &b.prune)
+	}
 	switch c.typ {
 	case level0Compaction:
 		atomic.AddUint32(&db.level0Comp, 1)
@@ -849,13 +881,29 @@ func (db *DB) tCompaction() {
 				waitQ[i] = nil
 			}
 			waitQ = waitQ[:0]
-			select {
-			case x = <-db.tcompCmdC:
-			case ch := <-db.tcompPauseC:
-				db.pauseCompaction(ch)
-				continue
-			case <-db.closeC:
-				return
+			if db.tableNeedMerkle() {
+				// Build the deferred Merkle trees while idle, a table
+				// at a time.
+				select {
+				case x = <-db.tcompCmdC:
+				case ch := <-db.tcompPauseC:
+					db.pauseCompaction(ch)
+					continue
+				case <-db.closeC:
+					return
+				default:
+					db.tableMerkleBuild(1)
+					continue
+				}
+			} else {
+				select {
+				case x = <-db.tcompCmdC:
+				case ch := <-db.tcompPauseC:
+					db.pauseCompaction(ch)
+					continue
+				case <-db.closeC:
+					return
+				}
 			}
 		}
 		if x != nil {
@@ -871,6 +919,19 @@ func (db *DB) tCompaction() {
 				}
 			case cRange:
 				x.ack(db.tableRangeCompaction(cmd.level, cmd.min, cmd.max))
+			case cRollback:
+				x.ack(db.tableRollback(cmd.version))
+			case cMerkleRebuild:
+				*cmd.checks = db.tableMerkleRebuild(cmd.levels)
+				x.ack(nil)
+			case cMerkleBuild:
+				// Run the pending compactions first, their output tables
+				// would wait for their tree as well.
+				for db.tableNeedCompaction() {
+					db.tableAutoCompaction()
+				}
+				db.tableMerkleBuild(0)
+				x.ack(nil)
 			default:
 				panic("leveldb: unknown command")
 			}
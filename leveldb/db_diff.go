@@ -0,0 +1,361 @@
+package leveldb
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"sync/atomic"
+
+	"github.com/syndtr/goleveldb/leveldb/dbkey"
+
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// ChangeKind describes how a key changed between two versions.
+type ChangeKind int
+
+const (
+	// ChangeAdded means the key is absent at the old version and present
+	// at the new version.
+	ChangeAdded ChangeKind = iota
+	// ChangeModified means the key is present at both versions with
+	// different values.
+	ChangeModified
+	// ChangeDeleted means the key is present at the old version and absent
+	// (or deleted) at the new version.
+	ChangeDeleted
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case ChangeAdded:
+		return "added"
+	case ChangeModified:
+		return "modified"
+	case ChangeDeleted:
+		return "deleted"
+	}
+	return fmt.Sprintf("<invalid:%d>", k)
+}
+
+// DiffEntry is a single record produced by DiffIterator.
+//
+// The state of a key at version V is the value written with the highest
+// version less than or equal to V. OldVersion and NewVersion hold the
+// versions the old and new values were written at; they are zero when the
+// key is absent at that endpoint.
+type DiffEntry struct {
+	Key  []byte
+	Kind ChangeKind
+
+	OldVersion uint64
+	OldValue   []byte
+	NewVersion uint64
+	NewValue   []byte
+
+	// OldProof and NewProof prove OldValue and NewValue respectively.
+	// They are only populated by DiffWithProof, and are nil for an absent
+	// endpoint.
+	OldProof *DBProof
+	NewProof *DBProof
+}
+
+// diffState is the resolved state of a key at one endpoint.
+type diffState struct {
+	found   bool
+	deleted bool
+	version uint64
+	ikey    []byte
+	value   []byte
+}
+
+func (s *diffState) reset() {
+	s.found = false
+	s.deleted = false
+	s.version = 0
+	s.ikey = s.ikey[:0]
+	s.value = s.value[:0]
+}
+
+func (s *diffState) set(ikey []byte, version uint64, kt dbkey.KeyType, value []byte) {
+	s.found = true
+	s.deleted = kt == dbkey.KeyTypeDel
+	s.version = version
+	s.ikey = append(s.ikey[:0], ikey...)
+	s.value = append(s.value[:0], value...)
+}
+
+func (s *diffState) live() bool {
+	return s.found && !s.deleted
+}
+
+// DiffIterator iterates over the keys that changed between two versions,
+// in key order.
+//
+// The iterator must be released after use, by calling Release method.
+type DiffIterator struct {
+	db        *DB
+	icmp      *iComparer
+	iter      iterator.Iterator
+	se        *snapshotElement
+	ro        *opt.ReadOptions
+	from, to  uint64
+	withProof bool
+	strict    bool
+	released  bool
+	ukey      []byte
+	old, cur  diffState
+	entry     DiffEntry
+	err       error
+	started   bool
+	valid     bool
+}
+
+// Diff returns an iterator over the keys whose state differs between
+// fromVersion and toVersion, as seen by the latest snapshot of the DB.
+//
+// The state of a key at a version is the value written with the highest
+// version less than or equal to that version; a key whose newest such
+// record is a deletion is treated as absent. Keys that are absent at both
+// endpoints, or hold an identical value at both, are skipped.
+//
+// Slice allows slicing the iterator to only contains keys in the given
+// range. A nil Range.Start is treated as a key before all keys in the
+// DB. And a nil Range.Limit is treated as a key after all keys in the
+// DB.
+//
+// The fromVersion must not be greater than toVersion, or the iterator
+// yields nothing and reports ErrVersionRange.
+//
+// The whole versioned key space is walked once through a merged iterator,
+// so the cost is proportional to the number of entries in the slice rather
+// than to the number of keys multiplied by the number of levels.
+//
+// The iterator must be released after use, by calling Release method.
+func (db *DB) Diff(fromVersion, toVersion uint64, slice *util.Range, ro *opt.ReadOptions) *DiffIterator {
+	return db.newDiffIterator(fromVersion, toVersion, slice, ro, false)
+}
+
+// DiffWithProof is like Diff, but every returned entry also carries Merkle
+// proofs for its old and new values. The proofs can be checked with
+// DBProof.Verify using the entry key together with OldVersion/OldValue and
+// NewVersion/NewValue respectively.
+func (db *DB) DiffWithProof(fromVersion, toVersion uint64, slice *util.Range, ro *opt.ReadOptions) *DiffIterator {
+	return db.newDiffIterator(fromVersion, toVersion, slice, ro, true)
+}
+
+func (db *DB) newDiffIterator(fromVersion, toVersion uint64, slice *util.Range, ro *opt.ReadOptions, withProof bool) *DiffIterator {
+	if err := db.ok(); err != nil {
+		return &DiffIterator{err: err, released: true}
+	}
+	if fromVersion > toVersion {
+		return &DiffIterator{err: ErrVersionRange, released: true}
+	}
+	if withProof {
+		if err := db.merkleReady(); err != nil {
+			return &DiffIterator{err: err, released: true}
+		}
+	}
+
+	var islice *util.Range
+	if slice != nil {
+		islice = &util.Range{}
+		if slice.Start != nil {
+			islice.Start = db.s.icmp.kf.MakeInternalKeyWithVersion(nil, slice.Start, dbkey.LastestVersion, dbkey.KeyMaxSeq, dbkey.KeyTypeSeek)
+		}
+		if slice.Limit != nil {
+			islice.Limit = db.s.icmp.kf.MakeInternalKeyWithVersion(nil, slice.Limit, dbkey.LastestVersion, dbkey.KeyMaxSeq, dbkey.KeyTypeSeek)
+		}
+	}
+
+	// The snapshot is held until the iterator is released so that the
+	// proofs are generated against the same sequence number as the scan.
+	se := db.acquireSnapshot()
+	it := &DiffIterator{
+		db:        db,
+		icmp:      db.s.icmp,
+		iter:      db.newRawIterator(nil, nil, islice, ro),
+		se:        se,
+		ro:        ro,
+		from:      fromVersion,
+		to:        toVersion,
+		withProof: withProof,
+		strict:    opt.GetStrict(db.s.o.Options, ro, opt.StrictReader),
+	}
+	atomic.AddInt32(&db.aliveIters, 1)
+	runtime.SetFinalizer(it, (*DiffIterator).Release)
+	return it
+}
+
+// Next moves the iterator to the next changed key. It returns false if the
+// iterator is exhausted or an error occurred.
+func (it *DiffIterator) Next() bool {
+	if it.err != nil {
+		return false
+	} else if it.released {
+		it.err = ErrIterReleased
+		return false
+	}
+
+	it.valid = false
+	if !it.started {
+		it.started = true
+		if !it.iter.First() {
+			it.err = it.iter.Error()
+			return false
+		}
+	}
+
+	for it.iter.Valid() {
+		if !it.scanKey() {
+			return false
+		}
+		if it.emit() {
+			it.valid = it.err == nil
+			return it.valid
+		}
+	}
+	it.err = it.iter.Error()
+	return false
+}
+
+// scanKey consumes every record of the user key under the raw iterator and
+// resolves its state at both endpoints.
+func (it *DiffIterator) scanKey() bool {
+	it.old.reset()
+	it.cur.reset()
+	first := true
+	for ; it.iter.Valid(); it.iter.Next() {
+		ikey := it.iter.Key()
+		ukey, version, seq, kt, kerr := it.icmp.kf.ParseInternalKeyWithVersion(ikey)
+		if kerr != nil {
+			if it.strict {
+				it.err = kerr
+				return false
+			}
+			continue
+		}
+		if first {
+			it.ukey = append(it.ukey[:0], ukey...)
+			first = false
+		} else if it.icmp.uCompare(ukey, it.ukey) != 0 {
+			break
+		}
+		if seq > it.se.seq {
+			continue
+		}
+		// Records of a user key are ordered by version, then by sequence
+		// number, both descending; the first visible record at or below
+		// an endpoint is therefore the one that defines its state.
+		if !it.cur.found && version <= it.to {
+			it.cur.set(ikey, version, kt, it.iter.Value())
+		}
+		if !it.old.found && version <= it.from {
+			it.old.set(ikey, version, kt, it.iter.Value())
+		}
+	}
+	if err := it.iter.Error(); err != nil {
+		it.err = err
+		return false
+	}
+	return true
+}
+
+// emit fills the current entry from the resolved states and reports whether
+// the key changed.
+func (it *DiffIterator) emit() bool {
+	e := &it.entry
+	switch {
+	case !it.old.live() && it.cur.live():
+		e.Kind = ChangeAdded
+	case it.old.live() && !it.cur.live():
+		e.Kind = ChangeDeleted
+	case it.old.live() && it.cur.live() && !bytes.Equal(it.old.value, it.cur.value):
+		e.Kind = ChangeModified
+	default:
+		return false
+	}
+
+	e.Key = append([]byte(nil), it.ukey...)
+	e.OldVersion, e.OldValue = 0, nil
+	e.NewVersion, e.NewValue = 0, nil
+	e.OldProof, e.NewProof = nil, nil
+	if it.old.live() {
+		e.OldVersion = it.old.version
+		e.OldValue = append([]byte(nil), it.old.value...)
+	}
+	if it.cur.live() {
+		e.NewVersion = it.cur.version
+		e.NewValue = append([]byte(nil), it.cur.value...)
+	}
+
+	if it.withProof {
+		if it.old.live() {
+			e.OldProof, it.err = it.db.proveEntry(it.old.ikey, it.ukey, it.old.version, it.se.seq, it.ro)
+		}
+		if it.err == nil && it.cur.live() {
+			e.NewProof, it.err = it.db.proveEntry(it.cur.ikey, it.ukey, it.cur.version, it.se.seq, it.ro)
+		}
+	}
+	return true
+}
+
+// Entry returns the current record, or nil if the iterator is not positioned
+// at one. The entry is overwritten by the next call to Next, but the slices
+// it holds are fresh copies and may be retained.
+func (it *DiffIterator) Entry() *DiffEntry {
+	if !it.valid {
+		return nil
+	}
+	return &it.entry
+}
+
+// Error returns any accumulated error.
+func (it *DiffIterator) Error() error {
+	return it.err
+}
+
+// Release releases associated resources. Release should always success
+// and can be called multiple times without causing error.
+func (it *DiffIterator) Release() {
+	if it.released {
+		return
+	}
+	runtime.SetFinalizer(it, nil)
+	it.released = true
+	it.iter.Release()
+	it.iter = nil
+	it.db.releaseSnapshot(it.se)
+	atomic.AddInt32(&it.db.aliveIters, -1)
+	it.db = nil
+}
+
+// proveEntry generates a proof for the record with the exact internal key
+// ikey, which must be visible at seq.
+func (db *DB) proveEntry(ikey []byte, ukey []byte, version, seq uint64, ro *opt.ReadOptions) (*DBProof, error) {
+	// The memdb proof is keyed by the exact internal key, so try it first.
+	em, fm, v := db.getMemsVersion()
+	defer v.release()
+	for _, m := range [...]*memDB{em, fm} {
+		if m != nil {
+			defer m.decref()
+		}
+	}
+	snapshots := memSnapshotsOf(em, fm)
+	for _, snapshot := range snapshots {
+		if memProof, _, ok := snapshot.GenerateProof(ikey); ok {
+			return db.buildMemDBProof(memProof, snapshot.GetRoot(), snapshots, v, db.strictProof(ro))
+		}
+	}
+
+	_, actualVersion, proof, err := db.getWithProof(nil, nil, ukey, version, seq, ro, false)
+	if err != nil {
+		return nil, err
+	}
+	if actualVersion != version {
+		return nil, ErrNotFound
+	}
+	return proof, nil
+}
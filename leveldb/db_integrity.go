@@ -0,0 +1,332 @@
+package leveldb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb/merkle"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/table"
+)
+
+// CorruptFile is a table found corrupted by an integrity audit.
+type CorruptFile struct {
+	Level int
+	Num   int64
+	// Min and Max are the user key range of the table, as recorded in the
+	// manifest, that is the range of the affected keys
+	Min, Max []byte
+	// Reason describes the failed checks, separated by "; "
+	Reason string
+}
+
+// IntegrityReport is the report of an integrity audit, see
+// DB.VerifyIntegrity.
+type IntegrityReport struct {
+	// Tables, Bytes and Entries are the number of audited tables, their
+	// total size and their total number of entries
+	Tables  int
+	Bytes   int64
+	Entries int
+	// NoMerkle is the number of audited tables written without Merkle
+	// tree, see opt.MerkleMode, whose tree is not checked
+	NoMerkle int
+	Corrupt  []CorruptFile
+	// MasterRoot is the master root recomputed from the data blocks of the
+	// tables, StoredMasterRoot the one computed from their stored Merkle
+	// trees, that is the root the proofs verify against, the tables written
+	// without Merkle tree being left out of both. Both are zero unless
+	// every level was audited.
+	MasterRoot       merkle.Hash
+	StoredMasterRoot merkle.Hash
+}
+
+// OK reports whether the audit found no corruption.
+func (r *IntegrityReport) OK() bool {
+	return len(r.Corrupt) == 0 && r.MasterRoot == r.StoredMasterRoot
+}
+
+// ioThrottle limits the rate of the bytes read by an audit.
+type ioThrottle struct {
+	rate  int
+	start time.Time
+	n     int64
+}
+
+func newIOThrottle(rate int) *ioThrottle {
+	return &ioThrottle{rate: rate, start: time.Now()}
+}
+
+// wait accounts n more read bytes, and waits until the rate is met again.
+// It returns the context error if the context is done first.
+func (th *ioThrottle) wait(ctx context.Context, n int64) error {
+	if th.rate <= 0 {
+		return ctx.Err()
+	}
+	th.n += n
+	d := time.Duration(float64(th.n)/float64(th.rate)*float64(time.Second)) - time.Since(th.start)
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// auditReadOptions reads the tables bypassing the cache, verifying every
+// block checksum.
+var auditReadOptions = &opt.ReadOptions{DontFillCache: true, Strict: opt.StrictOverride | opt.StrictReader | opt.StrictBlockChecksum}
+
+// auditTable checks the given table: its data blocks must be readable, its
+// Merkle tree must match them, unless written without, its first and last
+// keys must be the ones recorded in the manifest, as must be its root if
+// recorded by a Merkle check. It returns the table verification, nil if the data blocks are
+// unreadable, and the report of the table if corrupted.
+func (db *DB) auditTable(level int, t *tFile) (*table.MerkleVerification, *CorruptFile) {
+	var reasons []string
+	mv, err := db.s.tops.verifyMerkle(t, auditReadOptions)
+	if err != nil {
+		reasons = append(reasons, fmt.Sprintf("unreadable: %v", err))
+	} else {
+		switch mv.State {
+		case table.MerkleMissing:
+			if !t.noMerkle {
+				reasons = append(reasons, "no Merkle tree")
+			}
+		case table.MerkleCorrupted:
+			reasons = append(reasons, "Merkle tree doesn't match the data blocks")
+		}
+		if !bytes.Equal(mv.First, t.imin) || !bytes.Equal(mv.Last, t.imax) {
+			reasons = append(reasons, "key range doesn't match the manifest")
+		}
+		if c, ok := db.s.mcIndex.get(t.fd.Num); ok && c.status != MerkleUnreadable && !c.root.Equal(mv.Root) {
+			reasons = append(reasons, "Merkle root doesn't match the recorded check")
+		}
+	}
+	if len(reasons) == 0 {
+		return mv, nil
+	}
+	return mv, &CorruptFile{
+		Level:  level,
+		Num:    t.fd.Num,
+		Min:    append([]byte(nil), db.s.icmp.kf.Ukey(t.imin)...),
+		Max:    append([]byte(nil), db.s.icmp.kf.Ukey(t.imax)...),
+		Reason: strings.Join(reasons, "; "),
+	}
+}
+
+// VerifyIntegrity audits the tables of the DB, or of the levels given by
+// the options. Every table is read in full, verifying the block checksums,
+// and its Merkle leaves are recomputed from its data blocks and compared
+// with its stored Merkle tree, if not written without, see opt.MerkleMode,
+// and its key range and root with the manifest. The audit of every level also recomputes the master root from
+// the data blocks, which must match the root computed from the stored
+// trees. The corrupted tables are listed by the returned report, an error
+// is only returned if the audit couldn't complete.
+//
+// The audit runs against the DB state at the time of the call, and doesn't
+// block writes nor compactions. It reads at most
+// IntegrityOptions.BytesPerSecond if set, and stops with the context error
+// when the context is done.
+func (db *DB) VerifyIntegrity(ctx context.Context, io *opt.IntegrityOptions) (*IntegrityReport, error) {
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+	levels := io.GetLevels()
+	for _, level := range levels {
+		if level < 0 {
+			return nil, errInvalidLevel
+		}
+	}
+
+	v := db.s.version()
+	defer v.release()
+	snapshots := db.memSnapshots()
+
+	audit := make([]bool, len(v.levels))
+	for level := range audit {
+		audit[level] = len(levels) == 0
+	}
+	for _, level := range levels {
+		if level < len(audit) {
+			audit[level] = true
+		}
+	}
+
+	var (
+		start = time.Now()
+		th    = newIOThrottle(io.GetBytesPerSecond())
+		rep   = &IntegrityReport{}
+		roots = make(map[int64]merkle.Hash)
+	)
+	for level, tables := range v.levels {
+		if !audit[level] {
+			continue
+		}
+		for _, t := range tables {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			if err := db.ok(); err != nil {
+				return nil, err
+			}
+			mv, cf := db.auditTable(level, t)
+			rep.Tables++
+			rep.Bytes += t.size
+			if mv != nil {
+				rep.Entries += mv.Entries
+				roots[t.fd.Num] = mv.Root
+				if t.noMerkle && mv.State == table.MerkleMissing {
+					// Its root is zero, as in the stored master root.
+					rep.NoMerkle++
+					roots[t.fd.Num] = merkle.Hash{}
+				}
+			}
+			if cf != nil {
+				rep.Corrupt = append(rep.Corrupt, *cf)
+			}
+			if err := th.wait(ctx, t.size); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(levels) == 0 {
+		stored, _ := stateLayers(snapshots, v)
+		recomputed, _ := stateLayersWith(snapshots, v, func(t *tFile) (merkle.Hash, error) {
+			root, ok := roots[t.fd.Num]
+			if !ok {
+				return merkle.Hash{}, fmt.Errorf("table @%d unreadable", t.fd.Num)
+			}
+			return root, nil
+		})
+		rep.StoredMasterRoot = masterRootOf(stored)
+		rep.MasterRoot = masterRootOf(recomputed)
+	}
+	db.logf("db@integrity done T·%d S·%s C·%d T·%v", rep.Tables, shortenb(rep.Bytes), len(rep.Corrupt), time.Since(start))
+	return rep, nil
+}
+
+// scrubber runs the background integrity scrubber, see
+// Options.ScrubInterval.
+func (db *DB) scrubber() {
+	defer db.closeW.Done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-db.closeC:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	interval := db.s.o.GetScrubInterval()
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-db.closeC:
+			return
+		case <-timer.C:
+		}
+		if err := db.scrubPass(ctx); err != nil {
+			return
+		}
+		timer.Reset(interval)
+	}
+}
+
+// scrubPass audits, one at a time, the tables live at the start of the
+// pass and still live when their turn comes, taking the current version
+// for each of them, then publishes the report of the pass. It only returns
+// an error if the context is done.
+func (db *DB) scrubPass(ctx context.Context) error {
+	v := db.s.version()
+	pending := make(map[int64]bool)
+	for _, tables := range v.levels {
+		for _, t := range tables {
+			pending[t.fd.Num] = true
+		}
+	}
+	v.release()
+
+	var (
+		start = time.Now()
+		th    = newIOThrottle(db.s.o.GetScrubBytesPerSecond())
+		rep   = &IntegrityReport{}
+	)
+	for {
+		var (
+			level = -1
+			t     *tFile
+		)
+		v := db.s.version()
+	pick:
+		for l, tables := range v.levels {
+			for _, lt := range tables {
+				if pending[lt.fd.Num] {
+					level, t = l, lt
+					break pick
+				}
+			}
+		}
+		if t == nil {
+			v.release()
+			break
+		}
+		delete(pending, t.fd.Num)
+		mv, cf := db.auditTable(level, t)
+		v.release()
+
+		rep.Tables++
+		rep.Bytes += t.size
+		if mv != nil {
+			rep.Entries += mv.Entries
+			if t.noMerkle && mv.State == table.MerkleMissing {
+				rep.NoMerkle++
+			}
+		}
+		if cf != nil {
+			db.logf("db@scrub corrupted L%d@%d %s", cf.Level, cf.Num, cf.Reason)
+			rep.Corrupt = append(rep.Corrupt, *cf)
+		}
+		if err := th.wait(ctx, t.size); err != nil {
+			return err
+		}
+	}
+
+	db.scrubMu.Lock()
+	db.scrubReport = rep
+	db.scrubMu.Unlock()
+	db.logf("db@scrub done T·%d S·%s C·%d T·%v", rep.Tables, shortenb(rep.Bytes), len(rep.Corrupt), time.Since(start))
+	return nil
+}
+
+// ScrubReport returns the report of the last complete pass of the
+// background integrity scrubber, see Options.ScrubInterval. The scrubber
+// audits the tables one at a time against the DB state current at their
+// turn, so the report has no master root. It returns ErrNotFound if no pass
+// completed yet.
+//
+// The caller should not modify the returned report.
+func (db *DB) ScrubReport() (*IntegrityReport, error) {
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+	db.scrubMu.Lock()
+	defer db.scrubMu.Unlock()
+	if db.scrubReport == nil {
+		return nil, ErrNotFound
+	}
+	return db.scrubReport, nil
+}
@@ -67,10 +67,10 @@ func (db *DB) newIterator(auxm *memDB, auxt tFiles, seq uint64, slice *util.Rang
 	if slice != nil {
 		islice = &util.Range{}
 		if slice.Start != nil {
-			islice.Start = dbkey.MakeInternalKey(nil, slice.Start, dbkey.KeyMaxSeq, dbkey.KeyTypeSeek)
+			islice.Start = db.s.icmp.kf.MakeInternalKey(nil, slice.Start, dbkey.KeyMaxSeq, dbkey.KeyTypeSeek)
 		}
 		if slice.Limit != nil {
-			islice.Limit = dbkey.MakeInternalKey(nil, slice.Limit, dbkey.KeyMaxSeq, dbkey.KeyTypeSeek)
+			islice.Limit = db.s.icmp.kf.MakeInternalKey(nil, slice.Limit, dbkey.KeyMaxSeq, dbkey.KeyTypeSeek)
 		}
 	}
 	rawIter := db.newRawIterator(auxm, auxt, islice, ro)
@@ -193,7 +193,7 @@ func (i *dbIter) Seek(key []byte) bool {
 		return false
 	}
 
-	ikey := dbkey.MakeInternalKey(nil, key, i.seq, dbkey.KeyTypeSeek)
+	ikey := i.icmp.kf.MakeInternalKey(nil, key, i.seq, dbkey.KeyTypeSeek)
 	if i.iter.Seek(ikey) {
 		i.dir = dirSOI
 		return i.next()
@@ -211,7 +211,7 @@ func (i *dbIter) next() bool {
 		var kt dbkey.KeyType
 		var kerr error
 		iterKey := i.iter.Key()
-		ukey, _, seq, kt, kerr = dbkey.ParseInternalKeyWithVersion(iterKey)
+		ukey, _, seq, kt, kerr = i.icmp.kf.ParseInternalKeyWithVersion(iterKey)
 		if kerr == nil {
 			i.sampleSeek()
 			if seq <= i.seq {
@@ -269,7 +269,7 @@ func (i *dbIter) prev() bool {
 			var kt dbkey.KeyType
 			var kerr error
 			iterKey := i.iter.Key()
-			ukey, _, seq, kt, kerr = dbkey.ParseInternalKeyWithVersion(iterKey)
+			ukey, _, seq, kt, kerr = i.icmp.kf.ParseInternalKeyWithVersion(iterKey)
 			if kerr == nil {
 				i.sampleSeek()
 				if seq <= i.seq {
@@ -316,7 +316,7 @@ func (i *dbIter) Prev() bool {
 			var ukey []byte
 			var kerr error
 			iterKey := i.iter.Key()
-			ukey, _, _, _, kerr = dbkey.ParseInternalKeyWithVersion(iterKey)
+			ukey, _, _, _, kerr = i.icmp.kf.ParseInternalKeyWithVersion(iterKey)
 			if kerr == nil {
 				i.sampleSeek()
 				if i.icmp.uCompare(ukey, i.key) < 0 {
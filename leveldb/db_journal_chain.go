@@ -0,0 +1,260 @@
+package leveldb
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"sort"
+	"sync"
+
+	"github.com/syndtr/goleveldb/leveldb/errors"
+	"github.com/syndtr/goleveldb/leveldb/merkle"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+// journalChainDomain separates the journal chain hashes from any other
+// hash of the DB.
+const journalChainDomain = "leveldb/journal-chain/v1\x00"
+
+// ErrJournalChainBroken records the reason a hash-chained journal failed
+// its check against the chain, see Options.JournalHashChain. This error
+// will be wrapped with errors.ErrCorrupted.
+type ErrJournalChainBroken struct {
+	Reason string
+}
+
+func (e *ErrJournalChainBroken) Error() string {
+	return fmt.Sprintf("leveldb: journal hash chain broken: %s", e.Reason)
+}
+
+func newErrJournalChainBroken(fd storage.FileDesc, reason string) error {
+	return errors.NewErrCorrupted(fd, &ErrJournalChainBroken{reason})
+}
+
+// JournalChain is a head of the journal hash chain, see
+// Options.JournalHashChain. Every record of a chained journal extends the
+// chain with SHA-256("leveldb/journal-chain/v1\x00" || head || record),
+// the record being the batch header and data as journaled.
+type JournalChain struct {
+	// Seq is the sequence number of the last write covered by the head,
+	// zero before the first write
+	Seq  uint64
+	Head merkle.Hash
+}
+
+// newJournalChainHash returns the hash of the record following the given
+// head, the record bytes are yet to be written to it.
+func newJournalChainHash(head merkle.Hash) hash.Hash {
+	h := sha256.New()
+	h.Write([]byte(journalChainDomain))
+	h.Write(head[:])
+	return h
+}
+
+// nextJournalChain returns the head of the chain extended by the record.
+func nextJournalChain(head merkle.Hash, record []byte) (next merkle.Hash) {
+	h := newJournalChainHash(head)
+	h.Write(record)
+	h.Sum(next[:0])
+	return
+}
+
+// journalChainStart is the head of the journal hash chain at the start of
+// a journal, as recorded in the manifest. The records of a journal written
+// without the chain option don't extend the chain, which goes on unchanged
+// through the journal.
+type journalChainStart struct {
+	num     int64
+	chained bool
+	JournalChain
+}
+
+// journalChainIndex is the in-memory index of the chain heads at the start
+// of the journals persisted in the manifest.
+type journalChainIndex struct {
+	mu     sync.RWMutex
+	starts map[int64]journalChainStart
+}
+
+func (x *journalChainIndex) put(c journalChainStart) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.starts == nil {
+		x.starts = make(map[int64]journalChainStart)
+	}
+	x.starts[c.num] = c
+}
+
+func (x *journalChainIndex) get(num int64) (journalChainStart, bool) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	c, ok := x.starts[num]
+	return c, ok
+}
+
+// prune drops the heads of the journals below the given number, that is
+// of the obsolete journals, but the last one, from which the chain goes on
+// after journals written unchained.
+func (x *journalChainIndex) prune(num int64) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	var last int64 = -1
+	for n := range x.starts {
+		if n > last {
+			last = n
+		}
+	}
+	for n := range x.starts {
+		if n < num && n != last {
+			delete(x.starts, n)
+		}
+	}
+}
+
+// all returns the heads sorted by journal number.
+func (x *journalChainIndex) all() []journalChainStart {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	starts := make([]journalChainStart, 0, len(x.starts))
+	for _, c := range x.starts {
+		starts = append(starts, c)
+	}
+	sort.Slice(starts, func(i, j int) bool {
+		return starts[i].num < starts[j].num
+	})
+	return starts
+}
+
+// latest returns the head of the last chained journal.
+func (x *journalChainIndex) latest() (journalChainStart, bool) {
+	starts := x.all()
+	if len(starts) == 0 {
+		return journalChainStart{}, false
+	}
+	return starts[len(starts)-1], true
+}
+
+// journalChainVerifier checks the replayed journals against the chain
+// heads recorded in the manifest: every record of a chained journal must
+// extend the chain, which must end where the next chained journal starts,
+// if replayed right after.
+type journalChainVerifier struct {
+	s       *session
+	c       JournalChain
+	fd      storage.FileDesc
+	tracked bool // whether the journal has a chain head
+	chained bool
+}
+
+func newJournalChainVerifier(s *session) *journalChainVerifier {
+	cv := &journalChainVerifier{s: s}
+	if c, ok := s.jcIndex.latest(); ok {
+		cv.c = c.JournalChain
+	}
+	return cv
+}
+
+// checkFiles checks that none of the journals with a chain head to be
+// replayed is missing.
+func (cv *journalChainVerifier) checkFiles(fds []storage.FileDesc) error {
+starts:
+	for _, c := range cv.s.jcIndex.all() {
+		if c.num < cv.s.stJournalNum {
+			continue
+		}
+		for _, fd := range fds {
+			if fd.Num == c.num {
+				continue starts
+			}
+		}
+		fd := storage.FileDesc{Type: storage.TypeJournal, Num: c.num}
+		return newErrJournalChainBroken(fd, "journal missing")
+	}
+	return nil
+}
+
+// startJournal starts the replay of the given journal.
+func (cv *journalChainVerifier) startJournal(fd storage.FileDesc) error {
+	c, tracked := cv.s.jcIndex.get(fd.Num)
+	if tracked {
+		if cv.tracked && cv.c.Head != c.Head {
+			return newErrJournalChainBroken(fd, fmt.Sprintf("journal doesn't start where journal @%d ends", cv.fd.Num))
+		}
+		cv.c = c.JournalChain
+	}
+	cv.fd, cv.tracked, cv.chained = fd, tracked, c.chained
+	return nil
+}
+
+// record checks the given record of the journal, and returns it stripped
+// of its chain head.
+func (cv *journalChainVerifier) record(record []byte) ([]byte, error) {
+	if !cv.chained {
+		return record, nil
+	}
+	n := len(record) - merkle.HashSize
+	if n < 0 {
+		return nil, newErrJournalChainBroken(cv.fd, "record too short")
+	}
+	head := nextJournalChain(cv.c.Head, record[:n])
+	if !bytes.Equal(head[:], record[n:]) {
+		return nil, newErrJournalChainBroken(cv.fd, fmt.Sprintf("record after seq %d doesn't extend the chain", cv.c.Seq))
+	}
+	cv.c.Head = head
+	if seq, batchLen, err := decodeBatchHeader(record[:n]); err == nil && batchLen > 0 {
+		cv.c.Seq = seq + uint64(batchLen) - 1
+	}
+	return record[:n], nil
+}
+
+func (db *DB) journalChain() JournalChain {
+	db.jchainMu.Lock()
+	defer db.jchainMu.Unlock()
+	return db.jchain
+}
+
+func (db *DB) setJournalChain(c JournalChain) {
+	db.jchainMu.Lock()
+	db.jchain = c
+	db.jchainMu.Unlock()
+}
+
+// journalChainStart returns the chain head at the start of the current
+// journal, it reports false if the DB has no journal hash chain.
+func (db *DB) journalChainStart() (journalChainStart, bool) {
+	chained := db.s.o.GetJournalHashChain()
+	if _, ok := db.s.jcIndex.latest(); !ok && !chained {
+		return journalChainStart{}, false
+	}
+	return journalChainStart{db.journalFd.Num, chained, db.journalChain()}, true
+}
+
+// commitJournalChain persists in the manifest the chain head at the start
+// of the current journal. It is a noop if the DB has no journal hash
+// chain. The caller must hold the write lock.
+func (db *DB) commitJournalChain() error {
+	c, ok := db.journalChainStart()
+	if !ok {
+		return nil
+	}
+	rec := &sessionRecord{}
+	rec.addJournalChain(c)
+	db.compCommitLk.Lock()
+	defer db.compCommitLk.Unlock()
+	return db.s.commit(rec, false)
+}
+
+// JournalChainHead returns the current head of the journal hash chain,
+// which covers every write up to its sequence number, so that it can be
+// anchored outside of the DB. It returns ErrNotFound unless
+// Options.JournalHashChain is set.
+func (db *DB) JournalChainHead() (JournalChain, error) {
+	if err := db.ok(); err != nil {
+		return JournalChain{}, err
+	}
+	if !db.s.o.GetJournalHashChain() {
+		return JournalChain{}, ErrNotFound
+	}
+	return db.journalChain(), nil
+}
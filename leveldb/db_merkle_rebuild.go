@@ -0,0 +1,439 @@
+package leveldb
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/syndtr/goleveldb/leveldb/errors"
+	"github.com/syndtr/goleveldb/leveldb/merkle"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/syndtr/goleveldb/leveldb/table"
+)
+
+var errInvalidLevel = errors.New("leveldb: invalid level")
+
+// MerkleStatus is the outcome of the Merkle check of a table by
+// RebuildMerkle. These numbers are written to disk and should not be
+// changed.
+type MerkleStatus uint
+
+const (
+	// MerkleVerified means the Merkle tree matched the data blocks.
+	MerkleVerified MerkleStatus = iota + 1
+	// MerkleRebuilt means the table had no Merkle tree, e.g. it was written
+	// by an upstream goleveldb, and got rewritten with one.
+	MerkleRebuilt
+	// MerkleRepaired means the Merkle tree was unreadable or didn't match
+	// the data blocks, and the table got rewritten with a sound one.
+	MerkleRepaired
+	// MerkleUnreadable means the data blocks are corrupted, the table was
+	// left untouched.
+	MerkleUnreadable
+)
+
+func (s MerkleStatus) String() string {
+	switch s {
+	case MerkleVerified:
+		return "verified"
+	case MerkleRebuilt:
+		return "rebuilt"
+	case MerkleRepaired:
+		return "repaired"
+	case MerkleUnreadable:
+		return "unreadable"
+	}
+	return "unknown"
+}
+
+// MerkleTableCheck is the recorded Merkle check of a table.
+type MerkleTableCheck struct {
+	Level int
+	// Num is the file number of the table, the rewritten one if the table
+	// got rewritten
+	Num    int64
+	Status MerkleStatus
+	// Root is the Merkle root of the table
+	Root merkle.Hash
+}
+
+// merkleCheck is the Merkle check of a table as recorded in the manifest.
+type merkleCheck struct {
+	num    int64
+	status MerkleStatus
+	root   merkle.Hash
+}
+
+// merkleCheckIndex is the in-memory index of the Merkle checks of the live
+// tables persisted in the manifest.
+type merkleCheckIndex struct {
+	mu     sync.RWMutex
+	checks map[int64]merkleCheck
+}
+
+func (x *merkleCheckIndex) put(c merkleCheck) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.checks == nil {
+		x.checks = make(map[int64]merkleCheck)
+	}
+	x.checks[c.num] = c
+}
+
+func (x *merkleCheckIndex) get(num int64) (merkleCheck, bool) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	c, ok := x.checks[num]
+	return c, ok
+}
+
+func (x *merkleCheckIndex) remove(num int64) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	delete(x.checks, num)
+}
+
+// all returns the checks sorted by table number.
+func (x *merkleCheckIndex) all() []merkleCheck {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	checks := make([]merkleCheck, 0, len(x.checks))
+	for _, c := range x.checks {
+		checks = append(checks, c)
+	}
+	sort.Slice(checks, func(i, j int) bool {
+		return checks[i].num < checks[j].num
+	})
+	return checks
+}
+
+// merkleRebuilder checks the Merkle trees of the tables of the selected
+// levels, and rewrites, in the same level, the tables whose tree is
+// missing or bad.
+type merkleRebuilder struct {
+	s      *session
+	v      *version
+	rec    *sessionRecord
+	levels []int
+	ro     *opt.ReadOptions
+
+	checks []MerkleTableCheck
+}
+
+func (b *merkleRebuilder) rebuild(level int, t *tFile, status MerkleStatus) error {
+	nt, n, err := b.s.tops.rewriteMerkle(t, b.ro)
+	if err != nil {
+		return err
+	}
+	b.rec.delTable(level, t.fd.Num)
+	b.rec.addTableFile(level, nt)
+	root, err := b.s.tops.getMerkleRoot(nt)
+	if err != nil {
+		return err
+	}
+	b.rec.addMerkleCheck(merkleCheck{nt.fd.Num, status, root})
+	b.checks = append(b.checks, MerkleTableCheck{level, nt.fd.Num, status, root})
+	b.s.logf("table@merkle %s L%d@%d -> @%d N·%d S·%s", status, level, t.fd.Num, nt.fd.Num, n, shortenb(nt.size))
+	return nil
+}
+
+func (b *merkleRebuilder) run(cnt *compactionTransactCounter) error {
+	// Start over, discarding the output of a failed attempt.
+	if err := b.revert(); err != nil {
+		return err
+	}
+	b.rec.resetAddedTables()
+	b.rec.resetDeletedTables()
+	b.rec.resetMerkleChecks()
+	b.checks = b.checks[:0]
+
+	for _, level := range b.levels {
+		if level >= len(b.v.levels) {
+			continue
+		}
+		for _, t := range b.v.levels[level] {
+			cnt.incr()
+			mv, err := b.s.tops.verifyMerkle(t, b.ro)
+			if err != nil {
+				if !errors.IsCorrupted(err) {
+					return err
+				}
+				b.s.logf("table@merkle unreadable L%d@%d %q", level, t.fd.Num, err)
+				b.rec.addMerkleCheck(merkleCheck{t.fd.Num, MerkleUnreadable, merkle.Hash{}})
+				b.checks = append(b.checks, MerkleTableCheck{level, t.fd.Num, MerkleUnreadable, merkle.Hash{}})
+				continue
+			}
+			switch mv.State {
+			case table.MerkleValid:
+				b.rec.addMerkleCheck(merkleCheck{t.fd.Num, MerkleVerified, mv.Root})
+				b.checks = append(b.checks, MerkleTableCheck{level, t.fd.Num, MerkleVerified, mv.Root})
+			case table.MerkleMissing:
+				err = b.rebuild(level, t, MerkleRebuilt)
+			default:
+				err = b.rebuild(level, t, MerkleRepaired)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (b *merkleRebuilder) revert() error {
+	for _, at := range b.rec.addedTables {
+		b.s.logf("table@merkle revert @%d", at.num)
+		if err := b.s.tops.revert(storage.FileDesc{Type: storage.TypeTable, Num: at.num}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tableMerkleRebuild runs the Merkle rebuild of the given levels, and
+// records its results within the same manifest record.
+func (db *DB) tableMerkleRebuild(levels []int) []MerkleTableCheck {
+	v := db.s.version()
+	defer v.release()
+
+	b := &merkleRebuilder{
+		s:      db.s,
+		v:      v,
+		rec:    &sessionRecord{},
+		levels: levels,
+		ro:     &opt.ReadOptions{DontFillCache: true, Strict: opt.StrictOverride | opt.StrictReader | opt.StrictBlockChecksum},
+	}
+	db.compactionTransact("table@merkle", b)
+	db.compactionCommit("table-merkle", b.rec)
+	db.logf("table@merkle committed T·%d F%s", len(b.checks), sint(len(b.rec.addedTables)))
+	return b.checks
+}
+
+type cMerkleRebuild struct {
+	levels []int
+	checks *[]MerkleTableCheck
+	ackC   chan<- error
+}
+
+func (r cMerkleRebuild) ack(err error) {
+	if r.ackC != nil {
+		defer func() {
+			_ = recover()
+		}()
+		r.ackC <- err
+	}
+}
+
+// RebuildMerkle checks the Merkle trees of the tables of the given levels,
+// or of every level if none is given, against their data blocks. A table
+// without a Merkle tree, e.g. written by an upstream goleveldb, or whose
+// tree doesn't match its data, is rewritten in the same level with a sound
+// tree, which changes its file number. It returns the check of every
+// table, also recorded in the manifest, see MerkleChecks.
+//
+// The data blocks are read with checksum verification, a table with a
+// corrupted data block is left untouched and reported as MerkleUnreadable.
+// RebuildMerkle runs as a table compaction, and doesn't block writes.
+func (db *DB) RebuildMerkle(levels ...int) ([]MerkleTableCheck, error) {
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+	for _, level := range levels {
+		if level < 0 {
+			return nil, errInvalidLevel
+		}
+	}
+	if len(levels) == 0 {
+		v := db.s.version()
+		for level := range v.levels {
+			levels = append(levels, level)
+		}
+		v.release()
+	} else {
+		sorted := append([]int(nil), levels...)
+		sort.Ints(sorted)
+		levels = sorted[:0]
+		for _, level := range sorted {
+			if len(levels) == 0 || levels[len(levels)-1] != level {
+				levels = append(levels, level)
+			}
+		}
+	}
+
+	var checks []MerkleTableCheck
+	ch := make(chan error)
+	defer close(ch)
+	// Send cmd.
+	select {
+	case db.tcompCmdC <- cMerkleRebuild{levels, &checks, ch}:
+	case err := <-db.compErrC:
+		return nil, err
+	case <-db.closeC:
+		return nil, ErrClosed
+	}
+	// Wait cmd.
+	var err error
+	select {
+	case err = <-ch:
+	case err = <-db.compErrC:
+	case <-db.closeC:
+		return nil, ErrClosed
+	}
+	if err != nil {
+		return nil, err
+	}
+	return checks, nil
+}
+
+// MerkleChecks returns the recorded Merkle checks of the live tables, see
+// RebuildMerkle, in level order. Tables written since their level was
+// last checked, e.g. by a compaction, have no check.
+func (db *DB) MerkleChecks() ([]MerkleTableCheck, error) {
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+	v := db.s.version()
+	defer v.release()
+
+	var checks []MerkleTableCheck
+	for level, tables := range v.levels {
+		for _, t := range tables {
+			if c, ok := db.s.mcIndex.get(t.fd.Num); ok {
+				checks = append(checks, MerkleTableCheck{level, c.num, c.status, c.root})
+			}
+		}
+	}
+	return checks, nil
+}
+
+// merkleTreeBuilder builds the Merkle trees of the tables written without,
+// see opt.MerkleDeferred, rewriting them in the same level. The deeper
+// levels go first, their tables being the least likely to be compacted
+// soon.
+type merkleTreeBuilder struct {
+	s     *session
+	v     *version
+	rec   *sessionRecord
+	limit int // the maximum number of tables to rewrite, 0 for all
+	ro    *opt.ReadOptions
+}
+
+func (b *merkleTreeBuilder) run(cnt *compactionTransactCounter) error {
+	// Start over, discarding the output of a failed attempt.
+	if err := b.revert(); err != nil {
+		return err
+	}
+	b.rec.resetAddedTables()
+	b.rec.resetDeletedTables()
+
+	var built int
+	for level := len(b.v.levels) - 1; level >= 0; level-- {
+		for _, t := range b.v.levels[level] {
+			if !t.noMerkle {
+				continue
+			}
+			if b.limit > 0 && built >= b.limit {
+				return nil
+			}
+			cnt.incr()
+			nt, n, err := b.s.tops.rewriteMerkle(t, b.ro)
+			if err != nil {
+				return err
+			}
+			b.rec.delTable(level, t.fd.Num)
+			b.rec.addTableFile(level, nt)
+			built++
+			b.s.logf("table@merkle built L%d@%d -> @%d N·%d S·%s", level, t.fd.Num, nt.fd.Num, n, shortenb(nt.size))
+		}
+	}
+	return nil
+}
+
+func (b *merkleTreeBuilder) revert() error {
+	for _, at := range b.rec.addedTables {
+		b.s.logf("table@merkle revert @%d", at.num)
+		if err := b.s.tops.revert(storage.FileDesc{Type: storage.TypeTable, Num: at.num}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tableNeedMerkle returns true if tables of the current version wait for
+// their Merkle tree, see opt.MerkleDeferred.
+func (db *DB) tableNeedMerkle() bool {
+	if db.s.o.GetMerkleMode() != opt.MerkleDeferred {
+		return false
+	}
+	v := db.s.version()
+	defer v.release()
+	for _, tables := range v.levels {
+		for _, t := range tables {
+			if t.noMerkle {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tableMerkleBuild builds the Merkle trees of at most limit tables of the
+// current version written without, or of all of them if limit is 0.
+func (db *DB) tableMerkleBuild(limit int) {
+	v := db.s.version()
+	defer v.release()
+
+	b := &merkleTreeBuilder{
+		s:     db.s,
+		v:     v,
+		rec:   &sessionRecord{},
+		limit: limit,
+		ro:    &opt.ReadOptions{DontFillCache: true, Strict: opt.StrictOverride | opt.StrictReader},
+	}
+	db.compactionTransact("table@merkle", b)
+	if len(b.rec.addedTables) == 0 {
+		return
+	}
+	db.compactionCommit("table-merkle", b.rec)
+	db.logf("table@merkle committed F%s", sint(len(b.rec.addedTables)))
+}
+
+type cMerkleBuild struct {
+	ackC chan<- error
+}
+
+func (r cMerkleBuild) ack(err error) {
+	if r.ackC != nil {
+		defer func() {
+			_ = recover()
+		}()
+		r.ackC <- err
+	}
+}
+
+// merkleReady builds the Merkle trees the tables of the current version
+// wait for, see opt.MerkleDeferred, before a proof read.
+func (db *DB) merkleReady() error {
+	if !db.tableNeedMerkle() {
+		return nil
+	}
+	ch := make(chan error)
+	defer close(ch)
+	// Send cmd.
+	select {
+	case db.tcompCmdC <- cMerkleBuild{ch}:
+	case err := <-db.compErrC:
+		return err
+	case <-db.closeC:
+		return ErrClosed
+	}
+	// Wait cmd.
+	select {
+	case err := <-ch:
+		return err
+	case err := <-db.compErrC:
+		return err
+	case <-db.closeC:
+		return ErrClosed
+	}
+}
@@ -0,0 +1,350 @@
+package leveldb
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/syndtr/goleveldb/leveldb/dbkey"
+	"github.com/syndtr/goleveldb/leveldb/memdb"
+	"github.com/syndtr/goleveldb/leveldb/merkle"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// MultiGetEntry is the result of the lookup of a key by MultiGetWithProof.
+type MultiGetEntry struct {
+	Key     []byte
+	Version uint64 // Actual version of the value
+	Value   []byte
+	Found   bool // Only found keys are proven
+}
+
+// DBMultiProof is the Merkle multiproof of the entries returned by
+// MultiGetWithProof. It follows the same proof chain as DBProof, but each
+// tree of the chain is proven once for all the entries it holds, see
+// merkle.MultiProof.
+type DBMultiProof struct {
+	// Layers are the layers holding the entries, in master tree order
+	Layers []LayerMultiProof
+
+	// MasterProof proves the master leaves of the layers
+	MasterProof *merkle.MultiProof
+}
+
+// LayerMultiProof proves the entries found in a layer.
+type LayerMultiProof struct {
+	LayerKind merkle.LayerKind
+	Level     int
+
+	// Sources are the MemDB or the SSTs holding the entries, in layer order
+	Sources []SourceMultiProof
+
+	// LayerProof proves the layer leaves of the SSTs, it is nil for a MemDB
+	// layer, whose root is the MemDB root
+	LayerProof *merkle.MultiProof
+}
+
+// SourceMultiProof proves the entries found in a MemDB or an SST.
+type SourceMultiProof struct {
+	// TableMin and TableMax are the smallest and largest uvkeys of the SST,
+	// nil for a MemDB.
+	TableMin, TableMax []byte
+
+	// Entries are the indices, in the entries returned along the proof, of
+	// the proven leaves in leaf order
+	Entries []int
+
+	DataProof *merkle.MultiProof
+}
+
+// multiRecord is a record found by MultiGetWithProof.
+type multiRecord struct {
+	entry       int
+	ikey, value []byte
+}
+
+// newSourceMultiProof returns the proof of the given records of a source,
+// generated by prove.
+func newSourceMultiProof(records []multiRecord, prove func(keys, values [][]byte) (*merkle.MultiProof, []int, error)) (SourceMultiProof, error) {
+	keys := make([][]byte, len(records))
+	values := make([][]byte, len(records))
+	for i, r := range records {
+		keys[i], values[i] = r.ikey, r.value
+	}
+	dataProof, leafIndices, err := prove(keys, values)
+	if err != nil {
+		return SourceMultiProof{}, err
+	}
+	order := make([]int, len(records))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return leafIndices[order[i]] < leafIndices[order[j]]
+	})
+	entries := make([]int, len(records))
+	for i, o := range order {
+		entries[i] = records[o].entry
+	}
+	return SourceMultiProof{Entries: entries, DataProof: dataProof}, nil
+}
+
+// MultiGetWithProof gets the given keys at the given version, the same way
+// as GetWithProof, and returns a single Merkle multiproof for all of them.
+//
+// The keys are looked up against the same DB state, and the sibling hashes
+// shared by the proofs are included once: the proof size and the work to
+// build it grow sub-linearly with the number of keys. The entries are in
+// the order of the keys. Keys not found, or deleted, are returned with
+// Found unset and aren't proven. The proof is nil if no key is found. In
+// strict proof mode, see opt.ProofStrictness, a degraded layer or master
+// tree fails with an *ErrProofUnavailable error.
+//
+// The returned slices are their own copies, it is safe to modify them.
+// It is safe to modify the contents of the argument after MultiGetWithProof
+// returns.
+func (db *DB) MultiGetWithProof(keys [][]byte, version uint64, ro *opt.ReadOptions) (entries []MultiGetEntry, proof *DBMultiProof, err error) {
+	if err = db.ok(); err != nil {
+		return nil, nil, err
+	}
+	if err = db.merkleReady(); err != nil {
+		return nil, nil, err
+	}
+
+	// Pin the state: the snapshot, the memdbs with their Merkle trees and
+	// the version.
+	se := db.acquireSnapshot()
+	defer db.releaseSnapshot(se)
+	var (
+		mems      [2]*memDB
+		snapshots [2]*memdb.MerkleSnapshot
+	)
+	em, fm, v := db.getMemsVersion()
+	defer v.release()
+	for i, m := range [...]*memDB{em, fm} {
+		if m == nil {
+			continue
+		}
+		defer m.decref()
+		mems[i] = m
+		snapshots[i] = m.DB.BuildMerkleSnapshot()
+	}
+
+	var (
+		memRecords   [2][]multiRecord
+		tableRecords = make(map[*tFile][]multiRecord)
+		first        = make(map[string]int)
+		cSched       bool
+	)
+	entries = make([]MultiGetEntry, len(keys))
+	for i, key := range keys {
+		entry := &entries[i]
+		entry.Key = append([]byte(nil), key...)
+		if j, ok := first[string(key)]; ok {
+			// Duplicate keys share the record of the first one.
+			entry.Version, entry.Found = entries[j].Version, entries[j].Found
+			entry.Value = append([]byte(nil), entries[j].Value...)
+			continue
+		}
+		first[string(key)] = i
+
+		ikey := db.s.icmp.kf.MakeInternalKeyWithVersion(nil, key, version, se.seq, dbkey.KeyTypeSeek)
+		inMem := false
+		for mi, m := range mems {
+			if m == nil {
+				continue
+			}
+			if ok, mv, me := memGet(m.DB, ikey, db.s.icmp); ok {
+				inMem = true
+				if me == nil {
+					mk := append([]byte(nil), memFoundKey(m.DB, ikey)...)
+					if _, entry.Version, _, _, err = db.s.icmp.kf.ParseInternalKeyWithVersion(mk); err != nil {
+						return nil, nil, err
+					}
+					entry.Value, entry.Found = append([]byte(nil), mv...), true
+					memRecords[mi] = append(memRecords[mi], multiRecord{i, mk, entry.Value})
+				}
+				break
+			}
+		}
+		if inMem {
+			continue
+		}
+
+		// The proofs are generated per table once all keys are found, only
+		// the found records are recorded here.
+		var found map[*tFile][]byte
+		value, actualVersion, _, _, table, tcomp, lerr := v.lookup(nil, ikey, ro, func(f *tFile, key []byte, ro *opt.ReadOptions) ([]byte, []byte, *merkle.MerkleProof, error) {
+			rkey, rvalue, err := db.s.tops.find(f, key, ro)
+			if err == nil {
+				if found == nil {
+					found = make(map[*tFile][]byte)
+				}
+				found[f] = rkey
+			}
+			return rkey, rvalue, nil, err
+		})
+		cSched = cSched || tcomp
+		switch lerr {
+		case nil:
+		case ErrNotFound:
+			continue
+		default:
+			return nil, nil, lerr
+		}
+		entry.Version, entry.Value, entry.Found = actualVersion, append([]byte(nil), value...), true
+		tableRecords[table] = append(tableRecords[table], multiRecord{i, found[table], entry.Value})
+	}
+	if cSched {
+		// Trigger table compaction.
+		db.compTrigger(db.tcompCmdC)
+	}
+
+	strict := db.strictProof(ro)
+	proof = new(DBMultiProof)
+	layers, lerr := stateLayers(snapshots[:], v)
+	if lerr != nil && strict {
+		return nil, nil, &ErrProofUnavailable{ProofLinkMaster, lerr.Error()}
+	}
+	var masterIndices []int
+	for li, l := range layers {
+		layer := LayerMultiProof{LayerKind: l.kind, Level: l.level}
+		switch l.kind {
+		case merkle.LayerKindMemDB:
+			if len(memRecords[l.level]) == 0 {
+				continue
+			}
+			snapshot := snapshots[l.level]
+			source, err := newSourceMultiProof(memRecords[l.level], func(keys, _ [][]byte) (*merkle.MultiProof, []int, error) {
+				return snapshot.GenerateMultiProof(keys)
+			})
+			if err != nil {
+				return nil, nil, err
+			}
+			layer.Sources = append(layer.Sources, source)
+		case merkle.LayerKindLevel:
+			var tableIndices []int
+			for ti, t := range v.levels[l.level] {
+				records := tableRecords[t]
+				if len(records) == 0 {
+					continue
+				}
+				source, err := newSourceMultiProof(records, func(keys, values [][]byte) (*merkle.MultiProof, []int, error) {
+					return db.s.tops.multiProof(t, keys, values)
+				})
+				if err != nil {
+					return nil, nil, err
+				}
+				source.TableMin = append([]byte(nil), t.imin.UVkey()...)
+				source.TableMax = append([]byte(nil), t.imax.UVkey()...)
+				layer.Sources = append(layer.Sources, source)
+				tableIndices = append(tableIndices, ti)
+			}
+			if len(tableIndices) == 0 {
+				continue
+			}
+			leaves, lerr := v.layerLeaves(l.level)
+			if lerr != nil && strict {
+				return nil, nil, &ErrProofUnavailable{ProofLinkLayer, fmt.Sprintf("level %d: %v", l.level, lerr)}
+			}
+			if layer.LayerProof, err = merkle.NewMerkleTreeWithPool(leaves, db.s.merklePool).GenerateMultiProof(tableIndices); err != nil {
+				return nil, nil, err
+			}
+		}
+		proof.Layers = append(proof.Layers, layer)
+		masterIndices = append(masterIndices, li)
+	}
+	if len(masterIndices) == 0 {
+		return entries, nil, nil
+	}
+
+	masterLeaves := make([]merkle.Hash, len(layers))
+	for i, l := range layers {
+		masterLeaves[i] = l.hash()
+	}
+	if proof.MasterProof, err = merkle.NewMerkleTreeWithPool(masterLeaves, db.s.merklePool).GenerateMultiProof(masterIndices); err != nil {
+		return nil, nil, err
+	}
+	return entries, proof, nil
+}
+
+// Verify verifies the multiproof of the given entries, as returned by
+// MultiGetWithProof. Every found entry must be proven, a duplicate key by
+// its first occurrence.
+func (p *DBMultiProof) Verify(entries []MultiGetEntry) bool {
+	if p == nil || p.MasterProof == nil || len(p.Layers) != len(p.MasterProof.Indices) {
+		return false
+	}
+
+	proven := make([]bool, len(entries))
+	masterLeaves := make([]merkle.Hash, 0, len(p.Layers))
+	for _, layer := range p.Layers {
+		if len(layer.Sources) == 0 {
+			return false
+		}
+		layerLeaves := make([]merkle.Hash, 0, len(layer.Sources))
+		for _, source := range layer.Sources {
+			dataProof := source.DataProof
+			if dataProof == nil || len(source.Entries) != len(dataProof.Indices) {
+				return false
+			}
+			leaves := make([]merkle.Hash, 0, len(source.Entries))
+			for _, i := range source.Entries {
+				if i < 0 || i >= len(entries) || proven[i] || !entries[i].Found {
+					return false
+				}
+				proven[i] = true
+				e := entries[i]
+				leaf, ok := dataLeafHash(dataProof.LeafFormat, e.Key, e.Version, merkle.LeafKindValue, e.Value)
+				if !ok {
+					return false
+				}
+				leaves = append(leaves, leaf)
+			}
+			if !dataProof.Verify(leaves) {
+				return false
+			}
+			switch layer.LayerKind {
+			case merkle.LayerKindMemDB:
+				layerLeaves = append(layerLeaves, dataProof.Root)
+			case merkle.LayerKindLevel:
+				layerLeaves = append(layerLeaves, merkle.HashLayerLeaf(layer.Level, source.TableMin, source.TableMax, dataProof.Root))
+			default:
+				return false
+			}
+		}
+
+		var layerRoot merkle.Hash
+		if layer.LayerKind == merkle.LayerKindMemDB {
+			if len(layerLeaves) != 1 || layer.LayerProof != nil {
+				return false
+			}
+			layerRoot = layerLeaves[0]
+		} else {
+			if layer.LayerProof == nil || !layer.LayerProof.Verify(layerLeaves) {
+				return false
+			}
+			layerRoot = layer.LayerProof.Root
+		}
+		masterLeaves = append(masterLeaves, merkle.HashMasterLeaf(layer.LayerKind, layer.Level, layerRoot))
+	}
+	if !p.MasterProof.Verify(masterLeaves) {
+		return false
+	}
+
+	first := make(map[string]int)
+	for i, e := range entries {
+		if j, ok := first[string(e.Key)]; ok {
+			d := entries[j]
+			if !proven[i] && (e.Found != d.Found || e.Version != d.Version || !bytes.Equal(e.Value, d.Value)) {
+				return false
+			}
+			continue
+		}
+		first[string(e.Key)] = i
+		if e.Found && !proven[i] {
+			return false
+		}
+	}
+	return true
+}
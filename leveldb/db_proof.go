@@ -1,13 +1,44 @@
 package leveldb
 
 import (
+	"fmt"
+
 	"github.com/syndtr/goleveldb/leveldb/dbkey"
 	"github.com/syndtr/goleveldb/leveldb/merkle"
+	"github.com/syndtr/goleveldb/leveldb/opt"
 )
 
 // ProofSource indicates where the data was found
 type ProofSource int
 
+// The links of a proof chain, as reported by ErrProofUnavailable.
+const (
+	ProofLinkData   = "data"   // the record within its MemDB or SST
+	ProofLinkLayer  = "layer"  // the SST within its level
+	ProofLinkMaster = "master" // the layer within the master tree
+)
+
+// ErrProofUnavailable is the error returned by the proof reads in strict
+// proof mode, see opt.ProofStrictness, when a link of the proof chain is
+// missing or degraded.
+type ErrProofUnavailable struct {
+	// Layer is the failed link: ProofLinkData, ProofLinkLayer or
+	// ProofLinkMaster.
+	Layer string
+	// Reason tells why the link can't be proven.
+	Reason string
+}
+
+func (e *ErrProofUnavailable) Error() string {
+	return fmt.Sprintf("leveldb: %s proof unavailable: %s", e.Layer, e.Reason)
+}
+
+// strictProof reports whether the proofs read with the given options must
+// be complete.
+func (db *DB) strictProof(ro *opt.ReadOptions) bool {
+	return opt.GetProofStrict(db.s.o.Options, ro)
+}
+
 // DBProof contains the complete Merkle proof chain for a key-value pair.
 // The proof structure supports data from both MemDB and SST files.
 //
@@ -19,24 +50,110 @@ type ProofSource int
 // For MemDB data:
 //
 //	DataProof = MemDB's internal Merkle proof
-//	LayerProof = Proof that MemDB root is in the memory layer
+//	LayerProof = Trivial proof, the MemDB root is the layer root
 //
 // For SST data:
 //
 //	DataProof = SST's internal Merkle proof
-//	LayerProof = Proof that SST root is in its level
+//	LayerProof = Proof that the SST layer leaf is in its level, see
+//	             merkle.HashLayerLeaf
+//
+// The MasterProof proves the master leaf of the layer, see
+// merkle.HashMasterLeaf. The layer and master leaves commit to the layer
+// identity and the SST key range, so a proof can't be replayed as coming
+// from another layer, and every proof is checked against its leaf index
+// and tree size.
 type DBProof struct {
 	DataProof *merkle.MerkleProof
 
 	LayerProof *merkle.MerkleProof
 
 	MasterProof *merkle.MerkleProof
+
+	// LayerKind and Level identify the layer the data was found in.
+	LayerKind merkle.LayerKind
+	Level     int
+
+	// TableMin and TableMax are the smallest and largest uvkeys of the SST
+	// the data was found in, nil for MemDB data.
+	TableMin, TableMax []byte
 }
 
 // Verify verifies the complete Merkle proof chain for a key-value pair
 func (p *DBProof) Verify(key []byte, version uint64, value []byte) bool {
-	uvkey := dbkey.MakeUVKey(nil, key, version)
-	leafHash := merkle.HashLeaf(uvkey, value)
+	if p.DataProof == nil {
+		return false
+	}
+	leafHash, ok := dataLeafHash(p.DataProof.LeafFormat, key, version, merkle.LeafKindValue, value)
+	return ok && p.verifyLeaf(leafHash)
+}
+
+// VerifyDeletion verifies the complete Merkle proof chain for the
+// tombstone of a key, as returned by DB.GetDeletionWithProof. Legacy
+// leaves don't tell a tombstone apart from an empty value, so their proofs
+// never verify as a deletion.
+func (p *DBProof) VerifyDeletion(key []byte, version uint64) bool {
+	if p.DataProof == nil || p.DataProof.LeafFormat == merkle.LeafFormatLegacy {
+		return false
+	}
+	leafHash, ok := dataLeafHash(p.DataProof.LeafFormat, key, version, merkle.LeafKindDelete, nil)
+	return ok && p.verifyLeaf(leafHash)
+}
+
+// verifyLeaf verifies the proof chain of the given data leaf hash.
+func (p *DBProof) verifyLeaf(leafHash merkle.Hash) bool {
+	for _, proof := range [...]*merkle.MerkleProof{p.DataProof, p.LayerProof, p.MasterProof} {
+		if proof == nil || proof.TreeSize == 0 {
+			return false
+		}
+	}
 	dataProof := p.DataProof
-	return dataProof.Verify(leafHash) && p.LayerProof.Verify(dataProof.Root) && p.MasterProof.Verify(p.LayerProof.Root)
+	if !dataProof.Verify(leafHash) {
+		return false
+	}
+	var layerLeaf merkle.Hash
+	switch p.LayerKind {
+	case merkle.LayerKindMemDB:
+		layerLeaf = dataProof.Root
+	case merkle.LayerKindLevel:
+		layerLeaf = merkle.HashLayerLeaf(p.Level, p.TableMin, p.TableMax, dataProof.Root)
+	default:
+		return false
+	}
+	return p.LayerProof.Verify(layerLeaf) && p.MasterProof.Verify(merkle.HashMasterLeaf(p.LayerKind, p.Level, p.LayerProof.Root))
+}
+
+// VerifyValueHash verifies the complete Merkle proof chain for a key and
+// the hash of its value, see merkle.HashValue, without the value itself.
+// Only proofs of merkle.LeafFormatValueHash leaves, written with
+// opt.Options.MerkleValueHash, can be verified this way.
+func (p *DBProof) VerifyValueHash(key []byte, version uint64, valueHash merkle.Hash) bool {
+	if p.DataProof == nil || p.DataProof.LeafFormat != merkle.LeafFormatValueHash {
+		return false
+	}
+	return p.verifyLeaf(merkle.HashLeafValueHash(key, version, merkle.LeafKindValue, valueHash))
+}
+
+// dataLeafHash returns the data leaf hash of a record of the given kind in
+// the given leaf format, it reports false if the format is unknown. The
+// legacy format ignores the kind.
+func dataLeafHash(format merkle.LeafFormat, key []byte, version uint64, kind merkle.LeafKind, value []byte) (merkle.Hash, bool) {
+	switch format {
+	case merkle.LeafFormatLegacy:
+		return merkle.HashLeaf(dbkey.MakeUVKey(nil, key, version), value), true
+	case merkle.LeafFormatV1:
+		return merkle.HashLeafV1(key, version, kind, value), true
+	case merkle.LeafFormatValueHash:
+		return merkle.HashLeafValueHash(key, version, kind, merkle.HashValue(value)), true
+	}
+	return merkle.Hash{}, false
+}
+
+// merkleLeafFormat returns the format of the Merkle leaves of new memdbs,
+// tables get theirs from the options as well.
+func (db *DB) merkleLeafFormat() merkle.LeafFormat {
+	if db.s.o.GetMerkleValueHash() || db.s.o.GetDedupValues() {
+		return merkle.LeafFormatValueHash
+	}
+	return merkle.LeafFormatCurrent
 }
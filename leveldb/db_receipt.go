@@ -0,0 +1,113 @@
+package leveldb
+
+import (
+	"github.com/syndtr/goleveldb/leveldb/dbkey"
+	"github.com/syndtr/goleveldb/leveldb/merkle"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// WriteReceipt describes what a write committed, see DB.WriteWithReceipt.
+type WriteReceipt struct {
+	// FirstSeq and LastSeq are the sequence numbers assigned to the first
+	// and last records of the batch, both zero for an empty batch
+	FirstSeq, LastSeq uint64
+	// Versions are the distinct versions of the batch records, in
+	// ascending order, 0 standing for the unversioned records
+	Versions []uint64
+	// BatchHash is the hash of the batch contents, see Batch.Hash
+	BatchHash merkle.Hash
+	// MemRoot and MasterRoot are the root of the memdb the batch was
+	// written to and the master root, right after the write. They are zero
+	// unless requested by opt.WriteOptions.ReceiptRoots.
+	MemRoot    merkle.Hash
+	MasterRoot merkle.Hash
+
+	roots bool
+}
+
+// VerifyBatch reports whether the receipt is the one of the given batch.
+func (r *WriteReceipt) VerifyBatch(batch *Batch) bool {
+	if r == nil || batch == nil || r.BatchHash != batch.Hash() {
+		return false
+	}
+	if batch.Len() == 0 {
+		return r.FirstSeq == 0 && r.LastSeq == 0
+	}
+	return r.LastSeq-r.FirstSeq+1 == uint64(batch.Len())
+}
+
+// VerifyProof verifies the proof chain of the given key-value pair, whose
+// version must be one of the receipt versions. If the receipt holds the
+// master root, the proof must verify up to that root, which only holds
+// for proofs generated before any later write or compaction.
+func (r *WriteReceipt) VerifyProof(proof *DBProof, key []byte, version uint64, value []byte) bool {
+	if r == nil || proof == nil {
+		return false
+	}
+	found := false
+	for _, v := range r.Versions {
+		if v == version {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return false
+	}
+	if !r.MasterRoot.IsZero() && (proof.MasterProof == nil || !proof.MasterProof.Root.Equal(r.MasterRoot)) {
+		return false
+	}
+	return proof.Verify(key, version, value)
+}
+
+// WriteWithReceipt is like Write, and returns the receipt of the write,
+// which can later be checked against the batch and the proofs of its
+// records. The batch is never merged with concurrent writes, nor written
+// as a transaction, whatever its size.
+//
+// It is safe to modify the contents of the arguments after WriteWithReceipt
+// returns but not before.
+func (db *DB) WriteWithReceipt(batch *Batch, wo *opt.WriteOptions) (*WriteReceipt, error) {
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+	if batch == nil {
+		batch = &Batch{}
+	}
+	receipt := &WriteReceipt{
+		Versions:  batch.versions(),
+		BatchHash: batch.Hash(),
+		roots:     wo.GetReceiptRoots(),
+	}
+	if batch.Len() == 0 {
+		return receipt, nil
+	}
+
+	sync := wo.GetSync() && !db.s.o.GetNoSync()
+
+	// Acquire write lock.
+	select {
+	case db.writeLockC <- struct{}{}:
+		// Write lock acquired.
+	case err := <-db.compPerErrC:
+		// Compaction error.
+		return nil, err
+	case <-db.closeC:
+		// Closed
+		return nil, ErrClosed
+	}
+
+	if err := db.writeLocked(batch, nil, false, sync, wo.GetTimestamp(), receipt); err != nil {
+		return nil, err
+	}
+	return receipt, nil
+}
+
+// PutWithReceipt is like PutWithVersion, and returns the receipt of the
+// write, see WriteWithReceipt. A zero version writes an unversioned
+// record.
+func (db *DB) PutWithReceipt(key, value []byte, version uint64, wo *opt.WriteOptions) (*WriteReceipt, error) {
+	batch := new(Batch)
+	batch.appendRecWithVersion(dbkey.KeyTypeVal, key, value, version)
+	return db.WriteWithReceipt(batch, wo)
+}
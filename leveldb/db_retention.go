@@ -0,0 +1,173 @@
+package leveldb
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/syndtr/goleveldb/leveldb/dbkey"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// pruneStat records what table compaction dropped under the retention
+// policy.
+type pruneStat struct {
+	records    int64
+	size       int64
+	minVersion uint64
+	maxVersion uint64
+}
+
+func (p *pruneStat) record(version uint64, size int) {
+	if p.records == 0 || version < p.minVersion {
+		p.minVersion = version
+	}
+	if p.records == 0 || version > p.maxVersion {
+		p.maxVersion = version
+	}
+	p.records++
+	p.size += int64(size)
+}
+
+func (p *pruneStat) add(n *pruneStat) {
+	if n.records == 0 {
+		return
+	}
+	if p.records == 0 || n.minVersion < p.minVersion {
+		p.minVersion = n.minVersion
+	}
+	if p.records == 0 || n.maxVersion > p.maxVersion {
+		p.maxVersion = n.maxVersion
+	}
+	p.records += n.records
+	p.size += n.size
+}
+
+type pruneStats struct {
+	lk    sync.Mutex
+	stats []pruneStat
+}
+
+func (p *pruneStats) addStat(level int, n *pruneStat) {
+	p.lk.Lock()
+	if level >= len(p.stats) {
+		newStats := make([]pruneStat, level+1)
+		copy(newStats, p.stats)
+		p.stats = newStats
+	}
+	p.stats[level].add(n)
+	p.lk.Unlock()
+}
+
+func (p *pruneStats) getStat(level int) (stat pruneStat) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	if level < len(p.stats) {
+		return p.stats[level]
+	}
+	return
+}
+
+// versionPruner decides which records of a user key table compaction drops
+// under the retention policy. Records must be fed in internal key order, and
+// reset must be called at the first record of every user key.
+//
+// All decisions are conservative: a record is only dropped because of newer
+// records that are part of the same compaction output and visible to every
+// live snapshot. Newer versions living in other levels may therefore cause
+// more versions than strictly required to be kept, never fewer.
+type versionPruner struct {
+	policy    opt.Retention
+	n         int
+	watermark uint64
+	minSeq    uint64
+
+	kept        int
+	hasVersion  bool
+	lastVersion uint64
+	covered     bool
+}
+
+func (p *versionPruner) reset() {
+	p.kept = 0
+	p.hasVersion = false
+	p.lastVersion = 0
+	p.covered = false
+}
+
+// drop reports whether the given record should be dropped.
+func (p *versionPruner) drop(version, seq uint64, kt dbkey.KeyType) bool {
+	if p.policy == opt.RetainAll {
+		return false
+	}
+	if seq > p.minSeq {
+		// Newer than some live snapshot, which must not observe records
+		// disappearing underneath it.
+		return false
+	}
+	if p.hasVersion && version == p.lastVersion {
+		// Overwritten by a newer write of the same version.
+		return true
+	}
+
+	switch p.policy {
+	case opt.RetainLastN:
+		if p.kept >= p.n {
+			return true
+		}
+	case opt.RetainAboveWatermark:
+		if p.covered {
+			return true
+		}
+	case opt.RetainDropTombstones:
+		if kt == dbkey.KeyTypeDel && p.covered && version < p.watermark {
+			return true
+		}
+	}
+
+	p.kept++
+	p.hasVersion = true
+	p.lastVersion = version
+	if version <= p.watermark {
+		p.covered = true
+	}
+	return false
+}
+
+// SetPruneWatermark sets the version below which history may be pruned by
+// the RetainAboveWatermark and RetainDropTombstones retention policies.
+// The watermark only moves forward; a value lower than the current one is
+// ignored. It is persisted in the manifest, and kept across reopens.
+//
+// Pruning happens lazily as tables get compacted; use CompactRange to force
+// it over a key range.
+func (db *DB) SetPruneWatermark(version uint64) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	db.compCommitLk.Lock()
+	defer db.compCommitLk.Unlock()
+	if version <= atomic.LoadUint64(&db.pruneWatermark) {
+		return nil
+	}
+	rec := &sessionRecord{}
+	rec.setPruneWatermark(version)
+	if err := db.s.commit(rec, false); err != nil {
+		return err
+	}
+	atomic.StoreUint64(&db.pruneWatermark, version)
+	return nil
+}
+
+// PruneWatermark returns the current prune watermark.
+func (db *DB) PruneWatermark() uint64 {
+	return atomic.LoadUint64(&db.pruneWatermark)
+}
+
+func (db *DB) newVersionPruner(minSeq uint64) versionPruner {
+	return versionPruner{
+		policy:    db.s.o.GetRetention(),
+		n:         db.s.o.GetRetainVersions(),
+		watermark: db.PruneWatermark(),
+		minSeq:    minSeq,
+	}
+}
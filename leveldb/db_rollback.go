@@ -0,0 +1,277 @@
+package leveldb
+
+import (
+	"math"
+	"sync/atomic"
+
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+// RollbackToVersion discards every record written with a version greater
+// than the given one, so that writing can continue from that version, e.g.
+// after a chain reorganization orphaned the blocks above it.
+//
+// The records are physically removed: the memdb is flushed and every table
+// holding such a record is rewritten without it, so the resulting data is
+// the one of a DB that never saw the discarded writes. The Merkle roots
+// depend on the table layout as well, they only match the ones of such a
+// DB once both are fully compacted.
+// Writes are blocked for the whole duration of the rollback.
+//
+// The rollback is recorded in the manifest before anything is removed. If
+// it gets interrupted, e.g. by a crash, it is completed by the next Open,
+// and until it completes a later write with a version greater than the
+// target may be discarded as well. Callers should therefore retry a failed
+// rollback before writing again.
+//
+// The timestamps of the discarded versions are dropped from the version
+// timestamp index as well.
+//
+// Live snapshots and iterators might or might not observe the rollback.
+func (db *DB) RollbackToVersion(version uint64) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+
+	// Lock writer.
+	select {
+	case db.writeLockC <- struct{}{}:
+	case err := <-db.compPerErrC:
+		return err
+	case <-db.closeC:
+		return ErrClosed
+	}
+	defer func() {
+		<-db.writeLockC
+	}()
+
+	// Persist the rollback intent. A pending rollback to a lower version
+	// takes precedence, as its records are already doomed.
+	db.compCommitLk.Lock()
+	if db.s.stRollbackPending && db.s.stRollback < version {
+		version = db.s.stRollback
+	}
+	db.dropCapturedRoots(version)
+	rec := &sessionRecord{}
+	rec.setRollback(version)
+	rec.setVersionTrunc(version)
+	err := db.s.commit(rec, true)
+	db.compCommitLk.Unlock()
+	if err != nil {
+		return err
+	}
+	db.logf("db@rollback V·%d", version)
+
+	// Move the memdb content into tables, which obsoletes the journal.
+	if _, err := db.rotateMem(0, true); err != nil {
+		return err
+	}
+
+	// Rewrite the tables.
+	return db.compTriggerRollback(db.tcompCmdC, version)
+}
+
+// resumeRollback completes a rollback interrupted in a previous session.
+func (db *DB) resumeRollback() error {
+	if !db.s.stRollbackPending {
+		return nil
+	}
+	db.logf("db@rollback resuming V·%d", db.s.stRollback)
+	return db.RollbackToVersion(db.s.stRollback)
+}
+
+// rollbackBuilder rewrites the tables holding records above the rollback
+// version. Each table is replaced, in the same level, by a table holding
+// the remaining records, or simply deleted if none remain.
+type rollbackBuilder struct {
+	db      *DB
+	s       *session
+	v       *version
+	rec     *sessionRecord
+	version uint64
+	strict  bool
+
+	dropCnt int
+	tw      *tWriter
+}
+
+// keep reports whether the given record survives the rollback.
+func (b *rollbackBuilder) keep(ikey []byte) (bool, error) {
+	_, version, _, _, kerr := b.s.icmp.kf.ParseInternalKeyWithVersion(ikey)
+	if kerr != nil {
+		if b.strict {
+			return false, kerr
+		}
+		// Don't drop corrupted keys.
+		return true, nil
+	}
+	return version <= b.version, nil
+}
+
+// rewrite copies the surviving records of the table in a single pass. The
+// table is replaced by the copy if any record was dropped, otherwise the
+// copy is discarded and the table left as is.
+func (b *rollbackBuilder) rewrite(level int, t *tFile, cnt *compactionTransactCounter) error {
+	iter := b.s.tops.newRawIterator(t, nil, nil)
+	defer iter.Release()
+	dropCnt := 0
+	for iter.Next() {
+		cnt.incr()
+		keep, err := b.keep(iter.Key())
+		if err != nil {
+			return err
+		}
+		if !keep {
+			dropCnt++
+			continue
+		}
+		if b.tw == nil {
+			if b.tw, err = b.s.tops.create(int(t.size)); err != nil {
+				return err
+			}
+		}
+		if err := b.tw.appendRaw(iter.Key(), iter.Value()); err != nil {
+			return err
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	if dropCnt == 0 {
+		// Only tables without a known version range get here unaffected.
+		if b.tw != nil {
+			if err := b.tw.drop(); err != nil {
+				return err
+			}
+			b.tw = nil
+		}
+		return nil
+	}
+	b.dropCnt += dropCnt
+	b.rec.delTable(level, t.fd.Num)
+	if b.tw == nil {
+		b.s.logf("table@rollback deleted L%d@%d", level, t.fd.Num)
+		return nil
+	}
+	nt, err := b.tw.finish()
+	if err != nil {
+		return err
+	}
+	// Dropping records keeps the others ordered.
+	nt.ordered = t.ordered
+	b.rec.addTableFile(level, nt)
+	b.s.logf("table@rollback rewritten L%d@%d -> @%d N·%d S·%s", level, t.fd.Num, nt.fd.Num, b.tw.tw.EntriesLen(), shortenb(nt.size))
+	b.tw = nil
+	return nil
+}
+
+func (b *rollbackBuilder) run(cnt *compactionTransactCounter) (err error) {
+	// Start over, discarding the output of a failed attempt.
+	if err := b.revert(); err != nil {
+		return err
+	}
+	b.rec.resetAddedTables()
+	b.rec.resetDeletedTables()
+	b.dropCnt = 0
+
+	defer func() {
+		if b.tw != nil {
+			if derr := b.tw.drop(); derr != nil && err == nil {
+				err = derr
+			}
+			b.tw = nil
+		}
+	}()
+
+	for level, tables := range b.v.levels {
+		for _, t := range tables {
+			if !t.mayHoldVersions(b.version+1, math.MaxUint64) {
+				continue
+			}
+			if err := b.rewrite(level, t, cnt); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (b *rollbackBuilder) revert() error {
+	for _, at := range b.rec.addedTables {
+		b.s.logf("table@rollback revert @%d", at.num)
+		if err := b.s.tops.revert(storage.FileDesc{Type: storage.TypeTable, Num: at.num}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tableRollback rewrites the tables and marks the rollback as completed,
+// both within the same manifest record.
+func (db *DB) tableRollback(version uint64) error {
+	v := db.s.version()
+	defer v.release()
+
+	rec := &sessionRecord{}
+	b := &rollbackBuilder{
+		db:      db,
+		s:       db.s,
+		v:       v,
+		rec:     rec,
+		version: version,
+		strict:  db.s.o.GetStrict(opt.StrictCompaction),
+	}
+	db.compactionTransact("table@rollback", b)
+
+	// Writes are blocked and the memdb is empty, so every written version
+	// is now in the tables.
+	maxVersion := db.MaxVersion()
+	if maxVersion > version {
+		maxVersion = version
+	}
+	rec.clearRollback()
+	rec.setMaxVersion(maxVersion)
+	rec.setVersionTrunc(version)
+	db.compactionCommit("table-rollback", rec)
+	atomic.StoreUint64(&db.maxVersion, maxVersion)
+	db.logf("table@rollback committed V·%d F%s D·%d", version, sint(len(rec.addedTables)-len(rec.deletedTables)), b.dropCnt)
+	return nil
+}
+
+type cRollback struct {
+	version uint64
+	ackC    chan<- error
+}
+
+func (r cRollback) ack(err error) {
+	if r.ackC != nil {
+		defer func() {
+			_ = recover()
+		}()
+		r.ackC <- err
+	}
+}
+
+// Send rollback request.
+func (db *DB) compTriggerRollback(compC chan<- cCmd, version uint64) (err error) {
+	ch := make(chan error)
+	defer close(ch)
+	// Send cmd.
+	select {
+	case compC <- cRollback{version, ch}:
+	case err := <-db.compErrC:
+		return err
+	case <-db.closeC:
+		return ErrClosed
+	}
+	// Wait cmd.
+	select {
+	case err = <-ch:
+	case err = <-db.compErrC:
+	case <-db.closeC:
+		return ErrClosed
+	}
+	return err
+}
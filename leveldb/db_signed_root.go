@@ -0,0 +1,301 @@
+package leveldb
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"sort"
+	"sync"
+
+	"github.com/syndtr/goleveldb/leveldb/dbkey"
+	"github.com/syndtr/goleveldb/leveldb/merkle"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// signedRootDomain separates the signed root messages from any other
+// message signed with the same key.
+const signedRootDomain = "leveldb/signed-root/v1\x00"
+
+// SignedRoot is a master root signed by the Options.RootSigner, attesting
+// the DB state at the time it was the latest state of Version.
+//
+// The DB keeps no earlier state to generate proofs against: the proof reads
+// return proofs against the current master root, which only the root
+// returned by DB.SignRoot matches, until the next write or compaction. The
+// roots signed for the earlier versions are attestations: they verify the
+// proofs generated while their state was current, e.g. kept by a client,
+// and otherwise attest the root itself.
+type SignedRoot struct {
+	Version   uint64
+	Root      merkle.Hash
+	Signature []byte
+}
+
+// Message returns the message signed by the root signer: a domain tag,
+// the version as 8 big-endian bytes, and the root.
+func (r *SignedRoot) Message() []byte {
+	msg := make([]byte, 0, len(signedRootDomain)+8+merkle.HashSize)
+	msg = append(msg, signedRootDomain...)
+	msg = binary.BigEndian.AppendUint64(msg, r.Version)
+	return append(msg, r.Root[:]...)
+}
+
+// RootVerifier verifies the signatures made by an opt.RootSigner.
+type RootVerifier interface {
+	// VerifyRoot reports whether signature is a valid signature of the
+	// given signed root message.
+	VerifyRoot(message, signature []byte) bool
+}
+
+// Ed25519RootVerifier is a RootVerifier for the signatures of an
+// opt.Ed25519RootSigner, holding its ed25519 public key.
+type Ed25519RootVerifier ed25519.PublicKey
+
+func (k Ed25519RootVerifier) VerifyRoot(message, signature []byte) bool {
+	return len(k) == ed25519.PublicKeySize && ed25519.Verify(ed25519.PublicKey(k), message, signature)
+}
+
+// Verify verifies the signature of the root.
+func (r *SignedRoot) Verify(verifier RootVerifier) bool {
+	return r != nil && verifier != nil && verifier.VerifyRoot(r.Message(), r.Signature)
+}
+
+// VerifyProof verifies the signature of the root, then the proof chain of
+// the given key-value pair up to that root. The proof must have been
+// generated against the signed DB state, that is before any later write
+// or compaction; see SignedRoot.
+func (r *SignedRoot) VerifyProof(verifier RootVerifier, proof *DBProof, key []byte, version uint64, value []byte) bool {
+	return r.Verify(verifier) && proof != nil && proof.MasterProof != nil &&
+		proof.MasterProof.Root.Equal(r.Root) && proof.Verify(key, version, value)
+}
+
+// VerifyMultiProof is like VerifyProof, for the multiproof of the given
+// entries.
+func (r *SignedRoot) VerifyMultiProof(verifier RootVerifier, proof *DBMultiProof, entries []MultiGetEntry) bool {
+	return r.Verify(verifier) && proof != nil && proof.MasterProof != nil &&
+		proof.MasterProof.Root.Equal(r.Root) && proof.Verify(entries)
+}
+
+// signedRootIndex is the in-memory index of the signed roots persisted in
+// the manifest, one per version.
+//
+// The index holds the roots of at most limit versions, if not zero. Beyond
+// it, the roots of the lowest eighth of the versions are dropped at once,
+// which keeps the cost of pruning low.
+type signedRootIndex struct {
+	mu    sync.RWMutex
+	limit int
+	roots map[uint64]SignedRoot
+}
+
+// put adds the signed root, replacing any earlier root of its version.
+func (x *signedRootIndex) put(r SignedRoot) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.roots == nil {
+		x.roots = make(map[uint64]SignedRoot)
+	}
+	x.roots[r.Version] = r
+	if x.limit > 0 && len(x.roots) > x.limit {
+		versions := make([]uint64, 0, len(x.roots))
+		for v := range x.roots {
+			versions = append(versions, v)
+		}
+		sort.Slice(versions, func(i, j int) bool {
+			return versions[i] < versions[j]
+		})
+		for _, v := range versions[:len(versions)-x.limit+x.limit/8] {
+			delete(x.roots, v)
+		}
+	}
+}
+
+func (x *signedRootIndex) get(version uint64) (SignedRoot, bool) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	r, ok := x.roots[version]
+	return r, ok
+}
+
+// truncate drops the roots above the given version.
+func (x *signedRootIndex) truncate(version uint64) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if version == dbkey.LastestVersion {
+		return
+	}
+	for v := range x.roots {
+		if v > version {
+			delete(x.roots, v)
+		}
+	}
+}
+
+// all returns the roots sorted by version.
+func (x *signedRootIndex) all() []SignedRoot {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	roots := make([]SignedRoot, 0, len(x.roots))
+	for _, r := range x.roots {
+		roots = append(roots, r)
+	}
+	sort.Slice(roots, func(i, j int) bool {
+		return roots[i].Version < roots[j].Version
+	})
+	return roots
+}
+
+// captureRoot captures the master root of the current DB state as the root
+// of the given version, to be signed in the background. The write path
+// captures the root of the highest written version right before the first
+// write of a higher version, when no later write can change it anymore.
+// It is a noop without a root signer or for version 0. The caller must
+// hold the write lock, so that no write changes the state between the root
+// and its version.
+func (db *DB) captureRoot(version uint64) {
+	if db.s.o.GetRootSigner() == nil || version == 0 {
+		return
+	}
+	sr := SignedRoot{Version: version, Root: db.currentMasterRoot()}
+	db.srMu.Lock()
+	db.srPending = append(db.srPending, sr)
+	db.srMu.Unlock()
+	select {
+	case db.srSignC <- struct{}{}:
+	default:
+	}
+}
+
+// dropCapturedRoots drops the captured roots above the given version, and
+// any root being signed, as a rollback to that version discards them. The
+// caller must hold compCommitLk, which orders it with the manifest commits
+// of signCapturedRoot.
+func (db *DB) dropCapturedRoots(version uint64) {
+	db.srMu.Lock()
+	defer db.srMu.Unlock()
+	pending := db.srPending[:0]
+	for _, sr := range db.srPending {
+		if sr.Version <= version {
+			pending = append(pending, sr)
+		}
+	}
+	db.srPending = pending
+	db.srGen++
+}
+
+// signCapturedRoots signs the captured roots and persists them in the
+// manifest, in capture order. A root that fails to be signed or persisted
+// is logged and dropped, its writes being committed regardless; the first
+// such error is returned.
+func (db *DB) signCapturedRoots() error {
+	db.srSignMu.Lock()
+	defer db.srSignMu.Unlock()
+
+	signer := db.s.o.GetRootSigner()
+	var err error
+	for {
+		db.srMu.Lock()
+		if len(db.srPending) == 0 {
+			db.srMu.Unlock()
+			return err
+		}
+		sr := db.srPending[0]
+		db.srPending = db.srPending[1:]
+		gen := db.srGen
+		db.srMu.Unlock()
+
+		if serr := db.signCapturedRoot(signer, sr, gen); serr != nil {
+			db.logf("root@sign V·%d error %q", sr.Version, serr)
+			if err == nil {
+				err = serr
+			}
+		}
+	}
+}
+
+func (db *DB) signCapturedRoot(signer opt.RootSigner, sr SignedRoot, gen uint64) error {
+	sig, err := signer.SignRoot(sr.Message())
+	if err != nil {
+		return err
+	}
+	sr.Signature = sig
+
+	rec := &sessionRecord{}
+	rec.addSignedRoot(sr)
+	db.compCommitLk.Lock()
+	defer db.compCommitLk.Unlock()
+	db.srMu.Lock()
+	discarded := gen != db.srGen
+	db.srMu.Unlock()
+	if discarded {
+		// A rollback ran meanwhile.
+		return nil
+	}
+	return db.s.commit(rec, false)
+}
+
+// rootSigning signs the captured roots in the background, and the
+// remaining ones on close.
+func (db *DB) rootSigning() {
+	defer db.closeW.Done()
+
+	for {
+		select {
+		case <-db.srSignC:
+			db.signCapturedRoots()
+		case <-db.closeC:
+			db.signCapturedRoots()
+			return
+		}
+	}
+}
+
+// SignRoot signs the master root of the current DB state as the root of
+// the highest written version, see Options.RootSigner, and waits for the
+// earlier captured roots to be signed as well. The root of the highest
+// version is otherwise only signed once a higher version is written, as
+// the writes of that version keep changing it. It returns the signed root,
+// or the first signing error.
+//
+// The returned root is its own copy, it is safe to modify it.
+func (db *DB) SignRoot() (*SignedRoot, error) {
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+	if db.s.o.GetRootSigner() == nil {
+		return nil, ErrNoRootSigner
+	}
+
+	// Lock writer.
+	select {
+	case db.writeLockC <- struct{}{}:
+	case err := <-db.compPerErrC:
+		return nil, err
+	case <-db.closeC:
+		return nil, ErrClosed
+	}
+	version := db.MaxVersion()
+	db.captureRoot(version)
+	<-db.writeLockC
+
+	if err := db.signCapturedRoots(); err != nil {
+		return nil, err
+	}
+	return db.SignedRoot(version)
+}
+
+// SignedRoot returns the latest signed master root of the given version,
+// see Options.RootSigner. It returns ErrNotFound if the version has no
+// signed root.
+//
+// The returned root is its own copy, it is safe to modify it.
+func (db *DB) SignedRoot(version uint64) (*SignedRoot, error) {
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+	r, ok := db.s.srIndex.get(version)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	r.Signature = append([]byte(nil), r.Signature...)
+	return &r, nil
+}
@@ -26,6 +26,14 @@ type memDB struct {
 	db *DB
 	*memdb.DB
 	ref int32
+
+	// maxVersion is the highest version written into the memdb; need
+	// external synchronization.
+	maxVersion uint64
+	// unordered is set once a record is written into the memdb with a
+	// version lower than a version written before it; need external
+	// synchronization.
+	unordered bool
 }
 
 func (m *memDB) getref() int32 {
@@ -90,6 +98,9 @@ func (db *DB) mpoolGet(n int) *memDB {
 	}
 	if mdb == nil || mdb.Capacity() < n {
 		mdb = memdb.New(db.s.icmp, maxInt(db.s.o.GetWriteBuffer(), n))
+		mdb.SetLeafFormat(db.merkleLeafFormat())
+		mdb.SetKeyFormat(db.s.icmp.kf)
+		mdb.SetMerklePool(db.s.merklePool)
 	}
 	return &memDB{
 		db: db,
@@ -142,6 +153,13 @@ func (db *DB) newMem(n int) (mem *memDB, err error) {
 		if err := db.journal.Reset(w); err != nil {
 			return nil, err
 		}
+		// The chain head of the new journal, persisted by the caller,
+		// must not cover records lost from the old one.
+		if db.s.o.GetJournalHashChain() {
+			if err := db.journalWriter.Sync(); err != nil {
+				return nil, err
+			}
+		}
 		if err := db.journalWriter.Close(); err != nil {
 			return nil, err
 		}
@@ -175,6 +193,18 @@ func (db *DB) getMems() (e, f *memDB) {
 	return db.mem, db.frozenMem
 }
 
+// getMemsVersion returns the effective and frozen memdbs, see getMems,
+// together with the current version, see session.version. The proofs are
+// generated against such a state. A memdb compaction commits the table of
+// the frozen memdb and drops the memdb at once for it, which would
+// otherwise be counted twice, as a memdb and as its table.
+func (db *DB) getMemsVersion() (e, f *memDB, v *version) {
+	db.memStateMu.RLock()
+	defer db.memStateMu.RUnlock()
+	e, f = db.getMems()
+	return e, f, db.s.version()
+}
+
 // Get effective memdb.
 func (db *DB) getEffectiveMem() *memDB {
 	db.memMu.RLock()
@@ -0,0 +1,364 @@
+package leveldb
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb/dbkey"
+	"github.com/syndtr/goleveldb/leveldb/memdb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// versionTime maps a version to the time it was committed, in Unix
+// nanoseconds.
+type versionTime struct {
+	version uint64
+	time    int64
+}
+
+// versionTimeIndex is the in-memory version to timestamp index.
+//
+// The index is made durable in two steps: new entries are written to the
+// journal together with the batch that introduced their version, then
+// moved into the manifest by the next memdb flush, at which point they are
+// no longer pending.
+//
+// The index holds at most limit entries, if not zero. Beyond it, the
+// lowest eighth of the entries is dropped at once, which keeps the cost of
+// rebuilding ceil low.
+type versionTimeIndex struct {
+	mu      sync.RWMutex
+	limit   int
+	entries []versionTime // sorted by version
+	ceil    []int64       // ceil[i] is the latest time among entries[:i+1]
+	pending []versionTime // entries not yet in the manifest
+}
+
+func (x *versionTimeIndex) search(version uint64) int {
+	return sort.Search(len(x.entries), func(i int) bool {
+		return x.entries[i].version >= version
+	})
+}
+
+func (x *versionTimeIndex) has(version uint64) bool {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	i := x.search(version)
+	return i < len(x.entries) && x.entries[i].version == version
+}
+
+// add adds the entry unless its version is already indexed, in which case
+// the first recorded time wins. It reports whether the entry was added and
+// kept.
+func (x *versionTimeIndex) add(vt versionTime, pending bool) bool {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	i := x.search(vt.version)
+	if i < len(x.entries) && x.entries[i].version == vt.version {
+		return false
+	}
+	from := i // the first ceil entry to rebuild
+	if x.limit > 0 && len(x.entries) >= x.limit {
+		n := x.limit/8 + 1
+		if i < n {
+			// Would be dropped right away.
+			return false
+		}
+		x.entries = append(x.entries[:0], x.entries[n:]...)
+		i -= n
+		from = 0
+	}
+	x.entries = append(x.entries, versionTime{})
+	copy(x.entries[i+1:], x.entries[i:])
+	x.entries[i] = vt
+	x.ceil = append(x.ceil[:from], make([]int64, len(x.entries)-from)...)
+	for j := from; j < len(x.entries); j++ {
+		x.ceil[j] = x.entries[j].time
+		if j > 0 && x.ceil[j-1] > x.ceil[j] {
+			x.ceil[j] = x.ceil[j-1]
+		}
+	}
+	if pending {
+		x.pending = append(x.pending, vt)
+	}
+	return true
+}
+
+// truncate drops the entries above the given version.
+func (x *versionTimeIndex) truncate(version uint64) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	i := x.search(version + 1)
+	if version == dbkey.LastestVersion {
+		i = len(x.entries)
+	}
+	x.entries = x.entries[:i]
+	x.ceil = x.ceil[:i]
+	pending := x.pending[:0]
+	for _, vt := range x.pending {
+		if vt.version <= version {
+			pending = append(pending, vt)
+		}
+	}
+	x.pending = pending
+}
+
+// takePending returns the pending entries and marks them as persisted.
+func (x *versionTimeIndex) takePending() []versionTime {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	pending := x.pending
+	x.pending = nil
+	return pending
+}
+
+func (x *versionTimeIndex) all() []versionTime {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return append([]versionTime(nil), x.entries...)
+}
+
+func (x *versionTimeIndex) timeOf(version uint64) (int64, bool) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	i := x.search(version)
+	if i < len(x.entries) && x.entries[i].version == version {
+		return x.entries[i].time, true
+	}
+	return 0, false
+}
+
+// versionAt returns the highest indexed version such that it, and every
+// lower indexed version, was committed at or before t.
+func (x *versionTimeIndex) versionAt(t int64) (uint64, bool) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	i := sort.Search(len(x.ceil), func(i int) bool {
+		return x.ceil[i] > t
+	})
+	if i == 0 {
+		return 0, false
+	}
+	return x.entries[i-1].version, true
+}
+
+// collectVersionTimes appends to vts the timestamps of the batch versions
+// not indexed yet. The timestamp comes from the write options, else from
+// the Options.VersionTimestamp hook; versions without either are skipped.
+func (db *DB) collectVersionTimes(vts []versionTime, b *Batch, version uint64, ts time.Time) []versionTime {
+	hook := db.s.o.GetVersionTimestamp()
+	if ts.IsZero() && hook == nil {
+		return vts
+	}
+	add := func(version uint64) {
+		if version == 0 || db.s.vtIndex.has(version) {
+			return
+		}
+		for _, vt := range vts {
+			if vt.version == version {
+				return
+			}
+		}
+		t := ts
+		if t.IsZero() {
+			if t = hook(version); t.IsZero() {
+				return
+			}
+		}
+		vts = append(vts, versionTime{version, t.UnixNano()})
+	}
+	if b != nil {
+		for _, index := range b.index {
+			add(index.version)
+		}
+	} else {
+		add(version)
+	}
+	return vts
+}
+
+// loadVersionTimes adds the version timestamps of the given journaled
+// batch data to the index, as not persisted yet.
+func (db *DB) loadVersionTimes(data []byte) error {
+	return decodeBatch(data, func(i int, index batchIndex) error {
+		return nil
+	}, func(vt versionTime) error {
+		db.s.vtIndex.add(vt, true)
+		return nil
+	})
+}
+
+// takeVersionTimes moves the version timestamps not persisted yet into the
+// given record.
+func (db *DB) takeVersionTimes(rec *sessionRecord) {
+	for _, vt := range db.s.vtIndex.takePending() {
+		rec.addVersionTime(vt)
+	}
+}
+
+// VersionTime returns the time the given version was committed at, as
+// recorded by the version timestamp index. It returns ErrNotFound if the
+// version has no recorded time.
+func (db *DB) VersionTime(version uint64) (time.Time, error) {
+	if err := db.ok(); err != nil {
+		return time.Time{}, err
+	}
+	t, ok := db.s.vtIndex.timeOf(version)
+	if !ok {
+		return time.Time{}, ErrNotFound
+	}
+	return time.Unix(0, t), nil
+}
+
+// VersionAtTime resolves a time to a version using the version timestamp
+// index, which is fed by WriteOptions.Timestamp and the
+// Options.VersionTimestamp hook.
+//
+// It returns the highest indexed version such that it, and every lower
+// indexed version, was committed at or before t; a version stamped later
+// than one of its successors therefore hides them until its own time. It
+// returns ErrNotFound if no version was committed at or before t.
+func (db *DB) VersionAtTime(t time.Time) (uint64, error) {
+	if err := db.ok(); err != nil {
+		return 0, err
+	}
+	version, ok := db.s.vtIndex.versionAt(t.UnixNano())
+	if !ok {
+		return 0, ErrNotFound
+	}
+	return version, nil
+}
+
+// floorVersion returns the highest version, not greater than maxVersion,
+// written for the given key in the given memdbs and tables, among the
+// records visible at the given sequence number. Tombstones count as
+// written.
+func (db *DB) floorVersion(mems []*memdb.DB, v *version, key []byte, maxVersion, seq uint64) (version uint64, found bool, err error) {
+	// Records of a key are ordered by descending version, the first one at
+	// or after the seek key is thus the highest one not above maxVersion.
+	// A record written after seq is skipped by seeking again within its
+	// version, which only finds an older record of it in the bytewise
+	// format, as the legacy one doesn't order the records of a version,
+	// and then below its version.
+	find := func(find func(ikey []byte) ([]byte, error)) error {
+		for from := maxVersion; ; {
+			ikey := db.s.icmp.kf.MakeInternalKeyWithVersion(nil, key, from, seq, dbkey.KeyTypeSeek)
+			rkey, ferr := find(ikey)
+			if ferr != nil {
+				if ferr == ErrNotFound {
+					return nil
+				}
+				return ferr
+			}
+			rukey, rversion, rseq, _, kerr := db.s.icmp.kf.ParseInternalKeyWithVersion(rkey)
+			if kerr != nil || db.s.icmp.uCompare(rukey, key) != 0 {
+				return nil
+			}
+			if rseq <= seq {
+				if !found || rversion > version {
+					version, found = rversion, true
+				}
+				return nil
+			}
+			if rversion != from {
+				from = rversion
+			} else if rversion == 0 {
+				return nil
+			} else {
+				from = rversion - 1
+			}
+		}
+	}
+	for _, m := range mems {
+		if err = find(func(ikey []byte) ([]byte, error) {
+			rkey, _, merr := m.Find(ikey)
+			return rkey, merr
+		}); err != nil {
+			return 0, false, err
+		}
+	}
+	if v != nil {
+		ikey := db.s.icmp.kf.MakeInternalKeyWithVersion(nil, key, maxVersion, seq, dbkey.KeyTypeSeek)
+		v.walkOverlappingVersions(nil, ikey, 0, maxVersion, func(level int, t *tFile) bool {
+			// The filters can't be probed for the seek key, which is not
+			// an exact match, but for the user key.
+			if !db.s.tops.mayContain(t, key) {
+				return true
+			}
+			err = find(func(ikey []byte) ([]byte, error) {
+				return db.s.tops.findKey(t, ikey, false, nil)
+			})
+			return err == nil
+		}, nil)
+	}
+	return
+}
+
+// versionAsOf returns the version holding the state of the key at the
+// given version, i.e. the highest version written for it not greater than
+// the given one, among the records visible at the given sequence number.
+func (db *DB) versionAsOf(key []byte, version, seq uint64) (uint64, error) {
+	var mems []*memdb.DB
+	em, fm := db.getMems()
+	for _, m := range [...]*memDB{em, fm} {
+		if m != nil {
+			defer m.decref()
+			mems = append(mems, m.DB)
+		}
+	}
+	v := db.s.version()
+	defer v.release()
+	found, ok, err := db.floorVersion(mems, v, key, version, seq)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, ErrNotFound
+	}
+	return found, nil
+}
+
+// GetAsOfTime gets the value the given key held at time t. The time is
+// resolved to a version with VersionAtTime, and the value is the one
+// written with the highest version not greater than it, as read by
+// GetWithVersion. It returns the version the value was written at, and
+// ErrNotFound if the key did not exist or was deleted at that time.
+//
+// The returned slice is its own copy, it is safe to modify the contents
+// of the returned slice.
+func (db *DB) GetAsOfTime(key []byte, t time.Time, ro *opt.ReadOptions) (value []byte, version uint64, err error) {
+	at, err := db.VersionAtTime(t)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Resolve and read under the same snapshot.
+	se := db.acquireSnapshot()
+	defer db.releaseSnapshot(se)
+	if version, err = db.versionAsOf(key, at, se.seq); err != nil {
+		return nil, 0, err
+	}
+	value, err = db.get(nil, nil, key, version, se.seq, ro)
+	return
+}
+
+// GetAsOfTimeWithProof is like GetAsOfTime, but also returns the Merkle
+// proof of the value, as returned by GetWithProof for the resolved version.
+func (db *DB) GetAsOfTimeWithProof(key []byte, t time.Time, ro *opt.ReadOptions) (value []byte, version uint64, proof *DBProof, err error) {
+	at, err := db.VersionAtTime(t)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if err = db.merkleReady(); err != nil {
+		return nil, 0, nil, err
+	}
+
+	se := db.acquireSnapshot()
+	defer db.releaseSnapshot(se)
+	if version, err = db.versionAsOf(key, at, se.seq); err != nil {
+		return nil, 0, nil, err
+	}
+	value, _, proof, err = db.getWithProof(nil, nil, key, version, se.seq, ro, false)
+	return
+}
@@ -31,6 +31,10 @@ type Transaction struct {
 	rec       sessionRecord
 	stats     cStatStaging
 	closed    bool
+
+	vc           *versionChecker
+	maxVersion   uint64
+	versionTimes []versionTime
 }
 
 // Get gets the value for the given key. It returns ErrNotFound if the
@@ -117,8 +121,12 @@ func (tr *Transaction) flush() error {
 	return nil
 }
 
-func (tr *Transaction) put(kt dbkey.KeyType, key, value []byte) error {
-	tr.ikScratch = dbkey.MakeInternalKey(tr.ikScratch, key, tr.seq+1, kt)
+func (tr *Transaction) put(kt dbkey.KeyType, key, value []byte, version uint64) error {
+	if version > 0 {
+		tr.ikScratch = tr.db.s.icmp.kf.MakeInternalKeyWithVersion(tr.ikScratch, key, version, tr.seq+1, kt)
+	} else {
+		tr.ikScratch = tr.db.s.icmp.kf.MakeInternalKey(tr.ikScratch, key, tr.seq+1, kt)
+	}
 	if tr.mem.Free() < len(tr.ikScratch)+len(value) {
 		if err := tr.flush(); err != nil {
 			return err
@@ -143,7 +151,7 @@ func (tr *Transaction) Put(key, value []byte, wo *opt.WriteOptions) error {
 	if tr.closed {
 		return errTransactionDone
 	}
-	return tr.put(dbkey.KeyTypeVal, key, value)
+	return tr.put(dbkey.KeyTypeVal, key, value, 0)
 }
 
 // Delete deletes the value for the given key.
@@ -157,7 +165,7 @@ func (tr *Transaction) Delete(key []byte, wo *opt.WriteOptions) error {
 	if tr.closed {
 		return errTransactionDone
 	}
-	return tr.put(dbkey.KeyTypeDel, key, nil)
+	return tr.put(dbkey.KeyTypeDel, key, nil, 0)
 }
 
 // Write apply the given batch to the transaction. The batch will be applied
@@ -176,9 +184,25 @@ func (tr *Transaction) Write(b *Batch, wo *opt.WriteOptions) error {
 	if tr.closed {
 		return errTransactionDone
 	}
-	return b.replayInternal(func(i int, kt dbkey.KeyType, k, v []byte) error {
-		return tr.put(kt, k, v)
-	})
+	if tr.vc != nil {
+		// The transaction writes themselves are accounted by the checker.
+		release := tr.vc.acquireState()
+		err := tr.vc.check(b)
+		release()
+		if err != nil {
+			return err
+		}
+	}
+	for _, index := range b.index {
+		if err := tr.put(index.KeyType, index.k(b.data), index.v(b.data), index.version); err != nil {
+			return err
+		}
+	}
+	if version := b.maxVersion(); version > tr.maxVersion {
+		tr.maxVersion = version
+	}
+	tr.versionTimes = tr.db.collectVersionTimes(tr.versionTimes, b, 0, wo.GetTimestamp())
+	return nil
 }
 
 func (tr *Transaction) setDone() {
@@ -210,7 +234,18 @@ func (tr *Transaction) Commit() error {
 	if len(tr.tables) != 0 {
 		// Committing transaction.
 		tr.rec.setSeqNum(tr.seq)
+		if maxVersion := tr.db.MaxVersion(); tr.maxVersion > maxVersion {
+			// The state now holds the complete maxVersion.
+			tr.db.captureRoot(maxVersion)
+		}
 		tr.db.compCommitLk.Lock()
+		if tr.maxVersion > tr.db.s.stMaxVersion {
+			tr.rec.setMaxVersion(tr.maxVersion)
+		}
+		tr.rec.resetVersionTimes()
+		for _, vt := range tr.versionTimes {
+			tr.rec.addVersionTime(vt)
+		}
 		tr.stats.startTimer()
 		var cerr error
 		for retry := 0; retry < 3; retry++ {
@@ -227,6 +262,7 @@ func (tr *Transaction) Commit() error {
 			} else {
 				// Success. Set db.seq.
 				tr.db.setSeq(tr.seq)
+				tr.db.updateMaxVersion(tr.maxVersion)
 				break
 			}
 		}
@@ -330,6 +366,7 @@ func (db *DB) OpenTransaction() (*Transaction, error) {
 		db:  db,
 		seq: db.seq,
 		mem: db.mpoolGet(0),
+		vc:  db.newVersionChecker(nil, nil),
 	}
 	tr.mem.incref()
 	db.tr = tr
@@ -46,6 +46,7 @@ func (db *DB) checkAndCleanFiles() error {
 	for _, tables := range v.levels {
 		for _, t := range tables {
 			tmap[t.fd.Num] = false
+			db.s.tops.vlog.addTable(t)
 		}
 	}
 
@@ -56,6 +57,7 @@ func (db *DB) checkAndCleanFiles() error {
 
 	var nt int
 	var rem []storage.FileDesc
+	var vlogs []int64
 	for _, fd := range fds {
 		keep := true
 		switch fd.Type {
@@ -73,6 +75,11 @@ func (db *DB) checkAndCleanFiles() error {
 				tmap[fd.Num] = true
 				nt++
 			}
+		case storage.TypeValueLog:
+			keep = db.s.tops.vlog.referenced(fd.Num)
+			if keep {
+				vlogs = append(vlogs, fd.Num)
+			}
 		}
 
 		if !keep {
@@ -98,5 +105,14 @@ func (db *DB) checkAndCleanFiles() error {
 			return err
 		}
 	}
+
+	// Index the stored values, for dedup.
+	if db.s.o.GetDedupValues() {
+		for _, num := range vlogs {
+			if err := db.s.tops.vlog.loadIndex(num); err != nil {
+				db.logf("db@janitor value log index @%d %q", num, err)
+			}
+		}
+	}
 	return nil
 }
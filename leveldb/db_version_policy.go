@@ -0,0 +1,252 @@
+package leveldb
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/syndtr/goleveldb/leveldb/dbkey"
+	"github.com/syndtr/goleveldb/leveldb/memdb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// ErrVersionPolicy is returned when a write violates the version ordering
+// rules set by opt.Options.VersionPolicy.
+type ErrVersionPolicy struct {
+	// Rule is the violated rule.
+	Rule opt.VersionPolicy
+	// Key and Version identify the rejected record.
+	Key     []byte
+	Version uint64
+	// Conflict is the already written version the record conflicts with.
+	Conflict uint64
+}
+
+func (e *ErrVersionPolicy) Error() string {
+	switch e.Rule {
+	case opt.VersionRejectDuplicate:
+		return fmt.Sprintf("leveldb: version policy violated: key %q version %d already written", e.Key, e.Version)
+	case opt.VersionIncreasingPerKey:
+		return fmt.Sprintf("leveldb: version policy violated: key %q version %d not above version %d", e.Key, e.Version, e.Conflict)
+	case opt.VersionNonDecreasing:
+		return fmt.Sprintf("leveldb: version policy violated: key %q version %d below DB version %d", e.Key, e.Version, e.Conflict)
+	}
+	return fmt.Sprintf("leveldb: version policy %v violated: key %q version %d", e.Rule, e.Key, e.Version)
+}
+
+// MaxVersion returns the highest version written to the DB.
+//
+// The value is an upper bound: it does not decrease when versions get
+// pruned by the retention policy, only when they are discarded by
+// RollbackToVersion. For a DB created by an older release it only accounts
+// for the versions written since.
+func (db *DB) MaxVersion() uint64 {
+	return atomic.LoadUint64(&db.maxVersion)
+}
+
+// orderVersion returns the version the writes must not go below for their
+// memdb to stay ordered, see memDB.unordered. It is unknown, reported as
+// false, while a live table lacks a version range, as written by older
+// releases, since any of its records may hold a higher version.
+func (db *DB) orderVersion() (uint64, bool) {
+	if atomic.LoadInt32(&db.s.stUnversioned) != 0 {
+		return 0, false
+	}
+	version := db.MaxVersion()
+	if tversion := atomic.LoadUint64(&db.s.stTableVersion); tversion > version {
+		version = tversion
+	}
+	return version, true
+}
+
+// updateMaxVersion raises the highest written version.
+func (db *DB) updateMaxVersion(version uint64) {
+	for {
+		cur := atomic.LoadUint64(&db.maxVersion)
+		if version <= cur || atomic.CompareAndSwapUint64(&db.maxVersion, cur, version) {
+			return
+		}
+	}
+}
+
+// versionChecker enforces the version policy over a sequence of batches.
+// Batches checked successfully are accounted as written, so that later
+// batches are checked against them too, even before they reach the memdb.
+//
+// The checker relies on the write lock to see a stable DB state.
+type versionChecker struct {
+	db     *DB
+	policy opt.VersionPolicy
+	mems   []*memdb.DB
+	v      *version
+
+	maxVersion uint64
+	latest     map[string]uint64   // highest accounted version per key
+	written    map[string]struct{} // accounted (key, version) pairs
+
+	// State of the batch being checked.
+	batchMaxVersion uint64
+	batchLatest     map[string]uint64
+	batchWritten    map[string]struct{}
+	uvkey           []byte
+}
+
+// newVersionChecker returns a checker checking against the given memdbs and
+// version, which must stay valid while in use, or nil if no policy is set.
+func (db *DB) newVersionChecker(mems []*memdb.DB, v *version) *versionChecker {
+	policy := db.s.o.GetVersionPolicy()
+	if policy == opt.NoVersionPolicy {
+		return nil
+	}
+	if policy&opt.VersionIncreasingPerKey != 0 {
+		policy |= opt.VersionRejectDuplicate
+	}
+	return &versionChecker{
+		db:           db,
+		policy:       policy,
+		mems:         mems,
+		v:            v,
+		maxVersion:   db.MaxVersion(),
+		latest:       make(map[string]uint64),
+		written:      make(map[string]struct{}),
+		batchLatest:  make(map[string]uint64),
+		batchWritten: make(map[string]struct{}),
+	}
+}
+
+// acquireState points the checker to the current DB state. The returned
+// function releases the state and must be called once done.
+func (c *versionChecker) acquireState() func() {
+	// The memdbs must be acquired before the version, so that a concurrent
+	// memdb flush cannot make records invisible to both.
+	c.mems = c.mems[:0]
+	em, fm := c.db.getMems()
+	for _, m := range [...]*memDB{em, fm} {
+		if m != nil {
+			c.mems = append(c.mems, m.DB)
+		}
+	}
+	c.v = c.db.s.version()
+	return func() {
+		c.v.release()
+		c.v = nil
+		c.mems = c.mems[:0]
+		for _, m := range [...]*memDB{em, fm} {
+			if m != nil {
+				m.decref()
+			}
+		}
+	}
+}
+
+// newWriteVersionChecker returns a checker against the current DB state,
+// or nil if no policy is set. The returned function releases the state and
+// must be called once done, even when the checker is nil.
+func (db *DB) newWriteVersionChecker() (*versionChecker, func()) {
+	c := db.newVersionChecker(nil, nil)
+	if c == nil {
+		return nil, func() {}
+	}
+	return c, c.acquireState()
+}
+
+// lookup returns the highest version, not greater than maxVersion, written
+// for the given key, either in the DB or accounted by the checker.
+func (c *versionChecker) lookup(key []byte, maxVersion uint64) (version uint64, found bool, err error) {
+	for _, latest := range [...]map[string]uint64{c.latest, c.batchLatest} {
+		if x, ok := latest[string(key)]; ok && x <= maxVersion && (!found || x > version) {
+			version, found = x, true
+		}
+	}
+
+	x, ok, err := c.db.floorVersion(c.mems, c.v, key, maxVersion, dbkey.KeyMaxSeq)
+	if err != nil {
+		return 0, false, err
+	}
+	if ok && (!found || x > version) {
+		version, found = x, true
+	}
+	return
+}
+
+// check checks the versioned records of the batch against the policy, and
+// accounts them as written if they comply. A violating batch is not
+// accounted at all.
+func (c *versionChecker) check(b *Batch) error {
+	c.begin()
+	for _, index := range b.index {
+		if err := c.record(index.k(b.data), index.version); err != nil {
+			return err
+		}
+	}
+	c.commit()
+	return nil
+}
+
+// begin starts checking a new batch.
+func (c *versionChecker) begin() {
+	for k := range c.batchLatest {
+		delete(c.batchLatest, k)
+	}
+	for k := range c.batchWritten {
+		delete(c.batchWritten, k)
+	}
+	c.batchMaxVersion = c.maxVersion
+}
+
+// record checks a single record of the batch being checked.
+func (c *versionChecker) record(key []byte, version uint64) error {
+	if version == 0 {
+		return nil
+	}
+
+	if c.policy&opt.VersionNonDecreasing != 0 && version < c.batchMaxVersion {
+		return &ErrVersionPolicy{opt.VersionNonDecreasing, append([]byte(nil), key...), version, c.batchMaxVersion}
+	}
+	if c.policy&opt.VersionIncreasingPerKey != 0 {
+		latest, found, err := c.lookup(key, dbkey.LastestVersion)
+		if err != nil {
+			return err
+		}
+		if found && latest >= version {
+			return &ErrVersionPolicy{opt.VersionIncreasingPerKey, append([]byte(nil), key...), version, latest}
+		}
+	} else if c.policy&opt.VersionRejectDuplicate != 0 {
+		c.uvkey = dbkey.MakeUVKey(c.uvkey[:0], key, version)
+		_, dup := c.written[string(c.uvkey)]
+		if _, ok := c.batchWritten[string(c.uvkey)]; ok {
+			dup = true
+		}
+		if !dup {
+			x, found, err := c.lookup(key, version)
+			if err != nil {
+				return err
+			}
+			dup = found && x == version
+		}
+		if dup {
+			return &ErrVersionPolicy{opt.VersionRejectDuplicate, append([]byte(nil), key...), version, version}
+		}
+		c.batchWritten[string(c.uvkey)] = struct{}{}
+	}
+
+	if x, ok := c.batchLatest[string(key)]; !ok || version > x {
+		c.batchLatest[string(key)] = version
+	}
+	if version > c.batchMaxVersion {
+		c.batchMaxVersion = version
+	}
+	return nil
+}
+
+// commit accounts the records of the batch being checked as written.
+func (c *versionChecker) commit() {
+	for k, x := range c.batchLatest {
+		if cur, ok := c.latest[k]; !ok || x > cur {
+			c.latest[k] = x
+		}
+	}
+	for k := range c.batchWritten {
+		c.written[k] = struct{}{}
+	}
+	c.maxVersion = c.batchMaxVersion
+}
@@ -7,6 +7,7 @@
 package leveldb
 
 import (
+	"io"
 	"sync/atomic"
 	"time"
 
@@ -22,12 +23,29 @@ func (db *DB) writeJournal(batches []*Batch, seq uint64, sync bool) error {
 	if err != nil {
 		return err
 	}
-	if err := writeBatchesWithHeader(wr, batches, seq); err != nil {
+	chained := db.s.o.GetJournalHashChain()
+	var c JournalChain
+	if chained {
+		// The record carries the chain head extended by itself.
+		c = db.journalChain()
+		h := newJournalChainHash(c.Head)
+		if err := writeBatchesWithHeader(io.MultiWriter(wr, h), batches, seq); err != nil {
+			return err
+		}
+		h.Sum(c.Head[:0])
+		if _, err := wr.Write(c.Head[:]); err != nil {
+			return err
+		}
+		c.Seq = seq + uint64(batchesLen(batches)) - 1
+	} else if err := writeBatchesWithHeader(wr, batches, seq); err != nil {
 		return err
 	}
 	if err := db.journal.Flush(); err != nil {
 		return err
 	}
+	if chained {
+		db.setJournalChain(c)
+	}
 	if sync {
 		return db.journalWriter.Sync()
 	}
@@ -55,6 +73,10 @@ retry:
 		}
 		return
 	}
+	if err = db.commitJournalChain(); err != nil {
+		mem.decref()
+		return nil, err
+	}
 
 	// Schedule memdb compaction.
 	if wait {
@@ -138,6 +160,7 @@ type writeMerge struct {
 	KeyType    dbkey.KeyType
 	key, value []byte
 	version    uint64 // Version number for versioned writes
+	ts         time.Time
 }
 
 func (db *DB) unlockWrite(overflow bool, merged int, err error) {
@@ -153,8 +176,9 @@ func (db *DB) unlockWrite(overflow bool, merged int, err error) {
 	}
 }
 
-// ourBatch is batch that we can modify.
-func (db *DB) writeLocked(batch, ourBatch *Batch, merge, sync bool) error {
+// ourBatch is batch that we can modify. The receipt, if any, is filled for
+// batch, which must then be written unmerged.
+func (db *DB) writeLocked(batch, ourBatch *Batch, merge, sync bool, ts time.Time, receipt *WriteReceipt) error {
 	// Try to flush memdb. This method would also trying to throttle writes
 	// if it is too fast and compaction cannot catch-up.
 	mdb, mdbFree, err := db.flush(batch.internalLen)
@@ -164,10 +188,21 @@ func (db *DB) writeLocked(batch, ourBatch *Batch, merge, sync bool) error {
 	}
 	defer mdb.decref()
 
+	// Enforce the version policy.
+	vc, vcRelease := db.newWriteVersionChecker()
+	defer vcRelease()
+	if vc != nil {
+		if err := vc.check(batch); err != nil {
+			db.unlockWrite(false, 0, err)
+			return err
+		}
+	}
+
 	var (
 		overflow bool
 		merged   int
 		batches  = []*Batch{batch}
+		vts      = db.collectVersionTimes(nil, batch, 0, ts)
 	)
 
 	if merge {
@@ -189,11 +224,14 @@ func (db *DB) writeLocked(batch, ourBatch *Batch, merge, sync bool) error {
 			case incoming := <-db.writeMergeC:
 				if incoming.batch != nil {
 					// Merge batch.
-					if incoming.batch.internalLen > mergeLimit {
+					// A batch violating the version policy is left to its
+					// own writer, so that only that write fails.
+					if incoming.batch.internalLen > mergeLimit || (vc != nil && vc.check(incoming.batch) != nil) {
 						overflow = true
 						break merge
 					}
 					batches = append(batches, incoming.batch)
+					vts = db.collectVersionTimes(vts, incoming.batch, 0, incoming.ts)
 					mergeLimit -= incoming.batch.internalLen
 				} else {
 					// Merge put.
@@ -206,6 +244,14 @@ func (db *DB) writeLocked(batch, ourBatch *Batch, merge, sync bool) error {
 						overflow = true
 						break merge
 					}
+					if vc != nil {
+						vc.begin()
+						if vc.record(incoming.key, incoming.version) != nil {
+							overflow = true
+							break merge
+						}
+						vc.commit()
+					}
 					if ourBatch == nil {
 						ourBatch = db.batchPool.Get().(*Batch)
 						ourBatch.Reset()
@@ -218,6 +264,7 @@ func (db *DB) writeLocked(batch, ourBatch *Batch, merge, sync bool) error {
 					} else {
 						ourBatch.appendRec(incoming.KeyType, incoming.key, incoming.value)
 					}
+					vts = db.collectVersionTimes(vts, nil, incoming.version, incoming.ts)
 					mergeLimit -= internalLen
 				}
 				sync = sync || incoming.sync
@@ -235,6 +282,15 @@ func (db *DB) writeLocked(batch, ourBatch *Batch, merge, sync bool) error {
 		defer db.batchPool.Put(ourBatch)
 	}
 
+	// Journal the new version timestamps along with the batches.
+	if len(vts) > 0 {
+		vtBatch := new(Batch)
+		for _, vt := range vts {
+			vtBatch.appendVersionTime(vt)
+		}
+		batches = append(batches, vtBatch)
+	}
+
 	// Seq number.
 	seq := db.seq + 1
 
@@ -243,13 +299,46 @@ func (db *DB) writeLocked(batch, ourBatch *Batch, merge, sync bool) error {
 		db.unlockWrite(overflow, merged, err)
 		return err
 	}
+	for _, vt := range vts {
+		db.s.vtIndex.add(vt, true)
+	}
 
 	// Put batches.
+	if receipt != nil {
+		receipt.FirstSeq = seq
+		receipt.LastSeq = seq + uint64(batch.Len()) - 1
+	}
+	for _, batch := range batches {
+		if maxVersion := db.MaxVersion(); batch.maxVersion() > maxVersion {
+			// The state now holds the complete maxVersion.
+			db.captureRoot(maxVersion)
+			break
+		}
+	}
+	maxVersion, known := db.orderVersion()
+	if !known {
+		mdb.unordered = true
+	}
 	for _, batch := range batches {
 		if err := batch.putMem(seq, mdb.DB); err != nil {
 			panic(err)
 		}
 		seq += uint64(batch.Len())
+		if !batch.inOrder(maxVersion) {
+			mdb.unordered = true
+		}
+		version := batch.maxVersion()
+		if version > maxVersion {
+			maxVersion = version
+		}
+		if version > mdb.maxVersion {
+			mdb.maxVersion = version
+		}
+	}
+	db.updateMaxVersion(mdb.maxVersion)
+	if receipt != nil && receipt.roots {
+		receipt.MemRoot = mdb.DB.GetMerkleRoot()
+		receipt.MasterRoot = db.ComputeMasterRoot(db.s.version())
 	}
 
 	// Incr seq number.
@@ -296,11 +385,12 @@ func (db *DB) Write(batch *Batch, wo *opt.WriteOptions) error {
 
 	merge := !wo.GetNoWriteMerge() && !db.s.o.GetNoWriteMerge()
 	sync := wo.GetSync() && !db.s.o.GetNoSync()
+	ts := wo.GetTimestamp()
 
 	// Acquire write lock.
 	if merge {
 		select {
-		case db.writeMergeC <- writeMerge{sync: sync, batch: batch}:
+		case db.writeMergeC <- writeMerge{sync: sync, batch: batch, ts: ts}:
 			if <-db.writeMergedC {
 				// Write is merged.
 				return <-db.writeAckC
@@ -328,7 +418,7 @@ func (db *DB) Write(batch *Batch, wo *opt.WriteOptions) error {
 		}
 	}
 
-	return db.writeLocked(batch, nil, merge, sync)
+	return db.writeLocked(batch, nil, merge, sync, ts, nil)
 }
 
 func (db *DB) putRec(kt dbkey.KeyType, key, value []byte, wo *opt.WriteOptions) error {
@@ -338,11 +428,12 @@ func (db *DB) putRec(kt dbkey.KeyType, key, value []byte, wo *opt.WriteOptions)
 
 	merge := !wo.GetNoWriteMerge() && !db.s.o.GetNoWriteMerge()
 	sync := wo.GetSync() && !db.s.o.GetNoSync()
+	ts := wo.GetTimestamp()
 
 	// Acquire write lock.
 	if merge {
 		select {
-		case db.writeMergeC <- writeMerge{sync: sync, KeyType: kt, key: key, value: value}:
+		case db.writeMergeC <- writeMerge{sync: sync, KeyType: kt, key: key, value: value, ts: ts}:
 			if <-db.writeMergedC {
 				// Write is merged.
 				return <-db.writeAckC
@@ -373,7 +464,7 @@ func (db *DB) putRec(kt dbkey.KeyType, key, value []byte, wo *opt.WriteOptions)
 	batch := db.batchPool.Get().(*Batch)
 	batch.Reset()
 	batch.appendRec(kt, key, value)
-	return db.writeLocked(batch, batch, merge, sync)
+	return db.writeLocked(batch, batch, merge, sync, ts, nil)
 }
 
 // Put sets the value for the given key. It overwrites any previous value
@@ -401,11 +492,12 @@ func (db *DB) PutWithVersion(key, value []byte, version uint64, wo *opt.WriteOpt
 
 	merge := !wo.GetNoWriteMerge() && !db.s.o.GetNoWriteMerge()
 	sync := wo.GetSync() && !db.s.o.GetNoSync()
+	ts := wo.GetTimestamp()
 
 	// Acquire write lock.
 	if merge {
 		select {
-		case db.writeMergeC <- writeMerge{sync: sync, KeyType: dbkey.KeyTypeVal, key: key, value: value, version: version}:
+		case db.writeMergeC <- writeMerge{sync: sync, KeyType: dbkey.KeyTypeVal, key: key, value: value, version: version, ts: ts}:
 			if <-db.writeMergedC {
 				// Write is merged.
 				return <-db.writeAckC
@@ -436,7 +528,7 @@ func (db *DB) PutWithVersion(key, value []byte, version uint64, wo *opt.WriteOpt
 	batch := db.batchPool.Get().(*Batch)
 	batch.Reset()
 	batch.appendRecWithVersion(dbkey.KeyTypeVal, key, value, version)
-	return db.writeLocked(batch, batch, merge, sync)
+	return db.writeLocked(batch, batch, merge, sync, ts, nil)
 }
 
 // Delete deletes the value for the given key. Delete will not returns error if
@@ -451,8 +543,8 @@ func (db *DB) Delete(key []byte, wo *opt.WriteOptions) error {
 func isMemOverlaps(icmp *iComparer, mem *memdb.DB, min, max []byte) bool {
 	iter := mem.NewIterator(nil)
 	defer iter.Release()
-	return (max == nil || (iter.First() && icmp.uCompare(max, dbkey.InternalKey(iter.Key()).UVkey()) >= 0)) &&
-		(min == nil || (iter.Last() && icmp.uCompare(min, dbkey.InternalKey(iter.Key()).UVkey()) <= 0))
+	return (max == nil || (iter.First() && icmp.uCompare(max, icmp.kf.Ukey(iter.Key())) >= 0)) &&
+		(min == nil || (iter.Last() && icmp.uCompare(min, icmp.kf.Ukey(iter.Key())) <= 0))
 }
 
 // CompactRange compacts the underlying DB for the given key range.
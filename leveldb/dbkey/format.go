@@ -0,0 +1,256 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package dbkey
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// Format is the encoding of the version and sequence number suffixes of the
+// internal keys.
+// Don't modify; this value are saved to disk.
+type Format uint8
+
+const (
+	// FormatLegacy stores the suffixes little-endian, the internal keys are
+	// ordered by decoding them.
+	FormatLegacy Format = 0
+	// FormatBytewise stores the suffixes big-endian and bit-inverted, so
+	// that the suffixes of a user key, the higher versions and sequence
+	// numbers first, are ordered by bytes.Compare. The user key is escaped
+	// and terminated, see putBytewiseUkey, so that the whole internal
+	// keys are ordered by bytes.Compare too, as long as the user keys are.
+	FormatBytewise Format = 1
+)
+
+// The user key of a bytewise internal key has its 0x00 bytes escaped as
+// 0x00 0xff, and is terminated by 0x00 0x01. The terminator sorts before
+// any byte of a longer user key, the escaped 0x00 included, which keeps a
+// user key before its extensions, whatever the suffixes.
+const (
+	bytewiseEscape     = 0x00
+	bytewiseEscaped    = 0xff
+	bytewiseTerminator = 0x01
+)
+
+// bytewiseUkeyLen returns the length of the escaped and terminated user
+// key.
+func bytewiseUkeyLen(ukey []byte) int {
+	return len(ukey) + bytes.Count(ukey, []byte{bytewiseEscape}) + 2
+}
+
+// putBytewiseUkey writes the escaped and terminated user key into dst,
+// which must be large enough, and returns the number of bytes written.
+func putBytewiseUkey(dst, ukey []byte) int {
+	n := 0
+	for {
+		i := bytes.IndexByte(ukey, bytewiseEscape)
+		if i < 0 {
+			break
+		}
+		n += copy(dst[n:], ukey[:i+1])
+		dst[n] = bytewiseEscaped
+		n++
+		ukey = ukey[i+1:]
+	}
+	n += copy(dst[n:], ukey)
+	dst[n], dst[n+1] = bytewiseEscape, bytewiseTerminator
+	return n + 2
+}
+
+// SplitBytewise splits a bytewise internal key into its user key,
+// unescaped, and the suffixes following the terminator. The user key is a
+// slice of the internal key unless it holds escaped bytes. It reports
+// false if the key has no terminator or an invalid escape.
+func SplitBytewise(ik []byte) (ukey, suffix []byte, ok bool) {
+	i := bytes.IndexByte(ik, bytewiseEscape)
+	if i < 0 || i+1 >= len(ik) {
+		return nil, nil, false
+	}
+	if ik[i+1] == bytewiseTerminator {
+		return ik[:i], ik[i+2:], true
+	}
+	ukey = append([]byte(nil), ik[:i]...)
+	for i < len(ik) {
+		c := ik[i]
+		if c != bytewiseEscape {
+			ukey = append(ukey, c)
+			i++
+			continue
+		}
+		if i+1 >= len(ik) {
+			break
+		}
+		switch ik[i+1] {
+		case bytewiseEscaped:
+			ukey = append(ukey, bytewiseEscape)
+			i += 2
+		case bytewiseTerminator:
+			return ukey, ik[i+2:], true
+		default:
+			return nil, nil, false
+		}
+	}
+	return nil, nil, false
+}
+
+// Known reports whether the format is one of the defined formats.
+func (f Format) Known() bool {
+	return f <= FormatBytewise
+}
+
+func (f Format) String() string {
+	switch f {
+	case FormatLegacy:
+		return "legacy"
+	case FormatBytewise:
+		return "bytewise"
+	}
+	return fmt.Sprintf("<invalid:%d>", uint8(f))
+}
+
+func (f Format) putUint64(dst []byte, v uint64) {
+	if f == FormatBytewise {
+		binary.BigEndian.PutUint64(dst, ^v)
+	} else {
+		binary.LittleEndian.PutUint64(dst, v)
+	}
+}
+
+func (f Format) uint64(src []byte) uint64 {
+	if f == FormatBytewise {
+		return ^binary.BigEndian.Uint64(src)
+	}
+	return binary.LittleEndian.Uint64(src)
+}
+
+// MaxNumBytes returns the encoding of KeyMaxNum in the format.
+func (f Format) MaxNumBytes() []byte {
+	if f == FormatBytewise {
+		return keyMaxNumBytewise
+	}
+	return KeyMaxNumBytes
+}
+
+var keyMaxNumBytewise = make([]byte, 8)
+
+func init() {
+	FormatBytewise.putUint64(keyMaxNumBytewise, KeyMaxNum)
+}
+
+// MakeInternalKey creates an internal key without version in the format.
+// Format: uvkey | seq+type (8 bytes)
+func (f Format) MakeInternalKey(dst, ukey []byte, seq uint64, kt KeyType) InternalKey {
+	if seq > KeyMaxSeq {
+		panic("leveldb: invalid sequence number")
+	} else if kt > KeyTypeVal {
+		panic("leveldb: invalid type")
+	}
+
+	if f == FormatBytewise {
+		dst = ensureBuffer(dst, bytewiseUkeyLen(ukey)+8)
+		n := putBytewiseUkey(dst, ukey)
+		f.putUint64(dst[n:], (seq<<8)|uint64(kt))
+		return InternalKey(dst)
+	}
+
+	dst = ensureBuffer(dst, len(ukey)+8)
+	copy(dst, ukey)
+	f.putUint64(dst[len(ukey):], (seq<<8)|uint64(kt))
+	return InternalKey(dst)
+}
+
+// MakeInternalKeyWithVersion creates an internal key with version in the
+// format.
+// Format: ukey | version (8 bytes) | seq+type (8 bytes), the user key
+// escaped and terminated in the bytewise format.
+func (f Format) MakeInternalKeyWithVersion(dst, ukey []byte, version, seq uint64, kt KeyType) InternalKey {
+	if seq > KeyMaxSeq {
+		panic("leveldb: invalid sequence number")
+	} else if kt > KeyTypeVal {
+		panic("leveldb: invalid type")
+	}
+
+	n := len(ukey)
+	if f == FormatBytewise {
+		dst = ensureBuffer(dst, bytewiseUkeyLen(ukey)+16)
+		n = putBytewiseUkey(dst, ukey)
+	} else {
+		dst = ensureBuffer(dst, len(ukey)+16)
+		copy(dst, ukey)
+	}
+	f.putUint64(dst[n:], version)
+	f.putUint64(dst[n+8:], (seq<<8)|uint64(kt))
+	return InternalKey(dst)
+}
+
+// ParseInternalKey parses an internal key without version in the format.
+// The returned uvkey is the internal key without its sequence number, as
+// encoded, the user key escaped in the bytewise format.
+func (f Format) ParseInternalKey(ik []byte) (uvkey []byte, seq uint64, kt KeyType, err error) {
+	if len(ik) < 8 {
+		return nil, 0, 0, newErrInternalKeyCorrupted(ik, "invalid length")
+	}
+	num := f.uint64(ik[len(ik)-8:])
+	seq, kt = num>>8, KeyType(num&0xff)
+	if kt > KeyTypeVal {
+		return nil, 0, 0, newErrInternalKeyCorrupted(ik, "invalid type")
+	}
+	uvkey = ik[:len(ik)-8]
+	return
+}
+
+// ParseInternalKeyWithVersion parses an internal key with version in the
+// format.
+func (f Format) ParseInternalKeyWithVersion(ik []byte) (ukey []byte, version, seq uint64, kt KeyType, err error) {
+	if f == FormatBytewise {
+		ukey, suffix, ok := SplitBytewise(ik)
+		if !ok {
+			return nil, 0, 0, 0, newErrInternalKeyCorrupted(ik, "invalid user key encoding")
+		} else if len(suffix) != 16 {
+			return nil, 0, 0, 0, newErrInternalKeyCorrupted(ik, "invalid length for versioned key")
+		}
+		version = f.uint64(suffix[:8])
+		num := f.uint64(suffix[8:])
+		seq, kt = num>>8, KeyType(num&0xff)
+		if kt > KeyTypeVal {
+			return nil, 0, 0, 0, newErrInternalKeyCorrupted(ik, "invalid type")
+		}
+		return ukey, version, seq, kt, nil
+	}
+	if len(ik) < 16 {
+		return nil, 0, 0, 0, newErrInternalKeyCorrupted(ik, "invalid length for versioned key")
+	}
+	version = f.uint64(ik[len(ik)-16 : len(ik)-8])
+	num := f.uint64(ik[len(ik)-8:])
+	seq, kt = num>>8, KeyType(num&0xff)
+	if kt > KeyTypeVal {
+		return nil, 0, 0, 0, newErrInternalKeyCorrupted(ik, "invalid type")
+	}
+	ukey = ik[:len(ik)-16]
+	return
+}
+
+// Ukey returns the pure user key of the internal key, without version and
+// sequence number, see InternalKey.Ukey. In the bytewise format, it is
+// unescaped, and a slice of the internal key unless it holds 0x00 bytes.
+func (f Format) Ukey(ik InternalKey) []byte {
+	if f == FormatBytewise {
+		if ukey, _, ok := SplitBytewise(ik); ok {
+			return ukey
+		}
+	}
+	return ik.Ukey()
+}
+
+// ValidInternalKey reports whether the internal key is valid in the format.
+func (f Format) ValidInternalKey(ik []byte) bool {
+	_, _, _, err := f.ParseInternalKey(ik)
+	return err == nil
+}
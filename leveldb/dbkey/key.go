@@ -75,61 +75,28 @@ func init() {
 
 type InternalKey []byte
 
+// MakeInternalKey creates an internal key without version in the legacy
+// format.
 func MakeInternalKey(dst, ukey []byte, seq uint64, kt KeyType) InternalKey {
-	if seq > KeyMaxSeq {
-		panic("leveldb: invalid sequence number")
-	} else if kt > KeyTypeVal {
-		panic("leveldb: invalid type")
-	}
-
-	dst = ensureBuffer(dst, len(ukey)+8)
-	copy(dst, ukey)
-	binary.LittleEndian.PutUint64(dst[len(ukey):], (seq<<8)|uint64(kt))
-	return InternalKey(dst)
+	return FormatLegacy.MakeInternalKey(dst, ukey, seq, kt)
 }
 
 // MakeInternalKeyWithVersion creates an internal key with version support
+// in the legacy format.
 // Format: uvkey | version (8 bytes) | seq+type (8 bytes)
 func MakeInternalKeyWithVersion(dst, ukey []byte, version, seq uint64, kt KeyType) InternalKey {
-	if seq > KeyMaxSeq {
-		panic("leveldb: invalid sequence number")
-	} else if kt > KeyTypeVal {
-		panic("leveldb: invalid type")
-	}
-
-	dst = ensureBuffer(dst, len(ukey)+16)
-	copy(dst, ukey)
-	binary.LittleEndian.PutUint64(dst[len(ukey):], version)
-	binary.LittleEndian.PutUint64(dst[len(ukey)+8:], (seq<<8)|uint64(kt))
-	return InternalKey(dst)
+	return FormatLegacy.MakeInternalKeyWithVersion(dst, ukey, version, seq, kt)
 }
 
+// ParseInternalKey parses internal key in the legacy format.
 func ParseInternalKey(ik []byte) (uvkey []byte, seq uint64, kt KeyType, err error) {
-	if len(ik) < 8 {
-		return nil, 0, 0, newErrInternalKeyCorrupted(ik, "invalid length")
-	}
-	num := binary.LittleEndian.Uint64(ik[len(ik)-8:])
-	seq, kt = num>>8, KeyType(num&0xff)
-	if kt > KeyTypeVal {
-		return nil, 0, 0, newErrInternalKeyCorrupted(ik, "invalid type")
-	}
-	uvkey = ik[:len(ik)-8]
-	return
+	return FormatLegacy.ParseInternalKey(ik)
 }
 
-// ParseInternalKeyWithVersion parses internal key with version
+// ParseInternalKeyWithVersion parses internal key with version in the
+// legacy format.
 func ParseInternalKeyWithVersion(ik []byte) (ukey []byte, version, seq uint64, kt KeyType, err error) {
-	if len(ik) < 16 {
-		return nil, 0, 0, 0, newErrInternalKeyCorrupted(ik, "invalid length for versioned key")
-	}
-	version = binary.LittleEndian.Uint64(ik[len(ik)-16 : len(ik)-8])
-	num := binary.LittleEndian.Uint64(ik[len(ik)-8:])
-	seq, kt = num>>8, KeyType(num&0xff)
-	if kt > KeyTypeVal {
-		return nil, 0, 0, 0, newErrInternalKeyCorrupted(ik, "invalid type")
-	}
-	ukey = ik[:len(ik)-16]
-	return
+	return FormatLegacy.ParseInternalKeyWithVersion(ik)
 }
 
 //// ExtractVersion extracts version from internal key if present
@@ -147,8 +114,7 @@ func MakeUVKey(dst, ukey []byte, version uint64) []byte {
 }
 
 func ValidInternalKey(ik []byte) bool {
-	_, _, _, err := ParseInternalKey(ik)
-	return err == nil
+	return FormatLegacy.ValidInternalKey(ik)
 }
 
 func (ik InternalKey) assert() {
@@ -165,6 +131,16 @@ func (ik InternalKey) UVkey() []byte {
 	return ik[:len(ik)-8]
 }
 
+// Ukey returns the pure user key, without version and sequence number.
+// Keys too short to carry a version are treated as unversioned.
+func (ik InternalKey) Ukey() []byte {
+	ik.assert()
+	if len(ik) >= 16 {
+		return ik[:len(ik)-16]
+	}
+	return ik[:len(ik)-8]
+}
+
 func (ik InternalKey) Num() uint64 {
 	ik.assert()
 	return binary.LittleEndian.Uint64(ik[len(ik)-8:])
@@ -17,4 +17,7 @@ var (
 	ErrSnapshotReleased = errors.New("leveldb: snapshot released")
 	ErrIterReleased     = errors.New("leveldb: iterator released")
 	ErrClosed           = errors.New("leveldb: closed")
+	ErrRollbackPending  = errors.New("leveldb: rollback pending")
+	ErrVersionRange     = errors.New("leveldb: invalid version range")
+	ErrNoRootSigner     = errors.New("leveldb: no root signer")
 )
@@ -7,26 +7,121 @@
 package leveldb
 
 import (
+	"bytes"
+
 	"github.com/syndtr/goleveldb/leveldb/dbkey"
 	"github.com/syndtr/goleveldb/leveldb/filter"
 )
 
+// Name suffixes of the internal filters, the filters keyed on the user
+// key and version alone keep the name of the user filter.
+const (
+	iFilterUkeySuffix  = ".ukey"
+	iFilterUVkeySuffix = ".ukey+version"
+)
+
+// iFilter is the internal filter, keyed on the bare user key of the
+// records, and also on their user key and version if versions is set.
+//
+// The filter is probed with the internal seek keys: a key with the latest
+// version probes the user key, which holds for both latest and history
+// queries, and a key with any other version probes the exact version if
+// the filter has the versions, or else the user key.
 type iFilter struct {
 	filter.Filter
+	versions bool
+	icmp     *iComparer
+}
+
+func (f iFilter) Name() string {
+	if f.versions {
+		return f.Filter.Name() + iFilterUVkeySuffix
+	}
+	return f.Filter.Name() + iFilterUkeySuffix
 }
 
 func (f iFilter) Contains(filter, key []byte) bool {
-	return f.Filter.Contains(filter, dbkey.InternalKey(key).UVkey())
+	ikey := dbkey.InternalKey(key)
+	if f.versions && !isLatestSeekKey(f.icmp.kf, ikey) {
+		return f.Filter.Contains(filter, ikey.UVkey())
+	}
+	return f.Filter.Contains(filter, f.icmp.kf.Ukey(ikey))
 }
 
 func (f iFilter) NewGenerator() filter.FilterGenerator {
-	return iFilterGenerator{f.Filter.NewGenerator()}
+	return &iFilterGenerator{FilterGenerator: f.Filter.NewGenerator(), versions: f.versions, kf: f.icmp.kf}
 }
 
 type iFilterGenerator struct {
 	filter.FilterGenerator
+	versions bool
+	kf       dbkey.Format
+
+	// The records are added in order, the versions of a user key following
+	// each other, only the first one adds the user key.
+	lastUkey []byte
+	hasLast  bool
 }
 
-func (g iFilterGenerator) Add(key []byte) {
+func (g *iFilterGenerator) Add(key []byte) {
+	ikey := dbkey.InternalKey(key)
+	if ukey := g.kf.Ukey(ikey); !g.hasLast || !bytes.Equal(ukey, g.lastUkey) {
+		g.FilterGenerator.Add(ukey)
+		g.lastUkey = append(g.lastUkey[:0], ukey...)
+		g.hasLast = true
+	}
+	if g.versions {
+		g.FilterGenerator.Add(ikey.UVkey())
+	}
+}
+
+func (g *iFilterGenerator) Generate(b filter.Buffer) {
+	g.hasLast = false
+	g.FilterGenerator.Generate(b)
+}
+
+// iUVkeyFilter is the internal filter of the tables written before the
+// filters were keyed on the user key, which are keyed on the user key and
+// version only. It can't tell whether a table holds a user key, only
+// whether it holds an exact version of it.
+type iUVkeyFilter struct {
+	filter.Filter
+	icmp *iComparer
+}
+
+func (f iUVkeyFilter) Contains(filter, key []byte) bool {
+	ikey := dbkey.InternalKey(key)
+	if isLatestSeekKey(f.icmp.kf, ikey) {
+		return true
+	}
+	return f.Filter.Contains(filter, ikey.UVkey())
+}
+
+func (f iUVkeyFilter) NewGenerator() filter.FilterGenerator {
+	return iUVkeyFilterGenerator{f.Filter.NewGenerator()}
+}
+
+type iUVkeyFilterGenerator struct {
+	filter.FilterGenerator
+}
+
+func (g iUVkeyFilterGenerator) Add(key []byte) {
 	g.FilterGenerator.Add(dbkey.InternalKey(key).UVkey())
 }
+
+// isLatestSeekKey reports whether the internal key, encoded in the given
+// key format, carries the latest version, which sorts first among the
+// records of its user key.
+func isLatestSeekKey(kf dbkey.Format, ikey dbkey.InternalKey) bool {
+	if len(ikey) < 16 {
+		return false
+	}
+	_, version, _, _, err := kf.ParseInternalKeyWithVersion(ikey)
+	return err == nil && version == dbkey.LastestVersion
+}
+
+// ukeyProbe returns the seek key probing the filters for the given user
+// key, whatever its versions, in the given key format.
+func ukeyProbe(kf dbkey.Format, ukey []byte) dbkey.InternalKey {
+	return kf.MakeInternalKeyWithVersion(nil, ukey, dbkey.LastestVersion, dbkey.KeyMaxSeq, dbkey.KeyTypeSeek)
+}
@@ -14,7 +14,7 @@ import (
 	"github.com/syndtr/goleveldb/leveldb/dbkey"
 )
 
-var defaultIComparer = &iComparer{comparer.DefaultComparer}
+var defaultIComparer = &iComparer{ucmp: comparer.DefaultComparer}
 
 func ikey(key string, seq uint64, kt dbkey.KeyType) dbkey.InternalKey {
 	return dbkey.MakeInternalKey(nil, []byte(key), seq, kt)
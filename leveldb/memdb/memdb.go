@@ -12,8 +12,10 @@ import (
 	"sync"
 
 	"github.com/syndtr/goleveldb/leveldb/comparer"
+	"github.com/syndtr/goleveldb/leveldb/dbkey"
 	"github.com/syndtr/goleveldb/leveldb/errors"
 	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/merkle"
 	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
@@ -196,6 +198,10 @@ type DB struct {
 	maxHeight int
 	n         int
 	kvSize    int
+
+	leafFormat merkle.LeafFormat // Encoding of the Merkle leaves
+	keyFormat  dbkey.Format      // Encoding of the internal keys
+	merklePool *merkle.Pool      // Pool hashing the Merkle tree
 }
 
 func (p *DB) randHeight() (h int) {
@@ -473,6 +479,8 @@ func New(cmp comparer.BasicComparer, capacity int) *DB {
 		maxHeight: 1,
 		kvData:    make([]byte, 0, capacity),
 		nodeData:  make([]int, 4+tMaxHeight),
+
+		leafFormat: merkle.LeafFormatCurrent,
 	}
 	p.nodeData[nHeight] = tMaxHeight
 	return p
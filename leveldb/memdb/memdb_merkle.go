@@ -6,6 +6,7 @@ package memdb
 import (
 	"encoding/binary"
 
+	"github.com/syndtr/goleveldb/leveldb/dbkey"
 	"github.com/syndtr/goleveldb/leveldb/merkle"
 )
 
@@ -17,17 +18,56 @@ type MerkleSnapshot struct {
 	keys     [][]byte       // ordered keys for lookup
 	values   [][]byte       // corresponding values
 	root     merkle.Hash
+	format   merkle.LeafFormat
 }
 
-// parseVersionedKey extracts ukey and version from internal key
-// Internal key format: ukey | version (8 bytes) | seq+type (8 bytes)
-func parseVersionedKey(ikey []byte) (ukey []byte, version uint64, ok bool) {
-	if len(ikey) < 16 {
-		return nil, 0, false
+// leafHash returns the Merkle leaf hash of the given record, in the given
+// format, merkle.LeafFormatCurrent or merkle.LeafFormatValueHash.
+func leafHash(format merkle.LeafFormat, kf dbkey.Format, ikey, value []byte) merkle.Hash {
+	if len(ikey) < 8 {
+		return merkle.HashLeaf(ikey, value)
 	}
-	ukey = ikey[:len(ikey)-16]
-	version = binary.LittleEndian.Uint64(ikey[len(ikey)-16 : len(ikey)-8])
-	return ukey, version, true
+	ukey, version, _, kt, err := kf.ParseInternalKeyWithVersion(ikey)
+	if err != nil {
+		// Too short to carry a version.
+		ukey, _, kt, _ = kf.ParseInternalKey(ikey)
+		version = 0
+	}
+	if format == merkle.LeafFormatValueHash {
+		return merkle.HashLeafValueHash(ukey, version, merkle.LeafKind(kt), merkle.HashValue(value))
+	}
+	return merkle.HashLeafV1(ukey, version, merkle.LeafKind(kt), value)
+}
+
+// SetLeafFormat sets the format of the Merkle leaves of the memdb, either
+// merkle.LeafFormatCurrent or merkle.LeafFormatValueHash.
+func (p *DB) SetLeafFormat(format merkle.LeafFormat) {
+	p.mu.Lock()
+	p.leafFormat = format
+	p.mu.Unlock()
+}
+
+// SetKeyFormat sets the encoding of the internal keys of the memdb, which
+// are parsed for the Merkle leaves.
+func (p *DB) SetKeyFormat(kf dbkey.Format) {
+	p.mu.Lock()
+	p.keyFormat = kf
+	p.mu.Unlock()
+}
+
+// SetMerklePool sets the pool hashing the Merkle tree of the memdb in
+// parallel, nil hashing it on the caller goroutine.
+func (p *DB) SetMerklePool(pool *merkle.Pool) {
+	p.mu.Lock()
+	p.merklePool = pool
+	p.mu.Unlock()
+}
+
+// KeyFormat returns the encoding of the internal keys of the memdb.
+func (p *DB) KeyFormat() dbkey.Format {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.keyFormat
 }
 
 // MakeUVKey creates a key with version (ukey | version)
@@ -51,7 +91,8 @@ func (p *DB) BuildMerkleSnapshot() *MerkleSnapshot {
 func (p *DB) buildMerkleSnapshotLocked() *MerkleSnapshot {
 	if p.n == 0 {
 		return &MerkleSnapshot{
-			root: merkle.ZeroHash,
+			root:   merkle.ZeroHash,
+			format: p.leafFormat,
 		}
 	}
 
@@ -59,11 +100,10 @@ func (p *DB) buildMerkleSnapshotLocked() *MerkleSnapshot {
 		keyIndex: make(map[string]int),
 		keys:     make([][]byte, 0, p.n),
 		values:   make([][]byte, 0, p.n),
+		format:   p.leafFormat,
 	}
 
 	// Collect all key-value pairs in sorted order using skip list traversal
-	leafHashes := make([]merkle.Hash, 0, p.n)
-
 	// Traverse skip list from beginning
 	node := p.nodeData[nNext] // First node at level 0
 	idx := 0
@@ -84,27 +124,22 @@ func (p *DB) buildMerkleSnapshotLocked() *MerkleSnapshot {
 		snapshot.values = append(snapshot.values, value)
 		snapshot.keyIndex[string(ikey)] = idx
 
-		// Compute leaf hash using uvkey format: H(uvkey || value)
-		// uvkey = ukey | version (same format as SST)
-		ukey, version, ok := parseVersionedKey(ikey)
-		var leafHash merkle.Hash
-		if ok {
-			uvkey := MakeUVKey(ukey, version)
-			leafHash = merkle.HashLeaf(uvkey, value)
-		} else {
-			// Fallback: use full internal key
-			leafHash = merkle.HashLeaf(ikey, value)
-		}
-		leafHashes = append(leafHashes, leafHash)
-
 		// Move to next node at level 0
 		node = p.nodeData[node+nNext]
 		idx++
 	}
 
+	// Compute leaf hashes using the canonical leaf format (same as SST)
+	leafHashes := make([]merkle.Hash, len(snapshot.keys))
+	p.merklePool.Run(len(leafHashes), func(lo, hi int) {
+		for i := lo; i < hi; i++ {
+			leafHashes[i] = leafHash(p.leafFormat, p.keyFormat, snapshot.keys[i], snapshot.values[i])
+		}
+	})
+
 	// Build Merkle tree from leaf hashes
 	if len(leafHashes) > 0 {
-		snapshot.tree = merkle.NewMerkleTree(leafHashes)
+		snapshot.tree = merkle.NewMerkleTreeWithPool(leafHashes, p.merklePool)
 		snapshot.root = snapshot.tree.GetRoot()
 	} else {
 		snapshot.root = merkle.ZeroHash
@@ -137,10 +172,36 @@ func (s *MerkleSnapshot) GenerateProof(key []byte) (*merkle.MerkleProof, []byte,
 	if err != nil {
 		return nil, nil, false
 	}
+	proof.LeafFormat = s.format
 
 	return proof, s.values[idx], true
 }
 
+// GenerateMultiProof generates a Merkle multiproof for the given keys,
+// which must be distinct, and returns the leaf index of each of them.
+func (s *MerkleSnapshot) GenerateMultiProof(keys [][]byte) (*merkle.MultiProof, []int, error) {
+	if s == nil || s.tree == nil {
+		return nil, nil, merkle.ErrEmptyTree
+	}
+
+	leafIndices := make([]int, len(keys))
+	for i, key := range keys {
+		idx, exists := s.keyIndex[string(key)]
+		if !exists {
+			return nil, nil, merkle.ErrKeyNotFound
+		}
+		leafIndices[i] = idx
+	}
+
+	proof, err := s.tree.GenerateMultiProof(leafIndices)
+	if err != nil {
+		return nil, nil, err
+	}
+	proof.LeafFormat = s.format
+
+	return proof, leafIndices, nil
+}
+
 // GetWithProof gets value and Merkle proof for a key from MemDB
 // This builds a snapshot and generates proof in one operation
 func (p *DB) GetWithProof(key []byte) (value []byte, proof *merkle.MerkleProof, root merkle.Hash, err error) {
@@ -179,6 +240,7 @@ func (p *DB) GetWithProof(key []byte) (value []byte, proof *merkle.MerkleProof,
 		// Return value without proof
 		return value, nil, snapshot.root, nil
 	}
+	proof.LeafFormat = snapshot.format
 
 	return value, proof, snapshot.root, nil
 }
@@ -0,0 +1,70 @@
+// Copyright (c) 2024 mLSM Implementation
+// Use of this source code is governed by a BSD-style license
+
+package merkle
+
+import (
+	"fmt"
+	"testing"
+)
+
+const benchLeaves = 1 << 16
+
+var benchWorkers = []int{1, 2, 4, 8}
+
+func benchmarkPool(b *testing.B, fn func(b *testing.B, hashes []Hash, pool *Pool)) {
+	hashes := testLeafHashes(benchLeaves)
+	for _, workers := range benchWorkers {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			pool := NewPool(workers)
+			b.ResetTimer()
+			fn(b, hashes, pool)
+		})
+	}
+}
+
+func BenchmarkNewMerkleTree(b *testing.B) {
+	benchmarkPool(b, func(b *testing.B, hashes []Hash, pool *Pool) {
+		for i := 0; i < b.N; i++ {
+			NewMerkleTreeWithPool(hashes, pool)
+		}
+	})
+}
+
+func BenchmarkBuildTreeFromHashes(b *testing.B) {
+	benchmarkPool(b, func(b *testing.B, hashes []Hash, pool *Pool) {
+		for i := 0; i < b.N; i++ {
+			BuildTreeFromHashesWithPool(hashes, pool)
+		}
+	})
+}
+
+func BenchmarkTreeBuilder(b *testing.B) {
+	benchmarkPool(b, func(b *testing.B, hashes []Hash, pool *Pool) {
+		for i := 0; i < b.N; i++ {
+			builderRoot(b, hashes, pool)
+		}
+	})
+}
+
+func BenchmarkLeafHashes(b *testing.B) {
+	keys := make([][]byte, benchLeaves)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%08d", i))
+	}
+	value := make([]byte, 100)
+	for _, workers := range benchWorkers {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			pool := NewPool(workers)
+			hashes := make([]Hash, len(keys))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				pool.Run(len(keys), func(lo, hi int) {
+					for j := lo; j < hi; j++ {
+						hashes[j] = HashLeafV1(keys[j], uint64(i), LeafKindValue, value)
+					}
+				})
+			}
+		})
+	}
+}
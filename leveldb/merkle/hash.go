@@ -67,6 +67,8 @@ func HashConcat(data ...[]byte) Hash {
 
 // HashLeaf computes hash for a leaf node (key-value pair)
 // Format: Hash(0x00 || key || value)
+//
+// This is the LeafFormatLegacy encoding, new leaves use HashLeafV1.
 func HashLeaf(key, value []byte) Hash {
 	h := sha256.New()
 	h.Write([]byte{0x00}) // Leaf marker
@@ -77,6 +79,150 @@ func HashLeaf(key, value []byte) Hash {
 	return result
 }
 
+// LeafFormat identifies the encoding hashed into leaf nodes.
+type LeafFormat byte
+
+const (
+	// LeafFormatLegacy hashes 0x00 || uvkey || value, see HashLeaf. The
+	// encoding is ambiguous and doesn't commit to the key type; it is only
+	// kept to verify tables written by older releases.
+	LeafFormatLegacy LeafFormat = 0
+
+	// LeafFormatV1 hashes the canonical leaf encoding, see HashLeafV1.
+	LeafFormatV1 LeafFormat = 1
+
+	// LeafFormatValueHash hashes the canonical leaf encoding with the value
+	// replaced by its hash, see HashLeafValueHash. It is opt-in.
+	LeafFormatValueHash LeafFormat = 2
+
+	// LeafFormatCurrent is the default format of newly written leaves.
+	LeafFormatCurrent = LeafFormatV1
+)
+
+// Known reports whether the leaf format is known.
+func (f LeafFormat) Known() bool {
+	return f <= LeafFormatValueHash
+}
+
+// LeafKind is the kind of record a leaf commits to. The values match the
+// key types of the leveldb internal keys.
+type LeafKind byte
+
+const (
+	LeafKindDelete LeafKind = 0
+	LeafKindValue  LeafKind = 1
+)
+
+// HashLeafV1 computes the hash of a leaf node in the canonical format:
+//
+//	Hash(0x03 || uvarint(len(ukey)) || ukey || version (8 bytes BE) ||
+//	     kind || uvarint(len(value)) || value)
+//
+// Every variable-length field is length-prefixed, so distinct records
+// never share an encoding, and the kind tells a tombstone apart from an
+// empty value. A tombstone has an empty value.
+func HashLeafV1(ukey []byte, version uint64, kind LeafKind, value []byte) Hash {
+	var buf [1 + binary.MaxVarintLen64]byte
+	h := sha256.New()
+	buf[0] = 0x03 // Canonical leaf marker
+	n := binary.PutUvarint(buf[1:], uint64(len(ukey)))
+	h.Write(buf[:1+n])
+	h.Write(ukey)
+	binary.BigEndian.PutUint64(buf[:8], version)
+	buf[8] = byte(kind)
+	h.Write(buf[:9])
+	n = binary.PutUvarint(buf[:], uint64(len(value)))
+	h.Write(buf[:n])
+	h.Write(value)
+	var result Hash
+	copy(result[:], h.Sum(nil))
+	return result
+}
+
+// LayerKind is the kind of a layer of the master tree.
+type LayerKind byte
+
+const (
+	// LayerKindMemDB is a memdb layer, its level is the memdb index: 0 for
+	// the active memdb and 1 for the frozen one.
+	LayerKindMemDB LayerKind = 0
+
+	// LayerKindLevel is a level of tables, its level is the level number.
+	LayerKindLevel LayerKind = 1
+)
+
+// HashLayerLeaf computes the hash of a layer tree leaf, which binds a
+// table root to its level and key range:
+//
+//	Hash(0x04 || uvarint(level) || uvarint(len(minKey)) || minKey ||
+//	     uvarint(len(maxKey)) || maxKey || root)
+//
+// The keys are the smallest and largest uvkeys of the table.
+func HashLayerLeaf(level int, minKey, maxKey []byte, root Hash) Hash {
+	var buf [1 + binary.MaxVarintLen64]byte
+	h := sha256.New()
+	buf[0] = 0x04 // Layer leaf marker
+	n := binary.PutUvarint(buf[1:], uint64(level))
+	h.Write(buf[:1+n])
+	for _, key := range [...][]byte{minKey, maxKey} {
+		n = binary.PutUvarint(buf[:], uint64(len(key)))
+		h.Write(buf[:n])
+		h.Write(key)
+	}
+	h.Write(root[:])
+	var result Hash
+	copy(result[:], h.Sum(nil))
+	return result
+}
+
+// HashMasterLeaf computes the hash of a master tree leaf, which binds a
+// layer root to the layer kind and level:
+//
+//	Hash(0x05 || kind || uvarint(level) || root)
+func HashMasterLeaf(kind LayerKind, level int, root Hash) Hash {
+	var buf [2 + binary.MaxVarintLen64]byte
+	h := sha256.New()
+	buf[0] = 0x05 // Master leaf marker
+	buf[1] = byte(kind)
+	n := binary.PutUvarint(buf[2:], uint64(level))
+	h.Write(buf[:2+n])
+	h.Write(root[:])
+	var result Hash
+	copy(result[:], h.Sum(nil))
+	return result
+}
+
+// HashValue computes the value hash committed to by LeafFormatValueHash
+// leaves, the plain SHA-256 hash of the value.
+func HashValue(value []byte) Hash {
+	return sha256.Sum256(value)
+}
+
+// HashLeafValueHash computes the hash of a leaf node in the
+// LeafFormatValueHash format:
+//
+//	Hash(0x06 || uvarint(len(ukey)) || ukey || version (8 bytes BE) ||
+//	     kind || valueHash)
+//
+// It is the canonical leaf encoding of HashLeafV1, with a distinct marker
+// and the value replaced by HashValue(value). A tombstone has the hash of
+// an empty value.
+func HashLeafValueHash(ukey []byte, version uint64, kind LeafKind, valueHash Hash) Hash {
+	var buf [1 + binary.MaxVarintLen64]byte
+	h := sha256.New()
+	buf[0] = 0x06 // Value hash leaf marker
+	n := binary.PutUvarint(buf[1:], uint64(len(ukey)))
+	h.Write(buf[:1+n])
+	h.Write(ukey)
+	binary.BigEndian.PutUint64(buf[:8], version)
+	buf[8] = byte(kind)
+	h.Write(buf[:9])
+	h.Write(valueHash[:])
+	var result Hash
+	copy(result[:], h.Sum(nil))
+	return result
+}
+
 // HashInternal computes hash for an internal node
 // Format: Hash(0x01 || leftHash || rightHash)
 func HashInternal(left, right Hash) Hash {
@@ -0,0 +1,186 @@
+// Copyright (c) 2024 mLSM Implementation
+// Use of this source code is governed by a BSD-style license
+
+package merkle
+
+import (
+	"sort"
+)
+
+// MultiProof is a Merkle proof of several leaves of a tree at once.
+//
+// The sibling hashes shared by the leaf paths are included once, and those
+// computed from the proven leaves themselves aren't included at all, so
+// the proof grows sub-linearly with the number of leaves.
+type MultiProof struct {
+	// Indices are the indices of the proven leaves, in ascending order
+	Indices []int
+
+	// TreeSize is the number of leaves of the tree
+	TreeSize int
+
+	// Hashes are the sibling hashes that can't be computed from the proven
+	// leaves, in the order the verification consumes them: level by level
+	// from the leaves, and from left to right within a level
+	Hashes []Hash
+
+	// Root is the root hash of the tree
+	Root Hash
+
+	// LeafFormat is the encoding of the proven leaves
+	LeafFormat LeafFormat
+}
+
+// buildLevels builds the levels of the tree of the given leaves, from the
+// leaves up to the root, the same way as BuildTreeFromHashes.
+func buildLevels(leafHashes []Hash) [][]Hash {
+	levels := [][]Hash{leafHashes}
+	for current := leafHashes; len(current) > 1; {
+		next := make([]Hash, 0, (len(current)+1)/2)
+		for i := 0; i < len(current); i += 2 {
+			if i+1 < len(current) {
+				next = append(next, HashInternal(current[i], current[i+1]))
+			} else {
+				// Odd one out: promote to next level
+				next = append(next, current[i])
+			}
+		}
+		levels = append(levels, next)
+		current = next
+	}
+	return levels
+}
+
+// newMultiProof generates the multiproof of the leaves at the given
+// indices, which must be distinct, from the levels of the tree.
+func newMultiProof(levels [][]Hash, leafIndices []int) (*MultiProof, error) {
+	size := len(levels[0])
+	indices := append([]int(nil), leafIndices...)
+	sort.Ints(indices)
+	if len(indices) == 0 {
+		return nil, ErrKeyNotFound
+	}
+	for i, idx := range indices {
+		if idx < 0 || idx >= size || (i > 0 && indices[i-1] == idx) {
+			return nil, ErrKeyNotFound
+		}
+	}
+
+	proof := &MultiProof{
+		Indices:  indices,
+		TreeSize: size,
+		Root:     levels[len(levels)-1][0],
+	}
+	current := append([]int(nil), indices...)
+	for _, level := range levels[:len(levels)-1] {
+		n := 0
+		for i := 0; i < len(current); i++ {
+			idx := current[i]
+			switch {
+			case idx%2 == 1:
+				// The left sibling isn't proven, or it would have taken us.
+				proof.Hashes = append(proof.Hashes, level[idx-1])
+			case i+1 < len(current) && current[i+1] == idx+1:
+				// Both siblings are proven.
+				i++
+			case idx+1 < len(level):
+				proof.Hashes = append(proof.Hashes, level[idx+1])
+			}
+			current[n] = idx / 2
+			n++
+		}
+		current = current[:n]
+	}
+	return proof, nil
+}
+
+// Verify verifies the multiproof of the given leaf hashes, in the order
+// of Indices.
+func (p *MultiProof) Verify(leafHashes []Hash) bool {
+	if len(leafHashes) == 0 || len(leafHashes) != len(p.Indices) {
+		return false
+	}
+	for i, idx := range p.Indices {
+		if idx < 0 || idx >= p.TreeSize || (i > 0 && p.Indices[i-1] >= idx) {
+			return false
+		}
+	}
+
+	indices := append([]int(nil), p.Indices...)
+	current := append([]Hash(nil), leafHashes...)
+	hashes := p.Hashes
+	for size := p.TreeSize; size > 1; size = (size + 1) / 2 {
+		n := 0
+		for i := 0; i < len(indices); i++ {
+			idx, h := indices[i], current[i]
+			switch {
+			case idx%2 == 1:
+				if len(hashes) == 0 {
+					return false
+				}
+				h = HashInternal(hashes[0], h)
+				hashes = hashes[1:]
+			case i+1 < len(indices) && indices[i+1] == idx+1:
+				h = HashInternal(h, current[i+1])
+				i++
+			case idx+1 < size:
+				if len(hashes) == 0 {
+					return false
+				}
+				h = HashInternal(h, hashes[0])
+				hashes = hashes[1:]
+			}
+			indices[n], current[n] = idx/2, h
+			n++
+		}
+		indices, current = indices[:n], current[:n]
+	}
+	return len(hashes) == 0 && current[0].Equal(p.Root)
+}
+
+// GenerateMultiProof generates a multiproof for the leaves at the given
+// indices, which must be distinct.
+func (mt *MerkleTree) GenerateMultiProof(leafIndices []int) (*MultiProof, error) {
+	if len(mt.leafHashes) == 0 {
+		return nil, ErrEmptyTree
+	}
+	return newMultiProof(mt.levels, leafIndices)
+}
+
+// GenerateMultiProof generates a multiproof directly from CompactTreeFormat
+// for the leaves at the given indices, which must be distinct.
+func (ctf *CompactTreeFormat) GenerateMultiProof(leafIndices []int) (*MultiProof, error) {
+	if len(ctf.LeafHashes) == 0 {
+		return nil, ErrEmptyTree
+	}
+	proof, err := newMultiProof(buildLevels(ctf.LeafHashes), leafIndices)
+	if err != nil {
+		return nil, err
+	}
+	proof.Root = ctf.RootHash
+	return proof, nil
+}
+
+// LeafIndices returns the index of each of the given leaf hashes, found in
+// a single pass over the leaves.
+func (ctf *CompactTreeFormat) LeafIndices(leafHashes []Hash) ([]int, error) {
+	wanted := make(map[Hash][]int, len(leafHashes))
+	for i, h := range leafHashes {
+		wanted[h] = append(wanted[h], i)
+	}
+	indices := make([]int, len(leafHashes))
+	found := 0
+	for idx, h := range ctf.LeafHashes {
+		if positions, ok := wanted[h]; ok {
+			for _, i := range positions {
+				indices[i] = idx
+				found++
+			}
+			delete(wanted, h)
+		}
+	}
+	if found < len(leafHashes) {
+		return nil, ErrKeyNotFound
+	}
+	return indices, nil
+}
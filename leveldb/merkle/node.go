@@ -97,6 +97,15 @@ type MerkleProof struct {
 
 	// Exists indicates if the key exists in the tree
 	Exists bool
+
+	// LeafFormat is the encoding of the proven leaf
+	LeafFormat LeafFormat
+
+	// LeafIndex is the index of the proven leaf, and TreeSize the number
+	// of leaves of the tree. A zero TreeSize means the shape is unknown
+	// and the path isn't checked against them.
+	LeafIndex int
+	TreeSize  int
 }
 
 // ProofNode represents a node in the proof path
@@ -106,12 +115,15 @@ type ProofNode struct {
 	Height int32
 }
 
-// Verify verifies the Merkle proof
+// Verify verifies the Merkle proof. Non-existence proofs are not supported
+// and never verify.
 func (p *MerkleProof) Verify(leafHash Hash) bool {
 	if !p.Exists {
-		// For non-existence proofs, we need special handling
-		// This would require proving the absence via adjacent keys
-		return true // Simplified for now
+		return false
+	}
+
+	if p.TreeSize != 0 && !p.checkShape() {
+		return false
 	}
 
 	// Hash up the tree using the proof path
@@ -129,3 +141,29 @@ func (p *MerkleProof) Verify(leafHash Hash) bool {
 	// Final hash should match the root
 	return leafHash.Equal(p.Root)
 }
+
+// checkShape reports whether the path is the one of the leaf at LeafIndex
+// in a tree of TreeSize leaves. The trees pair adjacent nodes and promote
+// the odd one out of a level, which gets no sibling at that height.
+func (p *MerkleProof) checkShape() bool {
+	idx, size := p.LeafIndex, p.TreeSize
+	if idx < 0 || idx >= size {
+		return false
+	}
+	n := 0
+	for height := int32(0); size > 1; height++ {
+		if idx^1 < size {
+			if n >= len(p.Path) {
+				return false
+			}
+			sibling := p.Path[n]
+			if sibling.IsLeft != (idx%2 == 1) || sibling.Height != height {
+				return false
+			}
+			n++
+		}
+		idx /= 2
+		size = (size + 1) / 2
+	}
+	return n == len(p.Path)
+}
@@ -0,0 +1,97 @@
+// Copyright (c) 2024 mLSM Implementation
+// Use of this source code is governed by a BSD-style license
+
+package merkle
+
+import (
+	"sync"
+)
+
+// poolMinChunk is the minimum number of hashes computed by a goroutine of
+// a pool; smaller jobs are run on the caller goroutine.
+const poolMinChunk = 512
+
+// Pool is a bounded pool of goroutines hashing the Merkle trees in
+// parallel. The goroutines are shared by every job run on the pool; when
+// they are all busy, a job runs on the caller goroutine.
+//
+// A nil Pool runs every job on the caller goroutine. The trees and roots
+// are identical whatever the pool.
+type Pool struct {
+	workers int
+	sem     chan struct{}
+}
+
+// NewPool creates a pool of the given number of goroutines, the caller
+// goroutine included. It returns nil if workers is lower than 2.
+func NewPool(workers int) *Pool {
+	if workers < 2 {
+		return nil
+	}
+	return &Pool{
+		workers: workers,
+		sem:     make(chan struct{}, workers-1),
+	}
+}
+
+// Workers returns the number of goroutines of the pool, 1 for a nil pool.
+func (p *Pool) Workers() int {
+	if p == nil {
+		return 1
+	}
+	return p.workers
+}
+
+// Run calls fn on chunks of [0, n) covering it, in parallel, and returns
+// once they are all done. The chunks are disjoint, fn must only write
+// the results of its own chunk.
+func (p *Pool) Run(n int, fn func(lo, hi int)) {
+	if p == nil || n < 2*poolMinChunk {
+		fn(0, n)
+		return
+	}
+	chunks := n / poolMinChunk
+	if chunks > p.workers {
+		chunks = p.workers
+	}
+	size := (n + chunks - 1) / chunks
+
+	var wg sync.WaitGroup
+	for lo := size; lo < n; lo += size {
+		hi := lo + size
+		if hi > n {
+			hi = n
+		}
+		select {
+		case p.sem <- struct{}{}:
+			wg.Add(1)
+			go func(lo, hi int) {
+				defer func() {
+					<-p.sem
+					wg.Done()
+				}()
+				fn(lo, hi)
+			}(lo, hi)
+		default:
+			fn(lo, hi)
+		}
+	}
+	fn(0, size)
+	wg.Wait()
+}
+
+// nextLevel returns the level of the tree above the given one, the pairs
+// of hashes being hashed on the pool. An odd hash out is promoted.
+func (p *Pool) nextLevel(current []Hash) []Hash {
+	next := make([]Hash, (len(current)+1)/2)
+	p.Run(len(current)/2, func(lo, hi int) {
+		for i := lo; i < hi; i++ {
+			next[i] = HashInternal(current[2*i], current[2*i+1])
+		}
+	})
+	if len(current)%2 == 1 {
+		// Odd one out: promote to next level
+		next[len(next)-1] = current[len(current)-1]
+	}
+	return next
+}
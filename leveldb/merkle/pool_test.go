@@ -0,0 +1,100 @@
+// Copyright (c) 2024 mLSM Implementation
+// Use of this source code is governed by a BSD-style license
+
+package merkle
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// testLeafHashes returns n distinct leaf hashes.
+func testLeafHashes(n int) []Hash {
+	hashes := make([]Hash, n)
+	var key [8]byte
+	for i := range hashes {
+		binary.BigEndian.PutUint64(key[:], uint64(i))
+		hashes[i] = HashLeaf(key[:], key[:])
+	}
+	return hashes
+}
+
+// builderRoot returns the root of the tree built by a TreeBuilder on the
+// given pool.
+func builderRoot(t testing.TB, hashes []Hash, pool *Pool) Hash {
+	tb := NewTreeBuilder(nil)
+	tb.SetPool(pool)
+	for _, h := range hashes {
+		tb.AddLeafHash(h)
+	}
+	root, err := tb.Build()
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+	return root.Hash
+}
+
+func TestPoolRoots(t *testing.T) {
+	for _, n := range []int{1, 2, 3, 7, 2*poolMinChunk - 1, 2 * poolMinChunk, 2*poolMinChunk + 1, 5000} {
+		hashes := testLeafHashes(n)
+		tree := NewMerkleTree(hashes)
+		want := tree.GetRoot()
+		if root := BuildTreeFromHashes(hashes); root != want {
+			t.Fatalf("n=%d: BuildTreeFromHashes root %x, expected %x", n, root, want)
+		}
+		if root := builderRoot(t, hashes, nil); root != want {
+			t.Fatalf("n=%d: TreeBuilder root %x, expected %x", n, root, want)
+		}
+		for _, workers := range []int{2, 3, 4, 8} {
+			pool := NewPool(workers)
+			ptree := NewMerkleTreeWithPool(hashes, pool)
+			if root := ptree.GetRoot(); root != want {
+				t.Errorf("n=%d workers=%d: NewMerkleTreeWithPool root %x, expected %x", n, workers, root, want)
+			}
+			if root := BuildTreeFromHashesWithPool(hashes, pool); root != want {
+				t.Errorf("n=%d workers=%d: BuildTreeFromHashesWithPool root %x, expected %x", n, workers, root, want)
+			}
+			if root := builderRoot(t, hashes, pool); root != want {
+				t.Errorf("n=%d workers=%d: TreeBuilder root %x, expected %x", n, workers, root, want)
+			}
+			for _, i := range []int{0, n / 2, n - 1} {
+				proof, err := ptree.GenerateProof(i)
+				if err != nil {
+					t.Fatalf("n=%d workers=%d: GenerateProof(%d) failed: %v", n, workers, i, err)
+				}
+				if proof.Root != want {
+					t.Errorf("n=%d workers=%d: proof of %d to root %x, expected %x", n, workers, i, proof.Root, want)
+				}
+			}
+		}
+	}
+	if root := BuildTreeFromHashesWithPool(nil, NewPool(4)); root != ZeroHash {
+		t.Errorf("empty: root %x, expected the zero hash", root)
+	}
+}
+
+func TestPoolRun(t *testing.T) {
+	for _, workers := range []int{0, 1, 2, 4} {
+		pool := NewPool(workers)
+		want := workers
+		if want < 2 {
+			want = 1
+		}
+		if pool.Workers() != want {
+			t.Errorf("NewPool(%d): pool of %d workers, expected %d", workers, pool.Workers(), want)
+		}
+		for _, n := range []int{0, 1, poolMinChunk, 10*poolMinChunk + 3} {
+			counts := make([]int, n)
+			pool.Run(n, func(lo, hi int) {
+				for i := lo; i < hi; i++ {
+					counts[i]++
+				}
+			})
+			for i, c := range counts {
+				if c != 1 {
+					t.Fatalf("workers=%d n=%d: index %d run %d times", workers, n, i, c)
+				}
+			}
+		}
+	}
+}
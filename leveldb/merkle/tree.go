@@ -34,6 +34,12 @@ type MerkleTree struct {
 
 // NewMerkleTree creates a new Merkle tree from leaf hashes
 func NewMerkleTree(leafHashes []Hash) *MerkleTree {
+	return NewMerkleTreeWithPool(leafHashes, nil)
+}
+
+// NewMerkleTreeWithPool is like NewMerkleTree, the levels of the tree
+// being hashed on the given pool.
+func NewMerkleTreeWithPool(leafHashes []Hash, pool *Pool) *MerkleTree {
 	if len(leafHashes) == 0 {
 		return &MerkleTree{
 			rootHash: ZeroHash,
@@ -48,32 +54,20 @@ func NewMerkleTree(leafHashes []Hash) *MerkleTree {
 	}
 
 	// Build tree levels
-	mt.buildLevels()
+	mt.buildLevels(pool)
 
 	return mt
 }
 
 // buildLevels builds all tree levels from bottom to top
-func (mt *MerkleTree) buildLevels() {
+func (mt *MerkleTree) buildLevels(pool *Pool) {
 	mt.levels = make([][]Hash, 0, 8)
 	mt.levels = append(mt.levels, mt.leafHashes)
 
 	// Build each level by pairing hashes from previous level
 	currentLevel := mt.leafHashes
 	for len(currentLevel) > 1 {
-		nextLevel := make([]Hash, 0, (len(currentLevel)+1)/2)
-
-		for i := 0; i < len(currentLevel); i += 2 {
-			if i+1 < len(currentLevel) {
-				// Pair: hash the two siblings
-				parent := HashInternal(currentLevel[i], currentLevel[i+1])
-				nextLevel = append(nextLevel, parent)
-			} else {
-				// Odd one out: promote to next level
-				nextLevel = append(nextLevel, currentLevel[i])
-			}
-		}
-
+		nextLevel := pool.nextLevel(currentLevel)
 		mt.levels = append(mt.levels, nextLevel)
 		currentLevel = nextLevel
 	}
@@ -95,9 +89,11 @@ func (mt *MerkleTree) GenerateProof(leafIndex int) (*MerkleProof, error) {
 	}
 
 	proof := &MerkleProof{
-		Root:   mt.rootHash,
-		Exists: true,
-		Path:   make([]ProofNode, 0, mt.stats.TreeHeight),
+		Root:      mt.rootHash,
+		Exists:    true,
+		Path:      make([]ProofNode, 0, mt.stats.TreeHeight),
+		LeafIndex: leafIndex,
+		TreeSize:  len(mt.leafHashes),
 	}
 
 	// Build proof path by walking up the tree
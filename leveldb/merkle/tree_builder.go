@@ -9,6 +9,9 @@ type TreeBuilder struct {
 	// Sorted leaves - append only
 	leaves []*MerkleNode
 
+	// The pool hashing the levels of the tree, see SetPool
+	pool *Pool
+
 	// Statistics
 	totalNodes  int
 	totalLeaves int
@@ -32,6 +35,19 @@ func (tb *TreeBuilder) AddLeaf(key, value []byte) error {
 	return nil
 }
 
+// AddLeafHash adds a leaf node with the given precomputed hash.
+// Data must be added in sorted order (no validation for performance)
+func (tb *TreeBuilder) AddLeafHash(hash Hash) {
+	tb.leaves = append(tb.leaves, &MerkleNode{NodeType: NodeTypeLeaf, Hash: hash})
+	tb.totalLeaves++
+}
+
+// SetPool sets the pool hashing the levels of the tree in parallel, nil
+// hashing them on the caller goroutine.
+func (tb *TreeBuilder) SetPool(pool *Pool) {
+	tb.pool = pool
+}
+
 // Build constructs the Merkle tree from all added leaves
 // Returns the root node of the tree
 // Time complexity: O(n) for sorted data
@@ -62,20 +78,21 @@ func (tb *TreeBuilder) buildBalancedTree() (*MerkleNode, error) {
 
 	// Keep pairing up nodes until we have single root
 	for len(currentLevel) > 1 {
-		nextLevel := make([]*MerkleNode, 0, (len(currentLevel)+1)/2)
+		nextLevel := make([]*MerkleNode, (len(currentLevel)+1)/2)
 
 		// Pair up adjacent nodes
-		for i := 0; i < len(currentLevel); i += 2 {
-			if i+1 < len(currentLevel) {
+		tb.pool.Run(len(currentLevel)/2, func(lo, hi int) {
+			for i := lo; i < hi; i++ {
 				// Create parent from pair
-				parent := NewInternalNode(currentLevel[i], currentLevel[i+1])
+				parent := NewInternalNode(currentLevel[2*i], currentLevel[2*i+1])
 				parent.Height = height + 1
-				nextLevel = append(nextLevel, parent)
-				tb.totalNodes++
-			} else {
-				// Odd node out, promote to next level
-				nextLevel = append(nextLevel, currentLevel[i])
+				nextLevel[i] = parent
 			}
+		})
+		tb.totalNodes += len(currentLevel) / 2
+		if len(currentLevel)%2 == 1 {
+			// Odd node out, promote to next level
+			nextLevel[len(nextLevel)-1] = currentLevel[len(currentLevel)-1]
 		}
 
 		currentLevel = nextLevel
@@ -91,6 +108,12 @@ func (tb *TreeBuilder) buildBalancedTree() (*MerkleNode, error) {
 // This is used to build layer roots from SST roots, and MasterRoot from layer roots.
 // The hashes are treated as leaf nodes, and a balanced binary tree is constructed.
 func BuildTreeFromHashes(hashes []Hash) Hash {
+	return BuildTreeFromHashesWithPool(hashes, nil)
+}
+
+// BuildTreeFromHashesWithPool is like BuildTreeFromHashes, the levels of
+// the tree being hashed on the given pool.
+func BuildTreeFromHashesWithPool(hashes []Hash, pool *Pool) Hash {
 	if len(hashes) == 0 {
 		return ZeroHash
 	}
@@ -100,24 +123,9 @@ func BuildTreeFromHashes(hashes []Hash) Hash {
 	}
 
 	// Build balanced binary tree from hashes
-	currentLevel := make([]Hash, len(hashes))
-	copy(currentLevel, hashes)
-
+	currentLevel := hashes
 	for len(currentLevel) > 1 {
-		nextLevel := make([]Hash, 0, (len(currentLevel)+1)/2)
-
-		for i := 0; i < len(currentLevel); i += 2 {
-			if i+1 < len(currentLevel) {
-				// Pair: hash the two children
-				parent := HashInternal(currentLevel[i], currentLevel[i+1])
-				nextLevel = append(nextLevel, parent)
-			} else {
-				// Odd one out: promote to next level
-				nextLevel = append(nextLevel, currentLevel[i])
-			}
-		}
-
-		currentLevel = nextLevel
+		currentLevel = pool.nextLevel(currentLevel)
 	}
 
 	return currentLevel[0]
@@ -180,9 +180,11 @@ func (ctf *CompactTreeFormat) GenerateProof(leafIndex int) (*MerkleProof, error)
 	}
 
 	proof := &MerkleProof{
-		Root:   ctf.RootHash,
-		Exists: true,
-		Path:   make([]ProofNode, 0),
+		Root:      ctf.RootHash,
+		Exists:    true,
+		Path:      make([]ProofNode, 0),
+		LeafIndex: leafIndex,
+		TreeSize:  len(ctf.LeafHashes),
 	}
 
 	// Build levels on-the-fly and generate proof
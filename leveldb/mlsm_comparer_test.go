@@ -0,0 +1,149 @@
+package leveldb
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb/comparer"
+	"github.com/syndtr/goleveldb/leveldb/errors"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// reverseComparer orders the keys in the reverse of bytes.Compare, with
+// shortened separators.
+type reverseComparer struct{}
+
+func (reverseComparer) Name() string { return "test.reverse" }
+
+func (reverseComparer) Compare(a, b []byte) int { return bytes.Compare(b, a) }
+
+func (reverseComparer) Separator(dst, a, b []byte) []byte {
+	i, n := 0, len(a)
+	if n > len(b) {
+		n = len(b)
+	}
+	for ; i < n && a[i] == b[i]; i++ {
+	}
+	if i < n && a[i] > b[i] && i+1 < len(a) {
+		return append(dst, a[:i+1]...)
+	}
+	return nil
+}
+
+func (reverseComparer) Successor(dst, b []byte) []byte { return nil }
+
+// numericComparer orders the decimal numbers without leading zeros by their
+// value.
+type numericComparer struct{}
+
+func (numericComparer) Name() string { return "test.numeric" }
+
+func (numericComparer) Compare(a, b []byte) int {
+	if len(a) != len(b) {
+		if len(a) < len(b) {
+			return -1
+		}
+		return 1
+	}
+	return bytes.Compare(a, b)
+}
+
+func (numericComparer) Separator(dst, a, b []byte) []byte { return nil }
+
+func (numericComparer) Successor(dst, b []byte) []byte { return nil }
+
+// TestCustomComparer tests the versioned records of DBs ordered by a user
+// comparer: the separators of the table indexes, the lookups, the proofs
+// and the iteration order, and the comparer recorded in the manifest
+func TestCustomComparer(t *testing.T) {
+	for _, c := range []struct {
+		cmp  comparer.Comparer
+		keys []string // in the order of the comparer
+	}{
+		{reverseComparer{}, []string{"zz", "zebra", "za", "mango", "m", "apple", "a"}},
+		{numericComparer{}, []string{"7", "9", "10", "99", "100", "1000", "20000"}},
+	} {
+		t.Run(c.cmp.Name(), func(t *testing.T) {
+			dbPath := "testdata/custom_comparer_test"
+			os.RemoveAll(dbPath)
+			defer os.RemoveAll(dbPath)
+
+			// Small blocks, to get index separators between most records.
+			o := &opt.Options{Comparer: c.cmp, BlockSize: 64, BlockRestartInterval: 1}
+			db, err := OpenFile(dbPath, o)
+			if err != nil {
+				t.Fatalf("Failed to open database: %v", err)
+			}
+			value := func(key string, version uint64) string {
+				return fmt.Sprintf("%s@%d-%s", key, version, strings.Repeat("v", 32))
+			}
+			for version := uint64(1); version <= 3; version++ {
+				for _, key := range c.keys {
+					if err := db.PutWithVersion([]byte(key), []byte(value(key, version)), version, nil); err != nil {
+						t.Fatalf("PutWithVersion failed: %v", err)
+					}
+				}
+				mlsmCompactMem(t, db)
+			}
+
+			check := func(name string) {
+				for _, key := range c.keys {
+					for version := uint64(1); version <= 3; version++ {
+						v, err := db.GetWithVersion([]byte(key), version, nil)
+						if err != nil || string(v) != value(key, version) {
+							t.Errorf("%s: GetWithVersion(%s@%d): unexpected %q (%v)", name, key, version, v, err)
+						}
+					}
+					v, version, proof, err := db.GetWithProof([]byte(key), 2, nil)
+					if err != nil || version != 2 || !proof.Verify([]byte(key), 2, v) {
+						t.Errorf("%s: GetWithProof(%s@2): unexpected %q@%d (%v)", name, key, v, version, err)
+					}
+					if v, err := db.Get([]byte(key), nil); err != nil || string(v) != value(key, 3) {
+						t.Errorf("%s: Get(%s): unexpected %q (%v)", name, key, v, err)
+					}
+				}
+				keys := make([][]byte, len(c.keys))
+				for i, key := range c.keys {
+					keys[i] = []byte(key)
+				}
+				entries, proof, err := db.MultiGetWithProof(keys, 1, nil)
+				if err != nil || proof == nil {
+					t.Fatalf("%s: MultiGetWithProof failed: %v", name, err)
+				}
+				if !proof.Verify(entries) {
+					t.Errorf("%s: MultiGetWithProof: the proof does not verify", name)
+				}
+				var iterated []string
+				iter := db.NewIterator(nil, nil)
+				for iter.Next() {
+					iterated = append(iterated, string(iter.Key()))
+				}
+				iter.Release()
+				if strings.Join(iterated, ",") != strings.Join(c.keys, ",") {
+					t.Errorf("%s: iterated keys %v, expected %v", name, iterated, c.keys)
+				}
+			}
+			check("level 0")
+			if err := db.CompactRange(util.Range{}); err != nil {
+				t.Fatalf("CompactRange failed: %v", err)
+			}
+			check("compaction")
+			db.Close()
+
+			// The DB can't be opened with another comparer.
+			if _, err := OpenFile(dbPath, nil); !errors.IsCorrupted(err) || !strings.Contains(err.Error(), c.cmp.Name()) {
+				t.Errorf("OpenFile with the default comparer: unexpected %v", err)
+			}
+			db, err = OpenFile(dbPath, o)
+			if err != nil {
+				t.Fatalf("Failed to reopen database: %v", err)
+			}
+			defer db.Close()
+			check("reopen")
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package leveldb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb/merkle"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// valueLogsSize returns the total size of the values stored in the value
+// log files of the DB, their indexes left out.
+func valueLogsSize(t *testing.T, db *DB, dbPath string) (size int64) {
+	for _, num := range valueLogFiles(t, db) {
+		fd := storage.FileDesc{Type: storage.TypeValueLog, Num: num}
+		data, err := ioutil.ReadFile(filepath.Join(dbPath, fd.String()))
+		if err != nil {
+			t.Fatalf("ReadFile failed: %v", err)
+		}
+		if len(data) < vLogFooterLen {
+			t.Fatalf("value log @%d too short: %d bytes", num, len(data))
+		}
+		size += int64(binary.LittleEndian.Uint64(data[len(data)-vLogFooterLen:]))
+	}
+	return
+}
+
+// TestDedupValues tests that the values carried forward across versions and
+// keys are stored once, that their proofs verify against their hash, and
+// that the value log files are kept while any retained version references
+// them
+func TestDedupValues(t *testing.T) {
+	const versions = 5
+	blob := bytes.Repeat([]byte("blob-"), 200)
+	value := func(key string, version uint64) []byte {
+		if key == "c" {
+			return bytes.Repeat([]byte(fmt.Sprintf("c@%d-", version)), 200)
+		}
+		return blob
+	}
+	keys := []string{"a", "b", "c"}
+
+	dbPath := "testdata/dedup_values_test"
+	os.RemoveAll(dbPath)
+	defer os.RemoveAll(dbPath)
+	o := &opt.Options{
+		DisableSeeksCompaction: true,
+		CompactionL0Trigger:    versions + 1,
+		Retention:              opt.RetainLastN,
+		RetainVersions:         2,
+		ValueLogThreshold:      256,
+		DedupValues:            true,
+	}
+	db, err := OpenFile(dbPath, o)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	for version := uint64(1); version <= versions; version++ {
+		for _, key := range keys {
+			if err := db.PutWithVersion([]byte(key), value(key, version), version, nil); err != nil {
+				t.Fatalf("PutWithVersion failed: %v", err)
+			}
+		}
+		mlsmCompactMem(t, db)
+	}
+	logs := valueLogFiles(t, db)
+	if len(logs) != versions {
+		t.Fatalf("expected %d value log files, got %v", versions, logs)
+	}
+	if size, want := valueLogsSize(t, db, dbPath), int64(len(blob)+versions*len(value("c", 1))); size != want {
+		t.Errorf("value logs of %d bytes, expected %d", size, want)
+	}
+	prop, err := db.GetProperty("leveldb.valuelogs")
+	if err != nil {
+		t.Fatalf("GetProperty failed: %v", err)
+	}
+	if want := fmt.Sprintf("Files:%d Dedup:%d ", versions, 2*versions-1); !strings.HasPrefix(prop, want) {
+		t.Errorf("unexpected leveldb.valuelogs property %q, expected %q", prop, want)
+	}
+
+	check := func(name string, first, last uint64) {
+		for _, key := range keys {
+			for version := first; version <= last; version++ {
+				if v, err := db.GetWithVersion([]byte(key), version, nil); err != nil || !bytes.Equal(v, value(key, version)) {
+					t.Errorf("%s: GetWithVersion(%s@%d): unexpected %q (%v)", name, key, version, v, err)
+				}
+				h, actual, proof, err := db.GetValueHashWithProof([]byte(key), version, nil)
+				if err != nil || actual != version || h != merkle.HashValue(value(key, version)) || !proof.VerifyValueHash([]byte(key), version, h) {
+					t.Errorf("%s: GetValueHashWithProof(%s@%d): unexpected %x@%d (%v)", name, key, version, h, actual, err)
+				}
+			}
+			var want []uint64
+			for version := first; version <= last; version++ {
+				want = append(want, version)
+			}
+			expectVersions(t, name+": "+key, historyVersions(t, db, key), want...)
+		}
+	}
+	check("flush", 1, versions)
+
+	// The file of the first version holds the blob referenced by the
+	// retained versions.
+	if err := db.CompactRange(util.Range{}); err != nil {
+		t.Fatalf("CompactRange failed: %v", err)
+	}
+	check("compaction", versions-1, versions)
+	expectValueLogFiles(t, "compaction", db, []int64{logs[0], logs[versions-2], logs[versions-1]})
+	db.Close()
+
+	// Once read, the stored values are deduplicated again; the proofs of
+	// the memdb records verify against their hash as well.
+	db, err = OpenFile(dbPath, o)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer db.Close()
+	check("reopen", versions-1, versions)
+	size := valueLogsSize(t, db, dbPath)
+	for _, key := range keys {
+		if err := db.PutWithVersion([]byte(key), value(key, versions+1), versions+1, nil); err != nil {
+			t.Fatalf("PutWithVersion failed: %v", err)
+		}
+	}
+	check("memdb", versions-1, versions+1)
+	mlsmCompactMem(t, db)
+	check("flush after reopen", versions-1, versions+1)
+	if got, want := valueLogsSize(t, db, dbPath), size+int64(len(value("c", versions+1))); got != want {
+		t.Errorf("after reopen: value logs of %d bytes, expected %d", got, want)
+	}
+}
+
+// TestDedupValuesReopen tests that the values stored before a reopen are
+// deduplicated without being read first, the index being loaded from the
+// value log files, and that a value log file with a bad index is left out
+func TestDedupValuesReopen(t *testing.T) {
+	blob := bytes.Repeat([]byte("blob-"), 200)
+
+	dbPath := "testdata/dedup_values_reopen_test"
+	os.RemoveAll(dbPath)
+	defer os.RemoveAll(dbPath)
+	o := &opt.Options{
+		ValueLogThreshold: 256,
+		DedupValues:       true,
+	}
+	db, err := OpenFile(dbPath, o)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	if err := db.PutWithVersion([]byte("a"), blob, 1, nil); err != nil {
+		t.Fatalf("PutWithVersion failed: %v", err)
+	}
+	mlsmCompactMem(t, db)
+	logs := valueLogFiles(t, db)
+	if len(logs) != 1 {
+		t.Fatalf("expected a value log file, got %v", logs)
+	}
+	db.Close()
+
+	put := func(name, key string, version uint64) []int64 {
+		db, err := OpenFile(dbPath, o)
+		if err != nil {
+			t.Fatalf("%s: Failed to reopen database: %v", name, err)
+		}
+		defer db.Close()
+		if err := db.PutWithVersion([]byte(key), blob, version, nil); err != nil {
+			t.Fatalf("%s: PutWithVersion failed: %v", name, err)
+		}
+		mlsmCompactMem(t, db)
+		for _, key := range []string{"a", key} {
+			if v, err := db.Get([]byte(key), nil); err != nil || !bytes.Equal(v, blob) {
+				t.Errorf("%s: Get(%s): unexpected %q (%v)", name, key, v, err)
+			}
+		}
+		return valueLogFiles(t, db)
+	}
+	if got := put("reopen", "b", 2); fmt.Sprint(got) != fmt.Sprint(logs) {
+		t.Errorf("reopen: expected value log files %v, got %v", logs, got)
+	}
+
+	// Without its index, the file is not deduplicated against.
+	fd := storage.FileDesc{Type: storage.TypeValueLog, Num: logs[0]}
+	path := filepath.Join(dbPath, fd.String())
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if got := put("bad index", "c", 3); len(got) != 2 || got[0] != logs[0] {
+		t.Errorf("bad index: expected value log file %d and a new one, got %v", logs[0], got)
+	}
+}
@@ -0,0 +1,121 @@
+package leveldb
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// tablesSize returns the total size of the tables of the DB.
+func tablesSize(db *DB) (size int64) {
+	v := db.s.version()
+	defer v.release()
+	for _, tables := range v.levels {
+		size += tables.size()
+	}
+	return
+}
+
+// TestDeltaValues tests the records of tables written with delta values:
+// the lookups, the history, the iteration and the proofs of their versions,
+// across compactions and reopens with and without the option
+func TestDeltaValues(t *testing.T) {
+	keys := []string{"k1", "k2", "k3"}
+	const versions = 20
+	value := func(key string, version uint64) []byte {
+		value := bytes.Repeat([]byte(key+"-"), 200)
+		copy(value[version*9:], fmt.Sprintf("@%d", version))
+		return value
+	}
+	build := func(dbPath string, o *opt.Options) *DB {
+		db, err := OpenFile(dbPath, o)
+		if err != nil {
+			t.Fatalf("Failed to open database: %v", err)
+		}
+		for version := uint64(1); version <= versions; version++ {
+			for _, key := range keys {
+				if err := db.PutWithVersion([]byte(key), value(key, version), version, nil); err != nil {
+					t.Fatalf("PutWithVersion failed: %v", err)
+				}
+			}
+		}
+		mlsmCompactMem(t, db)
+		if err := db.CompactRange(util.Range{}); err != nil {
+			t.Fatalf("CompactRange failed: %v", err)
+		}
+		return db
+	}
+
+	dbPath := "testdata/delta_values_test"
+	os.RemoveAll(dbPath)
+	defer os.RemoveAll(dbPath)
+	plainPath := dbPath + "_plain"
+	os.RemoveAll(plainPath)
+	defer os.RemoveAll(plainPath)
+
+	o := &opt.Options{DeltaValues: true, Compression: opt.NoCompression}
+	db := build(dbPath, o)
+	plain := build(plainPath, &opt.Options{Compression: opt.NoCompression})
+	if size, plainSize := tablesSize(db), tablesSize(plain); size*2 > plainSize {
+		t.Errorf("tables of %d bytes, expected less than half of %d bytes", size, plainSize)
+	}
+	plain.Close()
+
+	check := func(name string) {
+		for _, key := range keys {
+			for version := uint64(1); version <= versions; version++ {
+				if v, err := db.GetWithVersion([]byte(key), version, nil); err != nil || !bytes.Equal(v, value(key, version)) {
+					t.Errorf("%s: GetWithVersion(%s@%d): unexpected %q (%v)", name, key, version, v, err)
+				}
+			}
+			if v, err := db.Get([]byte(key), nil); err != nil || !bytes.Equal(v, value(key, versions)) {
+				t.Errorf("%s: Get(%s): unexpected %q (%v)", name, key, v, err)
+			}
+			v, version, proof, err := db.GetWithProof([]byte(key), 7, nil)
+			if err != nil || version != 7 || !bytes.Equal(v, value(key, 7)) || !proof.Verify([]byte(key), 7, v) {
+				t.Errorf("%s: GetWithProof(%s@7): unexpected %q@%d (%v)", name, key, v, version, err)
+			}
+			entries, err := db.GetVersionHistory([]byte(key), 0, 0, nil)
+			if err != nil || len(entries) != versions {
+				t.Fatalf("%s: GetVersionHistory(%s): unexpected %d entries (%v)", name, key, len(entries), err)
+			}
+			for _, e := range entries {
+				if !bytes.Equal(e.Value, value(key, e.Version)) {
+					t.Errorf("%s: GetVersionHistory(%s): unexpected %q@%d", name, key, e.Value, e.Version)
+				}
+			}
+		}
+		var iterated []string
+		iter := db.NewIterator(nil, nil)
+		for iter.Next() {
+			if !bytes.Equal(iter.Value(), value(string(iter.Key()), versions)) {
+				t.Errorf("%s: iterated %s: unexpected %q", name, iter.Key(), iter.Value())
+			}
+			iterated = append(iterated, string(iter.Key()))
+		}
+		iter.Release()
+		if fmt.Sprint(iterated) != fmt.Sprint(keys) {
+			t.Errorf("%s: iterated keys %v, expected %v", name, iterated, keys)
+		}
+	}
+	check("compaction")
+	db.Close()
+
+	// The tables keep their encoding, whatever the option.
+	var err error
+	db, err = OpenFile(dbPath, nil)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer db.Close()
+	db.s.tops.fileCache.EvictAll()
+	check("reopen")
+	if err := db.CompactRange(util.Range{}); err != nil {
+		t.Fatalf("CompactRange failed: %v", err)
+	}
+	check("rewrite")
+}
@@ -0,0 +1,131 @@
+package leveldb
+
+import (
+	"os"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb/dbkey"
+	"github.com/syndtr/goleveldb/leveldb/filter"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/table"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// tableMayContain probes the filter of the single table of level 0 of the
+// DB with the given seek key.
+func tableMayContain(t *testing.T, db *DB, ikey dbkey.InternalKey) bool {
+	v := db.s.version()
+	defer v.release()
+	tables := v.levels[0]
+	if len(tables) != 1 {
+		t.Fatalf("expected one table, got %d", len(tables))
+	}
+	ch, err := db.s.tops.open(tables[0])
+	if err != nil {
+		t.Fatalf("open table failed: %v", err)
+	}
+	defer ch.Release()
+	ok, err := ch.Value().(*table.Reader).MayContain(ikey)
+	if err != nil {
+		t.Fatalf("MayContain failed: %v", err)
+	}
+	return ok
+}
+
+// TestUkeyFilter tests the lookups of every kind through the filters keyed
+// on the user key, and the filters keyed on the exact versions
+func TestUkeyFilter(t *testing.T) {
+	dbPath := "testdata/ukey_filter_test"
+	os.RemoveAll(dbPath)
+	defer os.RemoveAll(dbPath)
+
+	o := &opt.Options{Filter: filter.NewBloomFilter(10)}
+	db, err := OpenFile(dbPath, o)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	for _, r := range []struct {
+		key     string
+		version uint64
+	}{{"a", 1}, {"a", 2}, {"c", 1}, {"e", 4}} {
+		if err := db.PutWithVersion([]byte(r.key), []byte(r.key+"-value"), r.version, nil); err != nil {
+			t.Fatalf("PutWithVersion failed: %v", err)
+		}
+	}
+	mlsmCompactMem(t, db)
+
+	check := func(name string, versionsOfA int) {
+		if value, err := db.Get([]byte("a"), nil); err != nil || string(value) != "a-value" {
+			t.Errorf("%s: Get(a): unexpected %q (%v)", name, value, err)
+		}
+		if value, err := db.GetWithVersion([]byte("a"), 1, nil); err != nil || string(value) != "a-value" {
+			t.Errorf("%s: GetWithVersion(a@1): unexpected %q (%v)", name, value, err)
+		}
+		if _, _, proof, err := db.GetWithProof([]byte("c"), dbkey.LastestVersion, nil); err != nil || proof == nil {
+			t.Errorf("%s: GetWithProof(c): unexpected %v", name, err)
+		}
+		if entries, err := db.GetVersionHistory([]byte("a"), 0, 0, nil); err != nil || len(entries) != versionsOfA {
+			t.Errorf("%s: GetVersionHistory(a): unexpected %v (%v)", name, entries, err)
+		}
+		if version, err := db.versionAsOf([]byte("e"), 9, dbkey.KeyMaxSeq); err != nil || version != 4 {
+			t.Errorf("%s: versionAsOf(e@9): unexpected %d (%v)", name, version, err)
+		}
+		if _, err := db.Get([]byte("b"), nil); err != ErrNotFound {
+			t.Errorf("%s: Get(b): expected ErrNotFound, got %v", name, err)
+		}
+		if _, err := db.GetVersionHistory([]byte("d"), 0, 0, nil); err != ErrNotFound {
+			t.Errorf("%s: GetVersionHistory(d): expected ErrNotFound, got %v", name, err)
+		}
+	}
+	check("ukey filter", 2)
+
+	// The filter tells the missing user keys whatever the query.
+	if !tableMayContain(t, db, ukeyProbe(db.s.icmp.kf, []byte("a"))) || !tableMayContain(t, db, ukeyProbe(db.s.icmp.kf, []byte("e"))) {
+		t.Errorf("MayContain: the filter misses a present key")
+	}
+	if tableMayContain(t, db, ukeyProbe(db.s.icmp.kf, []byte("b"))) || tableMayContain(t, db, ukeyProbe(db.s.icmp.kf, []byte("d"))) {
+		t.Errorf("MayContain: the filter holds a missing key")
+	}
+	// It can't tell the missing versions of a present key.
+	a3 := dbkey.MakeInternalKeyWithVersion(nil, []byte("a"), 3, dbkey.KeyMaxSeq, dbkey.KeyTypeSeek)
+	if !tableMayContain(t, db, a3) {
+		t.Errorf("MayContain(a@3): the ukey filter holds no versions")
+	}
+	db.Close()
+
+	// The tables written without the versions are still read through their
+	// filter by a DB writing them.
+	o.FilterVersions = true
+	db, err = OpenFile(dbPath, o)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer db.Close()
+	check("mixed filters", 2)
+	if tableMayContain(t, db, ukeyProbe(db.s.icmp.kf, []byte("b"))) {
+		t.Errorf("MayContain(b): the ukey filter of the old table is not used")
+	}
+
+	// Push the old table down, and write a new one with the versions.
+	if err := db.CompactRange(util.Range{}); err != nil {
+		t.Fatalf("CompactRange failed: %v", err)
+	}
+	if err := db.PutWithVersion([]byte("a"), []byte("a-value"), 5, nil); err != nil {
+		t.Fatalf("PutWithVersion failed: %v", err)
+	}
+	mlsmCompactMem(t, db)
+	if !tableMayContain(t, db, ukeyProbe(db.s.icmp.kf, []byte("a"))) {
+		t.Errorf("MayContain(a): the filter misses a present key")
+	}
+	if tableMayContain(t, db, a3) {
+		t.Errorf("MayContain(a@3): the filter holds a missing version")
+	}
+	a5 := dbkey.MakeInternalKeyWithVersion(nil, []byte("a"), 5, dbkey.KeyMaxSeq, dbkey.KeyTypeSeek)
+	if !tableMayContain(t, db, a5) {
+		t.Errorf("MayContain(a@5): the filter misses a present version")
+	}
+	check("version filter", 3)
+	if value, err := db.GetWithVersion([]byte("a"), 5, nil); err != nil || string(value) != "a-value" {
+		t.Errorf("GetWithVersion(a@5): unexpected %q (%v)", value, err)
+	}
+}
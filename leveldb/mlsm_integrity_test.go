@@ -0,0 +1,197 @@
+package leveldb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb/merkle"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// corruptTableData flips a byte of the given data in the table files of
+// the DB, which must be written uncompressed.
+func corruptTableData(t *testing.T, dbPath string, data []byte) {
+	files, _ := filepath.Glob(filepath.Join(dbPath, "*.ldb"))
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("ReadFile failed: %v", err)
+		}
+		if i := bytes.Index(content, data); i >= 0 {
+			content[i] ^= 0xff
+			if err := os.WriteFile(file, content, 0644); err != nil {
+				t.Fatalf("WriteFile failed: %v", err)
+			}
+			return
+		}
+	}
+	t.Fatalf("table data %q not found", data)
+}
+
+// openIntegrityTestDB opens a DB with two tables, holding a-b and x-y, and
+// a memdb holding m.
+func openIntegrityTestDB(t *testing.T, dbPath string) *DB {
+	db, err := OpenFile(dbPath, &opt.Options{Compression: opt.NoCompression})
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	for _, keys := range [][]string{{"a", "b"}, {"x", "y"}, {"m"}} {
+		for _, key := range keys {
+			if err := db.PutWithVersion([]byte(key), []byte(key+"-integrity-value"), 1, nil); err != nil {
+				t.Fatalf("PutWithVersion failed: %v", err)
+			}
+		}
+		if keys[0] != "m" {
+			mlsmCompactMem(t, db)
+		}
+	}
+	return db
+}
+
+func findCorruptFile(rep *IntegrityReport, min string) *CorruptFile {
+	for i := range rep.Corrupt {
+		if string(rep.Corrupt[i].Min) == min {
+			return &rep.Corrupt[i]
+		}
+	}
+	return nil
+}
+
+// TestVerifyIntegrity tests the audit of a sound DB, and the report of
+// corrupted Merkle trees and data blocks
+func TestVerifyIntegrity(t *testing.T) {
+	dbPath := "testdata/verify_integrity_test"
+	os.RemoveAll(dbPath)
+	defer os.RemoveAll(dbPath)
+
+	db := openIntegrityTestDB(t, dbPath)
+	ctx := context.Background()
+	rep, err := db.VerifyIntegrity(ctx, nil)
+	if err != nil {
+		t.Fatalf("VerifyIntegrity failed: %v", err)
+	}
+	if !rep.OK() || rep.Tables != 2 || rep.Entries != 4 || rep.Bytes <= 0 {
+		t.Fatalf("VerifyIntegrity: unexpected report %+v", rep)
+	}
+	if rep.MasterRoot.IsZero() || rep.MasterRoot != db.ComputeMasterRoot(db.s.version()) {
+		t.Errorf("VerifyIntegrity: master root %x doesn't match the DB", rep.MasterRoot)
+	}
+
+	if _, err := db.VerifyIntegrity(ctx, &opt.IntegrityOptions{Levels: []int{-1}}); err == nil {
+		t.Errorf("VerifyIntegrity(-1): expected an error")
+	}
+	if rep, err := db.VerifyIntegrity(ctx, &opt.IntegrityOptions{Levels: []int{99}}); err != nil || rep.Tables != 0 || !rep.OK() {
+		t.Errorf("VerifyIntegrity(99): unexpected %+v (%v)", rep, err)
+	}
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := db.VerifyIntegrity(cctx, nil); err != context.Canceled {
+		t.Errorf("VerifyIntegrity with a canceled context: expected context.Canceled, got %v", err)
+	}
+	start := time.Now()
+	if _, err := db.VerifyIntegrity(ctx, &opt.IntegrityOptions{BytesPerSecond: int(rep.Bytes * 5)}); err != nil {
+		t.Errorf("throttled VerifyIntegrity failed: %v", err)
+	}
+	if d := time.Since(start); d < 150*time.Millisecond {
+		t.Errorf("throttled VerifyIntegrity took %v, expected about 200ms", d)
+	}
+	db.Close()
+
+	corruptMerkleLeaf(t, dbPath, merkle.HashLeafV1([]byte("a"), 1, merkle.LeafKindValue, []byte("a-integrity-value")))
+	corruptTableData(t, dbPath, []byte("y-integrity-value"))
+	db, err = OpenFile(dbPath, nil)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer db.Close()
+	rep, err = db.VerifyIntegrity(ctx, nil)
+	if err != nil {
+		t.Fatalf("VerifyIntegrity failed: %v", err)
+	}
+	// The reopen flushed the memdb to a third table.
+	if rep.OK() || rep.Tables != 3 || len(rep.Corrupt) != 2 || rep.MasterRoot == rep.StoredMasterRoot {
+		t.Fatalf("VerifyIntegrity: unexpected report %+v", rep)
+	}
+	if cf := findCorruptFile(rep, "a"); cf == nil || string(cf.Max) != "b" || !strings.Contains(cf.Reason, "Merkle tree") {
+		t.Errorf("VerifyIntegrity: unexpected report of a-b %+v", cf)
+	}
+	if cf := findCorruptFile(rep, "x"); cf == nil || string(cf.Max) != "y" || !strings.Contains(cf.Reason, "unreadable") {
+		t.Errorf("VerifyIntegrity: unexpected report of x-y %+v", cf)
+	}
+}
+
+// TestScrub tests that the background scrubber reports the corrupted
+// tables
+func TestScrub(t *testing.T) {
+	dbPath := "testdata/scrub_test"
+	os.RemoveAll(dbPath)
+	defer os.RemoveAll(dbPath)
+
+	db := openIntegrityTestDB(t, dbPath)
+	if _, err := db.ScrubReport(); err != ErrNotFound {
+		t.Errorf("ScrubReport without scrubber: expected ErrNotFound, got %v", err)
+	}
+	db.Close()
+
+	corruptTableData(t, dbPath, []byte("y-integrity-value"))
+	db, err := OpenFile(dbPath, &opt.Options{ScrubInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer db.Close()
+
+	var rep *IntegrityReport
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if rep, err = db.ScrubReport(); err == nil {
+			break
+		}
+	}
+	if rep == nil {
+		t.Fatalf("ScrubReport: no pass completed (%v)", err)
+	}
+	if rep.Tables != 3 || len(rep.Corrupt) != 1 || string(rep.Corrupt[0].Min) != "x" {
+		t.Errorf("ScrubReport: unexpected report %+v", rep)
+	}
+}
+
+// TestScrubMerkleOff tests that the scrubber doesn't report the tables
+// written without Merkle tree as corrupted
+func TestScrubMerkleOff(t *testing.T) {
+	db, err := Open(storage.NewMemStorage(), &opt.Options{
+		MerkleMode:    opt.MerkleOff,
+		ScrubInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	for i := 0; i < 100; i++ {
+		if err := db.PutWithVersion([]byte(fmt.Sprintf("k%03d", i)), []byte("value"), uint64(i+1), nil); err != nil {
+			t.Fatalf("PutWithVersion failed: %v", err)
+		}
+	}
+	if err := db.CompactRange(util.Range{}); err != nil {
+		t.Fatalf("CompactRange failed: %v", err)
+	}
+
+	var rep *IntegrityReport
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if rep, err = db.ScrubReport(); err == nil && rep.Tables > 0 {
+			break
+		}
+	}
+	if rep == nil || rep.Tables == 0 {
+		t.Fatalf("ScrubReport: no pass over the tables completed (%v)", err)
+	}
+	if !rep.OK() || rep.NoMerkle != rep.Tables {
+		t.Errorf("ScrubReport: unexpected report %+v", rep)
+	}
+}
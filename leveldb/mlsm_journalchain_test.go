@@ -0,0 +1,159 @@
+package leveldb
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb/errors"
+	"github.com/syndtr/goleveldb/leveldb/journal"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// forgeJournals rewrites the journals of the DB, replacing old with new in
+// their records, with valid checksums.
+func forgeJournals(t *testing.T, dbPath string, old, new []byte) {
+	files, _ := filepath.Glob(filepath.Join(dbPath, "*.log"))
+	forged := false
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		var records [][]byte
+		jr := journal.NewReader(f, nil, true, true)
+		for {
+			r, err := jr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("journal Next failed: %v", err)
+			}
+			record, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("journal ReadAll failed: %v", err)
+			}
+			if bytes.Contains(record, old) {
+				record = bytes.ReplaceAll(record, old, new)
+				forged = true
+			}
+			records = append(records, record)
+		}
+		f.Close()
+
+		var buf bytes.Buffer
+		jw := journal.NewWriter(&buf)
+		for _, record := range records {
+			w, _ := jw.Next()
+			w.Write(record)
+		}
+		jw.Close()
+		if err := os.WriteFile(file, buf.Bytes(), 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+	if !forged {
+		t.Fatalf("journal data %q not found", old)
+	}
+}
+
+func isJournalChainBroken(err error) bool {
+	if e, ok := err.(*errors.ErrCorrupted); ok {
+		_, ok = e.Err.(*ErrJournalChainBroken)
+		return ok
+	}
+	return false
+}
+
+// TestJournalChain tests the hash chain of the journal records, its
+// persistence across journals and sessions, and the detection of forged
+// or missing journals
+func TestJournalChain(t *testing.T) {
+	dbPath := "testdata/journal_chain_test"
+	os.RemoveAll(dbPath)
+	defer os.RemoveAll(dbPath)
+
+	chainOpts := &opt.Options{JournalHashChain: true}
+	db, err := OpenFile(dbPath, chainOpts)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	head0, err := db.JournalChainHead()
+	if err != nil || head0.Seq != 0 {
+		t.Fatalf("JournalChainHead of an empty DB: unexpected %+v (%v)", head0, err)
+	}
+	if err := db.PutWithVersion([]byte("a"), []byte("a1"), 1, nil); err != nil {
+		t.Fatalf("PutWithVersion failed: %v", err)
+	}
+	mlsmCompactMem(t, db)
+	if err := db.PutWithVersion([]byte("b"), []byte("b2"), 2, nil); err != nil {
+		t.Fatalf("PutWithVersion failed: %v", err)
+	}
+	head, err := db.JournalChainHead()
+	if err != nil || head.Seq != db.seq || head.Head == head0.Head {
+		t.Fatalf("JournalChainHead: unexpected %+v at seq %d (%v)", head, db.seq, err)
+	}
+	db.Close()
+
+	// The journals are replayed without the chain option, which leaves the
+	// chain as is.
+	db, err = OpenFile(dbPath, nil)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	if value, err := db.GetWithVersion([]byte("b"), 2, nil); err != nil || string(value) != "b2" {
+		t.Errorf("GetWithVersion(b): unexpected %q (%v)", value, err)
+	}
+	if _, err := db.JournalChainHead(); err != ErrNotFound {
+		t.Errorf("JournalChainHead without the chain option: expected ErrNotFound, got %v", err)
+	}
+	if err := db.PutWithVersion([]byte("c"), []byte("c3"), 3, nil); err != nil {
+		t.Fatalf("PutWithVersion failed: %v", err)
+	}
+	db.Close()
+
+	db, err = OpenFile(dbPath, chainOpts)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	if got, err := db.JournalChainHead(); err != nil || got != head {
+		t.Errorf("JournalChainHead after reopen: expected %+v, got %+v (%v)", head, got, err)
+	}
+	if err := db.PutWithVersion([]byte("d"), []byte("forge-me"), 4, nil); err != nil {
+		t.Fatalf("PutWithVersion failed: %v", err)
+	}
+	head, _ = db.JournalChainHead()
+	db.Close()
+
+	db, err = OpenFile(dbPath, chainOpts)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	if got, err := db.JournalChainHead(); err != nil || got != head {
+		t.Errorf("JournalChainHead after replay: expected %+v, got %+v (%v)", head, got, err)
+	}
+	if err := db.PutWithVersion([]byte("e"), []byte("e5"), 5, nil); err != nil {
+		t.Fatalf("PutWithVersion failed: %v", err)
+	}
+	db.Close()
+
+	// A journal rewritten with valid checksums breaks the chain.
+	forgeJournals(t, dbPath, []byte("e5"), []byte("e6"))
+	if _, err := OpenFile(dbPath, chainOpts); !isJournalChainBroken(err) {
+		t.Errorf("OpenFile of a forged journal: expected a broken chain, got %v", err)
+	}
+	if _, err := OpenFile(dbPath, &opt.Options{ReadOnly: true}); !isJournalChainBroken(err) {
+		t.Errorf("read-only OpenFile of a forged journal: expected a broken chain, got %v", err)
+	}
+
+	// So does a removed journal.
+	files, _ := filepath.Glob(filepath.Join(dbPath, "*.log"))
+	for _, file := range files {
+		os.Remove(file)
+	}
+	if _, err := OpenFile(dbPath, nil); !isJournalChainBroken(err) {
+		t.Errorf("OpenFile without journal: expected a broken chain, got %v", err)
+	}
+}
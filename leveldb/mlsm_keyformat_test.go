@@ -0,0 +1,174 @@
+package leveldb
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb/dbkey"
+	"github.com/syndtr/goleveldb/leveldb/filter"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// tableKeyFormat checks that the bounds of every table of the DB parse in
+// the given key format.
+func tableKeyFormat(t *testing.T, db *DB, kf dbkey.Format) {
+	v := db.s.version()
+	defer v.release()
+	n := 0
+	for _, tables := range v.levels {
+		for _, tf := range tables {
+			for _, ikey := range []dbkey.InternalKey{tf.imin, tf.imax} {
+				ukey, version, _, _, err := kf.ParseInternalKeyWithVersion(ikey)
+				if err != nil || len(ukey) != 1 || version == 0 || version > 9 {
+					t.Errorf("table @%d: bound %x is not a %s key", tf.fd.Num, []byte(ikey), kf)
+				}
+			}
+			n++
+		}
+	}
+	if n == 0 {
+		t.Errorf("no table")
+	}
+}
+
+// TestBytewiseKeys tests a DB created with the bytewise key format, the
+// format kept by the reopens, and the legacy DBs opened with the option
+func TestBytewiseKeys(t *testing.T) {
+	dbPath := "testdata/bytewise_keys_test"
+	os.RemoveAll(dbPath)
+	defer os.RemoveAll(dbPath)
+
+	o := &opt.Options{BytewiseKeys: true, Filter: filter.NewBloomFilter(10)}
+	db, err := OpenFile(dbPath, o)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	if db.s.icmp.kf != dbkey.FormatBytewise {
+		t.Fatalf("new DB: unexpected key format %s", db.s.icmp.kf)
+	}
+	put := func(key, value string, version uint64) {
+		if err := db.PutWithVersion([]byte(key), []byte(value), version, nil); err != nil {
+			t.Fatalf("PutWithVersion failed: %v", err)
+		}
+	}
+	// The versions cross a byte boundary of the encoding.
+	put("a", "a1", 1)
+	put("b", "b2", 2)
+	mlsmCompactMem(t, db)
+	put("a", "a9", 9)
+	batch := new(Batch)
+	batch.DeleteWithVersion([]byte("b"), 3)
+	if err := db.Write(batch, nil); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	put("c", "c4", 4)
+
+	check := func(name, keys string) {
+		for _, r := range []struct {
+			key, value string
+			version    uint64
+		}{{"a", "a9", dbkey.LastestVersion}, {"a", "a1", 1}, {"b", "b2", 2}, {"c", "c4", 4}} {
+			value, err := db.GetWithVersion([]byte(r.key), r.version, nil)
+			if err != nil || string(value) != r.value {
+				t.Errorf("%s: GetWithVersion(%s@%d): unexpected %q (%v)", name, r.key, r.version, value, err)
+			}
+		}
+		if _, err := db.Get([]byte("b"), nil); err != ErrNotFound {
+			t.Errorf("%s: Get(b): expected ErrNotFound, got %v", name, err)
+		}
+		if value, version, proof, err := db.GetWithProof([]byte("a"), 1, nil); err != nil || version != 1 || !proof.Verify([]byte("a"), 1, value) {
+			t.Errorf("%s: GetWithProof(a@1): unexpected %q@%d (%v)", name, value, version, err)
+		}
+		if entries, err := db.GetVersionHistory([]byte("a"), 0, 0, nil); err != nil || len(entries) != 2 || entries[0].Version != 1 || entries[1].Version != 9 {
+			t.Errorf("%s: GetVersionHistory(a): unexpected %v (%v)", name, entries, err)
+		}
+		if version, err := db.versionAsOf([]byte("a"), 8, dbkey.KeyMaxSeq); err != nil || version != 1 {
+			t.Errorf("%s: versionAsOf(a@8): unexpected %d (%v)", name, version, err)
+		}
+		var iterated string
+		iter := db.NewIterator(nil, nil)
+		for iter.Next() {
+			iterated += string(iter.Key())
+		}
+		iter.Release()
+		if iterated != keys {
+			t.Errorf("%s: iterated keys %q, expected %q", name, iterated, keys)
+		}
+	}
+	check("write", "ac")
+	mlsmCompactMem(t, db)
+	if err := db.CompactRange(util.Range{}); err != nil {
+		t.Fatalf("CompactRange failed: %v", err)
+	}
+	tableKeyFormat(t, db, dbkey.FormatBytewise)
+	check("compaction", "ac")
+	put("d", "d5", 5)
+	db.Close()
+
+	// The manifest holds the format, whatever the option.
+	db, err = OpenFile(dbPath, nil)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	if db.s.icmp.kf != dbkey.FormatBytewise {
+		t.Errorf("reopen: unexpected key format %s", db.s.icmp.kf)
+	}
+	check("reopen", "acd")
+
+	// The user keys holding 0x00 bytes, and prefixes of each other, are
+	// ordered by user key first.
+	zkeys := []string{"e", "e\x00", "e\x00\x01", "e\x01"}
+	for _, version := range []uint64{6, 7} {
+		for _, key := range zkeys {
+			put(key, fmt.Sprintf("%s@%d", key, version), version)
+		}
+		mlsmCompactMem(t, db)
+	}
+	if err := db.CompactRange(util.Range{}); err != nil {
+		t.Fatalf("CompactRange failed: %v", err)
+	}
+	for _, key := range zkeys {
+		for _, version := range []uint64{6, 7} {
+			value, err := db.GetWithVersion([]byte(key), version, nil)
+			if err != nil || string(value) != fmt.Sprintf("%s@%d", key, version) {
+				t.Errorf("GetWithVersion(%q@%d): unexpected %q (%v)", key, version, value, err)
+			}
+		}
+	}
+	var iterated []string
+	iter := db.NewIterator(util.BytesPrefix([]byte("e")), nil)
+	for iter.Next() {
+		iterated = append(iterated, string(iter.Key()))
+	}
+	iter.Release()
+	if fmt.Sprint(iterated) != fmt.Sprint(zkeys) {
+		t.Errorf("iterated keys %q, expected %q", iterated, zkeys)
+	}
+	db.Close()
+
+	// A legacy DB keeps its format.
+	legacyPath := dbPath + "_legacy"
+	os.RemoveAll(legacyPath)
+	defer os.RemoveAll(legacyPath)
+	db, err = OpenFile(legacyPath, nil)
+	if err != nil {
+		t.Fatalf("Failed to open legacy database: %v", err)
+	}
+	put("a", "a1", 1)
+	mlsmCompactMem(t, db)
+	db.Close()
+	db, err = OpenFile(legacyPath, o)
+	if err != nil {
+		t.Fatalf("Failed to reopen legacy database: %v", err)
+	}
+	defer db.Close()
+	if db.s.icmp.kf != dbkey.FormatLegacy || db.s.o.GetBytewiseKeys() {
+		t.Errorf("legacy DB: unexpected key format %s", db.s.icmp.kf)
+	}
+	tableKeyFormat(t, db, dbkey.FormatLegacy)
+	if value, err := db.Get([]byte("a"), nil); err != nil || string(value) != "a1" {
+		t.Errorf("legacy DB: Get(a): unexpected %q (%v)", value, err)
+	}
+}
@@ -0,0 +1,217 @@
+package leveldb
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb/dbkey"
+	"github.com/syndtr/goleveldb/leveldb/journal"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// tableOrdering returns the ordered flag of the tables of the DB, from the
+// newest to the oldest.
+func tableOrdering(db *DB) (ordered []bool) {
+	v := db.s.version()
+	defer v.release()
+	for _, tables := range v.levels {
+		for _, t := range tables {
+			ordered = append(ordered, t.ordered)
+		}
+	}
+	return
+}
+
+// TestLatestFastPath tests that the latest version lookups stop at the
+// records written in version order, and that the records written out of
+// order are still looked up in every level
+func TestLatestFastPath(t *testing.T) {
+	dbPath := "testdata/latest_fast_path_test"
+	os.RemoveAll(dbPath)
+	defer os.RemoveAll(dbPath)
+
+	db, err := OpenFile(dbPath, nil)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	put := func(key, value string, version uint64) {
+		if err := db.PutWithVersion([]byte(key), []byte(value), version, nil); err != nil {
+			t.Fatalf("PutWithVersion failed: %v", err)
+		}
+	}
+	get := func(key string) string {
+		db.s.tops.fileCache.EvictAll()
+		value, err := db.Get([]byte(key), nil)
+		if err != nil {
+			t.Fatalf("Get(%s) failed: %v", key, err)
+		}
+		return string(value)
+	}
+
+	// Both tables hold version 5, the deeper one can't be skipped by its
+	// version range.
+	batch := new(Batch)
+	batch.PutWithVersion([]byte("a"), []byte("a5-first"), 5)
+	batch.PutWithVersion([]byte("b"), []byte("b5"), 5)
+	if err := db.Write(batch, nil); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	mlsmCompactMem(t, db)
+	if err := db.CompactRange(util.Range{}); err != nil {
+		t.Fatalf("CompactRange failed: %v", err)
+	}
+	put("a", "a5-second", 5)
+	mlsmCompactMem(t, db)
+	if got := tableOrdering(db); len(got) != 2 || !got[0] || !got[1] {
+		t.Fatalf("expected 2 ordered tables, got %v", got)
+	}
+	if value := get("a"); value != "a5-second" {
+		t.Errorf("Get(a): unexpected %q", value)
+	}
+	if n := openedTables(t, db); n != "1" {
+		t.Errorf("Get(a): opened %s tables, expected 1", n)
+	}
+	if value := get("b"); value != "b5" {
+		t.Errorf("Get(b): unexpected %q", value)
+	}
+
+	// A version written out of order sits above the latest one.
+	put("a", "a3", 3)
+	mlsmCompactMem(t, db)
+	if got := tableOrdering(db); len(got) != 3 || got[0] || !got[1] {
+		t.Fatalf("expected the newest table unordered, got %v", got)
+	}
+	if value := get("a"); value != "a5-second" {
+		t.Errorf("Get(a) above an out of order version: unexpected %q", value)
+	}
+	if value, version, _, err := db.GetWithProof([]byte("a"), dbkey.LastestVersion, nil); err != nil || string(value) != "a5-second" || version != 5 {
+		t.Errorf("GetWithProof(a): unexpected %q@%d (%v)", value, version, err)
+	}
+
+	// The flag survives the reopen, and is recomputed by the journal
+	// replay.
+	put("c", "c1", 1)
+	db.Close()
+	db, err = OpenFile(dbPath, nil)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	if got := tableOrdering(db); len(got) != 4 || got[0] || got[1] || !got[2] || !got[3] {
+		t.Errorf("unexpected ordering after the replay of an out of order write %v", got)
+	}
+	put("d", "d9", 9)
+	db.Close()
+	db, err = OpenFile(dbPath, nil)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer db.Close()
+	if got := tableOrdering(db); len(got) != 5 || !got[0] || got[1] {
+		t.Errorf("unexpected ordering after the replay of an ordered write %v", got)
+	}
+	if value := get("a"); value != "a5-second" {
+		t.Errorf("Get(a) after reopen: unexpected %q", value)
+	}
+}
+
+// rewriteLegacyManifest rewrites the manifest of the closed DB as older
+// releases wrote it, without the highest version, and without the version
+// ranges of the tables if ranges is false.
+func rewriteLegacyManifest(t *testing.T, dbPath string, ranges bool) {
+	stor, err := storage.OpenFile(dbPath, false)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	defer stor.Close()
+	s, err := newSession(stor, nil)
+	if err != nil {
+		t.Fatalf("newSession failed: %v", err)
+	}
+	defer s.release()
+	if err := s.recover(); err != nil {
+		t.Fatalf("recover failed: %v", err)
+	}
+	defer s.close()
+
+	rec := &sessionRecord{}
+	s.fillRecord(rec, true)
+	v := s.version()
+	v.fillRecord(rec)
+	v.release()
+	rec.hasRec &^= 1 << recMaxVersion
+	for i := range rec.addedTables {
+		rec.addedTables[i].ordered = false
+		if !ranges {
+			rec.addedTables[i].hasVersions = false
+		}
+	}
+
+	fd := storage.FileDesc{Type: storage.TypeManifest, Num: s.allocFileNum()}
+	w, err := stor.Create(fd)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	jw := journal.NewWriter(w)
+	jr, err := jw.Next()
+	if err == nil {
+		err = rec.encode(jr)
+	}
+	if err == nil {
+		err = jw.Close()
+	}
+	w.Close()
+	if err != nil {
+		t.Fatalf("manifest write failed: %v", err)
+	}
+	if err := stor.SetMeta(fd); err != nil {
+		t.Fatalf("SetMeta failed: %v", err)
+	}
+}
+
+// TestLatestFastPathLegacyManifest tests that the writes don't count as
+// ordered against an unknown highest version, when the manifest of an
+// older release lacks it
+func TestLatestFastPathLegacyManifest(t *testing.T) {
+	for _, ranges := range []bool{true, false} {
+		name := fmt.Sprintf("ranges=%v", ranges)
+		dbPath := "testdata/latest_legacy_manifest_test"
+		os.RemoveAll(dbPath)
+		defer os.RemoveAll(dbPath)
+
+		db, err := OpenFile(dbPath, nil)
+		if err != nil {
+			t.Fatalf("%s: Failed to open database: %v", name, err)
+		}
+		if err := db.PutWithVersion([]byte("a"), []byte("a5"), 5, nil); err != nil {
+			t.Fatalf("%s: PutWithVersion failed: %v", name, err)
+		}
+		mlsmCompactMem(t, db)
+		if err := db.CompactRange(util.Range{}); err != nil {
+			t.Fatalf("%s: CompactRange failed: %v", name, err)
+		}
+		db.Close()
+		rewriteLegacyManifest(t, dbPath, ranges)
+
+		db, err = OpenFile(dbPath, nil)
+		if err != nil {
+			t.Fatalf("%s: Failed to reopen database: %v", name, err)
+		}
+		if ranges && db.MaxVersion() != 5 {
+			t.Errorf("%s: expected the highest version of the tables, got %d", name, db.MaxVersion())
+		}
+		if err := db.PutWithVersion([]byte("a"), []byte("a3"), 3, nil); err != nil {
+			t.Fatalf("%s: PutWithVersion failed: %v", name, err)
+		}
+		mlsmCompactMem(t, db)
+		if got := tableOrdering(db); len(got) != 2 || got[0] {
+			t.Errorf("%s: expected the newest table unordered, got %v", name, got)
+		}
+		db.s.tops.fileCache.EvictAll()
+		if value, err := db.Get([]byte("a"), nil); err != nil || string(value) != "a5" {
+			t.Errorf("%s: Get(a): unexpected %q (%v)", name, value, err)
+		}
+		db.Close()
+	}
+}
@@ -0,0 +1,176 @@
+package leveldb
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb/dbkey"
+	"github.com/syndtr/goleveldb/leveldb/merkle"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// TestLayerProofIdentity tests that proofs commit to the layer they come
+// from, and to their position in the layer and master trees
+func TestLayerProofIdentity(t *testing.T) {
+	dbPath := "testdata/layerproof_identity_test"
+	os.RemoveAll(dbPath)
+	defer os.RemoveAll(dbPath)
+
+	db, err := OpenFile(dbPath, nil)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	// Two tables in level 0 and a memdb.
+	for v := uint64(1); v <= 3; v++ {
+		for i := 0; i < 5; i++ {
+			key := []byte(fmt.Sprintf("key-%d-%d", v, i))
+			if err := db.PutWithVersion(key, []byte(fmt.Sprintf("value-%d", i)), v, nil); err != nil {
+				t.Fatalf("PutWithVersion failed: %v", err)
+			}
+		}
+		if v < 3 {
+			mlsmCompactMem(t, db)
+		}
+	}
+
+	prove := func(key string, version uint64) *DBProof {
+		value, _, proof, err := db.GetWithProof([]byte(key), version, nil)
+		if err != nil || proof == nil {
+			t.Fatalf("GetWithProof(%s): %v", key, err)
+		}
+		if !proof.Verify([]byte(key), version, value) {
+			t.Fatalf("GetWithProof(%s): proof verification failed", key)
+		}
+		return proof
+	}
+	masterRoot := db.ComputeMasterRoot(db.s.version())
+
+	sst := prove("key-1-2", 1)
+	if sst.LayerKind != merkle.LayerKindLevel || sst.Level != 0 || sst.TableMin == nil || sst.TableMax == nil {
+		t.Errorf("SST proof: unexpected layer %d@%d [%q, %q]", sst.LayerKind, sst.Level, sst.TableMin, sst.TableMax)
+	}
+	if sst.LayerProof.TreeSize != 2 || sst.MasterProof.TreeSize != 2 {
+		t.Errorf("SST proof: unexpected tree sizes %d and %d", sst.LayerProof.TreeSize, sst.MasterProof.TreeSize)
+	}
+	mem := prove("key-3-1", 3)
+	if mem.LayerKind != merkle.LayerKindMemDB || mem.Level != 0 {
+		t.Errorf("MemDB proof: unexpected layer %d@%d", mem.LayerKind, mem.Level)
+	}
+	for _, proof := range []*DBProof{sst, mem} {
+		if !proof.MasterProof.Root.Equal(masterRoot) {
+			t.Errorf("master root mismatch: %v vs %v", proof.MasterProof.Root, masterRoot)
+		}
+	}
+
+	tamper := []struct {
+		name  string
+		proof *DBProof
+		fn    func(p *DBProof)
+	}{
+		{"SST level", sst, func(p *DBProof) { p.Level = 1 }},
+		{"SST layer kind", sst, func(p *DBProof) { p.LayerKind = merkle.LayerKindMemDB }},
+		{"SST table range", sst, func(p *DBProof) { p.TableMax = p.TableMin }},
+		{"SST layer index", sst, func(p *DBProof) { p.LayerProof.LeafIndex ^= 1 }},
+		{"SST master size", sst, func(p *DBProof) { p.MasterProof.TreeSize = 3 }},
+		{"SST data height", sst, func(p *DBProof) { p.DataProof.Path[0].Height++ }},
+		{"MemDB level", mem, func(p *DBProof) { p.Level = 1 }},
+		{"MemDB layer kind", mem, func(p *DBProof) { p.LayerKind = merkle.LayerKindLevel }},
+		{"MemDB data index", mem, func(p *DBProof) { p.DataProof.LeafIndex ^= 1 }},
+		{"MemDB unknown shape", mem, func(p *DBProof) { p.DataProof.TreeSize = 0 }},
+		{"SST data non-existence", sst, func(p *DBProof) { p.DataProof.Exists = false }},
+		{"MemDB master non-existence", mem, func(p *DBProof) { p.MasterProof.Exists = false }},
+	}
+	for _, c := range tamper {
+		p := *c.proof
+		data, layer, master := *p.DataProof, *p.LayerProof, *p.MasterProof
+		data.Path = append([]merkle.ProofNode(nil), data.Path...)
+		p.DataProof, p.LayerProof, p.MasterProof = &data, &layer, &master
+		c.fn(&p)
+		if p.Verify([]byte("key-1-2"), 1, []byte("value-2")) || p.Verify([]byte("key-3-1"), 3, []byte("value-1")) {
+			t.Errorf("%s: tampered proof verified", c.name)
+		}
+	}
+
+	// A proof made of non-existence links proves nothing.
+	forged := &DBProof{LayerKind: merkle.LayerKindMemDB}
+	for _, link := range []**merkle.MerkleProof{&forged.DataProof, &forged.LayerProof, &forged.MasterProof} {
+		*link = &merkle.MerkleProof{Root: masterRoot, Exists: false, LeafFormat: merkle.LeafFormatValueHash, TreeSize: 1}
+	}
+	if forged.Verify([]byte("key-1-2"), 1, []byte("forged")) || forged.VerifyValueHash([]byte("key-1-2"), 1, merkle.Hash{}) || forged.VerifyDeletion([]byte("key-1-2"), 1) {
+		t.Errorf("forged non-existence proof verified")
+	}
+}
+
+// TestLayerProofDeletion tests the proofs of tombstones, in both the V1 and
+// the value hash leaf formats
+func TestLayerProofDeletion(t *testing.T) {
+	for _, valueHash := range []bool{false, true} {
+		dbPath := "testdata/layerproof_deletion_test"
+		os.RemoveAll(dbPath)
+		defer os.RemoveAll(dbPath)
+
+		name := fmt.Sprintf("valueHash=%v", valueHash)
+		db, err := OpenFile(dbPath, &opt.Options{MerkleValueHash: valueHash})
+		if err != nil {
+			t.Fatalf("%s: Failed to open database: %v", name, err)
+		}
+
+		// Key a is deleted at 2 in a table, key b at 4 in the memdb.
+		write := func(key string, version uint64, del bool) {
+			batch := new(Batch)
+			if del {
+				batch.DeleteWithVersion([]byte(key), version)
+			} else {
+				batch.PutWithVersion([]byte(key), []byte(key), version)
+			}
+			if err := db.Write(batch, nil); err != nil {
+				t.Fatalf("%s: Write failed: %v", name, err)
+			}
+		}
+		write("a", 1, false)
+		write("a", 2, true)
+		write("b", 3, false)
+		mlsmCompactMem(t, db)
+		write("b", 4, true)
+
+		for _, c := range []struct {
+			key     string
+			version uint64
+			want    uint64
+		}{
+			{"a", 2, 2}, {"a", dbkey.LastestVersion, 2}, {"b", 4, 4}, {"b", dbkey.LastestVersion, 4},
+		} {
+			version, proof, err := db.GetDeletionWithProof([]byte(c.key), c.version, nil)
+			if err != nil || proof == nil || version != c.want {
+				t.Errorf("%s: GetDeletionWithProof(%s@%d): unexpected %d (%v)", name, c.key, c.version, version, err)
+				continue
+			}
+			if !proof.VerifyDeletion([]byte(c.key), version) {
+				t.Errorf("%s: %s@%d: deletion proof verification failed", name, c.key, version)
+			}
+			if proof.Verify([]byte(c.key), version, nil) || proof.VerifyDeletion([]byte(c.key), version-1) {
+				t.Errorf("%s: %s@%d: deletion proof verified as another record", name, c.key, version)
+			}
+		}
+
+		// Neither a value nor a missing record prove a deletion.
+		for _, c := range []struct {
+			key     string
+			version uint64
+		}{
+			{"a", 1}, {"b", 3}, {"c", dbkey.LastestVersion},
+		} {
+			if _, _, err := db.GetDeletionWithProof([]byte(c.key), c.version, nil); err != ErrNotFound {
+				t.Errorf("%s: GetDeletionWithProof(%s@%d): expected ErrNotFound, got %v", name, c.key, c.version, err)
+			}
+		}
+		value, _, proof, err := db.GetWithProof([]byte("a"), 1, nil)
+		if err != nil || proof.VerifyDeletion([]byte("a"), 1) || !proof.Verify([]byte("a"), 1, value) {
+			t.Errorf("%s: value proof of a@1: unexpected verification (%v)", name, err)
+		}
+		db.Close()
+	}
+}
@@ -0,0 +1,78 @@
+package leveldb
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb/merkle"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// TestRebuildMerkle tests the check and repair of the table Merkle trees,
+// and the persistence of the checks
+func TestRebuildMerkle(t *testing.T) {
+	dbPath := "testdata/merkle_rebuild_test"
+	os.RemoveAll(dbPath)
+	defer os.RemoveAll(dbPath)
+
+	db, err := OpenFile(dbPath, nil)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	for v, key := range []string{"a", "b"} {
+		if err := db.PutWithVersion([]byte(key), []byte(key+"1"), uint64(v+1), nil); err != nil {
+			t.Fatalf("PutWithVersion failed: %v", err)
+		}
+		mlsmCompactMem(t, db)
+	}
+	db.Close()
+
+	corruptMerkleLeaf(t, dbPath, merkle.HashLeafV1([]byte("b"), 2, merkle.LeafKindValue, []byte("b1")))
+	db, err = OpenFile(dbPath, nil)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	if _, err := db.RebuildMerkle(-1); err == nil {
+		t.Errorf("RebuildMerkle(-1): expected an error")
+	}
+	checks, err := db.RebuildMerkle()
+	if err != nil {
+		t.Fatalf("RebuildMerkle failed: %v", err)
+	}
+	statuses := make(map[MerkleStatus]int)
+	for _, c := range checks {
+		statuses[c.Status]++
+		if c.Root.IsZero() {
+			t.Errorf("table @%d: zero root", c.Num)
+		}
+	}
+	if len(checks) != 2 || statuses[MerkleVerified] != 1 || statuses[MerkleRepaired] != 1 {
+		t.Fatalf("RebuildMerkle: unexpected checks %+v", checks)
+	}
+	strictRO := &opt.ReadOptions{ProofStrictness: opt.ProofStrict}
+	if _, _, proof, err := db.GetWithProof([]byte("b"), 2, strictRO); err != nil || !proof.Verify([]byte("b"), 2, []byte("b1")) {
+		t.Errorf("strict GetWithProof(b) after repair failed: %v", err)
+	}
+	db.Close()
+
+	// The checks are persisted, and forgotten with their tables.
+	db, err = OpenFile(dbPath, nil)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer db.Close()
+	if got, err := db.MerkleChecks(); err != nil || !reflect.DeepEqual(got, checks) {
+		t.Errorf("MerkleChecks after reopen: expected %+v, got %+v (%v)", checks, got, err)
+	}
+	if checks, err := db.RebuildMerkle(0); err != nil || len(checks) != 2 || checks[0].Status != MerkleVerified || checks[1].Status != MerkleVerified {
+		t.Errorf("RebuildMerkle(0) after repair: unexpected %+v (%v)", checks, err)
+	}
+	if err := db.CompactRange(util.Range{}); err != nil {
+		t.Fatalf("CompactRange failed: %v", err)
+	}
+	if got, err := db.MerkleChecks(); err != nil || len(got) != 0 {
+		t.Errorf("MerkleChecks after compaction: expected none, got %+v (%v)", got, err)
+	}
+}
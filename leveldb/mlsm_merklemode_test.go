@@ -0,0 +1,136 @@
+package leveldb
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// noMerkleTables returns the number of tables of the DB written without
+// Merkle tree.
+func noMerkleTables(db *DB) (n int) {
+	v := db.s.version()
+	defer v.release()
+	for _, tables := range v.levels {
+		for _, t := range tables {
+			if t.noMerkle {
+				n++
+			}
+		}
+	}
+	return
+}
+
+// TestMerkleMode tests the tables written without Merkle tree: no proof
+// with MerkleOff, and the trees built in the background or on demand by
+// the proof reads with MerkleDeferred
+func TestMerkleMode(t *testing.T) {
+	dbPath := "testdata/merkle_mode_test"
+	os.RemoveAll(dbPath)
+	defer os.RemoveAll(dbPath)
+	open := func(mode opt.MerkleMode) *DB {
+		db, err := OpenFile(dbPath, &opt.Options{MerkleMode: mode})
+		if err != nil {
+			t.Fatalf("Failed to open database: %v", err)
+		}
+		return db
+	}
+	write := func(db *DB, from, to uint64) {
+		for version := from; version <= to; version++ {
+			for _, key := range []string{"a", "b"} {
+				if err := db.PutWithVersion([]byte(key), []byte(fmt.Sprintf("%s-v%d", key, version)), version, nil); err != nil {
+					t.Fatalf("PutWithVersion failed: %v", err)
+				}
+			}
+			mlsmCompactMem(t, db)
+		}
+	}
+	strictRO := &opt.ReadOptions{ProofStrictness: opt.ProofStrict}
+	// The tables written without tree pass the audit, their tree unchecked.
+	audit := func(name string, db *DB, noMerkle bool) {
+		rep, err := db.VerifyIntegrity(context.Background(), nil)
+		if err != nil {
+			t.Fatalf("%s: VerifyIntegrity failed: %v", name, err)
+		}
+		if !rep.OK() || rep.MasterRoot.IsZero() {
+			t.Errorf("%s: unexpected audit %+v", name, rep)
+		}
+		if noMerkle && rep.NoMerkle == 0 {
+			t.Errorf("%s: no table audited without Merkle tree", name)
+		}
+	}
+	check := func(name string, db *DB, versions uint64) {
+		for version := uint64(1); version <= versions; version++ {
+			value := []byte(fmt.Sprintf("a-v%d", version))
+			v, actual, proof, err := db.GetWithProof([]byte("a"), version, strictRO)
+			if err != nil || actual != version || string(v) != string(value) || !proof.Verify([]byte("a"), version, v) {
+				t.Errorf("%s: GetWithProof(a@%d): unexpected %q@%d (%v)", name, version, v, actual, err)
+			}
+		}
+		var want []uint64
+		for version := uint64(1); version <= versions; version++ {
+			want = append(want, version)
+		}
+		expectVersions(t, name, historyVersions(t, db, "b"), want...)
+		entries, proof, err := db.MultiGetWithProof([][]byte{[]byte("a"), []byte("b")}, versions, strictRO)
+		if err != nil || !proof.Verify(entries) {
+			t.Errorf("%s: MultiGetWithProof: unexpected %v (%v)", name, entries, err)
+		}
+	}
+
+	// The tables written without tree get no proof.
+	db := open(opt.MerkleOff)
+	write(db, 1, 3)
+	if n := noMerkleTables(db); n != 3 {
+		t.Errorf("off: %d tables without Merkle tree, expected 3", n)
+	}
+	if v, err := db.GetWithVersion([]byte("a"), 2, nil); err != nil || string(v) != "a-v2" {
+		t.Errorf("off: GetWithVersion(a@2): unexpected %q (%v)", v, err)
+	}
+	if _, _, _, err := db.GetWithProof([]byte("a"), 2, strictRO); err == nil {
+		t.Errorf("off: GetWithProof(a@2) succeeded without Merkle tree")
+	} else if _, ok := err.(*ErrProofUnavailable); !ok {
+		t.Errorf("off: GetWithProof(a@2): unexpected error %v", err)
+	}
+	audit("off", db, true)
+	if err := db.CompactRange(util.Range{}); err != nil {
+		t.Fatalf("off: CompactRange failed: %v", err)
+	}
+	audit("off compaction", db, true)
+	db.Close()
+
+	// The background job builds the trees the tables wait for.
+	db = open(opt.MerkleDeferred)
+	n := noMerkleTables(db)
+	for deadline := time.Now().Add(5 * time.Second); n > 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		n = noMerkleTables(db)
+	}
+	if n > 0 {
+		t.Fatalf("deferred: %d tables still without Merkle tree", n)
+	}
+	check("deferred background", db, 3)
+
+	// The proof reads build the trees of the newly written tables, if the
+	// background job didn't yet.
+	write(db, 4, 6)
+	audit("deferred", db, false)
+	check("deferred on demand", db, 6)
+	audit("deferred built", db, false)
+	if n := noMerkleTables(db); n > 0 {
+		t.Errorf("deferred: %d tables without Merkle tree after the proof reads", n)
+	}
+	db.Close()
+
+	// The tables keep their tree, whatever the mode.
+	db = open(opt.MerkleOff)
+	defer db.Close()
+	if n := noMerkleTables(db); n > 0 {
+		t.Errorf("reopen: %d tables without Merkle tree", n)
+	}
+	check("reopen", db, 6)
+}
@@ -0,0 +1,125 @@
+package leveldb
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb/dbkey"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+func multiProofHashes(p *DBMultiProof) int {
+	n := len(p.MasterProof.Hashes)
+	for _, layer := range p.Layers {
+		if layer.LayerProof != nil {
+			n += len(layer.LayerProof.Hashes)
+		}
+		for _, source := range layer.Sources {
+			n += len(source.DataProof.Hashes)
+		}
+	}
+	return n
+}
+
+// TestMultiGetWithProof tests multi-key lookups against every kind of
+// layer, and the verification of their multiproof
+func TestMultiGetWithProof(t *testing.T) {
+	dbPath := "testdata/multiproof_test"
+	os.RemoveAll(dbPath)
+	defer os.RemoveAll(dbPath)
+
+	db, err := OpenFile(dbPath, nil)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	// Version 1 in a compacted level, versions 2-3 in level 0, version 4
+	// in the memdb.
+	for v := uint64(1); v <= 4; v++ {
+		batch := new(Batch)
+		for i := 0; i < 50; i++ {
+			key := []byte(fmt.Sprintf("key-%d-%02d", v, i))
+			batch.PutWithVersion(key, []byte(fmt.Sprintf("value-%d-%d", v, i)), v)
+		}
+		if v == 3 {
+			batch.DeleteWithVersion([]byte("key-1-00"), v)
+		}
+		if err := db.Write(batch, nil); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if v < 4 {
+			mlsmCompactMem(t, db)
+		}
+		if v == 1 {
+			if err := db.CompactRange(util.Range{}); err != nil {
+				t.Fatalf("CompactRange failed: %v", err)
+			}
+		}
+	}
+
+	var keys [][]byte
+	for v := 1; v <= 4; v++ {
+		for i := 1; i < 50; i += 7 {
+			keys = append(keys, []byte(fmt.Sprintf("key-%d-%02d", v, i)))
+		}
+	}
+	keys = append(keys, []byte("key-1-00"), []byte("missing"), []byte("key-2-08"))
+
+	entries, proof, err := db.MultiGetWithProof(keys, dbkey.LastestVersion, nil)
+	if err != nil || proof == nil {
+		t.Fatalf("MultiGetWithProof failed: %v", err)
+	}
+	if len(entries) != len(keys) {
+		t.Fatalf("expected %d entries, got %d", len(keys), len(entries))
+	}
+	if !proof.Verify(entries) {
+		t.Fatalf("multiproof verification failed")
+	}
+	if len(proof.Layers) != 3 {
+		t.Errorf("expected 3 proven layers, got %d", len(proof.Layers))
+	}
+
+	singleHashes := 0
+	for i, e := range entries {
+		value, version, single, err := db.GetWithProof(keys[i], dbkey.LastestVersion, nil)
+		if err == ErrNotFound {
+			if e.Found {
+				t.Errorf("%s: expected not found, got %q", keys[i], e.Value)
+			}
+			continue
+		}
+		if err != nil || !e.Found || string(e.Value) != string(value) || e.Version != version {
+			t.Errorf("%s: expected %q@%d, got %q@%d found=%v (%v)", keys[i], value, version, e.Value, e.Version, e.Found, err)
+			continue
+		}
+		singleHashes += len(single.DataProof.Path) + len(single.LayerProof.Path) + len(single.MasterProof.Path)
+	}
+	if n := multiProofHashes(proof); n >= singleHashes/2 {
+		t.Errorf("multiproof isn't compact: %d hashes vs %d for single proofs", n, singleHashes)
+	}
+
+	tamper := []struct {
+		name string
+		fn   func(entries []MultiGetEntry)
+	}{
+		{"value", func(e []MultiGetEntry) { e[3].Value = []byte("forged") }},
+		{"version", func(e []MultiGetEntry) { e[10].Version = 7 }},
+		{"unproven", func(e []MultiGetEntry) { e[len(e)-2].Found, e[len(e)-2].Value = true, []byte("forged") }},
+		{"duplicate", func(e []MultiGetEntry) { e[len(e)-1].Value = []byte("forged") }},
+		{"swap", func(e []MultiGetEntry) { e[0], e[20] = e[20], e[0] }},
+		{"dropped", func(e []MultiGetEntry) { e[5].Found = false }},
+	}
+	for _, c := range tamper {
+		forged := append([]MultiGetEntry(nil), entries...)
+		c.fn(forged)
+		if proof.Verify(forged) {
+			t.Errorf("%s: tampered entries verified", c.name)
+		}
+	}
+
+	if entries, proof, err := db.MultiGetWithProof([][]byte{[]byte("missing")}, dbkey.LastestVersion, nil); err != nil || proof != nil || entries[0].Found {
+		t.Errorf("MultiGetWithProof(missing): expected no proof, got %v (%v)", proof, err)
+	}
+}
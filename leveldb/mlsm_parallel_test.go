@@ -0,0 +1,117 @@
+package leveldb
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb/merkle"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// tableRoots returns the Merkle roots of the tables of the DB, level by
+// level.
+func tableRoots(t *testing.T, db *DB) (roots []merkle.Hash) {
+	v := db.s.version()
+	defer v.release()
+	for _, tables := range v.levels {
+		for _, tf := range tables {
+			root, err := db.s.tops.getMerkleRoot(tf)
+			if err != nil {
+				t.Fatalf("getMerkleRoot failed: %v", err)
+			}
+			roots = append(roots, root)
+		}
+	}
+	return
+}
+
+// TestMerkleWorkers tests that the DBs hashing their Merkle trees on a
+// pool get the same memdb, table and master roots as the ones hashing them
+// sequentially, and that their proofs verify
+func TestMerkleWorkers(t *testing.T) {
+	const (
+		versions = 3
+		keys     = 3000
+	)
+	value := func(key int, version uint64) []byte {
+		if key%10 == 0 {
+			return bytes.Repeat([]byte(fmt.Sprintf("%d@%d-", key, version)), 40)
+		}
+		return []byte(fmt.Sprintf("%d@%d", key, version))
+	}
+	open := func(name string, workers int) *DB {
+		dbPath := "testdata/merkle_workers_test_" + name
+		os.RemoveAll(dbPath)
+		t.Cleanup(func() { os.RemoveAll(dbPath) })
+		db, err := OpenFile(dbPath, &opt.Options{
+			DisableSeeksCompaction: true,
+			CompactionL0Trigger:    versions + 1,
+			ValueLogThreshold:      256,
+			MerkleWorkers:          workers,
+		})
+		if err != nil {
+			t.Fatalf("Failed to open database: %v", err)
+		}
+		return db
+	}
+	dbs := []*DB{open("sequential", 1), open("parallel", 4)}
+	defer func() {
+		for _, db := range dbs {
+			db.Close()
+		}
+	}()
+
+	sameRoots := func(name string) {
+		for i := 1; i < len(dbs); i++ {
+			if a, b := dbs[0].mem.DB.GetMerkleRoot(), dbs[i].mem.DB.GetMerkleRoot(); a != b {
+				t.Errorf("%s: memdb root %x, expected %x", name, b, a)
+			}
+			if a, b := fmt.Sprint(tableRoots(t, dbs[0])), fmt.Sprint(tableRoots(t, dbs[i])); a != b {
+				t.Errorf("%s: table roots %s, expected %s", name, b, a)
+			}
+			if a, b := dbs[0].ComputeMasterRoot(dbs[0].s.version()), dbs[i].ComputeMasterRoot(dbs[i].s.version()); a != b {
+				t.Errorf("%s: master root %x, expected %x", name, b, a)
+			}
+		}
+	}
+	check := func(name string, version uint64) {
+		for _, db := range dbs {
+			for _, k := range []int{0, 1, keys / 2, keys - 1} {
+				key := []byte(fmt.Sprintf("key%06d", k))
+				v, actual, proof, err := db.GetWithProof(key, version, nil)
+				if err != nil || actual != version || !bytes.Equal(v, value(k, version)) || !proof.Verify(key, version, v) {
+					t.Errorf("%s: GetWithProof(%s@%d): unexpected %q@%d (%v)", name, key, version, v, actual, err)
+				}
+			}
+		}
+	}
+
+	for version := uint64(1); version <= versions; version++ {
+		for _, db := range dbs {
+			for k := 0; k < keys; k++ {
+				if err := db.PutWithVersion([]byte(fmt.Sprintf("key%06d", k)), value(k, version), version, nil); err != nil {
+					t.Fatalf("PutWithVersion failed: %v", err)
+				}
+			}
+		}
+		sameRoots(fmt.Sprintf("memdb@%d", version))
+		check(fmt.Sprintf("memdb@%d", version), version)
+		for _, db := range dbs {
+			mlsmCompactMem(t, db)
+		}
+		sameRoots(fmt.Sprintf("flush@%d", version))
+		check(fmt.Sprintf("flush@%d", version), version)
+	}
+	for _, db := range dbs {
+		if err := db.CompactRange(util.Range{}); err != nil {
+			t.Fatalf("CompactRange failed: %v", err)
+		}
+	}
+	sameRoots("compaction")
+	for version := uint64(1); version <= versions; version++ {
+		check("compaction", version)
+	}
+}
@@ -0,0 +1,79 @@
+package leveldb
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// TestWriteReceipt tests the receipts of the writes, and their check
+// against the batches and the proofs
+func TestWriteReceipt(t *testing.T) {
+	dbPath := "testdata/write_receipt_test"
+	os.RemoveAll(dbPath)
+	defer os.RemoveAll(dbPath)
+
+	db, err := OpenFile(dbPath, nil)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	r1, err := db.PutWithReceipt([]byte("a"), []byte("a1"), 1, nil)
+	if err != nil {
+		t.Fatalf("PutWithReceipt failed: %v", err)
+	}
+	if r1.FirstSeq != 1 || r1.LastSeq != 1 || !reflect.DeepEqual(r1.Versions, []uint64{1}) || !r1.MasterRoot.IsZero() {
+		t.Errorf("PutWithReceipt: unexpected receipt %+v", r1)
+	}
+	mlsmCompactMem(t, db)
+
+	batch := new(Batch)
+	batch.PutWithVersion([]byte("a"), []byte("a2"), 2)
+	batch.PutWithVersion([]byte("b"), []byte("b2"), 2)
+	batch.PutWithVersion([]byte("c"), []byte("c3"), 3)
+	r2, err := db.WriteWithReceipt(batch, &opt.WriteOptions{ReceiptRoots: true})
+	if err != nil {
+		t.Fatalf("WriteWithReceipt failed: %v", err)
+	}
+	if r2.FirstSeq != 2 || r2.LastSeq != 4 || !reflect.DeepEqual(r2.Versions, []uint64{2, 3}) {
+		t.Errorf("WriteWithReceipt: unexpected receipt %+v", r2)
+	}
+	if !r2.VerifyBatch(batch) || r1.VerifyBatch(batch) {
+		t.Errorf("VerifyBatch: unexpected result")
+	}
+	if r2.MasterRoot != db.ComputeMasterRoot(db.s.version()) || r2.MemRoot != db.mem.DB.GetMerkleRoot() {
+		t.Errorf("WriteWithReceipt: unexpected roots %x %x", r2.MemRoot, r2.MasterRoot)
+	}
+
+	value, version, proof, err := db.GetWithProof([]byte("b"), 2, nil)
+	if err != nil {
+		t.Fatalf("GetWithProof failed: %v", err)
+	}
+	if !r2.VerifyProof(proof, []byte("b"), version, value) {
+		t.Errorf("VerifyProof(b@2) failed")
+	}
+	if r2.VerifyProof(proof, []byte("b"), version, []byte("forged")) {
+		t.Errorf("VerifyProof verified a forged value")
+	}
+	value, version, proof, _ = db.GetWithProof([]byte("a"), 1, nil)
+	if r2.VerifyProof(proof, []byte("a"), version, value) || !r1.VerifyProof(proof, []byte("a"), version, value) {
+		t.Errorf("VerifyProof(a@1): unexpected result")
+	}
+
+	// A later write changes the master root.
+	if err := db.PutWithVersion([]byte("d"), []byte("d4"), 4, nil); err != nil {
+		t.Fatalf("PutWithVersion failed: %v", err)
+	}
+	value, version, proof, _ = db.GetWithProof([]byte("b"), 2, nil)
+	if r2.VerifyProof(proof, []byte("b"), version, value) {
+		t.Errorf("VerifyProof(b@2) verified a proof of a later state")
+	}
+
+	r3, err := db.WriteWithReceipt(new(Batch), nil)
+	if err != nil || r3.FirstSeq != 0 || r3.LastSeq != 0 || !r3.VerifyBatch(new(Batch)) {
+		t.Errorf("WriteWithReceipt of an empty batch: unexpected %+v (%v)", r3, err)
+	}
+}
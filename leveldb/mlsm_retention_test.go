@@ -0,0 +1,217 @@
+package leveldb
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// openRetentionDB opens a DB with the given retention policy, whose tables
+// are only compacted, and pruned, by explicit compactions.
+func openRetentionDB(t *testing.T, dbPath string, policy opt.Retention, n int) *DB {
+	os.RemoveAll(dbPath)
+	return reopenRetentionDB(t, dbPath, policy, n)
+}
+
+func reopenRetentionDB(t *testing.T, dbPath string, policy opt.Retention, n int) *DB {
+	db, err := OpenFile(dbPath, &opt.Options{
+		DisableSeeksCompaction: true,
+		CompactionL0Trigger:    100,
+		Retention:              policy,
+		RetainVersions:         n,
+	})
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	return db
+}
+
+func historyVersions(t *testing.T, db *DB, key string) []uint64 {
+	entries, err := db.GetVersionHistoryWithProof([]byte(key), 0, 0, nil)
+	if err != nil && err != ErrNotFound {
+		t.Fatalf("GetVersionHistoryWithProof(%s) failed: %v", key, err)
+	}
+	var versions []uint64
+	for _, e := range entries {
+		if e.Proof == nil || !e.Proof.Verify([]byte(key), e.Version, e.Value) {
+			t.Errorf("key %s version %d: proof verification failed", key, e.Version)
+		}
+		versions = append(versions, e.Version)
+	}
+	return versions
+}
+
+func expectVersions(t *testing.T, name string, got []uint64, want ...uint64) {
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("%s: expected versions %v, got %v", name, want, got)
+	}
+}
+
+// TestRetentionLastN tests that compaction keeps the last N versions per key
+func TestRetentionLastN(t *testing.T) {
+	dbPath := "testdata/retention_lastn_test"
+	db := openRetentionDB(t, dbPath, opt.RetainLastN, 2)
+	defer os.RemoveAll(dbPath)
+	defer db.Close()
+
+	for v := uint64(1); v <= 5; v++ {
+		for _, k := range []string{"a", "b"} {
+			if err := db.PutWithVersion([]byte(k), []byte(fmt.Sprintf("%s-v%d", k, v)), v, nil); err != nil {
+				t.Fatalf("PutWithVersion failed: %v", err)
+			}
+		}
+		mlsmCompactMem(t, db)
+	}
+	expectVersions(t, "before compaction", historyVersions(t, db, "a"), 1, 2, 3, 4, 5)
+
+	if err := db.CompactRange(util.Range{}); err != nil {
+		t.Fatalf("CompactRange failed: %v", err)
+	}
+	expectVersions(t, "a", historyVersions(t, db, "a"), 4, 5)
+	expectVersions(t, "b", historyVersions(t, db, "b"), 4, 5)
+
+	value, err := db.GetWithVersion([]byte("a"), 3, nil)
+	if err != ErrNotFound {
+		t.Errorf("expected pruned version to be gone, got %q (%v)", value, err)
+	}
+
+	prop, err := db.GetProperty("leveldb.pruned")
+	if err != nil {
+		t.Fatalf("GetProperty failed: %v", err)
+	}
+	t.Logf("\n%s", prop)
+	if !strings.Contains(prop, "Policy:last-n") || !strings.Contains(prop, "| 1 .. 3") {
+		t.Errorf("unexpected leveldb.pruned property:\n%s", prop)
+	}
+}
+
+// TestRetentionSnapshot tests that versions visible to a live snapshot are not pruned
+func TestRetentionSnapshot(t *testing.T) {
+	dbPath := "testdata/retention_snapshot_test"
+	db := openRetentionDB(t, dbPath, opt.RetainLastN, 2)
+	defer os.RemoveAll(dbPath)
+	defer db.Close()
+
+	put := func(v uint64) {
+		if err := db.PutWithVersion([]byte("a"), []byte(fmt.Sprintf("v%d", v)), v, nil); err != nil {
+			t.Fatalf("PutWithVersion failed: %v", err)
+		}
+		mlsmCompactMem(t, db)
+	}
+	put(1)
+	put(2)
+	put(3)
+	snap, err := db.GetSnapshot()
+	if err != nil {
+		t.Fatalf("GetSnapshot failed: %v", err)
+	}
+	put(4)
+	put(5)
+
+	if err := db.CompactRange(util.Range{}); err != nil {
+		t.Fatalf("CompactRange failed: %v", err)
+	}
+	// The snapshot only sees versions 1..3, of which it keeps the last two.
+	expectVersions(t, "with snapshot", historyVersions(t, db, "a"), 2, 3, 4, 5)
+
+	snap.Release()
+	put(6)
+	if err := db.CompactRange(util.Range{}); err != nil {
+		t.Fatalf("CompactRange failed: %v", err)
+	}
+	expectVersions(t, "after release", historyVersions(t, db, "a"), 5, 6)
+}
+
+// TestRetentionWatermark tests the watermark based retention policies
+func TestRetentionWatermark(t *testing.T) {
+	t.Run("AboveWatermark", func(t *testing.T) {
+		dbPath := "testdata/retention_watermark_test"
+		db := openRetentionDB(t, dbPath, opt.RetainAboveWatermark, 0)
+		defer os.RemoveAll(dbPath)
+		defer func() {
+			db.Close()
+		}()
+
+		for _, v := range []uint64{1, 2, 4, 5} {
+			if err := db.PutWithVersion([]byte("a"), []byte(fmt.Sprintf("v%d", v)), v, nil); err != nil {
+				t.Fatalf("PutWithVersion failed: %v", err)
+			}
+			mlsmCompactMem(t, db)
+		}
+
+		// Zero watermark prunes nothing.
+		if err := db.CompactRange(util.Range{}); err != nil {
+			t.Fatalf("CompactRange failed: %v", err)
+		}
+		expectVersions(t, "zero watermark", historyVersions(t, db, "a"), 1, 2, 4, 5)
+
+		if err := db.SetPruneWatermark(3); err != nil {
+			t.Fatalf("SetPruneWatermark failed: %v", err)
+		}
+		db.SetPruneWatermark(1) // Ignored, the watermark only moves forward.
+		if w := db.PruneWatermark(); w != 3 {
+			t.Errorf("expected watermark 3, got %d", w)
+		}
+
+		// The watermark is kept across reopens.
+		db.Close()
+		db = reopenRetentionDB(t, dbPath, opt.RetainAboveWatermark, 0)
+		if w := db.PruneWatermark(); w != 3 {
+			t.Errorf("reopen: expected watermark 3, got %d", w)
+		}
+		if err := db.PutWithVersion([]byte("a"), []byte("v6"), 6, nil); err != nil {
+			t.Fatalf("PutWithVersion failed: %v", err)
+		}
+		mlsmCompactMem(t, db)
+		if err := db.CompactRange(util.Range{}); err != nil {
+			t.Fatalf("CompactRange failed: %v", err)
+		}
+		// Version 2 defines the state at the watermark and is kept.
+		expectVersions(t, "watermark 3", historyVersions(t, db, "a"), 2, 4, 5, 6)
+	})
+
+	t.Run("DropTombstones", func(t *testing.T) {
+		dbPath := "testdata/retention_tombstone_test"
+		db := openRetentionDB(t, dbPath, opt.RetainDropTombstones, 0)
+		defer os.RemoveAll(dbPath)
+		defer db.Close()
+
+		write := func(key string, v uint64, del bool) {
+			batch := new(Batch)
+			if del {
+				batch.DeleteWithVersion([]byte(key), v)
+			} else {
+				batch.PutWithVersion([]byte(key), []byte(fmt.Sprintf("%s-v%d", key, v)), v)
+			}
+			if err := db.Write(batch, nil); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			mlsmCompactMem(t, db)
+		}
+		// Key t: tombstone at 2 superseded by 3.
+		write("t", 1, false)
+		write("t", 2, true)
+		write("t", 3, false)
+		// Key u: tombstone at 2 is the latest record.
+		write("u", 1, false)
+		write("u", 2, true)
+
+		db.SetPruneWatermark(3)
+		if err := db.CompactRange(util.Range{}); err != nil {
+			t.Fatalf("CompactRange failed: %v", err)
+		}
+
+		prop, _ := db.GetProperty("leveldb.pruned")
+		if !strings.Contains(prop, "|          1 |") {
+			t.Errorf("expected exactly one pruned tombstone:\n%s", prop)
+		}
+		expectVersions(t, "t", historyVersions(t, db, "t"), 1, 3)
+		if _, err := db.Get([]byte("u"), nil); err != ErrNotFound {
+			t.Errorf("expected key u to stay deleted, got %v", err)
+		}
+	})
+}
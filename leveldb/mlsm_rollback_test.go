@@ -0,0 +1,134 @@
+package leveldb
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb/merkle"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+func openRollbackDB(t *testing.T, dbPath string) *DB {
+	db, err := OpenFile(dbPath, &opt.Options{DisableSeeksCompaction: true})
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	return db
+}
+
+// writeBlocks writes versions [from, to] of keys k0..k9, flushing the memdb
+// after every version but the last one.
+func writeBlocks(t *testing.T, db *DB, from, to uint64) {
+	for v := from; v <= to; v++ {
+		batch := new(Batch)
+		for i := 0; i < 10; i++ {
+			key := []byte(fmt.Sprintf("k%d", i))
+			if i == int(v)%10 {
+				batch.DeleteWithVersion(key, v)
+			} else {
+				batch.PutWithVersion(key, []byte(fmt.Sprintf("k%d-v%d", i, v)), v)
+			}
+		}
+		if err := db.Write(batch, nil); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if v < to {
+			mlsmCompactMem(t, db)
+		}
+	}
+}
+
+func compactedMasterRoot(t *testing.T, db *DB) merkle.Hash {
+	if err := db.CompactRange(util.Range{}); err != nil {
+		t.Fatalf("CompactRange failed: %v", err)
+	}
+	return db.ComputeMasterRoot(db.s.version())
+}
+
+// TestRollbackToVersion tests that a rollback leaves the DB as if the
+// discarded versions were never written
+func TestRollbackToVersion(t *testing.T) {
+	dbPath := "testdata/rollback_test"
+	refPath := "testdata/rollback_ref_test"
+	os.RemoveAll(dbPath)
+	os.RemoveAll(refPath)
+	defer os.RemoveAll(dbPath)
+	defer os.RemoveAll(refPath)
+
+	db := openRollbackDB(t, dbPath)
+	writeBlocks(t, db, 1, 6)
+
+	if err := db.RollbackToVersion(3); err != nil {
+		t.Fatalf("RollbackToVersion failed: %v", err)
+	}
+	for v := uint64(4); v <= 6; v++ {
+		if _, err := db.GetWithVersion([]byte("k0"), v, nil); err != ErrNotFound {
+			t.Errorf("version %d survived the rollback: %v", v, err)
+		}
+	}
+	if value, err := db.Get([]byte("k0"), nil); err != nil || string(value) != "k0-v3" {
+		t.Errorf("expected latest value k0-v3, got %q (%v)", value, err)
+	}
+	expectVersions(t, "k0", historyVersions(t, db, "k0"), 1, 2, 3)
+
+	// Continue on another branch, then reopen.
+	writeBlocks(t, db, 4, 5)
+	db.Close()
+	db = openRollbackDB(t, dbPath)
+	defer db.Close()
+	expectVersions(t, "k0 after reopen", historyVersions(t, db, "k0"), 1, 2, 3, 4, 5)
+	if err := db.RollbackToVersion(3); err != nil {
+		t.Fatalf("RollbackToVersion failed: %v", err)
+	}
+
+	ref := openRollbackDB(t, refPath)
+	defer ref.Close()
+	writeBlocks(t, ref, 1, 3)
+
+	got, want := compactedMasterRoot(t, db), compactedMasterRoot(t, ref)
+	if got != want {
+		t.Errorf("master root mismatch: got %x, want %x", got[:8], want[:8])
+	}
+	t.Logf("✓ 回滚后的 MasterRoot 与参考节点一致: %x", got[:8])
+}
+
+// TestRollbackResume tests that an interrupted rollback is completed by Open
+func TestRollbackResume(t *testing.T) {
+	dbPath := "testdata/rollback_resume_test"
+	os.RemoveAll(dbPath)
+	defer os.RemoveAll(dbPath)
+
+	db := openRollbackDB(t, dbPath)
+	writeBlocks(t, db, 1, 4)
+
+	// Record the rollback without performing it, as if the process crashed
+	// right after persisting it. Version 4 only lives in the journal.
+	db.compCommitLk.Lock()
+	rec := &sessionRecord{}
+	rec.setRollback(2)
+	err := db.s.commit(rec, true)
+	db.compCommitLk.Unlock()
+	if err != nil {
+		t.Fatalf("commit failed: %v", err)
+	}
+	db.Close()
+
+	if _, err := OpenFile(dbPath, &opt.Options{ReadOnly: true}); err != ErrRollbackPending {
+		t.Errorf("expected ErrRollbackPending in read-only mode, got %v", err)
+	}
+
+	db = openRollbackDB(t, dbPath)
+	defer func() {
+		db.Close()
+	}()
+	if db.s.stRollbackPending {
+		t.Errorf("rollback still pending after Open")
+	}
+	expectVersions(t, "k5", historyVersions(t, db, "k5"), 1, 2)
+
+	db.Close()
+	db = openRollbackDB(t, dbPath)
+	expectVersions(t, "k5 after reopen", historyVersions(t, db, "k5"), 1, 2)
+}
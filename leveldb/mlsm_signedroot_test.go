@@ -0,0 +1,266 @@
+package leveldb
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb/dbkey"
+	"github.com/syndtr/goleveldb/leveldb/merkle"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+type failingSigner struct{}
+
+func (failingSigner) SignRoot([]byte) ([]byte, error) {
+	return nil, errors.New("signer unavailable")
+}
+
+// TestSignedRoot tests the signing of the master roots at the version
+// boundaries and by SignRoot, their verification along a proof, and their
+// persistence
+func TestSignedRoot(t *testing.T) {
+	dbPath := "testdata/signed_root_test"
+	os.RemoveAll(dbPath)
+	defer os.RemoveAll(dbPath)
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	otherPub, _, _ := ed25519.GenerateKey(nil)
+	verifier := Ed25519RootVerifier(pub)
+
+	db, err := OpenFile(dbPath, &opt.Options{RootSigner: opt.Ed25519RootSigner(priv)})
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	if err := db.PutWithVersion([]byte("a"), []byte("a1"), 1, nil); err != nil {
+		t.Fatalf("PutWithVersion failed: %v", err)
+	}
+	mlsmCompactMem(t, db)
+	root1 := db.ComputeMasterRoot(db.s.version())
+	if err := db.PutWithVersion([]byte("b"), []byte("b2"), 2, nil); err != nil {
+		t.Fatalf("PutWithVersion failed: %v", err)
+	}
+
+	// Version 2 is only signed on demand, version 1 by the write of 2.
+	sr, err := db.SignRoot()
+	if err != nil {
+		t.Fatalf("SignRoot failed: %v", err)
+	}
+	if sr.Version != 2 || sr.Root != db.ComputeMasterRoot(db.s.version()) {
+		t.Fatalf("SignedRoot(2): unexpected root %x@%d", sr.Root, sr.Version)
+	}
+	if !sr.Verify(verifier) {
+		t.Fatalf("signature verification failed")
+	}
+	for _, key := range []string{"a", "b"} {
+		value, version, proof, err := db.GetWithProof([]byte(key), dbkey.LastestVersion, nil)
+		if err != nil {
+			t.Fatalf("GetWithProof(%s) failed: %v", key, err)
+		}
+		if !sr.VerifyProof(verifier, proof, []byte(key), version, value) {
+			t.Errorf("%s: proof verification against the signed root failed", key)
+		}
+		if sr.VerifyProof(Ed25519RootVerifier(otherPub), proof, []byte(key), version, value) {
+			t.Errorf("%s: proof verified with the wrong public key", key)
+		}
+		if sr.VerifyProof(verifier, proof, []byte(key), version, []byte("forged")) {
+			t.Errorf("%s: proof verified a forged value", key)
+		}
+	}
+
+	// A proof chain made of non-existence links, ending at the signed root,
+	// proves nothing.
+	forgedProof := &DBProof{LayerKind: merkle.LayerKindMemDB}
+	for _, link := range []**merkle.MerkleProof{&forgedProof.DataProof, &forgedProof.LayerProof, &forgedProof.MasterProof} {
+		*link = &merkle.MerkleProof{Root: sr.Root, Exists: false, TreeSize: 1}
+	}
+	if sr.VerifyProof(verifier, forgedProof, []byte("c"), 2, []byte("forged")) {
+		t.Errorf("forged non-existence proof verified against the signed root")
+	}
+
+	forged := *sr
+	forged.Root[0] ^= 1
+	if forged.Verify(verifier) {
+		t.Errorf("forged root verified")
+	}
+	forged = *sr
+	forged.Version = 3
+	if forged.Verify(verifier) {
+		t.Errorf("forged version verified")
+	}
+	forged = *sr
+	forged.Signature = append([]byte(nil), sr.Signature...)
+	forged.Signature[0] ^= 1
+	if forged.Verify(verifier) {
+		t.Errorf("forged signature verified")
+	}
+
+	sr1, err := db.SignedRoot(1)
+	if err != nil || !sr1.Verify(verifier) || sr1.Root != root1 {
+		t.Fatalf("SignedRoot(1): unexpected %v (%v)", sr1, err)
+	}
+	if _, err := db.SignedRoot(3); err != ErrNotFound {
+		t.Errorf("SignedRoot(3): expected ErrNotFound, got %v", err)
+	}
+	db.Close()
+
+	// The roots are persisted, and dropped by a rollback.
+	db, err = OpenFile(dbPath, nil)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	got, err := db.SignedRoot(2)
+	if err != nil || got.Root != sr.Root || string(got.Signature) != string(sr.Signature) || !got.Verify(verifier) {
+		t.Fatalf("SignedRoot(2) after reopen: unexpected %v (%v)", got, err)
+	}
+	if err := db.RollbackToVersion(1); err != nil {
+		t.Fatalf("RollbackToVersion failed: %v", err)
+	}
+	if _, err := db.SignedRoot(2); err != ErrNotFound {
+		t.Errorf("SignedRoot(2) after rollback: expected ErrNotFound, got %v", err)
+	}
+	if _, err := db.SignedRoot(1); err != nil {
+		t.Errorf("SignedRoot(1) after rollback: %v", err)
+	}
+	db.Close()
+
+	// A signing error never fails a write.
+	db, err = OpenFile(dbPath, &opt.Options{RootSigner: failingSigner{}})
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer db.Close()
+	for v := uint64(2); v <= 3; v++ {
+		if err := db.PutWithVersion([]byte("c"), []byte("c"), v, nil); err != nil {
+			t.Errorf("PutWithVersion(%d) failed: %v", v, err)
+		}
+	}
+	if value, err := db.GetWithVersion([]byte("c"), 3, nil); err != nil || string(value) != "c" {
+		t.Errorf("GetWithVersion(c): unexpected %q (%v)", value, err)
+	}
+	if _, err := db.SignRoot(); err == nil {
+		t.Errorf("SignRoot: expected the signer error")
+	}
+	for v := uint64(2); v <= 3; v++ {
+		if _, err := db.SignedRoot(v); err != ErrNotFound {
+			t.Errorf("SignedRoot(%d): expected ErrNotFound, got %v", v, err)
+		}
+	}
+}
+
+// TestSignedRootIndexSize tests that only the roots of the highest versions
+// are kept, across reopens, and that a transaction commit captures the
+// root of the version it supersedes
+func TestSignedRootIndexSize(t *testing.T) {
+	dbPath := "testdata/signed_root_size_test"
+	os.RemoveAll(dbPath)
+	defer os.RemoveAll(dbPath)
+
+	_, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	o := &opt.Options{RootSigner: opt.Ed25519RootSigner(priv), SignedRootIndexSize: 4}
+	db, err := OpenFile(dbPath, o)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	for v := uint64(1); v <= 9; v++ {
+		if err := db.PutWithVersion([]byte("a"), []byte(fmt.Sprint(v)), v, nil); err != nil {
+			t.Fatalf("PutWithVersion failed: %v", err)
+		}
+	}
+	tr, err := db.OpenTransaction()
+	if err != nil {
+		t.Fatalf("OpenTransaction failed: %v", err)
+	}
+	batch := new(Batch)
+	batch.PutWithVersion([]byte("a"), []byte("10"), 10)
+	if err := tr.Write(batch, nil); err != nil {
+		t.Fatalf("Transaction.Write failed: %v", err)
+	}
+	if err := tr.Commit(); err != nil {
+		t.Fatalf("Transaction.Commit failed: %v", err)
+	}
+	if _, err := db.SignRoot(); err != nil {
+		t.Fatalf("SignRoot failed: %v", err)
+	}
+
+	check := func(name string) {
+		for v := uint64(1); v <= 10; v++ {
+			_, err := db.SignedRoot(v)
+			if v > 6 && err != nil {
+				t.Errorf("%s: SignedRoot(%d) failed: %v", name, v, err)
+			} else if v <= 6 && err != ErrNotFound {
+				t.Errorf("%s: SignedRoot(%d): expected ErrNotFound, got %v", name, v, err)
+			}
+		}
+	}
+	check("open")
+	db.Close()
+
+	db, err = OpenFile(dbPath, o)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer db.Close()
+	check("reopen")
+}
+
+// TestSignedRootAttestation tests that the root signed for an earlier
+// version verifies the proofs generated while its state was current, but
+// not the proofs generated since, which verify against the root of the
+// current state
+func TestSignedRootAttestation(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	verifier := Ed25519RootVerifier(pub)
+	db, err := Open(storage.NewMemStorage(), &opt.Options{RootSigner: opt.Ed25519RootSigner(priv)})
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	getWithProof := func(name string) *DBProof {
+		value, version, proof, err := db.GetWithProof([]byte("a"), 1, nil)
+		if err != nil || version != 1 || string(value) != "a1" {
+			t.Fatalf("%s: GetWithProof(a@1): unexpected %q@%d (%v)", name, value, version, err)
+		}
+		return proof
+	}
+	if err := db.PutWithVersion([]byte("a"), []byte("a1"), 1, nil); err != nil {
+		t.Fatalf("PutWithVersion failed: %v", err)
+	}
+	kept := getWithProof("version 1")
+
+	// The write of version 2 captures the root of version 1.
+	if err := db.PutWithVersion([]byte("b"), []byte("b2"), 2, nil); err != nil {
+		t.Fatalf("PutWithVersion failed: %v", err)
+	}
+	sr2, err := db.SignRoot()
+	if err != nil {
+		t.Fatalf("SignRoot failed: %v", err)
+	}
+	sr1, err := db.SignedRoot(1)
+	if err != nil || !sr1.Verify(verifier) {
+		t.Fatalf("SignedRoot(1): unexpected %v (%v)", sr1, err)
+	}
+	current := getWithProof("version 2")
+	if !sr1.VerifyProof(verifier, kept, []byte("a"), 1, []byte("a1")) {
+		t.Errorf("the proof kept from version 1 doesn't verify against its signed root")
+	}
+	if sr1.VerifyProof(verifier, current, []byte("a"), 1, []byte("a1")) {
+		t.Errorf("a proof of the current state verified against the root of version 1")
+	}
+	if !sr2.VerifyProof(verifier, current, []byte("a"), 1, []byte("a1")) {
+		t.Errorf("a proof of the current state doesn't verify against its signed root")
+	}
+}
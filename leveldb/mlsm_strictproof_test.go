@@ -0,0 +1,118 @@
+package leveldb
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb/dbkey"
+	"github.com/syndtr/goleveldb/leveldb/merkle"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// corruptMerkleLeaf flips a byte of the given Merkle leaf hash in the
+// table files of the DB.
+func corruptMerkleLeaf(t *testing.T, dbPath string, leaf merkle.Hash) {
+	files, _ := filepath.Glob(filepath.Join(dbPath, "*.ldb"))
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("ReadFile failed: %v", err)
+		}
+		if i := bytes.Index(data, leaf[:]); i >= 0 {
+			data[i] ^= 0xff
+			if err := os.WriteFile(file, data, 0644); err != nil {
+				t.Fatalf("WriteFile failed: %v", err)
+			}
+			return
+		}
+	}
+	t.Fatalf("Merkle leaf %x not found", leaf[:8])
+}
+
+func isProofUnavailable(err error, layer string) bool {
+	e, ok := err.(*ErrProofUnavailable)
+	return ok && e.Layer == layer
+}
+
+// TestStrictProof tests that the strict proof mode fails the proof reads
+// whose proof chain is degraded, which the lenient mode returns weakened
+func TestStrictProof(t *testing.T) {
+	dbPath := "testdata/strict_proof_test"
+	os.RemoveAll(dbPath)
+	defer os.RemoveAll(dbPath)
+
+	strictRO := &opt.ReadOptions{ProofStrictness: opt.ProofStrict}
+	db, err := OpenFile(dbPath, nil)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	if err := db.PutWithVersion([]byte("a"), []byte("a1"), 1, nil); err != nil {
+		t.Fatalf("PutWithVersion failed: %v", err)
+	}
+	mlsmCompactMem(t, db)
+	if _, _, proof, err := db.GetWithProof([]byte("a"), 1, strictRO); err != nil || !proof.Verify([]byte("a"), 1, []byte("a1")) {
+		t.Fatalf("strict GetWithProof of a sound DB failed: %v", err)
+	}
+	db.Close()
+
+	corruptMerkleLeaf(t, dbPath, merkle.HashLeafV1([]byte("a"), 1, merkle.LeafKindValue, []byte("a1")))
+	db, err = OpenFile(dbPath, nil)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	if err := db.PutWithVersion([]byte("m"), []byte("m2"), 2, nil); err != nil {
+		t.Fatalf("PutWithVersion failed: %v", err)
+	}
+
+	// Lenient reads return the value with a missing or weakened proof.
+	value, _, proof, err := db.GetWithProof([]byte("a"), 1, nil)
+	if err != nil || string(value) != "a1" || proof != nil {
+		t.Errorf("lenient GetWithProof(a): unexpected %q %v (%v)", value, proof, err)
+	}
+	if _, _, proof, err := db.GetWithProof([]byte("m"), 2, nil); err != nil || proof == nil || proof.MasterProof == nil {
+		t.Errorf("lenient GetWithProof(m): unexpected %v (%v)", proof, err)
+	}
+
+	if _, _, _, err := db.GetWithProof([]byte("a"), 1, strictRO); !isProofUnavailable(err, ProofLinkData) {
+		t.Errorf("strict GetWithProof(a): expected a data ErrProofUnavailable, got %v", err)
+	}
+	if _, _, _, err := db.GetWithProof([]byte("m"), 2, strictRO); !isProofUnavailable(err, ProofLinkMaster) {
+		t.Errorf("strict GetWithProof(m): expected a master ErrProofUnavailable, got %v", err)
+	}
+	if _, err := db.GetVersionHistoryWithProof([]byte("a"), 0, 0, strictRO); !isProofUnavailable(err, ProofLinkData) {
+		t.Errorf("strict GetVersionHistoryWithProof(a): expected a data ErrProofUnavailable, got %v", err)
+	}
+	if _, _, err := db.MultiGetWithProof([][]byte{[]byte("m")}, dbkey.LastestVersion, strictRO); !isProofUnavailable(err, ProofLinkMaster) {
+		t.Errorf("strict MultiGetWithProof(m): expected a master ErrProofUnavailable, got %v", err)
+	}
+	if _, err := db.GetWithVersion([]byte("a"), 1, strictRO); err != nil {
+		t.Errorf("strict GetWithVersion(a) failed: %v", err)
+	}
+	db.Close()
+
+	// StrictAll leaves the proofs lenient, StrictProof is opt-in only.
+	db, err = OpenFile(dbPath, &opt.Options{Strict: opt.StrictAll})
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	if _, _, _, err := db.GetWithProof([]byte("a"), 1, nil); err != nil {
+		t.Errorf("GetWithProof(a) with StrictAll: %v", err)
+	}
+	db.Close()
+
+	// The StrictProof flag makes strict the default, which ReadOptions
+	// override.
+	db, err = OpenFile(dbPath, &opt.Options{Strict: opt.DefaultStrict | opt.StrictProof})
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer db.Close()
+	if _, _, _, err := db.GetWithProof([]byte("a"), 1, nil); !isProofUnavailable(err, ProofLinkData) {
+		t.Errorf("GetWithProof(a) with StrictProof: expected a data ErrProofUnavailable, got %v", err)
+	}
+	if _, _, _, err := db.GetWithProof([]byte("a"), 1, &opt.ReadOptions{ProofStrictness: opt.ProofLenient}); err != nil {
+		t.Errorf("lenient GetWithProof(a) with StrictProof: %v", err)
+	}
+}
@@ -0,0 +1,271 @@
+package leveldb
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb/dbkey"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+var timeIndexBase = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// blockTime is the test block time of the given version.
+func blockTime(version uint64) time.Time {
+	return timeIndexBase.Add(time.Duration(version) * time.Minute)
+}
+
+func openTimeIndexDB(t *testing.T, dbPath string, o *opt.Options) *DB {
+	db, err := OpenFile(dbPath, o)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	return db
+}
+
+func expectVersionAtTime(t *testing.T, db *DB, at time.Time, want uint64) {
+	got, err := db.VersionAtTime(at)
+	if want == 0 {
+		if err != ErrNotFound {
+			t.Errorf("VersionAtTime(%v): expected ErrNotFound, got %d (%v)", at, got, err)
+		}
+		return
+	}
+	if err != nil || got != want {
+		t.Errorf("VersionAtTime(%v): expected %d, got %d (%v)", at, want, got, err)
+	}
+}
+
+// TestTimeIndexWriteOptions tests timestamps given through WriteOptions and
+// the reads as of a time
+func TestTimeIndexWriteOptions(t *testing.T) {
+	dbPath := "testdata/timeindex_wo_test"
+	os.RemoveAll(dbPath)
+	defer os.RemoveAll(dbPath)
+	db := openTimeIndexDB(t, dbPath, nil)
+	defer db.Close()
+
+	// Version 2 doesn't write "a", version 4 deletes it.
+	for _, v := range []uint64{1, 2, 3, 5} {
+		wo := &opt.WriteOptions{Timestamp: blockTime(v)}
+		batch := new(Batch)
+		switch v {
+		case 2:
+			batch.PutWithVersion([]byte("b"), []byte("b2"), v)
+		case 5:
+			batch.DeleteWithVersion([]byte("a"), v)
+		default:
+			batch.PutWithVersion([]byte("a"), []byte{'a', byte('0' + v)}, v)
+		}
+		if err := db.Write(batch, wo); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if v == 2 {
+			mlsmCompactMem(t, db)
+		}
+	}
+	// The first timestamp of a version wins.
+	if err := db.PutWithVersion([]byte("c"), []byte("c3"), 3, &opt.WriteOptions{Timestamp: blockTime(10)}); err != nil {
+		t.Fatalf("PutWithVersion failed: %v", err)
+	}
+	if ts, err := db.VersionTime(3); err != nil || !ts.Equal(blockTime(3)) {
+		t.Errorf("VersionTime(3): expected %v, got %v (%v)", blockTime(3), ts, err)
+	}
+
+	expectVersionAtTime(t, db, blockTime(1).Add(-time.Second), 0)
+	expectVersionAtTime(t, db, blockTime(1), 1)
+	expectVersionAtTime(t, db, blockTime(2).Add(30*time.Second), 2)
+	expectVersionAtTime(t, db, blockTime(100), 5)
+
+	for _, c := range []struct {
+		at      time.Time
+		value   string
+		version uint64
+	}{
+		{blockTime(1), "a1", 1},
+		{blockTime(2), "a1", 1},
+		{blockTime(4), "a3", 3},
+		{blockTime(5), "", 0},
+	} {
+		value, version, proof, err := db.GetAsOfTimeWithProof([]byte("a"), c.at, nil)
+		if c.version == 0 {
+			if err != ErrNotFound {
+				t.Errorf("GetAsOfTimeWithProof(a, %v): expected ErrNotFound, got %q (%v)", c.at, value, err)
+			}
+			continue
+		}
+		if err != nil || string(value) != c.value || version != c.version {
+			t.Errorf("GetAsOfTimeWithProof(a, %v): expected %s@%d, got %q@%d (%v)", c.at, c.value, c.version, value, version, err)
+			continue
+		}
+		if proof == nil || !proof.Verify([]byte("a"), version, value) {
+			t.Errorf("GetAsOfTimeWithProof(a, %v): proof verification failed", c.at)
+		}
+		if value, _, err := db.GetAsOfTime([]byte("a"), c.at, nil); err != nil || string(value) != c.value {
+			t.Errorf("GetAsOfTime(a, %v): expected %s, got %q (%v)", c.at, c.value, value, err)
+		}
+	}
+	if _, _, err := db.GetAsOfTime([]byte("a"), blockTime(0), nil); err != ErrNotFound {
+		t.Errorf("GetAsOfTime before the first version: expected ErrNotFound, got %v", err)
+	}
+}
+
+// TestTimeIndexHook tests the Options.VersionTimestamp hook and that the
+// index survives reopen, from both the journal and the manifest
+func TestTimeIndexHook(t *testing.T) {
+	dbPath := "testdata/timeindex_hook_test"
+	os.RemoveAll(dbPath)
+	defer os.RemoveAll(dbPath)
+
+	calls := 0
+	o := &opt.Options{
+		VersionTimestamp: func(version uint64) time.Time {
+			calls++
+			if version == 4 {
+				// Unknown time, left out of the index.
+				return time.Time{}
+			}
+			return blockTime(version)
+		},
+	}
+	db := openTimeIndexDB(t, dbPath, o)
+	for v := uint64(1); v <= 4; v++ {
+		for _, key := range []string{"a", "b"} {
+			if err := db.PutWithVersion([]byte(key), []byte(key), v, nil); err != nil {
+				t.Fatalf("PutWithVersion failed: %v", err)
+			}
+		}
+		if v == 2 {
+			mlsmCompactMem(t, db)
+		}
+	}
+	if calls != 5 {
+		t.Errorf("expected the hook to be called once per indexed version, got %d calls", calls)
+	}
+	expectVersionAtTime(t, db, blockTime(100), 3)
+	db.Close()
+
+	// Versions 1-2 are in the manifest, version 3 in the journal.
+	o.VersionTimestamp = nil
+	for i := 0; i < 2; i++ {
+		db = openTimeIndexDB(t, dbPath, o)
+		for v := uint64(1); v <= 3; v++ {
+			if ts, err := db.VersionTime(v); err != nil || !ts.Equal(blockTime(v)) {
+				t.Errorf("reopen %d: VersionTime(%d): expected %v, got %v (%v)", i, v, blockTime(v), ts, err)
+			}
+		}
+		if _, err := db.VersionTime(4); err != ErrNotFound {
+			t.Errorf("reopen %d: VersionTime(4): expected ErrNotFound, got %v", i, err)
+		}
+		db.Close()
+	}
+
+	db = openTimeIndexDB(t, dbPath, &opt.Options{ReadOnly: true})
+	defer db.Close()
+	expectVersionAtTime(t, db, blockTime(100), 3)
+}
+
+// TestTimeIndexRollback tests that a rollback drops the timestamps of the
+// discarded versions
+func TestTimeIndexRollback(t *testing.T) {
+	dbPath := "testdata/timeindex_rollback_test"
+	os.RemoveAll(dbPath)
+	defer os.RemoveAll(dbPath)
+
+	o := &opt.Options{VersionTimestamp: blockTime}
+	db := openTimeIndexDB(t, dbPath, o)
+	writeBlocks(t, db, 1, 5)
+	if err := db.RollbackToVersion(3); err != nil {
+		t.Fatalf("RollbackToVersion failed: %v", err)
+	}
+	expectVersionAtTime(t, db, blockTime(100), 3)
+	db.Close()
+
+	// Version 4 gets a new time on the new branch.
+	o.VersionTimestamp = func(version uint64) time.Time {
+		return blockTime(version).Add(time.Hour)
+	}
+	db = openTimeIndexDB(t, dbPath, o)
+	writeBlocks(t, db, 4, 4)
+	db.Close()
+
+	db = openTimeIndexDB(t, dbPath, o)
+	defer db.Close()
+	expectVersionAtTime(t, db, blockTime(4), 3)
+	expectVersionAtTime(t, db, blockTime(4).Add(time.Hour), 4)
+	if _, err := db.VersionTime(5); err != ErrNotFound {
+		t.Errorf("VersionTime(5): expected ErrNotFound, got %v", err)
+	}
+	if value, version, err := db.GetAsOfTime([]byte("k1"), blockTime(100), nil); err != nil || version != 4 || string(value) != "k1-v4" {
+		t.Errorf("GetAsOfTime(k1): expected k1-v4@4, got %q@%d (%v)", value, version, err)
+	}
+}
+
+// TestTimeIndexSize tests that the index drops its lowest versions beyond
+// Options.VersionTimeIndexSize, also when reloaded from the manifest
+func TestTimeIndexSize(t *testing.T) {
+	dbPath := "testdata/timeindex_size_test"
+	os.RemoveAll(dbPath)
+	defer os.RemoveAll(dbPath)
+
+	o := &opt.Options{VersionTimestamp: blockTime, VersionTimeIndexSize: 8}
+	db := openTimeIndexDB(t, dbPath, o)
+	for v := uint64(1); v <= 20; v++ {
+		if err := db.PutWithVersion([]byte("a"), []byte("a"), v, nil); err != nil {
+			t.Fatalf("PutWithVersion failed: %v", err)
+		}
+		mlsmCompactMem(t, db)
+	}
+	check := func(name string) {
+		entries := db.s.vtIndex.all()
+		if len(entries) > 8 || entries[len(entries)-1].version != 20 {
+			t.Errorf("%s: unexpected index %v", name, entries)
+		}
+		if _, err := db.VersionTime(1); err != ErrNotFound {
+			t.Errorf("%s: VersionTime(1): expected ErrNotFound, got %v", name, err)
+		}
+		expectVersionAtTime(t, db, blockTime(1), 0)
+		expectVersionAtTime(t, db, blockTime(100), 20)
+	}
+	check("open")
+	db.Close()
+
+	db = openTimeIndexDB(t, dbPath, o)
+	defer db.Close()
+	check("reopen")
+}
+
+// TestTimeIndexSnapshot tests that the version read as of a time is
+// resolved among the records visible to the read snapshot
+func TestTimeIndexSnapshot(t *testing.T) {
+	dbPath := "testdata/timeindex_snapshot_test"
+	os.RemoveAll(dbPath)
+	defer os.RemoveAll(dbPath)
+	db := openTimeIndexDB(t, dbPath, nil)
+	defer db.Close()
+
+	put := func(v uint64) {
+		if err := db.PutWithVersion([]byte("a"), []byte{'a', byte('0' + v)}, v, nil); err != nil {
+			t.Fatalf("PutWithVersion failed: %v", err)
+		}
+	}
+	put(3)
+	put(1)
+	se := db.acquireSnapshot()
+	defer db.releaseSnapshot(se)
+	// Written after the snapshot, below its version 3.
+	put(2)
+
+	for _, flush := range []bool{false, true} {
+		if flush {
+			mlsmCompactMem(t, db)
+		}
+		if version, err := db.versionAsOf([]byte("a"), 2, se.seq); err != nil || version != 1 {
+			t.Errorf("flush=%v: versionAsOf(a@2) at the snapshot: expected 1, got %d (%v)", flush, version, err)
+		}
+		if version, err := db.versionAsOf([]byte("a"), 2, dbkey.KeyMaxSeq); err != nil || version != 2 {
+			t.Errorf("flush=%v: versionAsOf(a@2): expected 2, got %d (%v)", flush, version, err)
+		}
+	}
+}
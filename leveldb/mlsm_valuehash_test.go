@@ -0,0 +1,62 @@
+package leveldb
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb/merkle"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// TestValueHashProof tests proofs of value hash leaves, verified without
+// the value, from the memdb and from tables
+func TestValueHashProof(t *testing.T) {
+	dbPath := "testdata/valuehash_proof_test"
+	os.RemoveAll(dbPath)
+	defer os.RemoveAll(dbPath)
+
+	blob := bytes.Repeat([]byte("blob"), 1<<16)
+	db, err := OpenFile(dbPath, &opt.Options{MerkleValueHash: true})
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	if err := db.PutWithVersion([]byte("sst"), blob, 1, nil); err != nil {
+		t.Fatalf("PutWithVersion failed: %v", err)
+	}
+	mlsmCompactMem(t, db)
+	if err := db.PutWithVersion([]byte("mem"), blob[1:], 2, nil); err != nil {
+		t.Fatalf("PutWithVersion failed: %v", err)
+	}
+
+	check := func(db *DB, key string, version uint64, value []byte, valueHashLeaves bool) {
+		valueHash, actualVersion, proof, err := db.GetValueHashWithProof([]byte(key), version, nil)
+		if err != nil || actualVersion != version || valueHash != merkle.HashValue(value) {
+			t.Fatalf("GetValueHashWithProof(%s): unexpected %v@%d (%v)", key, valueHash, actualVersion, err)
+		}
+		if got := proof.VerifyValueHash([]byte(key), version, valueHash); got != valueHashLeaves {
+			t.Errorf("%s: VerifyValueHash: expected %v, got %v", key, valueHashLeaves, got)
+		}
+		if !proof.Verify([]byte(key), version, value) {
+			t.Errorf("%s: proof verification against the value failed", key)
+		}
+		if proof.VerifyValueHash([]byte(key), version, merkle.HashValue(value[1:])) {
+			t.Errorf("%s: proof verified against a wrong value hash", key)
+		}
+	}
+	check(db, "sst", 1, blob, true)
+	check(db, "mem", 2, blob[1:], true)
+	db.Close()
+
+	// Tables keep their leaf format, new writes follow the options.
+	db, err = OpenFile(dbPath, nil)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer db.Close()
+	if err := db.PutWithVersion([]byte("new"), blob, 3, nil); err != nil {
+		t.Fatalf("PutWithVersion failed: %v", err)
+	}
+	check(db, "sst", 1, blob, true)
+	check(db, "new", 3, blob, false)
+}
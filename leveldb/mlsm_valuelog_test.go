@@ -0,0 +1,344 @@
+package leveldb
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb/errors"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// valueLogFiles returns the numbers of the value log files of the DB.
+func valueLogFiles(t *testing.T, db *DB) []int64 {
+	fds, err := db.s.stor.List(storage.TypeValueLog)
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	sortFds(fds)
+	var nums []int64
+	for _, fd := range fds {
+		nums = append(nums, fd.Num)
+	}
+	return nums
+}
+
+// expectValueLogFiles waits for the value log files of the DB to be the
+// given ones, the files being removed along with the tables, asynchronously.
+func expectValueLogFiles(t *testing.T, name string, db *DB, want []int64) {
+	var got []int64
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if got = valueLogFiles(t, db); fmt.Sprint(got) == fmt.Sprint(want) {
+			return
+		}
+	}
+	t.Errorf("%s: expected value log files %v, got %v", name, want, got)
+}
+
+// TestValueLog tests the records of the values split out into value log
+// files: the lookups, the history, the iteration and the proofs of their
+// versions, the compactions copying the pointers, the removal of the files
+// of the pruned versions, and reopens without the option
+func TestValueLog(t *testing.T) {
+	const versions = 5
+	value := func(key string, version uint64) []byte {
+		if key == "small" {
+			return []byte(fmt.Sprintf("%s@%d", key, version))
+		}
+		return bytes.Repeat([]byte(fmt.Sprintf("%s@%d-", key, version)), 200)
+	}
+	keys := []string{"a", "b", "small"}
+
+	dbPath := "testdata/value_log_test"
+	os.RemoveAll(dbPath)
+	defer os.RemoveAll(dbPath)
+	db, err := OpenFile(dbPath, &opt.Options{
+		DisableSeeksCompaction: true,
+		Retention:              opt.RetainLastN,
+		RetainVersions:         2,
+		ValueLogThreshold:      256,
+		CompactionL0Trigger:    versions + 1,
+	})
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	for version := uint64(1); version <= versions; version++ {
+		for _, key := range keys {
+			if err := db.PutWithVersion([]byte(key), value(key, version), version, nil); err != nil {
+				t.Fatalf("PutWithVersion failed: %v", err)
+			}
+		}
+		mlsmCompactMem(t, db)
+	}
+	logs := valueLogFiles(t, db)
+	if len(logs) != versions {
+		t.Fatalf("expected %d value log files, got %v", versions, logs)
+	}
+	if size, values := tablesSize(db), int64(2*versions*len(value("a", 1))); size >= values {
+		t.Errorf("tables of %d bytes, expected less than the %d bytes of the large values", size, values)
+	}
+
+	check := func(name string, first uint64) {
+		for _, key := range keys {
+			for version := first; version <= versions; version++ {
+				if v, err := db.GetWithVersion([]byte(key), version, nil); err != nil || !bytes.Equal(v, value(key, version)) {
+					t.Errorf("%s: GetWithVersion(%s@%d): unexpected %q (%v)", name, key, version, v, err)
+				}
+			}
+			if v, err := db.Get([]byte(key), nil); err != nil || !bytes.Equal(v, value(key, versions)) {
+				t.Errorf("%s: Get(%s): unexpected %q (%v)", name, key, v, err)
+			}
+			v, version, proof, err := db.GetWithProof([]byte(key), versions-1, nil)
+			if err != nil || version != versions-1 || !bytes.Equal(v, value(key, versions-1)) || !proof.Verify([]byte(key), versions-1, v) {
+				t.Errorf("%s: GetWithProof(%s@%d): unexpected %q@%d (%v)", name, key, versions-1, v, version, err)
+			}
+			var want []uint64
+			for version := first; version <= versions; version++ {
+				want = append(want, version)
+			}
+			expectVersions(t, name+": "+key, historyVersions(t, db, key), want...)
+		}
+		var iterated []string
+		iter := db.NewIterator(nil, nil)
+		for iter.Next() {
+			if !bytes.Equal(iter.Value(), value(string(iter.Key()), versions)) {
+				t.Errorf("%s: iterated %s: unexpected %q", name, iter.Key(), iter.Value())
+			}
+			iterated = append(iterated, string(iter.Key()))
+		}
+		if err := iter.Error(); err != nil {
+			t.Errorf("%s: iterator error: %v", name, err)
+		}
+		iter.Release()
+		if fmt.Sprint(iterated) != fmt.Sprint(keys) {
+			t.Errorf("%s: iterated keys %v, expected %v", name, iterated, keys)
+		}
+	}
+	check("flush", 1)
+
+	// The compaction copies the pointers, and the files of the pruned
+	// versions go along with the last table pointing to them.
+	if err := db.CompactRange(util.Range{}); err != nil {
+		t.Fatalf("CompactRange failed: %v", err)
+	}
+	check("compaction", versions-1)
+	expectValueLogFiles(t, "compaction", db, logs[versions-2:])
+	db.Close()
+
+	// The tables keep their pointers, whatever the option.
+	db, err = OpenFile(dbPath, nil)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	check("reopen", versions-1)
+	if err := db.CompactRange(util.Range{}); err != nil {
+		t.Fatalf("CompactRange failed: %v", err)
+	}
+	check("rewrite", versions-1)
+	expectValueLogFiles(t, "rewrite", db, logs[versions-2:])
+	db.Close()
+
+	// A tampered value fails the lookup.
+	fd := storage.FileDesc{Type: storage.TypeValueLog, Num: logs[versions-1]}
+	path := filepath.Join(dbPath, fd.String())
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	data[0] ^= 0xff
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	db, err = OpenFile(dbPath, nil)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer db.Close()
+	if v, err := db.Get([]byte("a"), nil); err == nil {
+		t.Errorf("Get of a tampered value: unexpected %q", v)
+	}
+}
+
+// syncFailStorage fails the sync of a table file, once armed.
+type syncFailStorage struct {
+	storage.Storage
+
+	mu     sync.Mutex
+	failAt int // number of table syncs before the failing one, -1 for none
+	failed bool
+}
+
+func (s *syncFailStorage) Create(fd storage.FileDesc) (storage.Writer, error) {
+	w, err := s.Storage.Create(fd)
+	if err != nil || fd.Type != storage.TypeTable {
+		return w, err
+	}
+	return &syncFailWriter{w, s}, nil
+}
+
+// arm fails the table sync following the given number of them.
+func (s *syncFailStorage) arm(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failAt, s.failed = n, false
+}
+
+type syncFailWriter struct {
+	storage.Writer
+	s *syncFailStorage
+}
+
+func (w *syncFailWriter) Sync() error {
+	w.s.mu.Lock()
+	defer w.s.mu.Unlock()
+	switch {
+	case w.s.failAt == 0:
+		w.s.failAt, w.s.failed = -1, true
+		return errors.New("syncFailStorage: emulated sync error")
+	case w.s.failAt > 0:
+		w.s.failAt--
+	}
+	return w.Writer.Sync()
+}
+
+// TestValueLogRevert tests that the tables of a reverted attempt drop their
+// references to the value log files, which are then removed along with the
+// last table pointing to them.
+func TestValueLogRevert(t *testing.T) {
+	const n = 50
+	value := func(key string, version uint64) []byte {
+		return bytes.Repeat([]byte(fmt.Sprintf("%s@%d-", key, version)), 100)
+	}
+
+	stor := &syncFailStorage{Storage: storage.NewMemStorage(), failAt: -1}
+	db, err := Open(stor, &opt.Options{
+		DisableSeeksCompaction:   true,
+		DisableCompactionBackoff: true,
+		Retention:                opt.RetainLastN,
+		RetainVersions:           1,
+		ValueLogThreshold:        256,
+	})
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	keys := func(prefix string) (keys []string) {
+		for i := 0; i < n; i++ {
+			keys = append(keys, fmt.Sprintf("%s%03d", prefix, i))
+		}
+		return
+	}
+	for _, prefix := range []string{"a", "b"} {
+		for version := uint64(1); version <= 2; version++ {
+			for _, key := range keys(prefix) {
+				if err := db.PutWithVersion([]byte(key), value(key, version), version, nil); err != nil {
+					t.Fatalf("PutWithVersion failed: %v", err)
+				}
+			}
+		}
+		mlsmCompactMem(t, db)
+	}
+	if logs := valueLogFiles(t, db); len(logs) != 2 {
+		t.Fatalf("expected 2 value log files, got %v", logs)
+	}
+
+	// The rollback rewrites both tables, the second failing to sync; the
+	// next attempt starts over.
+	stor.arm(1)
+	if err := db.RollbackToVersion(1); err != nil {
+		t.Fatalf("RollbackToVersion failed: %v", err)
+	}
+	stor.mu.Lock()
+	failed := stor.failed
+	stor.mu.Unlock()
+	if !failed {
+		t.Fatal("the rollback did not fail")
+	}
+	for _, key := range append(keys("a"), keys("b")...) {
+		if v, err := db.Get([]byte(key), nil); err != nil || !bytes.Equal(v, value(key, 1)) {
+			t.Errorf("Get(%s): unexpected %q (%v)", key, v, err)
+		}
+	}
+
+	// Once the versions pointing to them are pruned, the files are removed.
+	for _, key := range append(keys("a"), keys("b")...) {
+		if err := db.PutWithVersion([]byte(key), []byte("small"), 2, nil); err != nil {
+			t.Fatalf("PutWithVersion failed: %v", err)
+		}
+	}
+	if err := db.CompactRange(util.Range{}); err != nil {
+		t.Fatalf("CompactRange failed: %v", err)
+	}
+	expectValueLogFiles(t, "pruned", db, nil)
+	if files, _, _ := db.s.tops.vlog.stats(); files != 0 {
+		t.Errorf("%d value log files referenced, expected none", files)
+	}
+}
+
+// TestValueLogGC tests that the compactions relocate the retained values of
+// the collected value log files, which are then removed, with and without
+// dedup
+func TestValueLogGC(t *testing.T) {
+	value := func(key string, version uint64) []byte {
+		return bytes.Repeat([]byte(fmt.Sprintf("%s@%d-", key, version)), 100)
+	}
+	for _, dedup := range []bool{false, true} {
+		name := fmt.Sprintf("dedup=%v", dedup)
+		db, err := Open(storage.NewMemStorage(), &opt.Options{
+			DisableSeeksCompaction: true,
+			Retention:              opt.RetainLastN,
+			RetainVersions:         1,
+			ValueLogThreshold:      256,
+			ValueLogGCRatio:        0.5,
+			DedupValues:            dedup,
+		})
+		if err != nil {
+			t.Fatalf("%s: Failed to open database: %v", name, err)
+		}
+		// The first file holds the retained b@1 and the pruned a@1.
+		for _, r := range []struct {
+			key     string
+			version uint64
+		}{{"a", 1}, {"b", 1}, {"a", 2}} {
+			if err := db.PutWithVersion([]byte(r.key), value(r.key, r.version), r.version, nil); err != nil {
+				t.Fatalf("%s: PutWithVersion failed: %v", name, err)
+			}
+			if r.key == "b" {
+				mlsmCompactMem(t, db)
+			}
+		}
+		mlsmCompactMem(t, db)
+		logs := valueLogFiles(t, db)
+		if len(logs) != 2 {
+			t.Fatalf("%s: expected 2 value log files, got %v", name, logs)
+		}
+
+		if err := db.CompactRange(util.Range{}); err != nil {
+			t.Fatalf("%s: CompactRange failed: %v", name, err)
+		}
+		got := valueLogFiles(t, db)
+		if last := got[len(got)-1]; last <= logs[1] {
+			t.Errorf("%s: expected a new value log file, got %v", name, got)
+		} else {
+			expectValueLogFiles(t, name, db, []int64{logs[1], last})
+		}
+		for _, r := range []struct {
+			key     string
+			version uint64
+		}{{"b", 1}, {"a", 2}} {
+			v, version, proof, err := db.GetWithProof([]byte(r.key), r.version, nil)
+			if err != nil || version != r.version || !bytes.Equal(v, value(r.key, r.version)) || !proof.Verify([]byte(r.key), r.version, v) {
+				t.Errorf("%s: GetWithProof(%s@%d): unexpected %q@%d (%v)", name, r.key, r.version, v, version, err)
+			}
+		}
+		expectVersions(t, name+": a", historyVersions(t, db, "a"), 2)
+		db.Close()
+	}
+}
@@ -0,0 +1,210 @@
+package leveldb
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+func openPolicyDB(t *testing.T, dbPath string, policy opt.VersionPolicy) *DB {
+	db, err := OpenFile(dbPath, &opt.Options{VersionPolicy: policy})
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	return db
+}
+
+func expectPolicyError(t *testing.T, name string, err error, rule opt.VersionPolicy, conflict uint64) {
+	perr, ok := err.(*ErrVersionPolicy)
+	if !ok {
+		t.Errorf("%s: expected ErrVersionPolicy, got %v", name, err)
+		return
+	}
+	if perr.Rule != rule || perr.Conflict != conflict {
+		t.Errorf("%s: expected rule %v conflicting with %d, got %v", name, rule, conflict, perr)
+	}
+}
+
+// TestVersionPolicyPerKey tests the strictly increasing per key rule
+func TestVersionPolicyPerKey(t *testing.T) {
+	dbPath := "testdata/version_policy_perkey_test"
+	os.RemoveAll(dbPath)
+	defer os.RemoveAll(dbPath)
+	db := openPolicyDB(t, dbPath, opt.VersionIncreasingPerKey)
+	defer db.Close()
+
+	if err := db.PutWithVersion([]byte("a"), []byte("a5"), 5, nil); err != nil {
+		t.Fatalf("PutWithVersion failed: %v", err)
+	}
+	expectPolicyError(t, "memdb", db.PutWithVersion([]byte("a"), []byte("a3"), 3, nil), opt.VersionIncreasingPerKey, 5)
+
+	mlsmCompactMem(t, db)
+	expectPolicyError(t, "table", db.PutWithVersion([]byte("a"), []byte("a5'"), 5, nil), opt.VersionIncreasingPerKey, 5)
+
+	// Other keys are independent.
+	if err := db.PutWithVersion([]byte("b"), []byte("b1"), 1, nil); err != nil {
+		t.Errorf("PutWithVersion(b, 1) failed: %v", err)
+	}
+
+	// A violation within a batch rejects the whole batch.
+	batch := new(Batch)
+	batch.PutWithVersion([]byte("c"), []byte("c6"), 6)
+	batch.PutWithVersion([]byte("a"), []byte("a6"), 6)
+	batch.PutWithVersion([]byte("a"), []byte("a6'"), 6)
+	expectPolicyError(t, "batch", db.Write(batch, nil), opt.VersionIncreasingPerKey, 6)
+	if _, err := db.Get([]byte("c"), nil); err != ErrNotFound {
+		t.Errorf("rejected batch was partially written: %v", err)
+	}
+
+	// Unversioned writes are not checked.
+	if err := db.Put([]byte("d"), []byte("d"), nil); err != nil {
+		t.Errorf("Put failed: %v", err)
+	}
+}
+
+// TestVersionPolicyDuplicate tests the duplicate (key, version) rule
+func TestVersionPolicyDuplicate(t *testing.T) {
+	dbPath := "testdata/version_policy_dup_test"
+	os.RemoveAll(dbPath)
+	defer os.RemoveAll(dbPath)
+	db := openPolicyDB(t, dbPath, opt.VersionRejectDuplicate)
+	defer db.Close()
+
+	put := func(version uint64) error {
+		return db.PutWithVersion([]byte("a"), []byte(fmt.Sprintf("a%d", version)), version, nil)
+	}
+	if err := put(5); err != nil {
+		t.Fatalf("PutWithVersion failed: %v", err)
+	}
+	mlsmCompactMem(t, db)
+	if err := put(3); err != nil {
+		t.Errorf("older version rejected: %v", err)
+	}
+	expectPolicyError(t, "memdb", put(3), opt.VersionRejectDuplicate, 3)
+	expectPolicyError(t, "table", put(5), opt.VersionRejectDuplicate, 5)
+
+	// A tombstone counts as written.
+	batch := new(Batch)
+	batch.DeleteWithVersion([]byte("a"), 7)
+	if err := db.Write(batch, nil); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	expectPolicyError(t, "tombstone", put(7), opt.VersionRejectDuplicate, 7)
+}
+
+// TestVersionPolicyNonDecreasing tests the global non-decreasing rule,
+// including across reopen and journal recovery
+func TestVersionPolicyNonDecreasing(t *testing.T) {
+	dbPath := "testdata/version_policy_global_test"
+	os.RemoveAll(dbPath)
+	defer os.RemoveAll(dbPath)
+	db := openPolicyDB(t, dbPath, opt.VersionNonDecreasing)
+
+	for i, key := range []string{"a", "b", "c"} {
+		if err := db.PutWithVersion([]byte(key), []byte(key), uint64(5+i/2), nil); err != nil {
+			t.Fatalf("PutWithVersion(%s) failed: %v", key, err)
+		}
+	}
+	mlsmCompactMem(t, db)
+	expectPolicyError(t, "flushed", db.PutWithVersion([]byte("d"), []byte("d"), 5, nil), opt.VersionNonDecreasing, 6)
+	if err := db.PutWithVersion([]byte("d"), []byte("d"), 7, nil); err != nil {
+		t.Fatalf("PutWithVersion failed: %v", err)
+	}
+	db.Close()
+
+	// Version 6 is persisted in the manifest, version 7 in the journal.
+	db = openPolicyDB(t, dbPath, opt.VersionNonDecreasing)
+	defer db.Close()
+	if v := db.MaxVersion(); v != 7 {
+		t.Errorf("expected max version 7 after reopen, got %d", v)
+	}
+	expectPolicyError(t, "reopened", db.PutWithVersion([]byte("e"), []byte("e"), 6, nil), opt.VersionNonDecreasing, 7)
+
+	// Concurrent writes may be merged; only the violating one fails.
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			version := uint64(10)
+			if i == 0 {
+				version = 1
+			}
+			errs[i] = db.PutWithVersion([]byte(fmt.Sprintf("k%d", i)), []byte("v"), version, nil)
+		}(i)
+	}
+	wg.Wait()
+	expectPolicyError(t, "concurrent", errs[0], opt.VersionNonDecreasing, 10)
+	for i, err := range errs[1:] {
+		if err != nil {
+			t.Errorf("concurrent write %d failed: %v", i+1, err)
+		}
+	}
+}
+
+// TestVersionPolicyRecovery tests that journal recovery checks the policy
+func TestVersionPolicyRecovery(t *testing.T) {
+	dbPath := "testdata/version_policy_recovery_test"
+	os.RemoveAll(dbPath)
+	defer os.RemoveAll(dbPath)
+
+	db := openPolicyDB(t, dbPath, opt.NoVersionPolicy)
+	db.PutWithVersion([]byte("a"), []byte("a5"), 5, nil)
+	db.PutWithVersion([]byte("a"), []byte("a3"), 3, nil)
+	db.Close()
+
+	if _, err := OpenFile(dbPath, &opt.Options{VersionPolicy: opt.VersionIncreasingPerKey}); err == nil {
+		t.Fatalf("expected journal recovery to fail")
+	} else {
+		expectPolicyError(t, "recovery", err, opt.VersionIncreasingPerKey, 5)
+	}
+
+	// The journal is left untouched and can be recovered without policy.
+	db = openPolicyDB(t, dbPath, opt.NoVersionPolicy)
+	defer db.Close()
+	if value, err := db.GetWithVersion([]byte("a"), 3, nil); err != nil || string(value) != "a3" {
+		t.Errorf("expected a3 at version 3, got %q (%v)", value, err)
+	}
+}
+
+// TestVersionPolicyTransaction tests large batches written through a
+// transaction keep their versions and are checked
+func TestVersionPolicyTransaction(t *testing.T) {
+	dbPath := "testdata/version_policy_tr_test"
+	os.RemoveAll(dbPath)
+	defer os.RemoveAll(dbPath)
+	db, err := OpenFile(dbPath, &opt.Options{
+		VersionPolicy: opt.VersionIncreasingPerKey,
+		WriteBuffer:   16 * opt.KiB,
+	})
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	value := bytes.Repeat([]byte("x"), 100)
+	batch := new(Batch)
+	for i := 0; i < 500; i++ {
+		batch.PutWithVersion([]byte(fmt.Sprintf("k%03d", i)), value, 2)
+	}
+	if err := db.Write(batch, nil); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if _, err := db.GetWithVersion([]byte("k042"), 2, nil); err != nil {
+		t.Errorf("GetWithVersion failed: %v", err)
+	}
+	if v := db.MaxVersion(); v != 2 {
+		t.Errorf("expected max version 2, got %d", v)
+	}
+
+	batch.Reset()
+	for i := 0; i < 500; i++ {
+		batch.PutWithVersion([]byte(fmt.Sprintf("k%03d", i)), value, 1)
+	}
+	expectPolicyError(t, "transaction", db.Write(batch, nil), opt.VersionIncreasingPerKey, 2)
+}
@@ -0,0 +1,130 @@
+package leveldb
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb/dbkey"
+	"github.com/syndtr/goleveldb/leveldb/table"
+)
+
+// openedTables returns the number of tables opened by the DB.
+func openedTables(t *testing.T, db *DB) string {
+	n, err := db.GetProperty("leveldb.openedtables")
+	if err != nil {
+		t.Fatalf("GetProperty failed: %v", err)
+	}
+	return n
+}
+
+// TestTableVersionRange tests the version ranges of the tables, their
+// persistence in the manifest, and the tables skipped by the lookups
+func TestTableVersionRange(t *testing.T) {
+	dbPath := "testdata/table_version_range_test"
+	os.RemoveAll(dbPath)
+	defer os.RemoveAll(dbPath)
+
+	db, err := OpenFile(dbPath, nil)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	for _, r := range []struct {
+		key     string
+		version uint64
+	}{{"a", 1}, {"b", 2}, {"", 0}, {"a", 5}, {"b", 6}} {
+		if r.key == "" {
+			mlsmCompactMem(t, db)
+			continue
+		}
+		if err := db.PutWithVersion([]byte(r.key), []byte(r.key+"-value"), r.version, nil); err != nil {
+			t.Fatalf("PutWithVersion failed: %v", err)
+		}
+	}
+	mlsmCompactMem(t, db)
+
+	expected := map[uint64]table.VersionRange{
+		1: {MinVersion: 1, MaxVersion: 2, MaxSeq: 2},
+		5: {MinVersion: 5, MaxVersion: 6, MaxSeq: 4},
+	}
+	check := func(name string) {
+		v := db.s.version()
+		defer v.release()
+		if len(v.levels[0]) != 2 {
+			t.Fatalf("%s: expected 2 tables, got %d", name, len(v.levels[0]))
+		}
+		for _, tf := range v.levels[0] {
+			if !tf.hasVersions || tf.versions != expected[tf.versions.MinVersion] {
+				t.Errorf("%s: table @%d: unexpected version range %+v (%v)", name, tf.fd.Num, tf.versions, tf.hasVersions)
+			}
+		}
+	}
+	check("write")
+	sstables, err := db.GetProperty("leveldb.sstables")
+	if err != nil || !strings.Contains(sstables, "V·[5 .. 6] Q·4") {
+		t.Errorf("GetProperty(sstables): unexpected %q (%v)", sstables, err)
+	}
+	db.Close()
+
+	db, err = OpenFile(dbPath, nil)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer db.Close()
+	check("reopen")
+
+	// Every lookup reads from a single table.
+	lookups := []struct {
+		name   string
+		lookup func() error
+	}{
+		{"GetWithVersion(a@1)", func() error {
+			_, err := db.GetWithVersion([]byte("a"), 1, nil)
+			return err
+		}},
+		{"Get(a)", func() error {
+			value, err := db.Get([]byte("a"), nil)
+			if err == nil && string(value) != "a-value" {
+				t.Errorf("Get(a): unexpected %q", value)
+			}
+			return err
+		}},
+		{"GetVersionHistory(a, 4, 9)", func() error {
+			entries, err := db.GetVersionHistory([]byte("a"), 4, 9, nil)
+			if err == nil && (len(entries) != 1 || entries[0].Version != 5) {
+				t.Errorf("GetVersionHistory(a, 4, 9): unexpected %v", entries)
+			}
+			return err
+		}},
+		{"versionAsOf(a@3)", func() error {
+			version, err := db.versionAsOf([]byte("a"), 3, dbkey.KeyMaxSeq)
+			if err == nil && version != 1 {
+				t.Errorf("versionAsOf(a@3): unexpected %d", version)
+			}
+			return err
+		}},
+	}
+	for _, l := range lookups {
+		db.s.tops.fileCache.EvictAll()
+		if err := l.lookup(); err != nil {
+			t.Errorf("%s failed: %v", l.name, err)
+		}
+		if n := openedTables(t, db); n != "1" {
+			t.Errorf("%s: opened %s tables, expected 1", l.name, n)
+		}
+	}
+
+	// The proofs find the records the same way, but read the roots of
+	// every table for the master proof.
+	if _, _, proof, err := db.GetWithProof([]byte("b"), 2, nil); err != nil || !proof.Verify([]byte("b"), 2, []byte("b-value")) {
+		t.Errorf("GetWithProof(b@2): unexpected %v", err)
+	}
+
+	db.s.tops.fileCache.EvictAll()
+	if _, err := db.GetWithVersion([]byte("a"), 3, nil); err != ErrNotFound {
+		t.Errorf("GetWithVersion(a@3): expected ErrNotFound, got %v", err)
+	}
+	if n := openedTables(t, db); n != "0" {
+		t.Errorf("GetWithVersion(a@3): opened %s tables, expected none", n)
+	}
+}
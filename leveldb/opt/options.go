@@ -8,7 +8,11 @@
 package opt
 
 import (
+	"crypto/ed25519"
+	"errors"
 	"math"
+	"strings"
+	"time"
 
 	"github.com/syndtr/goleveldb/leveldb/cache"
 	"github.com/syndtr/goleveldb/leveldb/comparer"
@@ -42,6 +46,10 @@ var (
 	DefaultWriteL0SlowdownTrigger        = 8
 	DefaultFilterBaseLg                  = 11
 	DefaultMaxManifestFileSize           = int64(64 * MiB)
+	DefaultRetainVersions                = 1
+	DefaultScrubBytesPerSecond           = 4 * MiB
+	DefaultVersionTimeIndexSize          = 65536
+	DefaultSignedRootIndexSize           = 1024
 )
 
 // Cacher is a caching algorithm.
@@ -162,7 +170,14 @@ const (
 	// 'strict level' will override global ones.
 	StrictOverride
 
-	// StrictAll enables all strict flags.
+	// If present then a missing or degraded link of a Merkle proof chain
+	// fails the 'read operation' with a leveldb.ErrProofUnavailable error,
+	// instead of returning a weaker or nil proof. See ProofStrictness.
+	// It changes the outcome of reads rather than guarding the data, and is
+	// thus opt-in only, not part of StrictAll.
+	StrictProof
+
+	// StrictAll enables all strict flags, but StrictProof.
 	StrictAll = StrictManifest | StrictJournalChecksum | StrictJournal | StrictBlockChecksum | StrictCompaction | StrictReader | StrictRecovery
 
 	// DefaultStrict is the default strict flags. Specify any strict flags
@@ -170,9 +185,151 @@ const (
 	DefaultStrict = StrictJournalChecksum | StrictBlockChecksum | StrictCompaction | StrictReader
 
 	// NoStrict disables all strict flags. Override default strict flags.
-	NoStrict = ^StrictAll
+	NoStrict = ^(StrictAll | StrictProof)
+)
+
+// Retention is the historical version retention policy enforced by table
+// compaction.
+type Retention uint
+
+func (r Retention) String() string {
+	switch r {
+	case RetainAll:
+		return "all"
+	case RetainLastN:
+		return "last-n"
+	case RetainAboveWatermark:
+		return "above-watermark"
+	case RetainDropTombstones:
+		return "drop-tombstones"
+	}
+	return "invalid"
+}
+
+const (
+	// RetainAll keeps every version and every tombstone.
+	RetainAll Retention = iota
+
+	// RetainLastN keeps the RetainVersions most recent versions of each key.
+	RetainLastN
+
+	// RetainAboveWatermark keeps versions above the prune watermark (see
+	// DB.SetPruneWatermark), plus the newest version at or below it, so
+	// that the state at the watermark stays readable.
+	RetainAboveWatermark
+
+	// RetainDropTombstones keeps every value but drops tombstones below the
+	// prune watermark that are superseded by a newer version which is
+	// itself at or below the watermark.
+	RetainDropTombstones
+
+	nRetention
+)
+
+// MerkleMode defines when the Merkle trees of the tables are built.
+type MerkleMode uint
+
+func (m MerkleMode) String() string {
+	switch m {
+	case MerkleEager:
+		return "eager"
+	case MerkleDeferred:
+		return "deferred"
+	case MerkleOff:
+		return "off"
+	}
+	return "invalid"
+}
+
+const (
+	// MerkleEager builds the Merkle tree of a table as it is written.
+	MerkleEager MerkleMode = iota
+
+	// MerkleDeferred writes the tables without Merkle tree, sparing the
+	// hashing to the flushes and compactions. The trees are built by a
+	// background job, rewriting the tables when no compaction is needed,
+	// or on demand by the proof reads, which wait for them.
+	MerkleDeferred
+
+	// MerkleOff writes the tables without Merkle tree, their records
+	// getting no proof.
+	MerkleOff
+
+	nMerkleMode
+)
+
+// VersionPolicy is the set of version ordering rules enforced on versioned
+// writes.
+type VersionPolicy uint
+
+const (
+	// If present then writing a (key, version) pair that has already been
+	// written is rejected.
+	VersionRejectDuplicate VersionPolicy = 1 << iota
+
+	// If present then the version of a write must be greater than every
+	// version already written for that key. Implies VersionRejectDuplicate.
+	VersionIncreasingPerKey
+
+	// If present then the version of a write must not be less than any
+	// version already written to the DB.
+	VersionNonDecreasing
+
+	// NoVersionPolicy disables all version ordering rules.
+	NoVersionPolicy VersionPolicy = 0
+)
+
+func (p VersionPolicy) String() string {
+	var names []string
+	if p&VersionRejectDuplicate != 0 {
+		names = append(names, "reject-duplicate")
+	}
+	if p&VersionIncreasingPerKey != 0 {
+		names = append(names, "increasing-per-key")
+	}
+	if p&VersionNonDecreasing != 0 {
+		names = append(names, "non-decreasing")
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, "|")
+}
+
+// ProofStrictness is the handling of the missing or degraded links of the
+// Merkle proof chains returned by a 'read operation'.
+type ProofStrictness uint
+
+const (
+	// DefaultProofStrictness follows the StrictProof flag of the DB and
+	// read 'strict levels'.
+	DefaultProofStrictness ProofStrictness = iota
+
+	// ProofLenient returns the weaker proof: a link that can't be proven is
+	// left nil, and an unreadable SST root is hashed as a zero hash.
+	ProofLenient
+
+	// ProofStrict fails the read with a leveldb.ErrProofUnavailable error.
+	ProofStrict
 )
 
+// RootSigner signs the master roots of the committed versions, see
+// Options.RootSigner.
+type RootSigner interface {
+	// SignRoot returns the signature of the given signed root message.
+	SignRoot(message []byte) ([]byte, error)
+}
+
+// Ed25519RootSigner is a RootSigner signing with an ed25519 private key.
+type Ed25519RootSigner ed25519.PrivateKey
+
+func (k Ed25519RootSigner) SignRoot(message []byte) ([]byte, error) {
+	if len(k) != ed25519.PrivateKeySize {
+		return nil, errors.New("leveldb/opt: invalid ed25519 private key size")
+	}
+	return ed25519.Sign(ed25519.PrivateKey(k), message), nil
+}
+
 // Options holds the optional parameters for the DB at large.
 type Options struct {
 	// AltFilters defines one or more 'alternative filters'.
@@ -283,6 +440,14 @@ type Options struct {
 	// than' relationship. The same comparison algorithm must be used for reads
 	// and writes over the lifetime of the DB.
 	//
+	// The comparer orders the user keys only, the versions of a user key are
+	// ordered by number, the newest first, whatever the comparer; the proofs
+	// follow the same order. The separators and successors it returns must
+	// sort as the comparer.Comparer contract says, or else they are not used.
+	// The name of the comparer is recorded in the manifest, along with the
+	// encoding of the versions, see BytewiseKeys, and the DB can't be opened
+	// with a comparer of another name.
+	//
 	// The default value uses the same ordering as bytes.Compare.
 	Comparer comparer.Comparer
 
@@ -346,6 +511,8 @@ type Options struct {
 	// filter during transition period.
 	//
 	// A filter is used to reduce disk reads when looking for a specific key.
+	// The filters are keyed on the user keys, whatever their versions, see
+	// FilterVersions.
 	//
 	// The default value is nil.
 	Filter filter.Filter
@@ -421,6 +588,204 @@ type Options struct {
 	//
 	// The default value is 64 MiB.
 	MaxManifestFileSize int64
+
+	// Retention defines which historical versions table compaction keeps.
+	// Versions are only pruned once they are invisible to every live
+	// snapshot, and memdb flushes never prune.
+	//
+	// Pruning proceeds one compaction at a time. Until the compactions
+	// reach the deeper levels, older versions of a key may survive there
+	// while newer ones got pruned, and a read of a pruned version then
+	// returns the surviving older version rather than ErrNotFound. Use
+	// DB.CompactRange to prune a key range completely.
+	//
+	// The default value (RetainAll) keeps the complete history.
+	Retention Retention
+
+	// RetainVersions is the number of versions per key kept under
+	// RetainLastN.
+	//
+	// The default value is 1.
+	RetainVersions int
+
+	// VersionPolicy defines the version ordering rules enforced by Write and
+	// PutWithVersion, and checked again while recovering the journal. A
+	// violating write is rejected as a whole with a leveldb.ErrVersionPolicy
+	// error. Writes without a version are not checked.
+	//
+	// Checking VersionIncreasingPerKey and VersionRejectDuplicate costs a
+	// lookup per written key.
+	//
+	// The default value is NoVersionPolicy.
+	VersionPolicy VersionPolicy
+
+	// VersionTimestamp returns the time the given version was committed at,
+	// e.g. the timestamp of the block at that height. It is called once for
+	// every version newly written without a WriteOptions.Timestamp, and its
+	// result is recorded in the DB version timestamp index, used by
+	// DB.VersionAtTime and DB.GetAsOfTime. A zero time leaves the version
+	// out of the index.
+	//
+	// The default value is nil.
+	VersionTimestamp func(version uint64) time.Time
+
+	// VersionTimeIndexSize limits the number of versions held by the DB
+	// version timestamp index. Once it is reached, the timestamps of the
+	// lowest versions are dropped, and DB.VersionAtTime no longer resolves
+	// the times before the lowest remaining one. The whole index is
+	// rewritten into every new manifest, which this keeps bounded.
+	// Use -1 for no limit.
+	//
+	// The default value is 65536.
+	VersionTimeIndexSize int
+
+	// MerkleValueHash defines whether the Merkle leaves of newly written
+	// tables and memdbs commit to the SHA-256 hash of the value rather than
+	// to the value itself. Their proofs can then be verified against a
+	// known value hash, without the value, see DB.GetValueHashWithProof.
+	// Tables keep the leaf format they were written with.
+	//
+	// The default value is false.
+	MerkleValueHash bool
+
+	// RootSigner, if set, signs the master roots of the committed
+	// versions, see leveldb.SignedRoot. The root of the highest written
+	// version is captured right before the first write of a higher
+	// version, and signed in the background; the root of the highest
+	// version itself is signed by leveldb.DB.SignRoot. The signature is
+	// persisted in the manifest along with the root, and replaces any
+	// earlier signed root of that version. A signing error is logged and
+	// leaves the version without a new signed root, it never fails a write.
+	//
+	// The proofs only verify against the signed root of the current state,
+	// the roots of the earlier versions being attestations, see
+	// leveldb.SignedRoot.
+	//
+	// Capturing a root costs a Merkle snapshot of the memdbs per version,
+	// and signing it a manifest write.
+	//
+	// The default value is nil.
+	RootSigner RootSigner
+
+	// SignedRootIndexSize limits the number of versions whose signed roots
+	// are kept. Once it is reached, the roots of the lowest versions are
+	// dropped. The whole index is rewritten into every new manifest, which
+	// this keeps bounded. Use -1 for no limit.
+	//
+	// The default value is 1024.
+	SignedRootIndexSize int
+
+	// ScrubInterval, if positive, enables the background integrity
+	// scrubber, which audits the tables one at a time like
+	// leveldb.DB.VerifyIntegrity, reading at most ScrubBytesPerSecond, and
+	// starts a new pass ScrubInterval after the end of the previous one.
+	// The report of the last pass is returned by leveldb.DB.ScrubReport.
+	//
+	// The default value is zero, the scrubber is disabled.
+	ScrubInterval time.Duration
+
+	// ScrubBytesPerSecond limits the table bytes read per second by the
+	// background integrity scrubber.
+	//
+	// The default value is 4MiB.
+	ScrubBytesPerSecond int
+
+	// JournalHashChain defines whether the journal records carry a running
+	// hash chain over the previous chain head and the record, making the
+	// write history tamper-evident, see leveldb.DB.JournalChainHead. The
+	// chain head is persisted in the manifest at every journal rotation,
+	// and the journals are checked against it by the recovery, which fails
+	// on a broken chain. The old journal gets synced at every rotation.
+	//
+	// The default value is false.
+	JournalHashChain bool
+
+	// FilterVersions defines whether the table filters also hold the user
+	// key and version of the records, on top of their bare user key. This
+	// lets the lookups of an exact version skip the tables holding other
+	// versions of the key only, at the cost of larger filters. It has no
+	// effect unless Filter is set.
+	//
+	// The default value is false.
+	FilterVersions bool
+
+	// BytewiseKeys defines whether a new DB stores the version and sequence
+	// number of its internal keys big-endian and bit-inverted, after the
+	// user key escaped and terminated, so that the internal keys are
+	// ordered by comparing them as bytes, rather than by decoding them,
+	// under the default comparer. The key encoding is recorded in
+	// the manifest; it is only chosen when the DB is created, or rebuilt by
+	// Recover, and an existing DB keeps its own whatever this option.
+	//
+	// The default value is false.
+	BytewiseKeys bool
+
+	// DeltaValues defines whether the newly written tables store a version
+	// of a key as a delta against its next-newer version in the same data
+	// block, when that is shorter than the value. This shrinks the tables
+	// of keys whose large values change little between the versions, at the
+	// cost of rebuilding the values when a data block is read. The Merkle
+	// leaves still commit to the full values. Tables keep the encoding they
+	// were written with.
+	//
+	// The default value is false.
+	DeltaValues bool
+
+	// ValueLogThreshold defines the size from which the values of the newly
+	// written tables are stored out of them, in append-only value log
+	// files, the tables holding a pointer to them. This spares the
+	// compactions the rewrite of the large values. The Merkle leaves of
+	// these tables commit to the SHA-256 hash of the values, held by the
+	// pointers. A value log file is removed once no table points to it
+	// anymore, as the records are dropped by the retention policy or by a
+	// rollback, see ValueLogGCRatio.
+	//
+	// The default value is 0, which disables the value logs.
+	ValueLogThreshold int
+
+	// ValueLogGCRatio defines the fraction of the oldest value log files
+	// collected by the compactions: the values they write from these files,
+	// the ones of the records retained, are relocated to the value log file
+	// of their output tables, rather than their pointers copied. A value
+	// log file holding both pruned and retained values is thus removed
+	// once the compactions went over the tables pointing to it. The files
+	// are numbered in order of creation; once collected, a file stays so.
+	//
+	// The default value is 0, which disables the relocation.
+	ValueLogGCRatio float64
+
+	// DedupValues defines whether the values stored in value log files, see
+	// ValueLogThreshold, are deduplicated by content: a value of the same
+	// SHA-256 hash as one already stored, by any key or version, is not
+	// stored again, the pointers of the tables referencing the stored one.
+	// A value log file is kept as long as any table references a value it
+	// holds. The Merkle leaves of newly written tables and memdbs commit to
+	// the value hashes, as with MerkleValueHash, their proofs verifying
+	// against the hash referencing the value.
+	//
+	// The index of the stored values is held in memory; each value log file
+	// ends with the index of the values it holds, loaded on open.
+	//
+	// The default value is false.
+	DedupValues bool
+
+	// MerkleMode defines when the Merkle trees of newly written tables are
+	// built. Tables keep their tree, whatever the mode; the master roots
+	// computed while tables lack theirs, e.g. the signed ones, don't commit
+	// to their records.
+	//
+	// The default value is MerkleEager.
+	MerkleMode MerkleMode
+
+	// MerkleWorkers defines the number of goroutines hashing the Merkle
+	// trees in parallel: the leaves and levels of the trees of the tables
+	// and memdbs, and the aggregation of the layer and master roots. They
+	// are shared by the flushes, compactions and reads of the DB. The trees
+	// and roots are identical whatever the number.
+	//
+	// The default value is 1, which hashes them on the goroutine building
+	// the tree.
+	MerkleWorkers int
 }
 
 func (o *Options) GetAltFilters() []filter.Filter {
@@ -702,8 +1067,15 @@ type ReadOptions struct {
 	DontFillCache bool
 
 	// Strict will be OR'ed with global DB 'strict level' unless StrictOverride
-	// is present. Currently only StrictReader that has effect here.
+	// is present. Currently only StrictReader and StrictProof that has effect
+	// here.
 	Strict Strict
+
+	// ProofStrictness defines whether the proofs of this 'read operation'
+	// must be complete, overriding the StrictProof flag.
+	//
+	// The default value is DefaultProofStrictness.
+	ProofStrictness ProofStrictness
 }
 
 func (ro *ReadOptions) GetDontFillCache() bool {
@@ -720,6 +1092,13 @@ func (ro *ReadOptions) GetStrict(strict Strict) bool {
 	return ro.Strict&strict != 0
 }
 
+func (ro *ReadOptions) GetProofStrictness() ProofStrictness {
+	if ro == nil {
+		return DefaultProofStrictness
+	}
+	return ro.ProofStrictness
+}
+
 // WriteOptions holds the optional parameters for 'write operation'. The
 // 'write operation' includes Write, Put and Delete.
 type WriteOptions struct {
@@ -741,6 +1120,21 @@ type WriteOptions struct {
 	//
 	// The default value is false.
 	Sync bool
+
+	// Timestamp is the time the versions written by the write were committed
+	// at. It is recorded in the DB version timestamp index for the versions
+	// not indexed yet, and takes precedence over Options.VersionTimestamp.
+	//
+	// The default value is the zero time, i.e. unset.
+	Timestamp time.Time
+
+	// ReceiptRoots defines whether the receipt of the write, see
+	// leveldb.DB.WriteWithReceipt, holds the memdb root and the master root
+	// of the DB state right after the write. Computing them costs a Merkle
+	// snapshot of the memdbs.
+	//
+	// The default value is false.
+	ReceiptRoots bool
 }
 
 func (wo *WriteOptions) GetNoWriteMerge() bool {
@@ -757,6 +1151,50 @@ func (wo *WriteOptions) GetSync() bool {
 	return wo.Sync
 }
 
+func (wo *WriteOptions) GetReceiptRoots() bool {
+	if wo == nil {
+		return false
+	}
+	return wo.ReceiptRoots
+}
+
+func (wo *WriteOptions) GetTimestamp() time.Time {
+	if wo == nil {
+		return time.Time{}
+	}
+	return wo.Timestamp
+}
+
+// IntegrityOptions holds the optional parameters for the integrity audit,
+// see leveldb.DB.VerifyIntegrity.
+type IntegrityOptions struct {
+	// Levels restricts the audit to the tables of the given levels. The
+	// master root is only recomputed by the audit of every level.
+	//
+	// The default is to audit every level.
+	Levels []int
+
+	// BytesPerSecond, if positive, limits the table bytes read per second
+	// by the audit.
+	//
+	// The default value is zero, the audit isn't throttled.
+	BytesPerSecond int
+}
+
+func (io *IntegrityOptions) GetLevels() []int {
+	if io == nil {
+		return nil
+	}
+	return io.Levels
+}
+
+func (io *IntegrityOptions) GetBytesPerSecond() int {
+	if io == nil || io.BytesPerSecond < 0 {
+		return 0
+	}
+	return io.BytesPerSecond
+}
+
 func GetStrict(o *Options, ro *ReadOptions, strict Strict) bool {
 	if ro.GetStrict(StrictOverride) {
 		return ro.GetStrict(strict)
@@ -764,9 +1202,161 @@ func GetStrict(o *Options, ro *ReadOptions, strict Strict) bool {
 	return o.GetStrict(strict) || ro.GetStrict(strict)
 }
 
+// GetProofStrict reports whether the proofs of a 'read operation' must be
+// complete, following ro.ProofStrictness else the StrictProof flag.
+func GetProofStrict(o *Options, ro *ReadOptions) bool {
+	switch ro.GetProofStrictness() {
+	case ProofStrict:
+		return true
+	case ProofLenient:
+		return false
+	}
+	return GetStrict(o, ro, StrictProof)
+}
+
 func (o *Options) GetMaxManifestFileSize() int64 {
 	if o == nil || o.MaxManifestFileSize <= 0 {
 		return DefaultMaxManifestFileSize
 	}
 	return o.MaxManifestFileSize
 }
+
+func (o *Options) GetRetention() Retention {
+	if o == nil || o.Retention >= nRetention {
+		return RetainAll
+	}
+	return o.Retention
+}
+
+func (o *Options) GetRetainVersions() int {
+	if o == nil || o.RetainVersions <= 0 {
+		return DefaultRetainVersions
+	}
+	return o.RetainVersions
+}
+
+func (o *Options) GetVersionPolicy() VersionPolicy {
+	if o == nil {
+		return NoVersionPolicy
+	}
+	return o.VersionPolicy
+}
+
+func (o *Options) GetVersionTimestamp() func(version uint64) time.Time {
+	if o == nil {
+		return nil
+	}
+	return o.VersionTimestamp
+}
+
+func (o *Options) GetVersionTimeIndexSize() int {
+	if o == nil || o.VersionTimeIndexSize == 0 {
+		return DefaultVersionTimeIndexSize
+	} else if o.VersionTimeIndexSize < 0 {
+		return 0
+	}
+	return o.VersionTimeIndexSize
+}
+
+func (o *Options) GetMerkleValueHash() bool {
+	if o == nil {
+		return false
+	}
+	return o.MerkleValueHash
+}
+
+func (o *Options) GetRootSigner() RootSigner {
+	if o == nil {
+		return nil
+	}
+	return o.RootSigner
+}
+
+func (o *Options) GetSignedRootIndexSize() int {
+	if o == nil || o.SignedRootIndexSize == 0 {
+		return DefaultSignedRootIndexSize
+	} else if o.SignedRootIndexSize < 0 {
+		return 0
+	}
+	return o.SignedRootIndexSize
+}
+
+func (o *Options) GetJournalHashChain() bool {
+	if o == nil {
+		return false
+	}
+	return o.JournalHashChain
+}
+
+func (o *Options) GetScrubInterval() time.Duration {
+	if o == nil || o.ScrubInterval < 0 {
+		return 0
+	}
+	return o.ScrubInterval
+}
+
+func (o *Options) GetScrubBytesPerSecond() int {
+	if o == nil || o.ScrubBytesPerSecond <= 0 {
+		return DefaultScrubBytesPerSecond
+	}
+	return o.ScrubBytesPerSecond
+}
+
+func (o *Options) GetFilterVersions() bool {
+	if o == nil {
+		return false
+	}
+	return o.FilterVersions
+}
+
+func (o *Options) GetBytewiseKeys() bool {
+	if o == nil {
+		return false
+	}
+	return o.BytewiseKeys
+}
+
+func (o *Options) GetDeltaValues() bool {
+	if o == nil {
+		return false
+	}
+	return o.DeltaValues
+}
+
+func (o *Options) GetValueLogThreshold() int {
+	if o == nil || o.ValueLogThreshold < 0 {
+		return 0
+	}
+	return o.ValueLogThreshold
+}
+
+func (o *Options) GetValueLogGCRatio() float64 {
+	if o == nil || o.ValueLogGCRatio <= 0 {
+		return 0
+	}
+	if o.ValueLogGCRatio > 1 {
+		return 1
+	}
+	return o.ValueLogGCRatio
+}
+
+func (o *Options) GetDedupValues() bool {
+	if o == nil {
+		return false
+	}
+	return o.DedupValues
+}
+
+func (o *Options) GetMerkleMode() MerkleMode {
+	if o == nil || o.MerkleMode >= nMerkleMode {
+		return MerkleEager
+	}
+	return o.MerkleMode
+}
+
+func (o *Options) GetMerkleWorkers() int {
+	if o == nil || o.MerkleWorkers <= 0 {
+		return 1
+	}
+	return o.MerkleWorkers
+}
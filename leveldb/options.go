@@ -7,6 +7,7 @@
 package leveldb
 
 import (
+	"github.com/syndtr/goleveldb/leveldb/dbkey"
 	"github.com/syndtr/goleveldb/leveldb/filter"
 	"github.com/syndtr/goleveldb/leveldb/opt"
 )
@@ -24,25 +25,34 @@ func dupOptions(o *opt.Options) *opt.Options {
 
 func (s *session) setOptions(o *opt.Options) {
 	no := dupOptions(o)
-	// Alternative filters.
-	if filters := o.GetAltFilters(); len(filters) > 0 {
-		no.AltFilters = make([]filter.Filter, len(filters))
-		for i, filter := range filters {
-			no.AltFilters[i] = &iFilter{filter}
-		}
-	}
 	// Comparer.
-	s.icmp = &iComparer{o.GetComparer()}
+	s.icmp = &iComparer{ucmp: o.GetComparer()}
+	if o.GetBytewiseKeys() {
+		s.icmp.kf = dbkey.FormatBytewise
+	}
 	no.Comparer = s.icmp
+	// Alternative filters, every filter is also read in the layouts it is
+	// not written in, the filter blocks telling their layout by name.
+	no.AltFilters = nil
+	for _, filter := range o.GetAltFilters() {
+		no.AltFilters = append(no.AltFilters, iFilterLayouts(s.icmp, filter)...)
+	}
 	// Filter.
 	if filter := o.GetFilter(); filter != nil {
-		no.Filter = &iFilter{filter}
+		no.Filter = &iFilter{filter, o.GetFilterVersions(), s.icmp}
+		no.AltFilters = append(no.AltFilters, iFilterLayouts(s.icmp, filter)...)
 	}
 
 	s.o = &cachedOptions{Options: no}
 	s.o.cache()
 }
 
+// iFilterLayouts returns the internal filters reading the filter blocks of
+// the given filter, in any of the layouts it may be written in.
+func iFilterLayouts(icmp *iComparer, f filter.Filter) []filter.Filter {
+	return []filter.Filter{&iFilter{f, false, icmp}, &iFilter{f, true, icmp}, &iUVkeyFilter{f, icmp}}
+}
+
 const optCachedLevel = 7
 
 type cachedOptions struct {
@@ -16,6 +16,7 @@ import (
 
 	"github.com/syndtr/goleveldb/leveldb/errors"
 	"github.com/syndtr/goleveldb/leveldb/journal"
+	"github.com/syndtr/goleveldb/leveldb/merkle"
 	"github.com/syndtr/goleveldb/leveldb/opt"
 	"github.com/syndtr/goleveldb/leveldb/storage"
 )
@@ -43,6 +44,11 @@ type session struct {
 	stPrevJournalNum int64 // prev journal file number; no longer used; for compatibility with older version of leveldb
 	stTempFileNum    int64
 	stSeqNum         uint64 // last mem compacted seq; need external synchronization
+	stMaxVersion     uint64 // highest version flushed out of the journal; need external synchronization
+	stPruneWatermark uint64 // prune watermark, see DB.SetPruneWatermark; need external synchronization
+	stRollback       uint64 // target version of the pending rollback; need external synchronization
+	stTableVersion   uint64 // highest version of the live tables, see version.tableVersions; atomic
+	stUnversioned    int32  // whether a live table lacks a version range, see tFile; atomic
 
 	stor     *iStorage
 	storLock storage.Locker
@@ -50,10 +56,19 @@ type session struct {
 	icmp     *iComparer
 	tops     *tOps
 
+	merklePool *merkle.Pool // hashes the Merkle trees, see Options.MerkleWorkers
+
 	manifest       *journal.Writer
 	manifestWriter storage.Writer
 	manifestFd     storage.FileDesc
 
+	stRollbackPending bool // whether a rollback is pending; need external synchronization
+
+	vtIndex versionTimeIndex  // version timestamp index
+	srIndex signedRootIndex   // signed root index
+	mcIndex merkleCheckIndex  // table Merkle check index
+	jcIndex journalChainIndex // journal hash chain index
+
 	stCompPtrs  []dbkey.InternalKey // compaction pointers; need external synchronization
 	stVersion   *version            // current version
 	ntVersionID int64               // next version id to assign
@@ -89,6 +104,9 @@ func newSession(stor storage.Storage, o *opt.Options) (s *session, err error) {
 		closeC:    make(chan struct{}),
 	}
 	s.setOptions(o)
+	s.vtIndex.limit = s.o.GetVersionTimeIndexSize()
+	s.srIndex.limit = s.o.GetSignedRootIndexSize()
+	s.merklePool = merkle.NewPool(s.o.GetMerkleWorkers())
 	s.tops = newTableOps(s)
 
 	s.closeW.Add(1)
@@ -175,6 +193,14 @@ func (s *session) recover() (err error) {
 			for _, r := range rec.compPtrs {
 				s.setCompPtr(r.level, r.ikey)
 			}
+			// load version timestamps
+			s.commitVersionTimes(rec)
+			// load signed roots
+			s.commitSignedRoots(rec)
+			// load table Merkle checks
+			s.commitMerkleChecks(rec)
+			// load journal chain heads
+			s.commitJournalChains(rec)
 			// commit record to version staging
 			staging.commit(rec)
 		} else {
@@ -187,6 +213,10 @@ func (s *session) recover() (err error) {
 		rec.resetCompPtrs()
 		rec.resetAddedTables()
 		rec.resetDeletedTables()
+		rec.resetSignedRoots()
+		rec.resetMerkleChecks()
+		rec.resetJournalChains()
+		rec.resetVersionTimes()
 	}
 
 	switch {
@@ -202,6 +232,13 @@ func (s *session) recover() (err error) {
 		return newErrManifestCorrupted(fd, "seq-num", "missing")
 	}
 
+	// The manifests written before the key formats hold the legacy keys.
+	if rec.has(recKeyFormat) {
+		s.setKeyFormat(rec.keyFormat)
+	} else {
+		s.setKeyFormat(dbkey.FormatLegacy)
+	}
+
 	s.manifestFd = fd
 	s.setVersion(rec, staging.finish(false))
 	s.setNextFileNum(rec.nextFileNum)
@@ -209,6 +246,13 @@ func (s *session) recover() (err error) {
 	return nil
 }
 
+// setKeyFormat sets the encoding of the internal keys of the DB, the tables
+// read it from the options; need external synchronization.
+func (s *session) setKeyFormat(kf dbkey.Format) {
+	s.icmp.kf = kf
+	s.o.BytewiseKeys = kf == dbkey.FormatBytewise
+}
+
 // Commit session; need external synchronization.
 func (s *session) commit(r *sessionRecord, trivial bool) (err error) {
 	v := s.version()
@@ -30,7 +30,9 @@ func (s *session) pickMemdbLevel(umin, umax []byte, maxLevel int) int {
 	return v.pickMemdbLevel(umin, umax, maxLevel)
 }
 
-func (s *session) flushMemdb(rec *sessionRecord, mdb *memdb.DB, maxLevel int) (int, error) {
+// flushMemdb flushes the memdb to a table, ordered tells whether its
+// records were written in version order, see tFile.
+func (s *session) flushMemdb(rec *sessionRecord, mdb *memdb.DB, maxLevel int, ordered bool) (int, error) {
 	// Create sorted table.
 	iter := mdb.NewIterator(nil)
 	defer iter.Release()
@@ -38,6 +40,7 @@ func (s *session) flushMemdb(rec *sessionRecord, mdb *memdb.DB, maxLevel int) (i
 	if err != nil {
 		return 0, err
 	}
+	t.ordered = ordered
 
 	// Pick level other than zero can cause compaction issue with large
 	// bulk insert and delete on strictly incrementing key-space. The
@@ -47,7 +50,7 @@ func (s *session) flushMemdb(rec *sessionRecord, mdb *memdb.DB, maxLevel int) (i
 	// higher level, thus maximum possible level is always picked, while
 	// overlapping deletion marker pushed into lower level.
 	// See: https://github.com/syndtr/goleveldb/issues/127.
-	flushLevel := s.pickMemdbLevel(t.imin.UVkey(), t.imax.UVkey(), maxLevel)
+	flushLevel := s.pickMemdbLevel(s.icmp.kf.Ukey(t.imin), s.icmp.kf.Ukey(t.imax), maxLevel)
 	rec.addTableFile(flushLevel, t)
 
 	s.logf("memdb@flush created L%d@%d N·%d S·%s %q:%q", flushLevel, t.fd.Num, n, shortenb(t.size), t.imin, t.imax)
@@ -210,22 +213,22 @@ func (c *compaction) expand() {
 	// For non-zero levels, the uvkey can't hop across tables at all.
 	if c.sourceLevel == 0 {
 		// We expand t0 here just incase uvkey hop across tables.
-		t0 = vt0.getOverlaps(t0, c.s.icmp, imin.UVkey(), imax.UVkey(), c.sourceLevel == 0)
+		t0 = vt0.getOverlaps(t0, c.s.icmp, c.s.icmp.kf.Ukey(imin), c.s.icmp.kf.Ukey(imax), c.sourceLevel == 0)
 		if len(t0) != len(c.levels[0]) {
 			imin, imax = t0.getRange(c.s.icmp)
 		}
 	}
-	t1 = vt1.getOverlaps(t1, c.s.icmp, imin.UVkey(), imax.UVkey(), false)
+	t1 = vt1.getOverlaps(t1, c.s.icmp, c.s.icmp.kf.Ukey(imin), c.s.icmp.kf.Ukey(imax), false)
 	// Get entire range covered by compaction.
 	amin, amax := append(t0, t1...).getRange(c.s.icmp)
 
 	// See if we can grow the number of inputs in "sourceLevel" without
 	// changing the number of "sourceLevel+1" files we pick up.
 	if len(t1) > 0 {
-		exp0 := vt0.getOverlaps(nil, c.s.icmp, amin.UVkey(), amax.UVkey(), c.sourceLevel == 0)
+		exp0 := vt0.getOverlaps(nil, c.s.icmp, c.s.icmp.kf.Ukey(amin), c.s.icmp.kf.Ukey(amax), c.sourceLevel == 0)
 		if len(exp0) > len(t0) && t1.size()+exp0.size() < limit {
 			xmin, xmax := exp0.getRange(c.s.icmp)
-			exp1 := vt1.getOverlaps(nil, c.s.icmp, xmin.UVkey(), xmax.UVkey(), false)
+			exp1 := vt1.getOverlaps(nil, c.s.icmp, c.s.icmp.kf.Ukey(xmin), c.s.icmp.kf.Ukey(xmax), false)
 			if len(exp1) == len(t1) {
 				c.s.logf("table@compaction expanding L%d+L%d (F·%d S·%s)+(F·%d S·%s) -> (F·%d S·%s)+(F·%d S·%s)",
 					c.sourceLevel, c.sourceLevel+1, len(t0), shortenb(t0.size()), len(t1), shortenb(t1.size()),
@@ -240,7 +243,7 @@ func (c *compaction) expand() {
 	// Compute the set of grandparent files that overlap this compaction
 	// (parent == sourceLevel+1; grandparent == sourceLevel+2)
 	if level := c.sourceLevel + 2; level < len(c.v.levels) {
-		c.gp = c.v.levels[level].getOverlaps(c.gp, c.s.icmp, amin.UVkey(), amax.UVkey(), false)
+		c.gp = c.v.levels[level].getOverlaps(c.gp, c.s.icmp, c.s.icmp.kf.Ukey(amin), c.s.icmp.kf.Ukey(amax), false)
 	}
 
 	c.levels[0], c.levels[1] = t0, t1
@@ -257,9 +260,9 @@ func (c *compaction) baseLevelForKey(ukey []byte) bool {
 		tables := c.v.levels[level]
 		for c.tPtrs[level] < len(tables) {
 			t := tables[c.tPtrs[level]]
-			if c.s.icmp.uCompare(ukey, t.imax.UVkey()) <= 0 {
+			if c.s.icmp.uCompare(ukey, c.s.icmp.kf.Ukey(t.imax)) <= 0 {
 				// We've advanced far enough.
-				if c.s.icmp.uCompare(ukey, t.imin.UVkey()) >= 0 {
+				if c.s.icmp.uCompare(ukey, c.s.icmp.kf.Ukey(t.imin)) >= 0 {
 					// Key falls in this file's range, so definitely not base level.
 					return false
 				}
@@ -319,10 +322,10 @@ func (c *compaction) newIterator() iterator.Iterator {
 		// Level-0 is not sorted and may overlaps each other.
 		if c.sourceLevel+i == 0 {
 			for _, t := range tables {
-				its = append(its, c.s.tops.newIterator(t, nil, ro))
+				its = append(its, c.s.tops.newRawIterator(t, nil, ro))
 			}
 		} else {
-			it := iterator.NewIndexedIterator(tables.newIndexIterator(c.s.tops, c.s.icmp, nil, ro), strict)
+			it := iterator.NewIndexedIterator(tables.newIndexIterator(c.s.tops, c.s.icmp, nil, ro, true), strict)
 			its = append(its, it)
 		}
 	}
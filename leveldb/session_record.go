@@ -16,6 +16,7 @@ import (
 
 	"github.com/syndtr/goleveldb/leveldb/errors"
 	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/syndtr/goleveldb/leveldb/table"
 )
 
 type byteReader interface {
@@ -34,6 +35,19 @@ const (
 	recAddTable    = 7
 	// 8 was used for large value refs
 	recPrevJournalNum = 9
+	recRollback       = 10
+	recMaxVersion     = 11
+	recVersionTime    = 12
+	recVersionTrunc   = 13
+	recSignedRoot     = 14
+	recMerkleCheck    = 15
+	recJournalChain   = 16
+	recTableVersions  = 17
+	recTableOrdered   = 18
+	recKeyFormat      = 19
+	recTableValueLogs = 20
+	recTableNoMerkle  = 21
+	recPruneWatermark = 22
 )
 
 type cpRecord struct {
@@ -47,6 +61,18 @@ type atRecord struct {
 	size  int64
 	imin  dbkey.InternalKey
 	imax  dbkey.InternalKey
+
+	// The range of the versions of the records, and whether they were
+	// written in version order, persisted by separate records following
+	// the add-table one.
+	versions    table.VersionRange
+	hasVersions bool
+	ordered     bool
+
+	// The value log files the table points to, and whether it was written
+	// without Merkle tree, persisted by separate records as well.
+	valueLogs []int64
+	noMerkle  bool
 }
 
 type dtRecord struct {
@@ -57,14 +83,38 @@ type dtRecord struct {
 type sessionRecord struct {
 	hasRec         int
 	comparer       string
+	keyFormat      dbkey.Format
 	journalNum     int64
 	prevJournalNum int64
 	nextFileNum    int64
 	seqNum         uint64
+	maxVersion     uint64
+	pruneWatermark uint64
 	compPtrs       []cpRecord
 	addedTables    []atRecord
 	deletedTables  []dtRecord
 
+	// rollback is the target version of a pending rollback; the record
+	// clears it when rollbackPending is false.
+	rollbackPending bool
+	rollback        uint64
+
+	// versionTimes are added to the version timestamp index, after the
+	// entries above versionTrunc got dropped from it.
+	versionTimes []versionTime
+	versionTrunc uint64
+
+	// signedRoots are added to the signed root index, after the entries
+	// above versionTrunc got dropped from it.
+	signedRoots []SignedRoot
+
+	// merkleChecks are the Merkle checks of tables, see DB.RebuildMerkle.
+	merkleChecks []merkleCheck
+
+	// journalChains are the journal hash chain heads at the start of the
+	// chained journals, see Options.JournalHashChain.
+	journalChains []journalChainStart
+
 	scratch [binary.MaxVarintLen64]byte
 	err     error
 }
@@ -78,6 +128,11 @@ func (p *sessionRecord) setComparer(name string) {
 	p.comparer = name
 }
 
+func (p *sessionRecord) setKeyFormat(kf dbkey.Format) {
+	p.hasRec |= 1 << recKeyFormat
+	p.keyFormat = kf
+}
+
 func (p *sessionRecord) setJournalNum(num int64) {
 	p.hasRec |= 1 << recJournalNum
 	p.journalNum = num
@@ -98,6 +153,74 @@ func (p *sessionRecord) setSeqNum(num uint64) {
 	p.seqNum = num
 }
 
+func (p *sessionRecord) setMaxVersion(version uint64) {
+	p.hasRec |= 1 << recMaxVersion
+	p.maxVersion = version
+}
+
+func (p *sessionRecord) setPruneWatermark(version uint64) {
+	p.hasRec |= 1 << recPruneWatermark
+	p.pruneWatermark = version
+}
+
+func (p *sessionRecord) setRollback(version uint64) {
+	p.hasRec |= 1 << recRollback
+	p.rollbackPending = true
+	p.rollback = version
+}
+
+func (p *sessionRecord) clearRollback() {
+	p.hasRec |= 1 << recRollback
+	p.rollbackPending = false
+	p.rollback = 0
+}
+
+func (p *sessionRecord) addVersionTime(vt versionTime) {
+	p.hasRec |= 1 << recVersionTime
+	p.versionTimes = append(p.versionTimes, vt)
+}
+
+func (p *sessionRecord) resetVersionTimes() {
+	p.hasRec &= ^(1<<recVersionTime | 1<<recVersionTrunc)
+	p.versionTimes = p.versionTimes[:0]
+	p.versionTrunc = 0
+}
+
+func (p *sessionRecord) setVersionTrunc(version uint64) {
+	p.hasRec |= 1 << recVersionTrunc
+	p.versionTrunc = version
+}
+
+func (p *sessionRecord) addSignedRoot(r SignedRoot) {
+	p.hasRec |= 1 << recSignedRoot
+	p.signedRoots = append(p.signedRoots, r)
+}
+
+func (p *sessionRecord) resetSignedRoots() {
+	p.hasRec &= ^(1 << recSignedRoot)
+	p.signedRoots = p.signedRoots[:0]
+}
+
+func (p *sessionRecord) addMerkleCheck(c merkleCheck) {
+	p.hasRec |= 1 << recMerkleCheck
+	p.merkleChecks = append(p.merkleChecks, c)
+}
+
+func (p *sessionRecord) resetMerkleChecks() {
+	p.hasRec &= ^(1 << recMerkleCheck)
+	p.merkleChecks = p.merkleChecks[:0]
+}
+
+func (p *sessionRecord) addJournalChain(c journalChainStart) {
+	p.hasRec |= 1 << recJournalChain
+	p.journalChains = append(p.journalChains, c)
+}
+
+func (p *sessionRecord) resetJournalChains() {
+	p.hasRec &= ^(1 << recJournalChain)
+	p.journalChains = p.journalChains[:0]
+}
+
 func (p *sessionRecord) addCompPtr(level int, ikey dbkey.InternalKey) {
 	p.hasRec |= 1 << recCompPtr
 	p.compPtrs = append(p.compPtrs, cpRecord{level, ikey})
@@ -110,11 +233,79 @@ func (p *sessionRecord) resetCompPtrs() {
 
 func (p *sessionRecord) addTable(level int, num, size int64, imin, imax dbkey.InternalKey) {
 	p.hasRec |= 1 << recAddTable
-	p.addedTables = append(p.addedTables, atRecord{level, num, size, imin, imax})
+	p.addedTables = append(p.addedTables, atRecord{level: level, num: num, size: size, imin: imin, imax: imax})
 }
 
 func (p *sessionRecord) addTableFile(level int, t *tFile) {
 	p.addTable(level, t.fd.Num, t.size, t.imin, t.imax)
+	if t.hasVersions {
+		p.setTableVersions(t.fd.Num, t.versions)
+	}
+	if t.ordered {
+		p.setTableOrdered(t.fd.Num)
+	}
+	if len(t.valueLogs) > 0 {
+		p.setTableValueLogs(t.fd.Num, t.valueLogs)
+	}
+	if t.noMerkle {
+		p.setTableNoMerkle(t.fd.Num)
+	}
+}
+
+// addedTable returns the last added table of the given number, or nil if
+// there is none.
+func (p *sessionRecord) addedTable(num int64) *atRecord {
+	for i := len(p.addedTables) - 1; i >= 0; i-- {
+		if r := &p.addedTables[i]; r.num == num {
+			return r
+		}
+	}
+	return nil
+}
+
+// setTableVersions sets the version range of the last added table of the
+// given number, it reports false if there is none.
+func (p *sessionRecord) setTableVersions(num int64, vr table.VersionRange) bool {
+	r := p.addedTable(num)
+	if r == nil {
+		return false
+	}
+	r.versions, r.hasVersions = vr, true
+	return true
+}
+
+// setTableOrdered marks the last added table of the given number as
+// ordered, see tFile, it reports false if there is none.
+func (p *sessionRecord) setTableOrdered(num int64) bool {
+	r := p.addedTable(num)
+	if r == nil {
+		return false
+	}
+	r.ordered = true
+	return true
+}
+
+// setTableValueLogs sets the value log files pointed to by the last added
+// table of the given number, it reports false if there is none.
+func (p *sessionRecord) setTableValueLogs(num int64, nums []int64) bool {
+	r := p.addedTable(num)
+	if r == nil {
+		return false
+	}
+	r.valueLogs = nums
+	return true
+}
+
+// setTableNoMerkle marks the last added table of the given number as
+// written without Merkle tree, see tFile, it reports false if there is
+// none.
+func (p *sessionRecord) setTableNoMerkle(num int64) bool {
+	r := p.addedTable(num)
+	if r == nil {
+		return false
+	}
+	r.noMerkle = true
+	return true
 }
 
 func (p *sessionRecord) resetAddedTables() {
@@ -164,6 +355,10 @@ func (p *sessionRecord) encode(w io.Writer) error {
 		p.putUvarint(w, recComparer)
 		p.putBytes(w, []byte(p.comparer))
 	}
+	if p.has(recKeyFormat) {
+		p.putUvarint(w, recKeyFormat)
+		p.putUvarint(w, uint64(p.keyFormat))
+	}
 	if p.has(recJournalNum) {
 		p.putUvarint(w, recJournalNum)
 		p.putVarint(w, p.journalNum)
@@ -176,6 +371,55 @@ func (p *sessionRecord) encode(w io.Writer) error {
 		p.putUvarint(w, recSeqNum)
 		p.putUvarint(w, p.seqNum)
 	}
+	if p.has(recMaxVersion) {
+		p.putUvarint(w, recMaxVersion)
+		p.putUvarint(w, p.maxVersion)
+	}
+	if p.has(recPruneWatermark) {
+		p.putUvarint(w, recPruneWatermark)
+		p.putUvarint(w, p.pruneWatermark)
+	}
+	if p.has(recRollback) {
+		p.putUvarint(w, recRollback)
+		if p.rollbackPending {
+			p.putUvarint(w, 1)
+		} else {
+			p.putUvarint(w, 0)
+		}
+		p.putUvarint(w, p.rollback)
+	}
+	if p.has(recVersionTrunc) {
+		p.putUvarint(w, recVersionTrunc)
+		p.putUvarint(w, p.versionTrunc)
+	}
+	for _, r := range p.versionTimes {
+		p.putUvarint(w, recVersionTime)
+		p.putUvarint(w, r.version)
+		p.putUvarint(w, uint64(r.time))
+	}
+	for _, r := range p.signedRoots {
+		p.putUvarint(w, recSignedRoot)
+		p.putUvarint(w, r.Version)
+		p.putBytes(w, r.Root[:])
+		p.putBytes(w, r.Signature)
+	}
+	for _, r := range p.merkleChecks {
+		p.putUvarint(w, recMerkleCheck)
+		p.putVarint(w, r.num)
+		p.putUvarint(w, uint64(r.status))
+		p.putBytes(w, r.root[:])
+	}
+	for _, r := range p.journalChains {
+		p.putUvarint(w, recJournalChain)
+		p.putVarint(w, r.num)
+		p.putUvarint(w, r.Seq)
+		p.putBytes(w, r.Head[:])
+		if r.chained {
+			p.putUvarint(w, 1)
+		} else {
+			p.putUvarint(w, 0)
+		}
+	}
 	for _, r := range p.compPtrs {
 		p.putUvarint(w, recCompPtr)
 		p.putUvarint(w, uint64(r.level))
@@ -193,6 +437,29 @@ func (p *sessionRecord) encode(w io.Writer) error {
 		p.putVarint(w, r.size)
 		p.putBytes(w, r.imin)
 		p.putBytes(w, r.imax)
+		if r.hasVersions {
+			p.putUvarint(w, recTableVersions)
+			p.putVarint(w, r.num)
+			p.putUvarint(w, r.versions.MinVersion)
+			p.putUvarint(w, r.versions.MaxVersion)
+			p.putUvarint(w, r.versions.MaxSeq)
+		}
+		if r.ordered {
+			p.putUvarint(w, recTableOrdered)
+			p.putVarint(w, r.num)
+		}
+		if len(r.valueLogs) > 0 {
+			p.putUvarint(w, recTableValueLogs)
+			p.putVarint(w, r.num)
+			p.putUvarint(w, uint64(len(r.valueLogs)))
+			for _, num := range r.valueLogs {
+				p.putVarint(w, num)
+			}
+		}
+		if r.noMerkle {
+			p.putUvarint(w, recTableNoMerkle)
+			p.putVarint(w, r.num)
+		}
 	}
 	return p.err
 }
@@ -277,6 +544,15 @@ func (p *sessionRecord) decode(r io.Reader) error {
 			if p.err == nil {
 				p.setComparer(string(x))
 			}
+		case recKeyFormat:
+			x := p.readUvarint("key-format", br)
+			if p.err == nil {
+				if kf := dbkey.Format(x); uint64(kf) != x || !kf.Known() {
+					p.err = errors.NewErrCorrupted(storage.FileDesc{}, &ErrManifestCorrupted{"key-format", "unknown format"})
+				} else {
+					p.setKeyFormat(kf)
+				}
+			}
 		case recJournalNum:
 			x := p.readVarint("journal-num", br)
 			if p.err == nil {
@@ -297,6 +573,75 @@ func (p *sessionRecord) decode(r io.Reader) error {
 			if p.err == nil {
 				p.setSeqNum(x)
 			}
+		case recMaxVersion:
+			x := p.readUvarint("max-version", br)
+			if p.err == nil {
+				p.setMaxVersion(x)
+			}
+		case recPruneWatermark:
+			x := p.readUvarint("prune-watermark", br)
+			if p.err == nil {
+				p.setPruneWatermark(x)
+			}
+		case recRollback:
+			pending := p.readUvarint("rollback.pending", br)
+			version := p.readUvarint("rollback.version", br)
+			if p.err == nil {
+				if pending != 0 {
+					p.setRollback(version)
+				} else {
+					p.clearRollback()
+				}
+			}
+		case recVersionTrunc:
+			x := p.readUvarint("version-trunc", br)
+			if p.err == nil {
+				p.setVersionTrunc(x)
+			}
+		case recVersionTime:
+			version := p.readUvarint("version-time.version", br)
+			t := p.readUvarint("version-time.time", br)
+			if p.err == nil {
+				p.addVersionTime(versionTime{version, int64(t)})
+			}
+		case recSignedRoot:
+			version := p.readUvarint("signed-root.version", br)
+			root := p.readBytes("signed-root.root", br)
+			sig := p.readBytes("signed-root.signature", br)
+			if p.err == nil {
+				r := SignedRoot{Version: version, Signature: sig}
+				if r.Root.UnmarshalBinary(root) != nil {
+					p.err = errors.NewErrCorrupted(storage.FileDesc{}, &ErrManifestCorrupted{"signed-root.root", "invalid hash size"})
+				} else {
+					p.addSignedRoot(r)
+				}
+			}
+		case recMerkleCheck:
+			num := p.readVarint("merkle-check.num", br)
+			status := p.readUvarint("merkle-check.status", br)
+			root := p.readBytes("merkle-check.root", br)
+			if p.err == nil {
+				c := merkleCheck{num: num, status: MerkleStatus(status)}
+				if c.root.UnmarshalBinary(root) != nil {
+					p.err = errors.NewErrCorrupted(storage.FileDesc{}, &ErrManifestCorrupted{"merkle-check.root", "invalid hash size"})
+				} else {
+					p.addMerkleCheck(c)
+				}
+			}
+		case recJournalChain:
+			num := p.readVarint("journal-chain.num", br)
+			seq := p.readUvarint("journal-chain.seq", br)
+			head := p.readBytes("journal-chain.head", br)
+			chained := p.readUvarint("journal-chain.chained", br)
+			if p.err == nil {
+				c := journalChainStart{num: num, chained: chained != 0}
+				c.Seq = seq
+				if c.Head.UnmarshalBinary(head) != nil {
+					p.err = errors.NewErrCorrupted(storage.FileDesc{}, &ErrManifestCorrupted{"journal-chain.head", "invalid hash size"})
+				} else {
+					p.addJournalChain(c)
+				}
+			}
 		case recCompPtr:
 			level := p.readLevel("comp-ptr.level", br)
 			ikey := p.readBytes("comp-ptr.ikey", br)
@@ -312,6 +657,35 @@ func (p *sessionRecord) decode(r io.Reader) error {
 			if p.err == nil {
 				p.addTable(level, num, size, imin, imax)
 			}
+		case recTableVersions:
+			num := p.readVarint("table-versions.num", br)
+			var vr table.VersionRange
+			vr.MinVersion = p.readUvarint("table-versions.min", br)
+			vr.MaxVersion = p.readUvarint("table-versions.max", br)
+			vr.MaxSeq = p.readUvarint("table-versions.max-seq", br)
+			if p.err == nil && !p.setTableVersions(num, vr) {
+				p.err = errors.NewErrCorrupted(storage.FileDesc{}, &ErrManifestCorrupted{"table-versions", "unknown table"})
+			}
+		case recTableOrdered:
+			num := p.readVarint("table-ordered.num", br)
+			if p.err == nil && !p.setTableOrdered(num) {
+				p.err = errors.NewErrCorrupted(storage.FileDesc{}, &ErrManifestCorrupted{"table-ordered", "unknown table"})
+			}
+		case recTableValueLogs:
+			num := p.readVarint("table-value-logs.num", br)
+			n := p.readUvarint("table-value-logs.len", br)
+			var nums []int64
+			for i := uint64(0); i < n && p.err == nil; i++ {
+				nums = append(nums, p.readVarint("table-value-logs.num", br))
+			}
+			if p.err == nil && !p.setTableValueLogs(num, nums) {
+				p.err = errors.NewErrCorrupted(storage.FileDesc{}, &ErrManifestCorrupted{"table-value-logs", "unknown table"})
+			}
+		case recTableNoMerkle:
+			num := p.readVarint("table-no-merkle.num", br)
+			if p.err == nil && !p.setTableNoMerkle(num) {
+				p.err = errors.NewErrCorrupted(storage.FileDesc{}, &ErrManifestCorrupted{"table-no-merkle", "unknown table"})
+			}
 		case recDelTable:
 			level := p.readLevel("del-table.level", br)
 			num := p.readVarint("del-table.num", br)
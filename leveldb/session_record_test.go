@@ -11,6 +11,8 @@ import (
 	"testing"
 
 	"github.com/syndtr/goleveldb/leveldb/dbkey"
+	"github.com/syndtr/goleveldb/leveldb/merkle"
+	"github.com/syndtr/goleveldb/leveldb/table"
 )
 
 func decodeEncode(v *sessionRecord) (res bool, err error) {
@@ -60,5 +62,41 @@ func TestSessionRecord_EncodeDecode(t *testing.T) {
 	v.setPrevJournalNum(big + 99)
 	v.setNextFileNum(big + 200)
 	v.setSeqNum(uint64(big + 1000))
+	v.setMaxVersion(uint64(big + 1050))
+	test()
+	v.setPruneWatermark(uint64(big + 1075))
+	test()
+	v.setRollback(uint64(big + 1100))
+	test()
+	v.clearRollback()
+	test()
+	v.addVersionTime(versionTime{uint64(big + 1150), -1})
+	v.addVersionTime(versionTime{uint64(big + 1151), big})
+	test()
+	v.setVersionTrunc(uint64(big + 1200))
+	test()
+	v.addSignedRoot(SignedRoot{Version: uint64(big + 1250), Signature: []byte("sig")})
+	v.addSignedRoot(SignedRoot{Version: uint64(big + 1251)})
+	test()
+	v.addMerkleCheck(merkleCheck{big + 1300, MerkleRepaired, merkle.HashBlock([]byte("table"))})
+	test()
+	v.addJournalChain(journalChainStart{big + 1350, true, JournalChain{uint64(big + 1351), merkle.HashBlock([]byte("journal"))}})
+	v.addJournalChain(journalChainStart{big + 1352, false, JournalChain{uint64(big + 1353), merkle.HashBlock([]byte("journal"))}})
+	test()
+	if !v.setTableVersions(big+301, table.VersionRange{MinVersion: uint64(big + 1400), MaxVersion: uint64(big + 1401), MaxSeq: uint64(big + 1402)}) {
+		t.Fatal("setTableVersions: table not found")
+	}
+	if !v.setTableOrdered(big + 302) {
+		t.Fatal("setTableOrdered: table not found")
+	}
+	test()
+	v.setKeyFormat(dbkey.FormatBytewise)
+	test()
+	if !v.setTableValueLogs(big+301, []int64{big + 1450, big + 1451}) {
+		t.Fatal("setTableValueLogs: table not found")
+	}
+	if !v.setTableNoMerkle(big + 302) {
+		t.Fatal("setTableNoMerkle: table not found")
+	}
 	test()
 }
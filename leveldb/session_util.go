@@ -294,6 +294,14 @@ func (s *session) setVersion(r *sessionRecord, v *version) {
 		s.stVersion.releaseNB()
 	}
 	s.stVersion = v
+
+	maxVersion, unversioned := v.tableVersions()
+	atomic.StoreUint64(&s.stTableVersion, maxVersion)
+	if unversioned {
+		atomic.StoreInt32(&s.stUnversioned, 1)
+	} else {
+		atomic.StoreInt32(&s.stUnversioned, 0)
+	}
 }
 
 // Get current unused file number.
@@ -372,13 +380,54 @@ func (s *session) fillRecord(r *sessionRecord, snapshot bool) {
 			r.setSeqNum(s.stSeqNum)
 		}
 
+		if !r.has(recMaxVersion) {
+			r.setMaxVersion(s.stMaxVersion)
+		}
+
+		if !r.has(recPruneWatermark) && s.stPruneWatermark > 0 {
+			r.setPruneWatermark(s.stPruneWatermark)
+		}
+
+		if !r.has(recRollback) && s.stRollbackPending {
+			r.setRollback(s.stRollback)
+		}
+
 		for level, ik := range s.stCompPtrs {
 			if ik != nil {
 				r.addCompPtr(level, ik)
 			}
 		}
 
+		for _, vt := range s.vtIndex.all() {
+			if !r.has(recVersionTrunc) || vt.version <= r.versionTrunc {
+				r.addVersionTime(vt)
+			}
+		}
+
+		for _, sr := range s.srIndex.all() {
+			if !r.has(recVersionTrunc) || sr.Version <= r.versionTrunc {
+				r.addSignedRoot(sr)
+			}
+		}
+
+	checks:
+		for _, c := range s.mcIndex.all() {
+			for _, dt := range r.deletedTables {
+				if dt.num == c.num {
+					continue checks
+				}
+			}
+			r.addMerkleCheck(c)
+		}
+
+		for _, c := range s.jcIndex.all() {
+			r.addJournalChain(c)
+		}
+
 		r.setComparer(s.icmp.uName())
+		if s.icmp.kf != dbkey.FormatLegacy {
+			r.setKeyFormat(s.icmp.kf)
+		}
 	}
 }
 
@@ -397,9 +446,69 @@ func (s *session) recordCommited(rec *sessionRecord) {
 		s.stSeqNum = rec.seqNum
 	}
 
+	if rec.has(recMaxVersion) {
+		s.stMaxVersion = rec.maxVersion
+	}
+
+	if rec.has(recPruneWatermark) {
+		s.stPruneWatermark = rec.pruneWatermark
+	}
+
+	if rec.has(recRollback) {
+		s.stRollbackPending = rec.rollbackPending
+		s.stRollback = rec.rollback
+	}
+
 	for _, r := range rec.compPtrs {
 		s.setCompPtr(r.level, r.ikey)
 	}
+
+	s.commitVersionTimes(rec)
+	s.commitSignedRoots(rec)
+	s.commitMerkleChecks(rec)
+	s.commitJournalChains(rec)
+}
+
+// Apply the version timestamps of the given record to the index.
+func (s *session) commitVersionTimes(rec *sessionRecord) {
+	if rec.has(recVersionTrunc) {
+		s.vtIndex.truncate(rec.versionTrunc)
+	}
+	for _, vt := range rec.versionTimes {
+		s.vtIndex.add(vt, false)
+	}
+}
+
+// Apply the signed roots of the given record to the index.
+func (s *session) commitSignedRoots(rec *sessionRecord) {
+	if rec.has(recVersionTrunc) {
+		s.srIndex.truncate(rec.versionTrunc)
+	}
+	for _, sr := range rec.signedRoots {
+		s.srIndex.put(sr)
+	}
+}
+
+// Apply the table Merkle checks of the given record to the index, the
+// checks of the deleted tables are dropped.
+func (s *session) commitMerkleChecks(rec *sessionRecord) {
+	for _, dt := range rec.deletedTables {
+		s.mcIndex.remove(dt.num)
+	}
+	for _, c := range rec.merkleChecks {
+		s.mcIndex.put(c)
+	}
+}
+
+// Apply the journal chain heads of the given record to the index, the
+// heads of the journals obsoleted by the record are dropped.
+func (s *session) commitJournalChains(rec *sessionRecord) {
+	if rec.has(recJournalNum) {
+		s.jcIndex.prune(rec.journalNum)
+	}
+	for _, c := range rec.journalChains {
+		s.jcIndex.put(c)
+	}
 }
 
 // Create a new manifest file; need external synchronization.
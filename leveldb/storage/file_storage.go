@@ -628,6 +628,8 @@ func fsGenName(fd FileDesc) string {
 		return fmt.Sprintf("%06d.ldb", fd.Num)
 	case TypeTemp:
 		return fmt.Sprintf("%06d.tmp", fd.Num)
+	case TypeValueLog:
+		return fmt.Sprintf("%06d.vlog", fd.Num)
 	default:
 		panic("invalid file type")
 	}
@@ -657,6 +659,8 @@ func fsParseName(name string) (fd FileDesc, ok bool) {
 			fd.Type = TypeTable
 		case "tmp":
 			fd.Type = TypeTemp
+		case "vlog":
+			fd.Type = TypeValueLog
 		default:
 			return
 		}
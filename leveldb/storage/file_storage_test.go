@@ -29,6 +29,7 @@ var cases = []struct {
 	{nil, "MANIFEST-000007", TypeManifest, 7},
 	{nil, "9223372036854775807.log", TypeJournal, 9223372036854775807},
 	{nil, "000100.tmp", TypeTemp, 100},
+	{nil, "000101.vlog", TypeValueLog, 101},
 }
 
 var invalidCases = []string{
@@ -7,7 +7,6 @@
 package leveldb
 
 import (
-	"bytes"
 	"fmt"
 	"sort"
 	"sync/atomic"
@@ -29,16 +28,34 @@ type tFile struct {
 	seekLeft   int32
 	size       int64
 	imin, imax dbkey.InternalKey
+
+	// The range of the versions of the records, unknown for the tables
+	// written by older releases.
+	versions    table.VersionRange
+	hasVersions bool
+
+	// The value log files the table points to.
+	valueLogs []int64
+
+	// ordered tells that every record of the table was written with a
+	// version not lower than any version written before it, so that none
+	// of the older records of its key, in deeper levels, holds a higher
+	// version. The latest version lookups stop at such records.
+	ordered bool
+
+	// noMerkle tells that the table was written without Merkle tree, see
+	// opt.MerkleDeferred.
+	noMerkle bool
 }
 
 // Returns true if given key is after largest key of this table.
 func (t *tFile) after(icmp *iComparer, ukey []byte) bool {
-	return ukey != nil && icmp.uCompare(ukey, t.imax.UVkey()) > 0
+	return ukey != nil && icmp.uCompare(ukey, icmp.kf.Ukey(t.imax)) > 0
 }
 
 // Returns true if given key is before smallest key of this table.
 func (t *tFile) before(icmp *iComparer, ukey []byte) bool {
-	return ukey != nil && icmp.uCompare(ukey, t.imin.UVkey()) < 0
+	return ukey != nil && icmp.uCompare(ukey, icmp.kf.Ukey(t.imin)) < 0
 }
 
 // Returns true if given key range overlaps with this table key range.
@@ -46,26 +63,15 @@ func (t *tFile) overlaps(icmp *iComparer, umin, umax []byte) bool {
 	return !t.after(icmp, umin) && !t.before(icmp, umax)
 }
 
+// mayHoldVersions returns true if the table may hold records of any version
+// of the given range, which is always the case if its range is unknown.
+func (t *tFile) mayHoldVersions(min, max uint64) bool {
+	return !t.hasVersions || t.versions.Overlaps(min, max)
+}
+
 // overlapsUkey returns true if given pure ukey (without version) overlaps with this table.
-// This extracts the pure ukey from the table's imin/imax for comparison.
 func (t *tFile) overlapsUkey(icmp *iComparer, ukey []byte) bool {
-	if ukey == nil {
-		return true
-	}
-	// Extract pure ukey from imin and imax (format: ukey | version | seq)
-	var iminUkey, imaxUkey []byte
-	if len(t.imin) >= 16 {
-		iminUkey = t.imin[:len(t.imin)-16]
-	} else {
-		iminUkey = t.imin.UVkey()
-	}
-	if len(t.imax) >= 16 {
-		imaxUkey = t.imax[:len(t.imax)-16]
-	} else {
-		imaxUkey = t.imax.UVkey()
-	}
-	// Check if ukey is within range [iminUkey, imaxUkey]
-	return icmp.uCompare(ukey, imaxUkey) <= 0 && icmp.uCompare(ukey, iminUkey) >= 0
+	return ukey == nil || t.overlaps(icmp, ukey, ukey)
 }
 
 // Cosumes one seek and return current seeks left.
@@ -104,7 +110,22 @@ func newTableFile(fd storage.FileDesc, size int64, imin, imax dbkey.InternalKey)
 }
 
 func tableFileFromRecord(r atRecord) *tFile {
-	return newTableFile(storage.FileDesc{Type: storage.TypeTable, Num: r.num}, r.size, r.imin, r.imax)
+	t := newTableFile(storage.FileDesc{Type: storage.TypeTable, Num: r.num}, r.size, r.imin, r.imax)
+	t.versions, t.hasVersions = r.versions, r.hasVersions
+	t.ordered = r.ordered
+	t.valueLogs = r.valueLogs
+	t.noMerkle = r.noMerkle
+	return t
+}
+
+// ordered returns true if every table is ordered, see tFile.
+func (tf tFiles) ordered() bool {
+	for _, t := range tf {
+		if !t.ordered {
+			return false
+		}
+	}
+	return true
 }
 
 // tFiles hold multiple tFile.
@@ -176,7 +197,7 @@ func (tf tFiles) searchNumLess(num int64) int {
 // key is after the given key.
 func (tf tFiles) searchMinUkey(icmp *iComparer, umin []byte) int {
 	return sort.Search(len(tf), func(i int) bool {
-		return icmp.ucmp.Compare(tf[i].imin.UVkey(), umin) > 0
+		return icmp.ucmp.Compare(icmp.kf.Ukey(tf[i].imin), umin) > 0
 	})
 }
 
@@ -184,7 +205,7 @@ func (tf tFiles) searchMinUkey(icmp *iComparer, umin []byte) int {
 // key is after the given key.
 func (tf tFiles) searchMaxUkey(icmp *iComparer, umax []byte) int {
 	return sort.Search(len(tf), func(i int) bool {
-		return icmp.ucmp.Compare(tf[i].imax.UVkey(), umax) > 0
+		return icmp.ucmp.Compare(icmp.kf.Ukey(tf[i].imax), umax) > 0
 	})
 }
 
@@ -204,7 +225,7 @@ func (tf tFiles) overlaps(icmp *iComparer, umin, umax []byte, unsorted bool) boo
 	i := 0
 	if len(umin) > 0 {
 		// Find the earliest possible internal key for min.
-		i = tf.searchMax(icmp, dbkey.MakeInternalKey(nil, umin, dbkey.KeyMaxSeq, dbkey.KeyTypeSeek))
+		i = tf.searchMax(icmp, icmp.kf.MakeInternalKeyWithVersion(nil, umin, dbkey.LastestVersion, dbkey.KeyMaxSeq, dbkey.KeyTypeSeek))
 	}
 	if i >= len(tf) {
 		// Beginning of range is after all files, so no overlap.
@@ -233,7 +254,7 @@ func (tf tFiles) getOverlaps(dst tFiles, icmp *iComparer, umin, umax []byte, ove
 			index := tf.searchMinUkey(icmp, umin)
 			if index == 0 {
 				begin = 0
-			} else if bytes.Compare(tf[index-1].imax.UVkey(), umin) >= 0 {
+			} else if icmp.uCompare(icmp.kf.Ukey(tf[index-1].imax), umin) >= 0 {
 				// The min uvkey overlaps with the index-1 file, expand it.
 				begin = index - 1
 			} else {
@@ -245,7 +266,7 @@ func (tf tFiles) getOverlaps(dst tFiles, icmp *iComparer, umin, umax []byte, ove
 			index := tf.searchMaxUkey(icmp, umax)
 			if index == len(tf) {
 				end = len(tf)
-			} else if bytes.Compare(tf[index].imin.UVkey(), umax) <= 0 {
+			} else if icmp.uCompare(icmp.kf.Ukey(tf[index].imin), umax) <= 0 {
 				// The max uvkey overlaps with the index file, expand it.
 				end = index + 1
 			} else {
@@ -267,13 +288,13 @@ func (tf tFiles) getOverlaps(dst tFiles, icmp *iComparer, umin, umax []byte, ove
 	for i := 0; i < len(tf); {
 		t := tf[i]
 		if t.overlaps(icmp, umin, umax) {
-			if umin != nil && icmp.uCompare(t.imin.UVkey(), umin) < 0 {
-				umin = t.imin.UVkey()
+			if umin != nil && icmp.uCompare(icmp.kf.Ukey(t.imin), umin) < 0 {
+				umin = icmp.kf.Ukey(t.imin)
 				dst = dst[:0]
 				i = 0
 				continue
-			} else if umax != nil && icmp.uCompare(t.imax.UVkey(), umax) > 0 {
-				umax = t.imax.UVkey()
+			} else if umax != nil && icmp.uCompare(icmp.kf.Ukey(t.imax), umax) > 0 {
+				umax = icmp.kf.Ukey(t.imax)
 				// Restart search if it is overlapped.
 				dst = dst[:0]
 				i = 0
@@ -306,8 +327,9 @@ func (tf tFiles) getRange(icmp *iComparer) (imin, imax dbkey.InternalKey) {
 	return
 }
 
-// Creates iterator index from tables.
-func (tf tFiles) newIndexIterator(tops *tOps, icmp *iComparer, slice *util.Range, ro *opt.ReadOptions) iterator.IteratorIndexer {
+// Creates iterator index from tables. The iterators of a raw index return
+// the raw values of the tables, see table.Reader.NewRawIterator.
+func (tf tFiles) newIndexIterator(tops *tOps, icmp *iComparer, slice *util.Range, ro *opt.ReadOptions, raw bool) iterator.IteratorIndexer {
 	if slice != nil {
 		var start, limit int
 		if slice.Start != nil {
@@ -326,6 +348,7 @@ func (tf tFiles) newIndexIterator(tops *tOps, icmp *iComparer, slice *util.Range
 		icmp:   icmp,
 		slice:  slice,
 		ro:     ro,
+		raw:    raw,
 	})
 }
 
@@ -336,6 +359,7 @@ type tFilesArrayIndexer struct {
 	icmp  *iComparer
 	slice *util.Range
 	ro    *opt.ReadOptions
+	raw   bool
 }
 
 func (a *tFilesArrayIndexer) Search(key []byte) int {
@@ -343,10 +367,14 @@ func (a *tFilesArrayIndexer) Search(key []byte) int {
 }
 
 func (a *tFilesArrayIndexer) Get(i int) iterator.Iterator {
-	if i == 0 || i == a.Len()-1 {
-		return a.tops.newIterator(a.tFiles[i], a.slice, a.ro)
+	slice := a.slice
+	if i != 0 && i != a.Len()-1 {
+		slice = nil
+	}
+	if a.raw {
+		return a.tops.newRawIterator(a.tFiles[i], slice, a.ro)
 	}
-	return a.tops.newIterator(a.tFiles[i], nil, a.ro)
+	return a.tops.newIterator(a.tFiles[i], slice, a.ro)
 }
 
 // Helper type for sortByKey.
@@ -376,6 +404,7 @@ type tOps struct {
 	fileCache    *cache.Cache
 	blockCache   *cache.Cache
 	blockBuffer  *util.BufferPool
+	vlog         *vLog
 }
 
 // Creates an empty table and returns table writer.
@@ -385,12 +414,19 @@ func (t *tOps) create(tSize int) (*tWriter, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &tWriter{
-		t:  t,
-		fd: fd,
-		w:  fw,
-		tw: table.NewWriter(fw, t.s.o.Options, t.blockBuffer, tSize),
-	}, nil
+	w := &tWriter{
+		t:      t,
+		fd:     fd,
+		w:      fw,
+		tw:     table.NewWriter(fw, t.s.o.Options, t.blockBuffer, tSize),
+		merkle: t.s.o.GetMerkleMode() == opt.MerkleEager,
+	}
+	w.tw.SetMerklePool(t.s.merklePool)
+	if t.vlog.active() {
+		w.vw = newValueLogWriter(t.vlog)
+		w.tw.SetValueLog(w.vw, t.s.o.GetValueLogThreshold())
+	}
+	return w, nil
 }
 
 // Builds table from src iterator.
@@ -424,6 +460,45 @@ func (t *tOps) createFrom(src iterator.Iterator) (f *tFile, n int, err error) {
 	return
 }
 
+// Rewrites the given table with a Merkle tree, copying its raw records,
+// see opt.MerkleDeferred.
+func (t *tOps) rewriteMerkle(f *tFile, ro *opt.ReadOptions) (nf *tFile, n int, err error) {
+	w, err := t.create(int(f.size))
+	if err != nil {
+		return
+	}
+	w.setMerkle()
+
+	defer func() {
+		if err != nil {
+			if derr := w.drop(); derr != nil {
+				err = fmt.Errorf("error rewriteMerkle (%v); error dropping (%v)", err, derr)
+			}
+		}
+	}()
+
+	iter := t.newRawIterator(f, nil, ro)
+	defer iter.Release()
+	for iter.Next() {
+		err = w.appendRaw(iter.Key(), iter.Value())
+		if err != nil {
+			return
+		}
+	}
+	err = iter.Error()
+	if err != nil {
+		return
+	}
+
+	n = w.tw.EntriesLen()
+	nf, err = w.finish()
+	if err != nil {
+		return
+	}
+	nf.ordered = f.ordered
+	return
+}
+
 // Opens table. It returns a cache handle, which should
 // be released after use.
 func (t *tOps) open(f *tFile) (ch *cache.Handle, err error) {
@@ -445,6 +520,7 @@ func (t *tOps) open(f *tFile) (ch *cache.Handle, err error) {
 			_ = r.Close()
 			return 0, nil
 		}
+		tr.SetValueLog(t.vlog)
 		return 1, tr
 
 	})
@@ -465,7 +541,9 @@ func (t *tOps) find(f *tFile, key []byte, ro *opt.ReadOptions) (rkey, rvalue []b
 	return ch.Value().(*table.Reader).Find(key, true, ro)
 }
 
-// findWithProof finds key/value pair and Merkle proof for the given key
+// findWithProof finds key/value pair and Merkle proof for the given key.
+// If the pair is found without its proof, it is returned along with an
+// *ErrProofUnavailable error.
 func (t *tOps) findWithProof(f *tFile, key []byte, ro *opt.ReadOptions) (rkey, rvalue []byte, proof *merkle.MerkleProof, err error) {
 	ch, err := t.open(f)
 	if err != nil {
@@ -476,13 +554,32 @@ func (t *tOps) findWithProof(f *tFile, key []byte, ro *opt.ReadOptions) (rkey, r
 	// Then get the proof
 	rkey, rvalue, proof, err = ch.Value().(*table.Reader).GetWithProof(key, ro)
 	if err != nil {
-		// If proof generation fails, still return the value
-		// (proof might not be available for all SSTs)
-		return rkey, rvalue, nil, nil
+		if rkey == nil {
+			// Lookup itself failed (e.g. ErrNotFound).
+			return nil, nil, nil, err
+		}
+		// If proof generation fails, still return the value along with
+		// the reason (proof might not be available for all SSTs)
+		return rkey, rvalue, nil, &ErrProofUnavailable{ProofLinkData, fmt.Sprintf("table @%d: %v", f.fd.Num, err)}
+	}
+	if proof == nil {
+		return rkey, rvalue, nil, &ErrProofUnavailable{ProofLinkData, fmt.Sprintf("table @%d has no Merkle tree", f.fd.Num)}
 	}
 	return rkey, rvalue, proof, nil
 }
 
+// multiProof gets the Merkle multiproof of the given records of a table
+// file, and the leaf index of each of them.
+func (t *tOps) multiProof(f *tFile, keys, values [][]byte) (*merkle.MultiProof, []int, error) {
+	ch, err := t.open(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer ch.Release()
+
+	return ch.Value().(*table.Reader).GetMultiProof(keys, values)
+}
+
 // getMerkleRoot gets the Merkle root hash from a table file
 func (t *tOps) getMerkleRoot(f *tFile) (merkle.Hash, error) {
 	ch, err := t.open(f)
@@ -494,14 +591,40 @@ func (t *tOps) getMerkleRoot(f *tFile) (merkle.Hash, error) {
 	return ch.Value().(*table.Reader).GetMerkleRoot()
 }
 
-// Finds key that is greater than or equal to the given key.
-func (t *tOps) findKey(f *tFile, key []byte, ro *opt.ReadOptions) (rkey []byte, err error) {
+// verifyMerkle checks the Merkle tree of a table file against its data
+// blocks, see table.Reader.VerifyMerkle.
+func (t *tOps) verifyMerkle(f *tFile, ro *opt.ReadOptions) (*table.MerkleVerification, error) {
 	ch, err := t.open(f)
 	if err != nil {
 		return nil, err
 	}
 	defer ch.Release()
-	return ch.Value().(*table.Reader).FindKey(key, true, ro)
+
+	return ch.Value().(*table.Reader).VerifyMerkle(ro)
+}
+
+// Finds key that is greater than or equal to the given key. The key must
+// be an exact match if filtered is set, see table.Reader.FindKey.
+func (t *tOps) findKey(f *tFile, key []byte, filtered bool, ro *opt.ReadOptions) (rkey []byte, err error) {
+	ch, err := t.open(f)
+	if err != nil {
+		return nil, err
+	}
+	defer ch.Release()
+	return ch.Value().(*table.Reader).FindKey(key, filtered, ro)
+}
+
+// mayContain reports whether the table file may hold records of the given
+// user key, as told by its filter. Errors are left to the reads of the
+// table, which report true.
+func (t *tOps) mayContain(f *tFile, ukey []byte) bool {
+	ch, err := t.open(f)
+	if err != nil {
+		return true
+	}
+	defer ch.Release()
+	ok, err := ch.Value().(*table.Reader).MayContain(ukeyProbe(t.s.icmp.kf, ukey))
+	return ok || err != nil
 }
 
 // Returns approximate offset of the given key.
@@ -525,6 +648,18 @@ func (t *tOps) newIterator(f *tFile, slice *util.Range, ro *opt.ReadOptions) ite
 	return iter
 }
 
+// Creates an iterator from the given table, returning its raw values, see
+// table.Reader.NewRawIterator.
+func (t *tOps) newRawIterator(f *tFile, slice *util.Range, ro *opt.ReadOptions) iterator.Iterator {
+	ch, err := t.open(f)
+	if err != nil {
+		return iterator.NewEmptyIterator(err)
+	}
+	iter := ch.Value().(*table.Reader).NewRawIterator(slice, ro)
+	iter.SetReleaser(ch)
+	return iter
+}
+
 // Removes table from persistent storage. It waits until
 // no one use the the table.
 func (t *tOps) remove(fd storage.FileDesc) {
@@ -537,11 +672,22 @@ func (t *tOps) remove(fd storage.FileDesc) {
 		if t.evictRemoved && t.blockCache != nil {
 			t.blockCache.EvictNS(uint64(fd.Num))
 		}
+		t.vlog.removeTable(fd.Num)
 		// Try to reuse file num, useful for discarded transaction.
 		t.s.reuseFileNum(fd.Num)
 	})
 }
 
+// Removes a table built by a reverted compaction, dropping its references
+// to the value log files along.
+func (t *tOps) revert(fd storage.FileDesc) error {
+	if err := t.s.stor.Remove(fd); err != nil {
+		return err
+	}
+	t.vlog.removeTable(fd.Num)
+	return nil
+}
+
 // Closes the table ops instance. It will close all tables,
 // regadless still used or not.
 func (t *tOps) close() {
@@ -549,6 +695,7 @@ func (t *tOps) close() {
 	if t.blockCache != nil {
 		t.blockCache.Close(false)
 	}
+	t.vlog.close()
 }
 
 // Creates new initialized table ops instance.
@@ -578,6 +725,7 @@ func newTableOps(s *session) *tOps {
 		fileCache:    cache.NewCache(fileCacher),
 		blockCache:   blockCache,
 		blockBuffer:  blockBuffer,
+		vlog:         newValueLog(s),
 	}
 }
 
@@ -589,10 +737,19 @@ type tWriter struct {
 	fd storage.FileDesc
 	w  storage.Writer
 	tw *table.Writer
+	vw *vLogWriter // the value log of the values split out, if any
 
+	merkle      bool // whether the Merkle tree of the table is built
 	first, last []byte
 }
 
+// Builds the Merkle tree of the table, whatever the opt.MerkleMode. It must
+// be called before any append.
+func (w *tWriter) setMerkle() {
+	w.tw.SetMerkle(true)
+	w.merkle = true
+}
+
 // Append key/value pair to the table.
 func (w *tWriter) append(key, value []byte) error {
 	if w.first == nil {
@@ -602,6 +759,25 @@ func (w *tWriter) append(key, value []byte) error {
 	return w.tw.Append(key, value)
 }
 
+// Append key and raw value to the table, see table.Writer.AppendRaw. The
+// values of the collected value log files are relocated.
+func (w *tWriter) appendRaw(key, raw []byte) error {
+	if w.vw != nil {
+		if p, ok := table.RawValuePointer(raw); ok && p.Num < w.vw.gcBelow {
+			value, err := w.t.vlog.Read(p)
+			if err != nil {
+				return err
+			}
+			return w.append(key, value)
+		}
+	}
+	if w.first == nil {
+		w.first = append([]byte(nil), key...)
+	}
+	w.last = append(w.last[:0], key...)
+	return w.tw.AppendRaw(key, raw)
+}
+
 // Returns true if the table is empty.
 func (w *tWriter) empty() bool {
 	return w.first == nil
@@ -633,6 +809,12 @@ func (w *tWriter) finish() (f *tFile, err error) {
 	if err != nil {
 		return
 	}
+	// The values must be durable along the table.
+	if w.vw != nil {
+		if err = w.vw.finish(w.t.noSync); err != nil {
+			return
+		}
+	}
 	if !w.t.noSync {
 		err = w.w.Sync()
 		if err != nil {
@@ -640,6 +822,13 @@ func (w *tWriter) finish() (f *tFile, err error) {
 		}
 	}
 	f = newTableFile(w.fd, int64(w.tw.BytesLen()), w.first, w.last)
+	f.versions, f.hasVersions = w.tw.VersionRange()
+	f.valueLogs = w.tw.ValueLogs()
+	f.noMerkle = !w.merkle
+	w.t.vlog.addTable(f)
+	if w.vw != nil {
+		w.vw.commit()
+	}
 	return
 }
 
@@ -651,6 +840,11 @@ func (w *tWriter) drop() error {
 	w.tw = nil
 	w.first = nil
 	w.last = nil
+	if w.vw != nil {
+		if err := w.vw.drop(); err != nil {
+			return err
+		}
+	}
 	if err := w.t.s.stor.Remove(w.fd); err != nil {
 		return err
 	}
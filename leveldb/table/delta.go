@@ -0,0 +1,129 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package table
+
+import (
+	"encoding/binary"
+)
+
+// The tags of the values of the data blocks written with delta values or
+// value pointers.
+// These constants are part of the file format and should not be changed.
+const (
+	valueFull    = 0 // the value follows
+	valueDelta   = 1 // a delta against the value of the preceding entry follows
+	valuePointer = 2 // a pointer to the value in a value log follows
+)
+
+// The kinds of the delta ops, held by the low two bits of their uvarint
+// header, the high bits holding their length.
+const (
+	deltaCopy   = 0 // copy n bytes of the base
+	deltaInsert = 1 // insert the n bytes following the header
+	deltaSkip   = 2 // skip n bytes of the base
+)
+
+// deltaMinCopy is the shortest run of unchanged bytes copied from the base
+// within the changed range of values of the same length; the shorter runs
+// are inserted along with the changes around them.
+const deltaMinCopy = 8
+
+func appendDeltaOp(dst []byte, kind, n int) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	m := binary.PutUvarint(buf[:], uint64(n)<<2|uint64(kind))
+	return append(dst, buf[:m]...)
+}
+
+// appendDeltaChange appends the ops replacing skip bytes of the base with
+// the given bytes.
+func appendDeltaChange(dst, insert []byte, skip int) []byte {
+	if len(insert) > 0 {
+		dst = appendDeltaOp(dst, deltaInsert, len(insert))
+		dst = append(dst, insert...)
+	}
+	if skip > 0 {
+		dst = appendDeltaOp(dst, deltaSkip, skip)
+	}
+	return dst
+}
+
+// appendDelta appends to dst the ops building value from base. It copies
+// their common prefix and suffix; in between, the values of the same length
+// are diffed byte by byte, the others replaced as a whole.
+func appendDelta(dst, base, value []byte) []byte {
+	prefix := 0
+	for prefix < len(base) && prefix < len(value) && base[prefix] == value[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(base)-prefix && suffix < len(value)-prefix &&
+		base[len(base)-1-suffix] == value[len(value)-1-suffix] {
+		suffix++
+	}
+	if prefix > 0 {
+		dst = appendDeltaOp(dst, deltaCopy, prefix)
+	}
+	b, v := base[prefix:len(base)-suffix], value[prefix:len(value)-suffix]
+	if len(b) == len(v) {
+		changed := 0 // start of the pending change
+		for i := 0; i < len(v); {
+			j := i
+			for j < len(v) && b[j] == v[j] {
+				j++
+			}
+			if j-i >= deltaMinCopy {
+				dst = appendDeltaChange(dst, v[changed:i], i-changed)
+				dst = appendDeltaOp(dst, deltaCopy, j-i)
+				changed = j
+			}
+			i = j + 1
+		}
+		dst = appendDeltaChange(dst, v[changed:], len(v)-changed)
+	} else {
+		dst = appendDeltaChange(dst, v, len(b))
+	}
+	if suffix > 0 {
+		dst = appendDeltaOp(dst, deltaCopy, suffix)
+	}
+	return dst
+}
+
+// applyDelta appends to dst the value built by the delta ops from base. It
+// reports false if the ops are malformed or run past the base.
+func applyDelta(dst, base, delta []byte) ([]byte, bool) {
+	pos := 0
+	for len(delta) > 0 {
+		op, m := binary.Uvarint(delta)
+		if m <= 0 {
+			return nil, false
+		}
+		delta = delta[m:]
+		n := op >> 2
+		switch op & 3 {
+		case deltaCopy:
+			if n > uint64(len(base)-pos) {
+				return nil, false
+			}
+			dst = append(dst, base[pos:pos+int(n)]...)
+			pos += int(n)
+		case deltaInsert:
+			if n > uint64(len(delta)) {
+				return nil, false
+			}
+			dst = append(dst, delta[:n]...)
+			delta = delta[n:]
+		case deltaSkip:
+			if n > uint64(len(base)-pos) {
+				return nil, false
+			}
+			pos += int(n)
+		default:
+			return nil, false
+		}
+	}
+	return dst, true
+}
@@ -15,10 +15,10 @@ import (
 	"sync"
 
 	"github.com/golang/snappy"
-	"github.com/syndtr/goleveldb/leveldb/dbkey"
 
 	"github.com/syndtr/goleveldb/leveldb/cache"
 	"github.com/syndtr/goleveldb/leveldb/comparer"
+	"github.com/syndtr/goleveldb/leveldb/dbkey"
 	"github.com/syndtr/goleveldb/leveldb/errors"
 	"github.com/syndtr/goleveldb/leveldb/filter"
 	"github.com/syndtr/goleveldb/leveldb/iterator"
@@ -484,12 +484,88 @@ func (b *filterBlock) Release() {
 	b.data = nil
 }
 
+// valueIter is a data block iterator returning the values of the tables
+// with value pointers, the pointed ones read from the value logs, or the
+// raw values, see Reader.NewRawIterator.
+type valueIter struct {
+	*blockIter
+	tr  *Reader
+	raw bool
+
+	value  []byte
+	loaded bool
+	err    error
+}
+
+func (i *valueIter) First() bool {
+	i.loaded = false
+	return i.err == nil && i.blockIter.First()
+}
+
+func (i *valueIter) Last() bool {
+	i.loaded = false
+	return i.err == nil && i.blockIter.Last()
+}
+
+func (i *valueIter) Seek(key []byte) bool {
+	i.loaded = false
+	return i.err == nil && i.blockIter.Seek(key)
+}
+
+func (i *valueIter) Next() bool {
+	i.loaded = false
+	return i.err == nil && i.blockIter.Next()
+}
+
+func (i *valueIter) Prev() bool {
+	i.loaded = false
+	return i.err == nil && i.blockIter.Prev()
+}
+
+func (i *valueIter) Value() []byte {
+	if i.err != nil {
+		return nil
+	}
+	value := i.blockIter.Value()
+	if value == nil {
+		return nil
+	} else if i.loaded {
+		return i.value
+	}
+	switch {
+	case i.raw && i.tr.valuePointers:
+		i.value = value
+	case i.raw:
+		i.value = append(append(i.value[:0], valueFull), value...)
+	case len(value) > 0 && value[0] == valueFull:
+		i.value = value[1:]
+	case len(value) > 0 && value[0] == valuePointer:
+		i.value, i.err = i.tr.readValue(i.block.bh, value[1:])
+	default:
+		i.err = i.tr.newErrCorruptedBH(i.block.bh, "untagged value")
+	}
+	i.loaded = i.err == nil
+	return i.value
+}
+
+func (i *valueIter) Valid() bool {
+	return i.err == nil && i.blockIter.Valid()
+}
+
+func (i *valueIter) Error() error {
+	if i.err != nil {
+		return i.err
+	}
+	return i.blockIter.Error()
+}
+
 type indexIter struct {
 	*blockIter
 	tr    *Reader
 	slice *util.Range
 	// Options
 	fillCache bool
+	raw       bool
 }
 
 func (i *indexIter) Get() iterator.Iterator {
@@ -506,7 +582,7 @@ func (i *indexIter) Get() iterator.Iterator {
 	if i.slice != nil && (i.blockIter.isFirst() || i.blockIter.isLast()) {
 		slice = i.slice
 	}
-	return i.tr.getDataIterErr(dataBH, slice, i.tr.verifyChecksum, i.fillCache)
+	return i.tr.getDataIterErr(dataBH, slice, i.tr.verifyChecksum, i.fillCache, i.raw)
 }
 
 // Reader is a table reader.
@@ -529,9 +605,19 @@ type Reader struct {
 	filterBlock               *filterBlock
 
 	// Merkle tree support
-	merkleBH      blockHandle
-	merkleTree    *merkle.CompactTreeFormat
-	merkleEnabled bool
+	merkleBH         blockHandle
+	merkleTree       *merkle.CompactTreeFormat
+	merkleEnabled    bool
+	merkleLeafFormat merkle.LeafFormat
+	keyFormat        dbkey.Format
+
+	versions    VersionRange
+	hasVersions bool
+
+	deltaValues   bool
+	valuePointers bool
+	valueLog      ValueLogReader
+	valueLogs     valueLogs
 }
 
 func (r *Reader) blockKind(bh blockHandle) string {
@@ -611,6 +697,11 @@ func (r *Reader) readBlock(bh blockHandle, verifyChecksum bool) (*block, error)
 	if err != nil {
 		return nil, err
 	}
+	if r.deltaValues && bh.offset != r.metaBH.offset && bh.offset != r.indexBH.offset {
+		if data, err = r.expandValues(bh, data); err != nil {
+			return nil, err
+		}
+	}
 	restartsLen := int(binary.LittleEndian.Uint32(data[len(data)-4:]))
 	b := &block{
 		bpool:          r.bpool,
@@ -622,6 +713,98 @@ func (r *Reader) readBlock(bh blockHandle, verifyChecksum bool) (*block, error)
 	return b, nil
 }
 
+// expandValues rewrites the given data block of delta encoded values into
+// a block of the full values, and releases it. The values are left tagged
+// if the table has value pointers.
+func (r *Reader) expandValues(bh blockHandle, data []byte) ([]byte, error) {
+	defer r.bpool.Put(data)
+	if len(data) < 4 {
+		return nil, r.newErrCorruptedBH(bh, "block too short")
+	}
+	restartsLen := int(binary.LittleEndian.Uint32(data[len(data)-4:]))
+	b := &block{
+		data:           data,
+		restartsLen:    restartsLen,
+		restartsOffset: len(data) - (restartsLen+1)*4,
+	}
+	if restartsLen == 0 || b.restartsOffset < 0 {
+		return nil, r.newErrCorruptedBH(bh, "bad restarts")
+	}
+
+	var (
+		dst       = r.bpool.Get(len(data))[:0]
+		restarts  = make([]uint32, 0, restartsLen)
+		tmp       [3 * binary.MaxVarintLen64]byte
+		prev, val []byte
+	)
+	for offset := 0; ; {
+		for len(restarts) < restartsLen && b.restartOffset(len(restarts)) == offset {
+			restarts = append(restarts, uint32(len(dst)))
+		}
+		key, value, nShared, n, err := b.entry(offset)
+		if err != nil {
+			return nil, r.fixErrCorruptedBH(bh, err)
+		}
+		if n == 0 {
+			break
+		}
+		if len(value) == 0 {
+			return nil, r.newErrCorruptedBH(bh, "untagged value")
+		}
+		// The values which may be pointers stay tagged.
+		val = val[:0]
+		if r.valuePointers {
+			val = append(val, valueFull)
+		}
+		switch {
+		case value[0] == valueFull:
+			val = append(val, value[1:]...)
+		case value[0] == valueDelta:
+			var ok bool
+			if val, ok = applyDelta(val, prev, value[1:]); !ok || prev == nil {
+				return nil, r.newErrCorruptedBH(bh, "bad value delta")
+			}
+		case value[0] == valuePointer && r.valuePointers:
+			val = append(val[:0], value...)
+		default:
+			return nil, r.newErrCorruptedBH(bh, fmt.Sprintf("unknown value tag %#x", value[0]))
+		}
+		m := binary.PutUvarint(tmp[:], uint64(nShared))
+		m += binary.PutUvarint(tmp[m:], uint64(len(key)))
+		m += binary.PutUvarint(tmp[m:], uint64(len(val)))
+		dst = append(append(append(dst, tmp[:m]...), key...), val...)
+		if prev = nil; !r.valuePointers || val[0] != valuePointer {
+			prev = dst[len(dst)-len(val):]
+			if r.valuePointers {
+				prev = prev[1:]
+			}
+		}
+		offset += n
+	}
+	if len(restarts) != restartsLen {
+		return nil, r.newErrCorruptedBH(bh, "restart points not aligned")
+	}
+	for _, restart := range restarts {
+		binary.LittleEndian.PutUint32(tmp[:], restart)
+		dst = append(dst, tmp[:4]...)
+	}
+	binary.LittleEndian.PutUint32(tmp[:], uint32(restartsLen))
+	return append(dst, tmp[:4]...), nil
+}
+
+// readValue reads the value at the given encoded pointer, held by the data
+// block of the given handle.
+func (r *Reader) readValue(bh blockHandle, src []byte) ([]byte, error) {
+	p, ok := decodeValuePointer(src)
+	if !ok {
+		return nil, r.newErrCorruptedBH(bh, "bad value pointer")
+	}
+	if r.valueLog == nil {
+		return nil, errors.New("leveldb/table: no value log")
+	}
+	return r.valueLog.Read(p)
+}
+
 func (r *Reader) readBlockCached(bh blockHandle, verifyChecksum, fillCache bool) (*block, util.Releaser, error) {
 	if r.cache != nil {
 		var (
@@ -768,15 +951,19 @@ func (r *Reader) newBlockIter(b *block, bReleaser util.Releaser, slice *util.Ran
 	return bi
 }
 
-func (r *Reader) getDataIter(dataBH blockHandle, slice *util.Range, verifyChecksum, fillCache bool) iterator.Iterator {
+func (r *Reader) getDataIter(dataBH blockHandle, slice *util.Range, verifyChecksum, fillCache, raw bool) iterator.Iterator {
 	b, rel, err := r.readBlockCached(dataBH, verifyChecksum, fillCache)
 	if err != nil {
 		return iterator.NewEmptyIterator(err)
 	}
-	return r.newBlockIter(b, rel, slice, false)
+	bi := r.newBlockIter(b, rel, slice, false)
+	if raw || r.valuePointers {
+		return &valueIter{blockIter: bi, tr: r, raw: raw}
+	}
+	return bi
 }
 
-func (r *Reader) getDataIterErr(dataBH blockHandle, slice *util.Range, verifyChecksum, fillCache bool) iterator.Iterator {
+func (r *Reader) getDataIterErr(dataBH blockHandle, slice *util.Range, verifyChecksum, fillCache, raw bool) iterator.Iterator {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
@@ -784,7 +971,7 @@ func (r *Reader) getDataIterErr(dataBH blockHandle, slice *util.Range, verifyChe
 		return iterator.NewEmptyIterator(r.err)
 	}
 
-	return r.getDataIter(dataBH, slice, verifyChecksum, fillCache)
+	return r.getDataIter(dataBH, slice, verifyChecksum, fillCache, raw)
 }
 
 // NewIterator creates an iterator from the table.
@@ -803,6 +990,18 @@ func (r *Reader) getDataIterErr(dataBH blockHandle, slice *util.Range, verifyChe
 //
 // Also read Iterator documentation of the leveldb/iterator package.
 func (r *Reader) NewIterator(slice *util.Range, ro *opt.ReadOptions) iterator.Iterator {
+	return r.newIterator(slice, ro, false)
+}
+
+// NewRawIterator is like NewIterator, but the iterator returns the raw
+// values: the values stored in a value log are returned as their pointer,
+// without being read. The raw values are opaque, and meant to be appended
+// to another table by Writer.AppendRaw.
+func (r *Reader) NewRawIterator(slice *util.Range, ro *opt.ReadOptions) iterator.Iterator {
+	return r.newIterator(slice, ro, true)
+}
+
+func (r *Reader) newIterator(slice *util.Range, ro *opt.ReadOptions, raw bool) iterator.Iterator {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
@@ -820,6 +1019,7 @@ func (r *Reader) NewIterator(slice *util.Range, ro *opt.ReadOptions) iterator.It
 		tr:        r,
 		slice:     slice,
 		fillCache: !ro.GetDontFillCache(),
+		raw:       raw,
 	}
 	return iterator.NewIndexedIterator(index, opt.GetStrict(r.o, ro, opt.StrictReader))
 }
@@ -869,7 +1069,7 @@ func (r *Reader) find(key []byte, filtered bool, ro *opt.ReadOptions, noValue bo
 		}
 	}
 
-	data := r.getDataIter(dataBH, nil, r.verifyChecksum, !ro.GetDontFillCache())
+	data := r.getDataIter(dataBH, nil, r.verifyChecksum, !ro.GetDontFillCache(), false)
 	if !data.Seek(key) {
 		data.Release()
 		if err = data.Error(); err != nil {
@@ -890,7 +1090,7 @@ func (r *Reader) find(key []byte, filtered bool, ro *opt.ReadOptions, noValue bo
 			return nil, nil, r.err
 		}
 
-		data = r.getDataIter(dataBH, nil, r.verifyChecksum, !ro.GetDontFillCache())
+		data = r.getDataIter(dataBH, nil, r.verifyChecksum, !ro.GetDontFillCache(), false)
 		if !data.Next() {
 			data.Release()
 			if err = data.Error(); err == nil {
@@ -910,11 +1110,81 @@ func (r *Reader) find(key []byte, filtered bool, ro *opt.ReadOptions, noValue bo
 			// recycled, it need to be copied.
 			value = append([]byte(nil), data.Value()...)
 		}
+		// The value may be read from a value log.
+		if err = data.Error(); err != nil {
+			rkey, value = nil, nil
+		}
 	}
 	data.Release()
 	return
 }
 
+// SetValueLog sets the value log reading the values stored out of the
+// table. It must be called before any read.
+func (r *Reader) SetValueLog(vl ValueLogReader) {
+	r.valueLog = vl
+}
+
+// ValueLogs returns the numbers of the value log files pointed to by the
+// table, in increasing order.
+func (r *Reader) ValueLogs() []int64 {
+	return r.valueLogs
+}
+
+// VersionRange returns the range of the versions of the records of the
+// table. It reports false if the table doesn't record it, as tables
+// written by older releases, or tables of unversioned keys.
+func (r *Reader) VersionRange() (VersionRange, bool) {
+	return r.versions, r.hasVersions
+}
+
+// MayContain reports whether the table may contain the given key, as told
+// by the 'filter data' of the nearest 'block', without reading the 'block'
+// itself. It reports true if the table has no 'filter data', and false if
+// the table holds no key greater than or equal to the given key.
+//
+// It is safe to modify the contents of the argument after MayContain
+// returns.
+func (r *Reader) MayContain(key []byte) (bool, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.err != nil {
+		return false, r.err
+	}
+
+	indexBlock, rel, err := r.getIndexBlock(true)
+	if err != nil {
+		return false, err
+	}
+	defer rel.Release()
+
+	index := r.newBlockIter(indexBlock, nil, nil, true)
+	defer index.Release()
+
+	if !index.Seek(key) {
+		return false, index.Error()
+	}
+	if r.filter == nil {
+		return true, nil
+	}
+
+	dataBH, n := decodeBlockHandle(index.Value())
+	if n == 0 {
+		r.err = r.newErrCorruptedBH(r.indexBH, "bad data block handle")
+		return false, r.err
+	}
+	filterBlock, frel, err := r.getFilterBlock(true)
+	if err != nil {
+		if errors.IsCorrupted(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	defer frel.Release()
+	return filterBlock.contains(r.filter, dataBH.offset, key), nil
+}
+
 // Find finds key/value pair whose key is greater than or equal to the
 // given key. It returns ErrNotFound if the table doesn't contain
 // such pair.
@@ -1070,6 +1340,42 @@ func (r *Reader) GetWithProof(key []byte, ro *opt.ReadOptions) (rkey, value []by
 	return rkey, value, proof, nil
 }
 
+// GetMultiProof returns the Merkle multiproof of the given records, as
+// found by Find, and the leaf index of each of them. The records must be
+// distinct.
+func (r *Reader) GetMultiProof(keys, values [][]byte) (proof *merkle.MultiProof, leafIndices []int, err error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.err != nil {
+		return nil, nil, r.err
+	}
+	if !r.merkleEnabled {
+		return nil, nil, errors.New("leveldb/table: merkle tree not enabled")
+	}
+	if err := r.loadMerkleTree(); err != nil {
+		return nil, nil, err
+	}
+
+	leafHashes := make([]merkle.Hash, len(keys))
+	for i := range keys {
+		leafHashes[i] = merkleLeafHash(r.merkleLeafFormat, r.keyFormat, keys[i], values[i])
+	}
+	if leafIndices, err = r.merkleTree.LeafIndices(leafHashes); err != nil {
+		return nil, nil, err
+	}
+	if proof, err = r.merkleTree.GenerateMultiProof(leafIndices); err != nil {
+		return nil, nil, err
+	}
+	proof.LeafFormat = r.merkleLeafFormat
+	return proof, leafIndices, nil
+}
+
+// HasMerkle returns true if the table has a Merkle tree.
+func (r *Reader) HasMerkle() bool {
+	return r.merkleEnabled
+}
+
 // GetMerkleRoot returns the Merkle root hash of this table
 func (r *Reader) GetMerkleRoot() (merkle.Hash, error) {
 	r.mu.RLock()
@@ -1092,6 +1398,92 @@ func (r *Reader) GetMerkleRoot() (merkle.Hash, error) {
 	return r.merkleTree.GetRoot(), nil
 }
 
+// MerkleState is the state of the Merkle tree of a table, as found by
+// Reader.VerifyMerkle.
+type MerkleState int
+
+const (
+	// MerkleValid means the tree matches the data blocks.
+	MerkleValid MerkleState = iota
+	// MerkleMissing means the table has no tree, e.g. it was written by an
+	// upstream goleveldb.
+	MerkleMissing
+	// MerkleCorrupted means the tree is unreadable or doesn't match the
+	// data blocks.
+	MerkleCorrupted
+)
+
+// MerkleVerification is the result of Reader.VerifyMerkle.
+type MerkleVerification struct {
+	State MerkleState
+	// Root is the root computed from the data blocks
+	Root merkle.Hash
+	// First and Last are the first and last keys of the table
+	First, Last []byte
+	Entries     int
+}
+
+// VerifyMerkle checks the Merkle tree of the table against its data blocks:
+// the tree leaves must be the leaf hashes of the records, in order, and the
+// tree root the root of these leaves. The returned error is a failure to
+// read the data blocks, a bad tree is reported by the state.
+func (r *Reader) VerifyMerkle(ro *opt.ReadOptions) (*MerkleVerification, error) {
+	r.mu.RLock()
+	if r.err != nil {
+		r.mu.RUnlock()
+		return nil, r.err
+	}
+	enabled, format := r.merkleEnabled, r.merkleLeafFormat
+	var lerr error
+	if enabled {
+		lerr = r.loadMerkleTree()
+	}
+	tree := r.merkleTree
+	r.mu.RUnlock()
+
+	var (
+		mv     = &MerkleVerification{}
+		leaves []merkle.Hash
+	)
+	iter := r.NewIterator(nil, ro)
+	for iter.Next() {
+		if mv.First == nil {
+			mv.First = append([]byte(nil), iter.Key()...)
+		}
+		leaves = append(leaves, merkleLeafHash(format, r.keyFormat, iter.Key(), iter.Value()))
+	}
+	if iter.Last() {
+		mv.Last = append([]byte(nil), iter.Key()...)
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	mv.Root = merkle.BuildTreeFromHashes(leaves)
+	mv.Entries = len(leaves)
+
+	switch {
+	case !enabled:
+		mv.State = MerkleMissing
+	case lerr != nil:
+		if !errors.IsCorrupted(lerr) {
+			return nil, lerr
+		}
+		mv.State = MerkleCorrupted
+	case tree == nil || len(tree.LeafHashes) != len(leaves) || !tree.RootHash.Equal(mv.Root):
+		mv.State = MerkleCorrupted
+	default:
+		mv.State = MerkleValid
+		for i, leaf := range leaves {
+			if !tree.LeafHashes[i].Equal(leaf) {
+				mv.State = MerkleCorrupted
+				break
+			}
+		}
+	}
+	return mv, nil
+}
+
 // generateProofForKey generates a Merkle proof for a specific key
 // This is a simplified version that creates a proof based on the stored tree structure
 func (r *Reader) generateProofForKey(key, value []byte) (*merkle.MerkleProof, error) {
@@ -1104,8 +1496,10 @@ func (r *Reader) generateProofForKey(key, value []byte) (*merkle.MerkleProof, er
 	// 2. Using the tree structure to build the path to root
 
 	// Create a proof structure
-	uvkey, _, _, _ := dbkey.ParseInternalKey(key)
-	proof, _ := r.merkleTree.GenerateProofByHash(merkle.HashLeaf(uvkey, value))
+	proof, _ := r.merkleTree.GenerateProofByHash(merkleLeafHash(r.merkleLeafFormat, r.keyFormat, key, value))
+	if proof != nil {
+		proof.LeafFormat = r.merkleLeafFormat
+	}
 
 	return proof, nil
 }
@@ -1153,6 +1547,7 @@ func NewReader(f io.ReaderAt, size int64, fd storage.FileDesc, cache *cache.Name
 		o:              o,
 		cmp:            o.GetComparer(),
 		verifyChecksum: o.GetStrict(opt.StrictBlockChecksum),
+		keyFormat:      keyFormat(o),
 	}
 
 	if size < footerLen {
@@ -1203,8 +1598,50 @@ func NewReader(f io.ReaderAt, size int64, fd storage.FileDesc, cache *cache.Name
 	for metaIter.Next() {
 		key := string(metaIter.Key())
 
+		// Check for Merkle leaf format
+		if key == merkleLeafKey {
+			format, n := binary.Uvarint(metaIter.Value())
+			if n <= 0 || !merkle.LeafFormat(format).Known() {
+				r.err = r.newErrCorruptedBH(r.metaBH, "unknown merkle leaf format")
+				break
+			}
+			r.merkleLeafFormat = merkle.LeafFormat(format)
+			continue
+		}
+
+		if key == valuesKey {
+			encoding, n := binary.Uvarint(metaIter.Value())
+			if n <= 0 || encoding&^(valueEncodingDelta|valueEncodingPointers) != 0 {
+				r.err = r.newErrCorruptedBH(r.metaBH, "unknown value encoding")
+				break
+			}
+			r.deltaValues = encoding&valueEncodingDelta != 0
+			r.valuePointers = encoding&valueEncodingPointers != 0
+			continue
+		}
+
+		if key == valueLogsKey {
+			vls, ok := decodeValueLogs(metaIter.Value())
+			if !ok {
+				r.err = r.newErrCorruptedBH(r.metaBH, "bad value logs")
+				break
+			}
+			r.valueLogs = vls
+			continue
+		}
+
+		if key == versionsKey {
+			vr, ok := decodeVersionRange(metaIter.Value())
+			if !ok {
+				r.err = r.newErrCorruptedBH(r.metaBH, "bad version range")
+				break
+			}
+			r.versions, r.hasVersions = vr, true
+			continue
+		}
+
 		// Check for Merkle tree block
-		if key == "merkle.tree" {
+		if key == merkleTreeKey {
 			merkleBH, n := decodeBlockHandle(metaIter.Value())
 			if n > 0 {
 				r.merkleBH = merkleBH
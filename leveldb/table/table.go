@@ -9,6 +9,10 @@ package table
 
 import (
 	"encoding/binary"
+
+	"github.com/syndtr/goleveldb/leveldb/dbkey"
+	"github.com/syndtr/goleveldb/leveldb/merkle"
+	"github.com/syndtr/goleveldb/leveldb/opt"
 )
 
 /*
@@ -52,6 +56,37 @@ Table footer:
 
     The magic are first 64-bit of SHA-1 sum of "http://code.google.com/p/leveldb/".
 
+Merkle tree:
+
+    A table written with a Merkle tree has a "merkle.tree" metaindex entry
+    holding the handle of the serialized tree, with a leaf per record. The
+    "merkle.leaf" metaindex entry holds the uvarint encoded leaf format, see
+    merkle.LeafFormat; tables without it use merkle.LeafFormatLegacy.
+
+Versions:
+
+    A table of versioned internal keys has a "versions" metaindex entry
+    holding the uvarint encoded lowest and highest versions of the records,
+    followed by their highest sequence number, see VersionRange.
+
+Values:
+
+    A table written with delta values or value pointers has a "values"
+    metaindex entry holding the uvarint encoded flags of the encoding: 1 for
+    the delta values, 2 for the value pointers. The value of every entry of
+    its data blocks is then prefixed with a tag byte: 0 if the full value
+    follows, 1 if a delta against the full value of the preceding entry of
+    the block follows, 2 if a pointer to the value in a value log file
+    follows. The delta is a sequence of ops, each a uvarint header
+    n<<2|kind: 0 copies the next n bytes of the base, 1 inserts the n bytes
+    following the header, 2 skips the next n bytes of the base. Only the
+    entries which are not restart points, and follow a version of the same
+    user key, are delta encoded. The pointer is the uvarint encoded number
+    of the file, offset and length of the value, followed by the SHA-256
+    hash of the value, which the Merkle leaves of the table commit to, see
+    merkle.LeafFormatValueHash. The "values.logs" metaindex entry holds the
+    uvarint encoded count and numbers of the files pointed to.
+
 NOTE: All fixed-length integer are little-endian.
 */
 
@@ -151,6 +186,22 @@ const (
 	// These constants are part of the file format and should not be changed.
 	blockTypeNoCompression     = 0
 	blockTypeSnappyCompression = 1
+
+	// Metaindex keys of the Merkle tree.
+	merkleTreeKey = "merkle.tree"
+	merkleLeafKey = "merkle.leaf"
+
+	// Metaindex key of the version range of the records.
+	versionsKey = "versions"
+
+	// Metaindex key of the encoding of the values of the data blocks, and
+	// its flags.
+	valuesKey             = "values"
+	valueEncodingDelta    = 1
+	valueEncodingPointers = 2
+
+	// Metaindex key of the value log files pointed to by the table.
+	valueLogsKey = "values.logs"
 )
 
 type blockHandle struct {
@@ -171,3 +222,95 @@ func encodeBlockHandle(dst []byte, b blockHandle) int {
 	m := binary.PutUvarint(dst[n:], b.length)
 	return n + m
 }
+
+// keyFormat returns the encoding of the internal keys of the tables.
+func keyFormat(o *opt.Options) dbkey.Format {
+	if o.GetBytewiseKeys() {
+		return dbkey.FormatBytewise
+	}
+	return dbkey.FormatLegacy
+}
+
+// merkleLeafHash returns the Merkle leaf hash of the given record, whose
+// key is encoded in the given key format.
+func merkleLeafHash(format merkle.LeafFormat, kf dbkey.Format, ikey, value []byte) merkle.Hash {
+	if format == merkle.LeafFormatLegacy {
+		uvkey, _, _, _ := kf.ParseInternalKey(ikey)
+		return merkle.HashLeaf(uvkey, value)
+	}
+	ukey, version, _, kt, err := kf.ParseInternalKeyWithVersion(ikey)
+	if err != nil {
+		// Too short to carry a version.
+		ukey, _, kt, _ = kf.ParseInternalKey(ikey)
+		version = 0
+	}
+	if format == merkle.LeafFormatValueHash {
+		return merkle.HashLeafValueHash(ukey, version, merkle.LeafKind(kt), merkle.HashValue(value))
+	}
+	return merkle.HashLeafV1(ukey, version, merkle.LeafKind(kt), value)
+}
+
+// merklePointerLeafHash returns the Merkle leaf hash of the given record
+// whose value is stored at the pointer, the leaves committing to the value
+// hash.
+func merklePointerLeafHash(kf dbkey.Format, ikey []byte, p ValuePointer) merkle.Hash {
+	ukey, version, _, kt, err := kf.ParseInternalKeyWithVersion(ikey)
+	if err != nil {
+		ukey, _, kt, _ = kf.ParseInternalKey(ikey)
+		version = 0
+	}
+	return merkle.HashLeafValueHash(ukey, version, merkle.LeafKind(kt), p.Hash)
+}
+
+// VersionRange is the range of the versions of the records of a table, and
+// the highest sequence number among them.
+type VersionRange struct {
+	MinVersion, MaxVersion uint64
+	MaxSeq                 uint64
+}
+
+// Overlaps reports whether the range holds any version of [min, max].
+func (vr VersionRange) Overlaps(min, max uint64) bool {
+	return vr.MinVersion <= max && vr.MaxVersion >= min
+}
+
+// add extends the range with the given record key, encoded in the given
+// key format, it reports false if the key is not a versioned internal key.
+func (vr *VersionRange) add(kf dbkey.Format, ikey []byte, first bool) bool {
+	_, version, seq, _, err := kf.ParseInternalKeyWithVersion(ikey)
+	if err != nil {
+		return false
+	}
+	if first || version < vr.MinVersion {
+		vr.MinVersion = version
+	}
+	if first || version > vr.MaxVersion {
+		vr.MaxVersion = version
+	}
+	if first || seq > vr.MaxSeq {
+		vr.MaxSeq = seq
+	}
+	return true
+}
+
+func (vr VersionRange) encode(dst []byte) int {
+	n := binary.PutUvarint(dst, vr.MinVersion)
+	n += binary.PutUvarint(dst[n:], vr.MaxVersion)
+	n += binary.PutUvarint(dst[n:], vr.MaxSeq)
+	return n
+}
+
+func decodeVersionRange(src []byte) (vr VersionRange, ok bool) {
+	var n, m int
+	if vr.MinVersion, n = binary.Uvarint(src); n <= 0 {
+		return
+	}
+	if vr.MaxVersion, m = binary.Uvarint(src[n:]); m <= 0 {
+		return
+	}
+	n += m
+	if vr.MaxSeq, m = binary.Uvarint(src[n:]); m <= 0 || n+m != len(src) {
+		return
+	}
+	return vr, vr.MinVersion <= vr.MaxVersion
+}
@@ -8,17 +8,44 @@ package table
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
+	"github.com/syndtr/goleveldb/leveldb/dbkey"
 	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/merkle"
 	"github.com/syndtr/goleveldb/leveldb/opt"
 	"github.com/syndtr/goleveldb/leveldb/storage"
 	"github.com/syndtr/goleveldb/leveldb/testutil"
 	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
+// memValueLog is a value log held in memory.
+type memValueLog struct {
+	num  int64
+	data []byte
+}
+
+func (l *memValueLog) Append(value []byte) (ValuePointer, error) {
+	p := ValuePointer{Num: l.num, Offset: uint64(len(l.data)), Length: uint64(len(value)), Hash: merkle.HashValue(value)}
+	l.data = append(l.data, value...)
+	return p, nil
+}
+
+func (l *memValueLog) Read(p ValuePointer) ([]byte, error) {
+	if p.Num != l.num || p.Offset+p.Length > uint64(len(l.data)) {
+		return nil, errors.New("bad value pointer")
+	}
+	value := append([]byte(nil), l.data[p.Offset:p.Offset+p.Length]...)
+	if merkle.HashValue(value) != p.Hash {
+		return nil, errors.New("value hash mismatch")
+	}
+	return value, nil
+}
+
 type tableWrapper struct {
 	*Reader
 }
@@ -89,6 +116,328 @@ var _ = testutil.Defer(func() {
 			})
 		})
 
+		Describe("merkle leaf test", func() {
+			Build := func(format merkle.LeafFormat) *Reader {
+				o := &opt.Options{BlockSize: 512}
+				buf := &bytes.Buffer{}
+				tw := NewWriter(buf, o, nil, 0)
+				tw.merkleLeafFormat = format
+				Expect(tw.Append(dbkey.MakeInternalKeyWithVersion(nil, []byte("k01"), 1, 1, dbkey.KeyTypeVal), nil)).ShouldNot(HaveOccurred())
+				Expect(tw.Append(dbkey.MakeInternalKeyWithVersion(nil, []byte("k02"), 2, 2, dbkey.KeyTypeDel), nil)).ShouldNot(HaveOccurred())
+				Expect(tw.Close()).ShouldNot(HaveOccurred())
+				tr, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()), storage.FileDesc{}, nil, nil, o)
+				Expect(err).ShouldNot(HaveOccurred())
+				return tr
+			}
+			Prove := func(tr *Reader, key []byte) *merkle.MerkleProof {
+				_, _, proof, err := tr.GetWithProof(key, nil)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(proof).ShouldNot(BeNil())
+				return proof
+			}
+
+			It("Should commit to the key type", func() {
+				tr := Build(merkle.LeafFormatCurrent)
+				Expect(tr.merkleLeafFormat).Should(Equal(merkle.LeafFormatV1))
+				proof := Prove(tr, dbkey.MakeInternalKeyWithVersion(nil, []byte("k02"), 2, 2, dbkey.KeyTypeDel))
+				Expect(proof.LeafFormat).Should(Equal(merkle.LeafFormatV1))
+				Expect(proof.Verify(merkle.HashLeafV1([]byte("k02"), 2, merkle.LeafKindDelete, nil))).Should(BeTrue())
+				Expect(proof.Verify(merkle.HashLeafV1([]byte("k02"), 2, merkle.LeafKindValue, nil))).Should(BeFalse())
+			})
+
+			It("Should read tables with legacy leaves", func() {
+				tr := Build(merkle.LeafFormatLegacy)
+				Expect(tr.merkleLeafFormat).Should(Equal(merkle.LeafFormatLegacy))
+				proof := Prove(tr, dbkey.MakeInternalKeyWithVersion(nil, []byte("k01"), 1, 1, dbkey.KeyTypeVal))
+				Expect(proof.LeafFormat).Should(Equal(merkle.LeafFormatLegacy))
+				Expect(proof.Verify(merkle.HashLeaf(dbkey.MakeUVKey(nil, []byte("k01"), 1), nil))).Should(BeTrue())
+			})
+
+			It("Should commit to the value hash", func() {
+				o := &opt.Options{BlockSize: 512, MerkleValueHash: true}
+				buf := &bytes.Buffer{}
+				tw := NewWriter(buf, o, nil, 0)
+				ikey := dbkey.MakeInternalKeyWithVersion(nil, []byte("k01"), 1, 1, dbkey.KeyTypeVal)
+				Expect(tw.Append(ikey, []byte("large value"))).ShouldNot(HaveOccurred())
+				Expect(tw.Close()).ShouldNot(HaveOccurred())
+				tr, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()), storage.FileDesc{}, nil, nil, nil)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(tr.merkleLeafFormat).Should(Equal(merkle.LeafFormatValueHash))
+				proof := Prove(tr, ikey)
+				Expect(proof.LeafFormat).Should(Equal(merkle.LeafFormatValueHash))
+				valueHash := merkle.HashValue([]byte("large value"))
+				Expect(proof.Verify(merkle.HashLeafValueHash([]byte("k01"), 1, merkle.LeafKindValue, valueHash))).Should(BeTrue())
+				Expect(proof.Verify(merkle.HashLeafV1([]byte("k01"), 1, merkle.LeafKindValue, valueHash[:]))).Should(BeFalse())
+			})
+
+			It("Should verify the tree against the data blocks", func() {
+				tr := Build(merkle.LeafFormatCurrent)
+				mv, err := tr.VerifyMerkle(nil)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(mv.State).Should(Equal(MerkleValid))
+				Expect(tr.GetMerkleRoot()).Should(Equal(mv.Root))
+				Expect(mv.Entries).Should(Equal(2))
+				Expect(mv.First).Should(Equal([]byte(dbkey.MakeInternalKeyWithVersion(nil, []byte("k01"), 1, 1, dbkey.KeyTypeVal))))
+				Expect(mv.Last).Should(Equal([]byte(dbkey.MakeInternalKeyWithVersion(nil, []byte("k02"), 2, 2, dbkey.KeyTypeDel))))
+
+				o := &opt.Options{BlockSize: 512}
+				buf := &bytes.Buffer{}
+				tw := NewWriter(buf, o, nil, 0)
+				tw.enableMerkle = false
+				Expect(tw.Append(dbkey.MakeInternalKeyWithVersion(nil, []byte("k01"), 1, 1, dbkey.KeyTypeVal), nil)).ShouldNot(HaveOccurred())
+				Expect(tw.Close()).ShouldNot(HaveOccurred())
+				tr, err = NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()), storage.FileDesc{}, nil, nil, o)
+				Expect(err).ShouldNot(HaveOccurred())
+				mv, err = tr.VerifyMerkle(nil)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(mv.State).Should(Equal(MerkleMissing))
+			})
+
+			It("Should build the tree as of the Merkle mode", func() {
+				ikey := dbkey.MakeInternalKeyWithVersion(nil, []byte("k01"), 1, 1, dbkey.KeyTypeVal)
+				Write := func(mode opt.MerkleMode, build bool) *Reader {
+					o := &opt.Options{BlockSize: 512, MerkleMode: mode}
+					buf := &bytes.Buffer{}
+					tw := NewWriter(buf, o, nil, 0)
+					if build {
+						tw.SetMerkle(true)
+					}
+					Expect(tw.Append(ikey, []byte("v01"))).ShouldNot(HaveOccurred())
+					Expect(tw.Close()).ShouldNot(HaveOccurred())
+					tr, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()), storage.FileDesc{}, nil, nil, o)
+					Expect(err).ShouldNot(HaveOccurred())
+					return tr
+				}
+				Expect(Write(opt.MerkleEager, false).HasMerkle()).Should(BeTrue())
+				Expect(Write(opt.MerkleDeferred, false).HasMerkle()).Should(BeFalse())
+				Expect(Write(opt.MerkleOff, false).HasMerkle()).Should(BeFalse())
+
+				tr := Write(opt.MerkleDeferred, true)
+				Expect(tr.HasMerkle()).Should(BeTrue())
+				Expect(Prove(tr, ikey).Verify(merkle.HashLeafV1([]byte("k01"), 1, merkle.LeafKindValue, []byte("v01")))).Should(BeTrue())
+			})
+
+			It("Should build the same tree on a Merkle pool", func() {
+				const n = 2*merkleLeavesBatch + 100
+				Write := func(pool *merkle.Pool) *Reader {
+					o := &opt.Options{BlockSize: 512}
+					buf := &bytes.Buffer{}
+					tw := NewWriter(buf, o, nil, 0)
+					tw.SetMerklePool(pool)
+					for i := 0; i < n; i++ {
+						ikey := dbkey.MakeInternalKeyWithVersion(nil, []byte(fmt.Sprintf("k%06d", i)), 1, uint64(i+1), dbkey.KeyTypeVal)
+						Expect(tw.Append(ikey, []byte(fmt.Sprintf("v%d", i)))).ShouldNot(HaveOccurred())
+					}
+					Expect(tw.Close()).ShouldNot(HaveOccurred())
+					tr, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()), storage.FileDesc{}, nil, nil, o)
+					Expect(err).ShouldNot(HaveOccurred())
+					return tr
+				}
+				root, err := Write(nil).GetMerkleRoot()
+				Expect(err).ShouldNot(HaveOccurred())
+				tr := Write(merkle.NewPool(4))
+				Expect(tr.GetMerkleRoot()).Should(Equal(root))
+				mv, err := tr.VerifyMerkle(nil)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(mv.State).Should(Equal(MerkleValid))
+				Expect(mv.Entries).Should(Equal(n))
+				ikey := dbkey.MakeInternalKeyWithVersion(nil, []byte(fmt.Sprintf("k%06d", n-1)), 1, uint64(n), dbkey.KeyTypeVal)
+				Expect(Prove(tr, ikey).Verify(merkle.HashLeafV1([]byte(fmt.Sprintf("k%06d", n-1)), 1, merkle.LeafKindValue, []byte(fmt.Sprintf("v%d", n-1))))).Should(BeTrue())
+			})
+		})
+
+		Describe("delta values test", func() {
+			Value := func(key string, version uint64) []byte {
+				value := bytes.Repeat([]byte(key), 100)
+				copy(value[version*7:], fmt.Sprintf("@%d", version))
+				return value
+			}
+			Build := func(deltaValues bool) (*Reader, int, [][]byte) {
+				o := &opt.Options{
+					BlockSize:            4096,
+					BlockRestartInterval: 4,
+					Compression:          opt.NoCompression,
+					BytewiseKeys:         true,
+					DeltaValues:          deltaValues,
+				}
+				buf := &bytes.Buffer{}
+				tw := NewWriter(buf, o, nil, 0)
+				var keys [][]byte
+				for _, key := range []string{"k01", "k02", "k03"} {
+					for version := uint64(20); version > 0; version-- {
+						ikey := dbkey.FormatBytewise.MakeInternalKeyWithVersion(nil, []byte(key), version, version, dbkey.KeyTypeVal)
+						Expect(tw.Append(ikey, Value(key, version))).ShouldNot(HaveOccurred())
+						keys = append(keys, ikey)
+					}
+				}
+				Expect(tw.Close()).ShouldNot(HaveOccurred())
+				tr, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()), storage.FileDesc{}, nil, nil, o)
+				Expect(err).ShouldNot(HaveOccurred())
+				return tr, buf.Len(), keys
+			}
+			Record := func(ikey []byte) (string, uint64) {
+				ukey, version, _, _, err := dbkey.FormatBytewise.ParseInternalKeyWithVersion(ikey)
+				Expect(err).ShouldNot(HaveOccurred())
+				return string(ukey), version
+			}
+
+			It("Should shrink the tables", func() {
+				tr, size, _ := Build(true)
+				Expect(tr.deltaValues).Should(BeTrue())
+				plain, plainSize, _ := Build(false)
+				Expect(plain.deltaValues).Should(BeFalse())
+				Expect(size).Should(BeNumerically("<", plainSize/2))
+			})
+
+			It("Should rebuild the values", func() {
+				tr, _, keys := Build(true)
+				for _, ikey := range keys {
+					key, version := Record(ikey)
+					value, err := tr.Get(ikey, nil)
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(value).Should(Equal(Value(key, version)))
+				}
+
+				iter := tr.NewIterator(nil, nil)
+				for i := range keys {
+					Expect(iter.Next()).Should(BeTrue())
+					Expect(iter.Key()).Should(Equal(keys[i]))
+					key, version := Record(keys[i])
+					Expect(iter.Value()).Should(Equal(Value(key, version)))
+				}
+				Expect(iter.Next()).Should(BeFalse())
+				for i := len(keys) - 1; i >= 0; i-- {
+					Expect(iter.Prev()).Should(BeTrue())
+					Expect(iter.Key()).Should(Equal(keys[i]))
+					key, version := Record(keys[i])
+					Expect(iter.Value()).Should(Equal(Value(key, version)))
+				}
+				Expect(iter.Error()).ShouldNot(HaveOccurred())
+				iter.Release()
+			})
+
+			It("Should commit the Merkle leaves to the full values", func() {
+				tr, _, keys := Build(true)
+				for _, ikey := range keys {
+					key, version := Record(ikey)
+					_, value, proof, err := tr.GetWithProof(ikey, nil)
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(proof.Verify(merkle.HashLeafV1([]byte(key), version, merkle.LeafKindValue, value))).Should(BeTrue())
+				}
+				mv, err := tr.VerifyMerkle(nil)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(mv.State).Should(Equal(MerkleValid))
+				Expect(mv.Entries).Should(Equal(len(keys)))
+			})
+		})
+
+		Describe("value log test", func() {
+			Value := func(version uint64) []byte {
+				if version%2 == 0 {
+					return []byte(fmt.Sprintf("small %d", version))
+				}
+				return bytes.Repeat([]byte(fmt.Sprintf("large %d;", version)), 20)
+			}
+			Options := func() *opt.Options {
+				return &opt.Options{
+					BlockSize:            512,
+					BlockRestartInterval: 4,
+					BytewiseKeys:         true,
+					DeltaValues:          true,
+				}
+			}
+			Open := func(buf *bytes.Buffer, vl ValueLogReader) *Reader {
+				tr, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()), storage.FileDesc{}, nil, nil, Options())
+				Expect(err).ShouldNot(HaveOccurred())
+				tr.SetValueLog(vl)
+				return tr
+			}
+			Build := func(vl *memValueLog) (*bytes.Buffer, [][]byte) {
+				buf := &bytes.Buffer{}
+				tw := NewWriter(buf, Options(), nil, 0)
+				tw.SetValueLog(vl, 100)
+				var keys [][]byte
+				for _, key := range []string{"k01", "k02"} {
+					for version := uint64(9); version > 0; version-- {
+						ikey := dbkey.FormatBytewise.MakeInternalKeyWithVersion(nil, []byte(key), version, version, dbkey.KeyTypeVal)
+						Expect(tw.Append(ikey, Value(version))).ShouldNot(HaveOccurred())
+						keys = append(keys, ikey)
+					}
+				}
+				Expect(tw.ValueLogs()).Should(Equal([]int64{vl.num}))
+				Expect(tw.Close()).ShouldNot(HaveOccurred())
+				return buf, keys
+			}
+			Check := func(tr *Reader, keys [][]byte) {
+				Expect(tr.ValueLogs()).Should(Equal([]int64{7}))
+				iter := tr.NewIterator(nil, nil)
+				for _, ikey := range keys {
+					ukey, version, _, _, err := dbkey.FormatBytewise.ParseInternalKeyWithVersion(ikey)
+					Expect(err).ShouldNot(HaveOccurred())
+					value, err := tr.Get(ikey, nil)
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(value).Should(Equal(Value(version)))
+					_, value, proof, err := tr.GetWithProof(ikey, nil)
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(proof.LeafFormat).Should(Equal(merkle.LeafFormatValueHash))
+					Expect(proof.Verify(merkle.HashLeafValueHash(ukey, version, merkle.LeafKindValue, merkle.HashValue(value)))).Should(BeTrue())
+					Expect(iter.Next()).Should(BeTrue())
+					Expect(iter.Value()).Should(Equal(Value(version)))
+				}
+				Expect(iter.Next()).Should(BeFalse())
+				Expect(iter.Error()).ShouldNot(HaveOccurred())
+				iter.Release()
+				mv, err := tr.VerifyMerkle(nil)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(mv.State).Should(Equal(MerkleValid))
+			}
+
+			It("Should read the values from the value log", func() {
+				vl := &memValueLog{num: 7}
+				buf, keys := Build(vl)
+				Check(Open(buf, vl), keys)
+				Expect(bytes.Contains(vl.data, Value(1))).Should(BeTrue())
+				Expect(bytes.Contains(buf.Bytes(), Value(1))).Should(BeFalse())
+
+				// The values are checked against the pointers.
+				vl.data[0]++
+				_, err := Open(buf, vl).Get(keys[0], nil)
+				Expect(err).Should(HaveOccurred())
+				_, err = Open(buf, nil).Get(keys[2], nil)
+				Expect(err).Should(HaveOccurred())
+			})
+
+			It("Should copy the raw values", func() {
+				vl := &memValueLog{num: 7}
+				buf, keys := Build(vl)
+				tr := Open(buf, vl)
+				root, err := tr.GetMerkleRoot()
+				Expect(err).ShouldNot(HaveOccurred())
+
+				copied := &bytes.Buffer{}
+				tw := NewWriter(copied, Options(), nil, 0)
+				tw.SetValueLog(nil, 0)
+				plain := NewWriter(&bytes.Buffer{}, Options(), nil, 0)
+				iter := tr.NewRawIterator(nil, nil)
+				for iter.Next() {
+					Expect(tw.AppendRaw(iter.Key(), iter.Value())).ShouldNot(HaveOccurred())
+					if err := plain.AppendRaw(iter.Key(), iter.Value()); err != nil {
+						Expect(err.Error()).Should(ContainSubstring("value pointer without value log"))
+					}
+				}
+				Expect(iter.Error()).ShouldNot(HaveOccurred())
+				iter.Release()
+				Expect(tw.Close()).ShouldNot(HaveOccurred())
+				Expect(plain.Close()).Should(HaveOccurred())
+
+				n := len(vl.data)
+				tr = Open(copied, vl)
+				Check(tr, keys)
+				Expect(len(vl.data)).Should(Equal(n))
+				Expect(tr.GetMerkleRoot()).Should(Equal(root))
+			})
+		})
+
 		Describe("read test", func() {
 			Build := func(kv testutil.KeyValue) testutil.DB {
 				o := &opt.Options{
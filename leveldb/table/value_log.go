@@ -0,0 +1,111 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package table
+
+import (
+	"encoding/binary"
+	"sort"
+
+	"github.com/syndtr/goleveldb/leveldb/merkle"
+)
+
+// ValuePointer locates a value stored out of a table, in a value log file.
+type ValuePointer struct {
+	Num    int64  // number of the value log file
+	Offset uint64 // offset of the value in the file
+	Length uint64
+	Hash   merkle.Hash // hash of the value, see merkle.HashValue
+}
+
+func (p ValuePointer) encode(dst []byte) []byte {
+	var buf [3 * binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], uint64(p.Num))
+	n += binary.PutUvarint(buf[n:], p.Offset)
+	n += binary.PutUvarint(buf[n:], p.Length)
+	return append(append(dst, buf[:n]...), p.Hash[:]...)
+}
+
+func decodeValuePointer(src []byte) (p ValuePointer, ok bool) {
+	var fields [3]uint64
+	for i := range fields {
+		v, n := binary.Uvarint(src)
+		if n <= 0 {
+			return
+		}
+		fields[i], src = v, src[n:]
+	}
+	if len(src) != merkle.HashSize || fields[0] > 1<<63-1 {
+		return
+	}
+	p.Num, p.Offset, p.Length = int64(fields[0]), fields[1], fields[2]
+	copy(p.Hash[:], src)
+	return p, true
+}
+
+// RawValuePointer returns the pointer held by the given raw value, as
+// returned by the iterators of Reader.NewRawIterator. It reports false if
+// the value is stored in the table.
+func RawValuePointer(raw []byte) (ValuePointer, bool) {
+	if len(raw) == 0 || raw[0] != valuePointer {
+		return ValuePointer{}, false
+	}
+	return decodeValuePointer(raw[1:])
+}
+
+// ValueLogWriter stores the values split out of a table by its Writer.
+type ValueLogWriter interface {
+	// Append appends the value to a value log file, and returns its
+	// pointer.
+	Append(value []byte) (ValuePointer, error)
+}
+
+// ValueLogReader reads the values split out of a table for its Reader.
+type ValueLogReader interface {
+	// Read returns the value at the given pointer. It must check the value
+	// against the hash held by the pointer.
+	Read(p ValuePointer) ([]byte, error)
+}
+
+// valueLogs is the sorted set of the numbers of the value log files pointed
+// to by a table.
+type valueLogs []int64
+
+func (s *valueLogs) add(num int64) {
+	i := sort.Search(len(*s), func(i int) bool { return (*s)[i] >= num })
+	if i < len(*s) && (*s)[i] == num {
+		return
+	}
+	*s = append(*s, 0)
+	copy((*s)[i+1:], (*s)[i:])
+	(*s)[i] = num
+}
+
+func (s valueLogs) encode(dst []byte) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	dst = append(dst, buf[:binary.PutUvarint(buf[:], uint64(len(s)))]...)
+	for _, num := range s {
+		dst = append(dst, buf[:binary.PutUvarint(buf[:], uint64(num))]...)
+	}
+	return dst
+}
+
+func decodeValueLogs(src []byte) (s valueLogs, ok bool) {
+	count, n := binary.Uvarint(src)
+	if n <= 0 || count > uint64(len(src)) {
+		return
+	}
+	src = src[n:]
+	s = make(valueLogs, 0, count)
+	for ; count > 0; count-- {
+		num, n := binary.Uvarint(src)
+		if n <= 0 || num > 1<<63-1 || (len(s) > 0 && int64(num) <= s[len(s)-1]) {
+			return nil, false
+		}
+		s, src = append(s, int64(num)), src[n:]
+	}
+	return s, len(src) == 0
+}
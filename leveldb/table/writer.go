@@ -7,15 +7,16 @@
 package table
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 
 	"github.com/golang/snappy"
-	"github.com/syndtr/goleveldb/leveldb/dbkey"
 
 	"github.com/syndtr/goleveldb/leveldb/comparer"
+	"github.com/syndtr/goleveldb/leveldb/dbkey"
 	"github.com/syndtr/goleveldb/leveldb/filter"
 	"github.com/syndtr/goleveldb/leveldb/merkle"
 	"github.com/syndtr/goleveldb/leveldb/opt"
@@ -146,6 +147,46 @@ func (w *filterWriter) generate() {
 	}
 }
 
+// Limits of the batches of leaves hashed on the pool, see
+// Writer.SetMerklePool.
+const (
+	merkleLeavesBatch     = 4096
+	merkleLeavesBatchSize = 1 << 20
+)
+
+// merkleLeaf is a Merkle leaf pending hashing, its key and value being
+// copied into the buffer of merkleLeaves.
+type merkleLeaf struct {
+	offset, keyLen, valueLen int
+	pointer                  bool
+	p                        ValuePointer
+}
+
+// merkleLeaves buffers the Merkle leaves of a table writer pending hashing.
+type merkleLeaves struct {
+	buf    []byte
+	leaves []merkleLeaf
+}
+
+// add buffers the given leaf, and reports whether the batch is full.
+func (l *merkleLeaves) add(key, value []byte, p *ValuePointer) bool {
+	leaf := merkleLeaf{offset: len(l.buf), keyLen: len(key)}
+	l.buf = append(l.buf, key...)
+	if p != nil {
+		leaf.pointer, leaf.p = true, *p
+	} else {
+		leaf.valueLen = len(value)
+		l.buf = append(l.buf, value...)
+	}
+	l.leaves = append(l.leaves, leaf)
+	return len(l.leaves) >= merkleLeavesBatch || len(l.buf) >= merkleLeavesBatchSize
+}
+
+func (l *merkleLeaves) reset() {
+	l.buf = l.buf[:0]
+	l.leaves = l.leaves[:0]
+}
+
 // Writer is a table writer.
 type Writer struct {
 	writer io.Writer
@@ -171,9 +212,26 @@ type Writer struct {
 	compressionScratch []byte
 
 	// Merkle tree support
-	merkleBuilder *merkle.TreeBuilder // Merkle tree builder for key-value pairs
-	merkleTree    *merkle.MerkleNode  // Root of Merkle tree
-	enableMerkle  bool                // Enable Merkle tree generation
+	merkleBuilder    *merkle.TreeBuilder // Merkle tree builder for key-value pairs
+	merkleTree       *merkle.MerkleNode  // Root of Merkle tree
+	enableMerkle     bool                // Enable Merkle tree generation
+	merkleLeafFormat merkle.LeafFormat   // Encoding of the Merkle leaves
+	keyFormat        dbkey.Format        // Encoding of the internal keys
+	merklePool       *merkle.Pool        // Pool hashing the leaves, see SetMerklePool
+	merkleLeaves     merkleLeaves        // Leaves pending hashing on the pool
+
+	versions   VersionRange
+	versionsOK bool // whether every key so far is a versioned internal key
+
+	deltaValues  bool   // whether the data values may be deltas, see deltaValue
+	prevValue    []byte // full value of the preceding entry of the data block
+	prevPointer  bool   // whether the preceding entry is a value pointer
+	valueScratch []byte
+
+	valuePointers     bool // whether the data values may be value pointers
+	valueLog          ValueLogWriter
+	valueLogThreshold int
+	valueLogs         valueLogs
 }
 
 func (w *Writer) writeBlock(buf *util.Buffer, compression opt.Compression) (bh blockHandle, err error) {
@@ -260,6 +318,36 @@ func (w *Writer) finishBlock() error {
 //
 // It is safe to modify the contents of the arguments after Append returns.
 func (w *Writer) Append(key, value []byte) error {
+	return w.append(key, value, nil)
+}
+
+// AppendRaw is like Append, but takes a raw value, as returned by the
+// iterators of Reader.NewRawIterator. A value stored in a value log is
+// appended as its pointer, without being read; the writer must then have a
+// value log, see SetValueLog.
+func (w *Writer) AppendRaw(key, raw []byte) error {
+	if w.err != nil {
+		return w.err
+	}
+	if len(raw) > 0 {
+		switch raw[0] {
+		case valueFull:
+			return w.append(key, raw[1:], nil)
+		case valuePointer:
+			if !w.valuePointers {
+				w.err = errors.New("leveldb/table: Writer: value pointer without value log")
+				return w.err
+			}
+			if p, ok := decodeValuePointer(raw[1:]); ok {
+				return w.append(key, nil, &p)
+			}
+		}
+	}
+	w.err = fmt.Errorf("leveldb/table: Writer: invalid raw value %q", raw)
+	return w.err
+}
+
+func (w *Writer) append(key, value []byte, p *ValuePointer) error {
 	if w.err != nil {
 		return w.err
 	}
@@ -271,21 +359,46 @@ func (w *Writer) Append(key, value []byte) error {
 	if err := w.flushPendingBH(key); err != nil {
 		return err
 	}
+	// Split the value out of the table if large enough.
+	if p == nil && w.valueLog != nil && w.valueLogThreshold > 0 && len(value) >= w.valueLogThreshold {
+		vp, err := w.valueLog.Append(value)
+		if err != nil {
+			w.err = err
+			return w.err
+		}
+		p = &vp
+	}
 	// Append key/value pair to the data block.
-	if err := w.dataBlock.append(key, value); err != nil {
+	blockValue := value
+	if p != nil {
+		blockValue = p.encode(append(w.valueScratch[:0], valuePointer))
+		w.valueScratch = blockValue
+		w.valueLogs.add(p.Num)
+		w.prevValue = w.prevValue[:0]
+		w.prevPointer = true
+	} else if w.deltaValues || w.valuePointers {
+		blockValue = w.deltaValue(key, value)
+	}
+	if err := w.dataBlock.append(key, blockValue); err != nil {
 		return err
 	}
 	// Add key to the filter block.
 	w.filterBlock.add(key)
+	// Extend the version range.
+	w.versionsOK = (w.nEntries == 0 || w.versionsOK) && w.versions.add(w.keyFormat, key, w.nEntries == 0)
 
 	// Add key-value hash to Merkle tree builder if enabled
-	if w.enableMerkle && w.merkleBuilder != nil {
-		// Use hash as both key and value for the tree builder
-		// This way we only store hashes, not the actual key-value pairs
-		uvkey, _, _, _ := dbkey.ParseInternalKey(key)
-		if err := w.merkleBuilder.AddLeaf(uvkey, value); err != nil {
-			w.err = err
-			return w.err
+	if w.enableMerkle && w.merkleBuilder != nil && w.merklePool != nil {
+		// The leaves are hashed by batches on the pool
+		if w.merkleLeaves.add(key, value, p) {
+			w.flushMerkleLeaves()
+		}
+	} else if w.enableMerkle && w.merkleBuilder != nil {
+		// Only the leaf hash is stored, not the actual key-value pair
+		if p != nil {
+			w.merkleBuilder.AddLeafHash(merklePointerLeafHash(w.keyFormat, key, *p))
+		} else {
+			w.merkleBuilder.AddLeafHash(merkleLeafHash(w.merkleLeafFormat, w.keyFormat, key, value))
 		}
 	}
 
@@ -300,6 +413,93 @@ func (w *Writer) Append(key, value []byte) error {
 	return nil
 }
 
+// deltaValue returns the tagged value of the given record for the data
+// block. With delta values, the value is stored as a delta against the
+// value of the preceding entry if that is the next-newer version of the
+// same user key, the record is not a restart point, and the delta is
+// shorter than the value.
+func (w *Writer) deltaValue(key, value []byte) []byte {
+	buf := w.valueScratch[:0]
+	if w.deltaValues && !w.prevPointer && w.dataBlock.nEntries%w.dataBlock.restartInterval != 0 {
+		prevUkey, _, _, _, err0 := w.keyFormat.ParseInternalKeyWithVersion(w.dataBlock.prevKey)
+		ukey, _, _, _, err1 := w.keyFormat.ParseInternalKeyWithVersion(key)
+		if err0 == nil && err1 == nil && bytes.Equal(prevUkey, ukey) {
+			buf = appendDelta(append(buf, valueDelta), w.prevValue, value)
+		}
+	}
+	if len(buf) == 0 || len(buf) > len(value) {
+		buf = append(append(buf[:0], valueFull), value...)
+	}
+	w.prevValue = append(w.prevValue[:0], value...)
+	w.prevPointer = false
+	w.valueScratch = buf
+	return buf
+}
+
+// SetMerkle sets whether the Merkle tree of the table is built, whatever
+// the opt.Options.MerkleMode. It must be called before any Append.
+func (w *Writer) SetMerkle(enabled bool) {
+	w.enableMerkle = enabled
+}
+
+// SetMerklePool sets the pool hashing the leaves and levels of the Merkle
+// tree of the table in parallel, nil hashing them on the caller goroutine.
+// The tree is identical whatever the pool. It must be called before any
+// Append.
+func (w *Writer) SetMerklePool(pool *merkle.Pool) {
+	w.merklePool = pool
+	w.merkleBuilder.SetPool(pool)
+}
+
+// flushMerkleLeaves hashes the pending leaves on the pool and adds them to
+// the Merkle tree builder, in order.
+func (w *Writer) flushMerkleLeaves() {
+	l := &w.merkleLeaves
+	if len(l.leaves) == 0 {
+		return
+	}
+	hashes := make([]merkle.Hash, len(l.leaves))
+	w.merklePool.Run(len(hashes), func(lo, hi int) {
+		for i := lo; i < hi; i++ {
+			leaf := &l.leaves[i]
+			key := l.buf[leaf.offset : leaf.offset+leaf.keyLen]
+			if leaf.pointer {
+				hashes[i] = merklePointerLeafHash(w.keyFormat, key, leaf.p)
+			} else {
+				value := l.buf[leaf.offset+leaf.keyLen : leaf.offset+leaf.keyLen+leaf.valueLen]
+				hashes[i] = merkleLeafHash(w.merkleLeafFormat, w.keyFormat, key, value)
+			}
+		}
+	})
+	for _, h := range hashes {
+		w.merkleBuilder.AddLeafHash(h)
+	}
+	l.reset()
+}
+
+// SetValueLog sets the value log storing the values of at least the given
+// size out of the table, none if the threshold is zero. The Merkle leaves
+// of the table then commit to the hash of the values. It must be called
+// before any Append.
+func (w *Writer) SetValueLog(vl ValueLogWriter, threshold int) {
+	w.valueLog, w.valueLogThreshold = vl, threshold
+	w.valuePointers = true
+	w.merkleLeafFormat = merkle.LeafFormatValueHash
+}
+
+// ValueLogs returns the numbers of the value log files pointed to by the
+// records appended so far, in increasing order.
+func (w *Writer) ValueLogs() []int64 {
+	return w.valueLogs
+}
+
+// VersionRange returns the range of the versions of the records appended
+// so far. It reports false if there is none, or if any of the keys is not
+// a versioned internal key.
+func (w *Writer) VersionRange() (VersionRange, bool) {
+	return w.versions, w.versionsOK
+}
+
 // BlocksLen returns number of blocks written so far.
 func (w *Writer) BlocksLen() int {
 	n := w.indexBlock.nEntries
@@ -353,6 +553,7 @@ func (w *Writer) Close() error {
 	// Build Merkle tree if enabled and has entries
 	var merkleBH blockHandle
 	if w.enableMerkle && w.merkleBuilder != nil && w.nEntries > 0 {
+		w.flushMerkleLeaves()
 		// Build Merkle tree from key-value pairs
 		root, err := w.merkleBuilder.Build()
 		if err != nil {
@@ -397,11 +598,43 @@ func (w *Writer) Close() error {
 			return err
 		}
 	}
-	// Add Merkle tree block handle to metaindex
+	// Add Merkle leaf format and tree block handle to metaindex. The format
+	// is omitted for legacy leaves, as written by older releases.
 	if merkleBH.length > 0 {
-		key := []byte("merkle.tree")
+		if w.merkleLeafFormat != merkle.LeafFormatLegacy {
+			n := binary.PutUvarint(w.scratch[:20], uint64(w.merkleLeafFormat))
+			if err := w.dataBlock.append([]byte(merkleLeafKey), w.scratch[:n]); err != nil {
+				return err
+			}
+		}
 		n := encodeBlockHandle(w.scratch[:20], merkleBH)
-		if err := w.dataBlock.append(key, w.scratch[:n]); err != nil {
+		if err := w.dataBlock.append([]byte(merkleTreeKey), w.scratch[:n]); err != nil {
+			return err
+		}
+	}
+	if w.deltaValues || w.valuePointers {
+		var encoding uint64
+		if w.deltaValues {
+			encoding |= valueEncodingDelta
+		}
+		if w.valuePointers {
+			encoding |= valueEncodingPointers
+		}
+		var buf [binary.MaxVarintLen64]byte
+		n := binary.PutUvarint(buf[:], encoding)
+		if err := w.dataBlock.append([]byte(valuesKey), buf[:n]); err != nil {
+			return err
+		}
+	}
+	if len(w.valueLogs) > 0 {
+		if err := w.dataBlock.append([]byte(valueLogsKey), w.valueLogs.encode(nil)); err != nil {
+			return err
+		}
+	}
+	if w.versionsOK {
+		var buf [3 * binary.MaxVarintLen64]byte
+		n := w.versions.encode(buf[:])
+		if err := w.dataBlock.append([]byte(versionsKey), buf[:n]); err != nil {
 			return err
 		}
 	}
@@ -455,16 +688,22 @@ func NewWriter(f io.Writer, o *opt.Options, pool *util.BufferPool, size int) *Wr
 	bufBytes = bufBytes[:0]
 
 	w := &Writer{
-		writer:          f,
-		cmp:             o.GetComparer(),
-		filter:          o.GetFilter(),
-		compression:     o.GetCompression(),
-		blockSize:       o.GetBlockSize(),
-		comparerScratch: make([]byte, 0),
-		bpool:           pool,
-		dataBlock:       blockWriter{buf: *util.NewBuffer(bufBytes)},
-		enableMerkle:    true,                       // Enable Merkle tree by default
-		merkleBuilder:   merkle.NewTreeBuilder(nil), // Initialize Merkle tree builder
+		writer:           f,
+		cmp:              o.GetComparer(),
+		filter:           o.GetFilter(),
+		compression:      o.GetCompression(),
+		blockSize:        o.GetBlockSize(),
+		comparerScratch:  make([]byte, 0),
+		bpool:            pool,
+		dataBlock:        blockWriter{buf: *util.NewBuffer(bufBytes)},
+		enableMerkle:     o.GetMerkleMode() == opt.MerkleEager,
+		merkleBuilder:    merkle.NewTreeBuilder(nil), // Initialize Merkle tree builder
+		merkleLeafFormat: merkle.LeafFormatCurrent,
+		keyFormat:        keyFormat(o),
+		deltaValues:      o.GetDeltaValues(),
+	}
+	if o.GetMerkleValueHash() || o.GetDedupValues() {
+		w.merkleLeafFormat = merkle.LeafFormatValueHash
 	}
 	// data block
 	w.dataBlock.restartInterval = o.GetBlockRestartInterval()
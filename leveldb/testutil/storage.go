@@ -60,6 +60,7 @@ const (
 	typeJournal
 	typeTable
 	typeTemp
+	typeValueLog
 
 	typeCount
 )
@@ -98,6 +99,8 @@ func flattenType(m StorageMode, t storage.FileType) int {
 		return x + typeTable
 	case storage.TypeTemp:
 		return x + typeTemp
+	case storage.TypeValueLog:
+		return x + typeValueLog
 	default:
 		panic("invalid file type")
 	}
@@ -116,6 +119,8 @@ func listFlattenType(m StorageMode, t storage.FileType) []int {
 			ret = append(ret, x+typeTable)
 		case t&storage.TypeTemp != 0:
 			ret = append(ret, x+typeTemp)
+		case t&storage.TypeValueLog != 0:
+			ret = append(ret, x+typeValueLog)
 		}
 	}
 	switch {
@@ -0,0 +1,434 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package leveldb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/syndtr/goleveldb/leveldb/errors"
+	"github.com/syndtr/goleveldb/leveldb/merkle"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/syndtr/goleveldb/leveldb/table"
+)
+
+// vLog manages the value log files, holding the values split out of the
+// tables, see opt.Options.ValueLogThreshold. A value log file is removed
+// once the last table pointing to it is.
+//
+// With opt.Options.DedupValues, the stored values are indexed by hash, the
+// writers pointing to them rather than storing them again; a writer pins
+// the value log files it points to until its table is added. Each value log
+// file ends with the index of the values it holds, loaded on open, see
+// loadIndex.
+//
+// With opt.Options.ValueLogGCRatio, the oldest value log files are
+// collected: the writers relocate the values they copy from them, and
+// don't deduplicate against them, see gcCutoff.
+type vLog struct {
+	s *session
+
+	mu      sync.Mutex
+	tables  map[int64][]int64 // value log files pointed to by each table
+	refs    map[int64]int     // number of tables and writers pointing to each value log file
+	readers map[int64]storage.Reader
+	closed  bool
+	gcBelow int64 // the value log files numbered below are collected
+
+	index   map[merkle.Hash]table.ValuePointer // stored values, by hash
+	indexed map[int64][]merkle.Hash            // indexed values of each value log file
+
+	dedupN    int64 // number of values deduplicated
+	dedupSize int64 // size of the values deduplicated
+}
+
+// The value log file layout:
+//
+//	values | index | index offset (8-bytes) | magic (8-bytes)
+//
+// The values are stored back to back from the start of the file, the index
+// holding, in order, the uvarint length and the hash of each of them.
+const (
+	vLogFooterLen = 16
+	vLogMagic     = "\x8f\x3a\x6e\x1d\xc2\x57\x04\xb9"
+)
+
+func newValueLog(s *session) *vLog {
+	return &vLog{
+		s:       s,
+		tables:  make(map[int64][]int64),
+		refs:    make(map[int64]int),
+		readers: make(map[int64]storage.Reader),
+		index:   make(map[merkle.Hash]table.ValuePointer),
+		indexed: make(map[int64][]merkle.Hash),
+	}
+}
+
+// active reports whether the new tables may hold value pointers: the value
+// logs are enabled, or some table points to a value log file, its pointers
+// being copied by the compactions.
+func (l *vLog) active() bool {
+	if l.s.o.GetValueLogThreshold() > 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.refs) > 0
+}
+
+// referenced reports whether any table points to the given value log file.
+func (l *vLog) referenced(num int64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.refs[num] > 0
+}
+
+// addTable records the value log files pointed to by the given table.
+func (l *vLog) addTable(t *tFile) {
+	if len(t.valueLogs) == 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, exist := l.tables[t.fd.Num]; exist {
+		return
+	}
+	l.tables[t.fd.Num] = t.valueLogs
+	for _, num := range t.valueLogs {
+		l.refs[num]++
+	}
+}
+
+// removeTable drops the references of the given removed table.
+func (l *vLog) removeTable(tnum int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	nums, exist := l.tables[tnum]
+	if !exist {
+		return
+	}
+	delete(l.tables, tnum)
+	for _, num := range nums {
+		l.unref(num)
+	}
+}
+
+// unref drops a reference to the given value log file, and removes it if
+// nothing points to it anymore. The caller must hold l.mu.
+func (l *vLog) unref(num int64) {
+	if l.refs[num]--; l.refs[num] > 0 {
+		return
+	}
+	delete(l.refs, num)
+	for _, h := range l.indexed[num] {
+		if l.index[h].Num == num {
+			delete(l.index, h)
+		}
+	}
+	delete(l.indexed, num)
+	if r := l.readers[num]; r != nil {
+		r.Close()
+		delete(l.readers, num)
+	}
+	fd := storage.FileDesc{Type: storage.TypeValueLog, Num: num}
+	if err := l.s.stor.Remove(fd); err != nil {
+		l.s.logf("value-log@remove removing @%d %q", num, err)
+	} else {
+		l.s.logf("value-log@remove removed @%d", num)
+	}
+}
+
+// lookup returns the pointer to the stored value of the given hash and
+// length, if any, pinning its value log file, see unpin.
+func (l *vLog) lookup(h merkle.Hash, length int) (table.ValuePointer, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	p, exist := l.index[h]
+	if !exist || p.Length != uint64(length) || p.Num < l.gcBelow {
+		return table.ValuePointer{}, false
+	}
+	l.refs[p.Num]++
+	l.dedupN++
+	l.dedupSize += int64(length)
+	return p, true
+}
+
+// unpin drops the pins of the given value log files, see lookup.
+func (l *vLog) unpin(nums []int64) {
+	if len(nums) == 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, num := range nums {
+		l.unref(num)
+	}
+}
+
+// addIndex indexes the given stored values, the ones of value log files
+// nothing points to or collected being left out.
+func (l *vLog) addIndex(ps ...table.ValuePointer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, p := range ps {
+		if l.refs[p.Num] == 0 || p.Num < l.gcBelow {
+			continue
+		}
+		if q, exist := l.index[p.Hash]; exist && q.Num >= l.gcBelow {
+			continue
+		}
+		l.index[p.Hash] = p
+		l.indexed[p.Num] = append(l.indexed[p.Num], p.Hash)
+	}
+}
+
+// loadIndex indexes the values held by the given value log file, as read
+// from its index.
+func (l *vLog) loadIndex(num int64) error {
+	fd := storage.FileDesc{Type: storage.TypeValueLog, Num: num}
+	r, err := l.s.stor.Open(fd)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if size < vLogFooterLen {
+		return errors.NewErrCorrupted(fd, errors.New("leveldb: value log too short for the footer"))
+	}
+	var footer [vLogFooterLen]byte
+	if _, err := r.ReadAt(footer[:], size-vLogFooterLen); err != nil {
+		return err
+	}
+	offset := binary.LittleEndian.Uint64(footer[:8])
+	if string(footer[8:]) != vLogMagic || offset > uint64(size-vLogFooterLen) {
+		return errors.NewErrCorrupted(fd, errors.New("leveldb: value log bad footer"))
+	}
+	index := make([]byte, uint64(size-vLogFooterLen)-offset)
+	if _, err := r.ReadAt(index, int64(offset)); err != nil {
+		return err
+	}
+	var ps []table.ValuePointer
+	for p := (table.ValuePointer{Num: num}); len(index) > 0; p.Offset += p.Length {
+		length, n := binary.Uvarint(index)
+		if n <= 0 || len(index) < n+merkle.HashSize || length > offset-p.Offset {
+			return errors.NewErrCorrupted(fd, errors.New("leveldb: value log bad index"))
+		}
+		p.Length = length
+		copy(p.Hash[:], index[n:])
+		ps, index = append(ps, p), index[n+merkle.HashSize:]
+	}
+	l.addIndex(ps...)
+	return nil
+}
+
+// gcCutoff returns the number below which the value log files are
+// collected, the oldest ones as per opt.Options.ValueLogGCRatio. The
+// cutoff never decreases, a collected file staying so.
+func (l *vLog) gcCutoff() int64 {
+	ratio := l.s.o.GetValueLogGCRatio()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if ratio == 0 {
+		return l.gcBelow
+	}
+	nums := make([]int64, 0, len(l.refs))
+	for num := range l.refs {
+		nums = append(nums, num)
+	}
+	sort.Slice(nums, func(i, j int) bool { return nums[i] < nums[j] })
+	if n := int(float64(len(nums)) * ratio); n > 0 && nums[n-1] >= l.gcBelow {
+		l.gcBelow = nums[n-1] + 1
+	}
+	return l.gcBelow
+}
+
+// stats returns the number of value log files, and the number and size of
+// the values deduplicated.
+func (l *vLog) stats() (files int, dedupN, dedupSize int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.refs), l.dedupN, l.dedupSize
+}
+
+// Read implements table.ValueLogReader.
+func (l *vLog) Read(p table.ValuePointer) ([]byte, error) {
+	fd := storage.FileDesc{Type: storage.TypeValueLog, Num: p.Num}
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil, ErrClosed
+	}
+	r := l.readers[p.Num]
+	if r == nil {
+		var err error
+		if r, err = l.s.stor.Open(fd); err != nil {
+			l.mu.Unlock()
+			return nil, err
+		}
+		l.readers[p.Num] = r
+	}
+	l.mu.Unlock()
+
+	value := make([]byte, p.Length)
+	if _, err := r.ReadAt(value, int64(p.Offset)); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, errors.NewErrCorrupted(fd, fmt.Errorf("leveldb: value log too short for the value at %d", p.Offset))
+		}
+		return nil, err
+	}
+	if merkle.HashValue(value) != p.Hash {
+		return nil, errors.NewErrCorrupted(fd, fmt.Errorf("leveldb: value log hash mismatch for the value at %d", p.Offset))
+	}
+	if l.s.o.GetDedupValues() {
+		l.addIndex(p)
+	}
+	return value, nil
+}
+
+// close closes the value log files.
+func (l *vLog) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for num, r := range l.readers {
+		r.Close()
+		delete(l.readers, num)
+	}
+	l.closed = true
+}
+
+// vLogWriter appends the values split out of a table to a value log file,
+// created on the first one.
+type vLogWriter struct {
+	l      *vLog
+	fd     storage.FileDesc
+	w      storage.Writer
+	offset uint64
+
+	// The value log files numbered below are collected, their values
+	// relocated rather than their pointers copied.
+	gcBelow int64
+
+	// The index of the values written, see vLog.loadIndex.
+	index []byte
+
+	// With dedup, the values written, by hash, and the value log files
+	// pinned by the values deduplicated.
+	dedup   bool
+	written map[merkle.Hash]table.ValuePointer
+	pinned  []int64
+}
+
+func newValueLogWriter(l *vLog) *vLogWriter {
+	w := &vLogWriter{l: l, dedup: l.s.o.GetDedupValues(), gcBelow: l.gcCutoff()}
+	if w.dedup {
+		w.written = make(map[merkle.Hash]table.ValuePointer)
+	}
+	return w
+}
+
+// Append implements table.ValueLogWriter.
+func (w *vLogWriter) Append(value []byte) (table.ValuePointer, error) {
+	h := merkle.HashValue(value)
+	if w.dedup {
+		if p, exist := w.written[h]; exist && p.Length == uint64(len(value)) {
+			w.l.mu.Lock()
+			w.l.dedupN++
+			w.l.dedupSize += int64(len(value))
+			w.l.mu.Unlock()
+			return p, nil
+		}
+		if p, exist := w.l.lookup(h, len(value)); exist {
+			w.pinned = append(w.pinned, p.Num)
+			return p, nil
+		}
+	}
+	if w.w == nil {
+		if !w.fd.Zero() {
+			return table.ValuePointer{}, errors.New("leveldb: value log is closed")
+		}
+		fd := storage.FileDesc{Type: storage.TypeValueLog, Num: w.l.s.allocFileNum()}
+		fw, err := w.l.s.stor.Create(fd)
+		if err != nil {
+			return table.ValuePointer{}, err
+		}
+		w.fd, w.w = fd, fw
+	}
+	if _, err := w.w.Write(value); err != nil {
+		return table.ValuePointer{}, err
+	}
+	p := table.ValuePointer{
+		Num:    w.fd.Num,
+		Offset: w.offset,
+		Length: uint64(len(value)),
+		Hash:   h,
+	}
+	w.offset += uint64(len(value))
+	var buf [binary.MaxVarintLen64]byte
+	w.index = append(w.index, buf[:binary.PutUvarint(buf[:], p.Length)]...)
+	w.index = append(w.index, h[:]...)
+	if w.dedup {
+		w.written[h] = p
+	}
+	return p, nil
+}
+
+// finish writes the index, syncs and closes the value log file, if any.
+func (w *vLogWriter) finish(noSync bool) error {
+	if w.w == nil {
+		return nil
+	}
+	var footer [vLogFooterLen]byte
+	binary.LittleEndian.PutUint64(footer[:8], w.offset)
+	copy(footer[8:], vLogMagic)
+	if _, err := w.w.Write(append(w.index, footer[:]...)); err != nil {
+		return err
+	}
+	w.index = nil
+	if !noSync {
+		if err := w.w.Sync(); err != nil {
+			return err
+		}
+	}
+	err := w.w.Close()
+	w.w = nil
+	return err
+}
+
+// commit indexes the values written and drops the pins, once the table
+// pointing to them is added, see vLog.addTable.
+func (w *vLogWriter) commit() {
+	if len(w.written) > 0 {
+		ps := make([]table.ValuePointer, 0, len(w.written))
+		for _, p := range w.written {
+			ps = append(ps, p)
+		}
+		w.l.addIndex(ps...)
+		w.written = nil
+	}
+	w.l.unpin(w.pinned)
+	w.pinned = nil
+}
+
+// drop drops the pins and removes the value log file, if any.
+func (w *vLogWriter) drop() error {
+	w.l.unpin(w.pinned)
+	w.pinned = nil
+	if w.fd.Zero() {
+		return nil
+	}
+	if w.w != nil {
+		w.w.Close()
+		w.w = nil
+	}
+	return w.l.s.stor.Remove(w.fd)
+}
@@ -91,19 +91,20 @@ func (v *version) release() {
 }
 
 func (v *version) walkOverlapping(aux tFiles, ikey dbkey.InternalKey, f func(level int, t *tFile) bool, lf func(level int) bool) {
+	v.walkOverlappingVersions(aux, ikey, 0, dbkey.LastestVersion, f, lf)
+}
+
+// walkOverlappingVersions is like walkOverlapping, but skips the tables
+// holding no version of the range [minVersion, maxVersion] as told by
+// their version range.
+func (v *version) walkOverlappingVersions(aux tFiles, ikey dbkey.InternalKey, minVersion, maxVersion uint64, f func(level int, t *tFile) bool, lf func(level int) bool) {
 	// Extract pure ukey (without version and seq) for overlap checking
-	// Key format: ukey | version (8 bytes) | seq+type (8 bytes)
-	var ukey []byte
-	if len(ikey) >= 16 {
-		ukey = ikey[:len(ikey)-16]
-	} else {
-		ukey = ikey.UVkey()
-	}
+	ukey := v.s.icmp.kf.Ukey(ikey)
 
 	// Aux level.
 	if aux != nil {
 		for _, t := range aux {
-			if t.overlapsUkey(v.s.icmp, ukey) {
+			if t.overlapsUkey(v.s.icmp, ukey) && t.mayHoldVersions(minVersion, maxVersion) {
 				if !f(-1, t) {
 					return
 				}
@@ -125,7 +126,7 @@ func (v *version) walkOverlapping(aux tFiles, ikey dbkey.InternalKey, f func(lev
 			// Level-0 files may overlap each other. Find all files that
 			// overlap ukey.
 			for _, t := range tables {
-				if t.overlapsUkey(v.s.icmp, ukey) {
+				if t.overlapsUkey(v.s.icmp, ukey) && t.mayHoldVersions(minVersion, maxVersion) {
 					if !f(level, t) {
 						return
 					}
@@ -134,7 +135,7 @@ func (v *version) walkOverlapping(aux tFiles, ikey dbkey.InternalKey, f func(lev
 		} else {
 			// For non-level-0, find tables that might contain this ukey
 			for _, t := range tables {
-				if t.overlapsUkey(v.s.icmp, ukey) {
+				if t.overlapsUkey(v.s.icmp, ukey) && t.mayHoldVersions(minVersion, maxVersion) {
 					if !f(level, t) {
 						return
 					}
@@ -148,17 +149,27 @@ func (v *version) walkOverlapping(aux tFiles, ikey dbkey.InternalKey, f func(lev
 	}
 }
 
+// queryVersions returns the range of the versions matching a lookup of
+// the given version, which is any version for the latest one.
+func queryVersions(version uint64) (min, max uint64) {
+	if version == dbkey.LastestVersion {
+		return 0, dbkey.LastestVersion
+	}
+	return version, version
+}
+
 func (v *version) get(aux tFiles, ikey dbkey.InternalKey, ro *opt.ReadOptions, noValue bool) (value []byte, tcomp bool, err error) {
 	if v.closing {
 		return nil, false, ErrClosed
 	}
 
 	// Parse query key to get ukey and target version
-	qukey, targetVersion, _, _, qerr := dbkey.ParseInternalKeyWithVersion(ikey)
+	qukey, targetVersion, _, _, qerr := v.s.icmp.kf.ParseInternalKeyWithVersion(ikey)
 	if qerr != nil {
 		return nil, false, qerr
 	}
 	queryLatest := targetVersion == dbkey.LastestVersion
+	minVersion, maxVersion := queryVersions(targetVersion)
 
 	sampleSeeks := !v.s.o.GetDisableSeeksCompaction()
 
@@ -172,13 +183,19 @@ func (v *version) get(aux tFiles, ikey dbkey.InternalKey, ro *opt.ReadOptions, n
 		zversion uint64
 		zkt      dbkey.KeyType
 		zval     []byte
+		zordered bool
 	)
 
 	err = ErrNotFound
 
 	// Since entries never hop across level, finding key/value
 	// in smaller level make later levels irrelevant.
-	v.walkOverlapping(aux, ikey, func(level int, t *tFile) bool {
+	v.walkOverlappingVersions(aux, ikey, minVersion, maxVersion, func(level int, t *tFile) bool {
+		// The latest version can't be in a table holding only lower
+		// versions than the highest one found so far.
+		if queryLatest && zfound && t.hasVersions && t.versions.MaxVersion < zversion {
+			return true
+		}
 		if sampleSeeks && level >= 0 && !tseek {
 			if tset == nil {
 				tset = &tSet{level, t}
@@ -192,7 +209,7 @@ func (v *version) get(aux tFiles, ikey dbkey.InternalKey, ro *opt.ReadOptions, n
 			ferr        error
 		)
 		if noValue {
-			fikey, ferr = v.s.tops.findKey(t, ikey, ro)
+			fikey, ferr = v.s.tops.findKey(t, ikey, true, ro)
 		} else {
 			fikey, fval, ferr = v.s.tops.find(t, ikey, ro)
 		}
@@ -207,7 +224,7 @@ func (v *version) get(aux tFiles, ikey dbkey.InternalKey, ro *opt.ReadOptions, n
 		}
 
 		// Parse as versioned key (all keys must be versioned)
-		fukey, fversion, fseq, fkt, fkerr := dbkey.ParseInternalKeyWithVersion(fikey)
+		fukey, fversion, fseq, fkt, fkerr := v.s.icmp.kf.ParseInternalKeyWithVersion(fikey)
 		if fkerr != nil {
 			err = fkerr
 			return false
@@ -221,7 +238,8 @@ func (v *version) get(aux tFiles, ikey dbkey.InternalKey, ro *opt.ReadOptions, n
 				return true
 			}
 
-			// For queryLatest, always collect the highest version across all levels
+			// For queryLatest, collect the highest version across the levels, down
+			// to the level of a record of an ordered table
 			// For specific version query in level > 0, first match is the best
 			if queryLatest {
 				// Prefer higher version, then higher seq
@@ -231,6 +249,7 @@ func (v *version) get(aux tFiles, ikey dbkey.InternalKey, ro *opt.ReadOptions, n
 					zversion = fversion
 					zkt = fkt
 					zval = fval
+					zordered = t.ordered
 				}
 				// Continue searching for potentially higher versions
 				return true
@@ -275,6 +294,11 @@ func (v *version) get(aux tFiles, ikey dbkey.InternalKey, ro *opt.ReadOptions, n
 			}
 			return false
 		}
+		// The latest version found in an ordered table can't be
+		// outdone by the older records of the deeper levels.
+		if queryLatest && zfound && zordered {
+			return false
+		}
 
 		return true
 	})
@@ -303,21 +327,90 @@ func (v *version) get(aux tFiles, ikey dbkey.InternalKey, ro *opt.ReadOptions, n
 // Returns:
 //   - value: the value of the key
 //   - actualVersion: the actual version found (may differ from query version if querying latest)
-//   - proof: Merkle proof within the SSTable (from leaf to SSTable root)
-//   - layerProof: Merkle proof of the SSTable within its layer (from SSTable root to layer root)
+//   - dbProof: Merkle proof within the SSTable (from leaf to SSTable root) and
+//     of the SSTable within its layer (from SSTable root to layer root), the
+//     master proof is left to the caller
 //   - tcomp: whether table compaction is triggered
-//   - err: error if any
-func (v *version) getWithProof(aux tFiles, ikey dbkey.InternalKey, ro *opt.ReadOptions) (value []byte, actualVersion uint64, proof *merkle.MerkleProof, layerProof *merkle.MerkleProof, tcomp bool, err error) {
+//   - err: error if any, in strict mode an *ErrProofUnavailable error if
+//     the value was found without a complete proof
+//
+// With tombstone, it proves the tombstone found for the key instead, and a
+// value found for it is ErrNotFound.
+func (v *version) getWithProof(aux tFiles, ikey dbkey.InternalKey, ro *opt.ReadOptions, strict, tombstone bool) (value []byte, actualVersion uint64, dbProof *DBProof, tcomp bool, err error) {
+	// The tables whose records were found without proof, only the failure
+	// of the table the value is found in matters.
+	var proofErrs map[*tFile]error
+	find := func(f *tFile, key []byte, ro *opt.ReadOptions) ([]byte, []byte, *merkle.MerkleProof, error) {
+		rkey, rvalue, proof, err := v.s.tops.findWithProof(f, key, ro)
+		if _, ok := err.(*ErrProofUnavailable); ok {
+			if proofErrs == nil {
+				proofErrs = make(map[*tFile]error)
+			}
+			proofErrs[f] = err
+			err = nil
+		}
+		return rkey, rvalue, proof, err
+	}
+	value, actualVersion, proof, foundLevel, foundTable, tcomp, err := v.lookup(aux, ikey, ro, find)
+	switch {
+	case tombstone && err == ErrNotFound && foundTable != nil:
+		err = nil
+	case err != nil:
+		return
+	case tombstone:
+		return nil, 0, nil, tcomp, ErrNotFound
+	}
+
+	// Generate layer proof if we found the key
+	var perr error
+	switch {
+	case foundTable == nil || foundLevel < 0:
+		perr = &ErrProofUnavailable{ProofLinkLayer, "table isn't part of the DB state"}
+	case proof == nil:
+		if perr = proofErrs[foundTable]; perr == nil {
+			perr = &ErrProofUnavailable{ProofLinkData, fmt.Sprintf("table @%d gave no proof", foundTable.fd.Num)}
+		}
+	default:
+		layerProof, lerr := v.generateLayerProof(foundLevel, foundTable, strict)
+		if lerr != nil {
+			perr = &ErrProofUnavailable{ProofLinkLayer, fmt.Sprintf("level %d: %v", foundLevel, lerr)}
+			break
+		}
+		dbProof = &DBProof{
+			DataProof:  proof,
+			LayerProof: layerProof,
+			LayerKind:  merkle.LayerKindLevel,
+			Level:      foundLevel,
+			TableMin:   append([]byte(nil), foundTable.imin.UVkey()...),
+			TableMax:   append([]byte(nil), foundTable.imax.UVkey()...),
+		}
+	}
+	if perr != nil && strict {
+		return nil, 0, nil, tcomp, perr
+	}
+	return
+}
+
+// tableFinder finds the key/value pair whose key is greater than or equal
+// to the given key in a table, with its Merkle proof if it provides one.
+type tableFinder func(f *tFile, key []byte, ro *opt.ReadOptions) (rkey, rvalue []byte, proof *merkle.MerkleProof, err error)
+
+// lookup looks the key up in the SST files with the given finder, the same
+// way as get. It returns the level and table the value was found in, and
+// the proof given by the finder for it. A tombstone is ErrNotFound, along
+// with its version, level, table and proof.
+func (v *version) lookup(aux tFiles, ikey dbkey.InternalKey, ro *opt.ReadOptions, find tableFinder) (value []byte, actualVersion uint64, proof *merkle.MerkleProof, foundLevel int, foundTable *tFile, tcomp bool, err error) {
 	if v.closing {
-		return nil, 0, nil, nil, false, ErrClosed
+		return nil, 0, nil, 0, nil, false, ErrClosed
 	}
 
 	// Parse query key to get ukey and target version
-	qukey, targetVersion, _, _, qerr := dbkey.ParseInternalKeyWithVersion(ikey)
+	qukey, targetVersion, _, _, qerr := v.s.icmp.kf.ParseInternalKeyWithVersion(ikey)
 	if qerr != nil {
-		return nil, 0, nil, nil, false, qerr
+		return nil, 0, nil, 0, nil, false, qerr
 	}
 	queryLatest := targetVersion == dbkey.LastestVersion
+	minVersion, maxVersion := queryVersions(targetVersion)
 
 	sampleSeeks := !v.s.o.GetDisableSeeksCompaction()
 
@@ -326,20 +419,24 @@ func (v *version) getWithProof(aux tFiles, ikey dbkey.InternalKey, ro *opt.ReadO
 		tseek bool
 
 		// Level-0.
-		zfound     bool
-		zseq       uint64
-		zversion   uint64
-		zkt        dbkey.KeyType
-		zval       []byte
-		zproof     *merkle.MerkleProof
-		foundLevel int
-		foundTable *tFile
+		zfound   bool
+		zseq     uint64
+		zversion uint64
+		zkt      dbkey.KeyType
+		zval     []byte
+		zproof   *merkle.MerkleProof
+		zordered bool
 	)
 
 	err = ErrNotFound
 
 	// Walk through levels to find the key
-	v.walkOverlapping(aux, ikey, func(level int, t *tFile) bool {
+	v.walkOverlappingVersions(aux, ikey, minVersion, maxVersion, func(level int, t *tFile) bool {
+		// The latest version can't be in a table holding only lower
+		// versions than the highest one found so far.
+		if queryLatest && zfound && t.hasVersions && t.versions.MaxVersion < zversion {
+			return true
+		}
 		if sampleSeeks && level >= 0 && !tseek {
 			if tset == nil {
 				tset = &tSet{level, t}
@@ -349,7 +446,7 @@ func (v *version) getWithProof(aux tFiles, ikey dbkey.InternalKey, ro *opt.ReadO
 		}
 
 		// Try to get value with proof from table
-		fikey, fval, fproof, ferr := v.s.tops.findWithProof(t, ikey, ro)
+		fikey, fval, fproof, ferr := find(t, ikey, ro)
 
 		switch ferr {
 		case nil:
@@ -361,7 +458,7 @@ func (v *version) getWithProof(aux tFiles, ikey dbkey.InternalKey, ro *opt.ReadO
 		}
 
 		// Parse as versioned key (all keys must be versioned)
-		fukey, fversion, fseq, fkt, fkerr := dbkey.ParseInternalKeyWithVersion(fikey)
+		fukey, fversion, fseq, fkt, fkerr := v.s.icmp.kf.ParseInternalKeyWithVersion(fikey)
 		if fkerr != nil {
 			err = fkerr
 			return false
@@ -375,7 +472,8 @@ func (v *version) getWithProof(aux tFiles, ikey dbkey.InternalKey, ro *opt.ReadO
 				return true
 			}
 
-			// For queryLatest, always collect the highest version across all levels
+			// For queryLatest, collect the highest version across the levels, down
+			// to the level of a record of an ordered table
 			// For specific version query in level > 0, first match is the best
 			if queryLatest {
 				// Prefer higher version, then higher seq
@@ -388,6 +486,7 @@ func (v *version) getWithProof(aux tFiles, ikey dbkey.InternalKey, ro *opt.ReadO
 					zproof = fproof
 					foundLevel = level
 					foundTable = t
+					zordered = t.ordered
 				}
 				// Continue searching for potentially higher versions
 				return true
@@ -415,6 +514,10 @@ func (v *version) getWithProof(aux tFiles, ikey dbkey.InternalKey, ro *opt.ReadO
 						foundTable = t
 						err = nil
 					case dbkey.KeyTypeDel:
+						actualVersion = fversion
+						proof = fproof
+						foundLevel = level
+						foundTable = t
 					default:
 						panic("leveldb: invalid InternalKey type")
 					}
@@ -434,11 +537,18 @@ func (v *version) getWithProof(aux tFiles, ikey dbkey.InternalKey, ro *opt.ReadO
 				proof = zproof
 				err = nil
 			case dbkey.KeyTypeDel:
+				actualVersion = zversion
+				proof = zproof
 			default:
 				panic("leveldb: invalid InternalKey type")
 			}
 			return false
 		}
+		// The latest version found in an ordered table can't be
+		// outdone by the older records of the deeper levels.
+		if queryLatest && zfound && zordered {
+			return false
+		}
 
 		return true
 	})
@@ -453,6 +563,8 @@ func (v *version) getWithProof(aux tFiles, ikey dbkey.InternalKey, ro *opt.ReadO
 			err = nil
 		case dbkey.KeyTypeDel:
 			// Key was deleted
+			actualVersion = zversion
+			proof = zproof
 		default:
 			panic("leveldb: invalid InternalKey type")
 		}
@@ -465,18 +577,42 @@ func (v *version) getWithProof(aux tFiles, ikey dbkey.InternalKey, ro *opt.ReadO
 		tcomp = atomic.CompareAndSwapPointer(&v.cSeek, nil, unsafe.Pointer(tset))
 	}
 
-	// Generate layer proof if we found the key
-	if err == nil && foundTable != nil && foundLevel >= 0 {
-		layerProof, _ = v.generateLayerProof(foundLevel, foundTable)
-	}
-
 	return
 }
 
+// layerLeaves returns the leaves of the layer tree of the given level, one
+// per table, binding the table root to the level and the table key range.
+// The leaves are complete even on error, which reports the first table
+// whose root couldn't be read.
+func (v *version) layerLeaves(level int) (leaves []merkle.Hash, err error) {
+	return v.layerLeavesWith(level, v.s.tops.getMerkleRoot)
+}
+
+// layerLeavesWith is like layerLeaves, with the table roots given by
+// rootOf.
+func (v *version) layerLeavesWith(level int, rootOf func(t *tFile) (merkle.Hash, error)) (leaves []merkle.Hash, err error) {
+	tables := v.levels[level]
+	leaves = make([]merkle.Hash, 0, len(tables))
+	for _, t := range tables {
+		root, rerr := rootOf(t)
+		if rerr != nil {
+			// If we can't get the Merkle root, use a zero hash
+			root = merkle.Hash{}
+			if err == nil {
+				err = fmt.Errorf("table @%d root unreadable: %v", t.fd.Num, rerr)
+			}
+		}
+		leaves = append(leaves, merkle.HashLayerLeaf(level, t.imin.UVkey(), t.imax.UVkey(), root))
+	}
+	return leaves, err
+}
+
 // generateLayerProof generates a Merkle proof for an SSTable within its layer.
-// The leaf nodes are all SSTable root hashes in the layer, and we generate a proof
-// showing that the target SSTable's root is part of the layer's Merkle tree.
-func (v *version) generateLayerProof(level int, targetTable *tFile) (*merkle.MerkleProof, error) {
+// The leaf nodes are the layer leaves of all SSTables in the layer, and we
+// generate a proof showing that the target SSTable is part of the layer's
+// Merkle tree. In strict mode, an unreadable table root of the layer fails
+// the proof.
+func (v *version) generateLayerProof(level int, targetTable *tFile, strict bool) (*merkle.MerkleProof, error) {
 	if level < 0 || level >= len(v.levels) {
 		return nil, fmt.Errorf("invalid level: %d", level)
 	}
@@ -486,21 +622,12 @@ func (v *version) generateLayerProof(level int, targetTable *tFile) (*merkle.Mer
 		return nil, fmt.Errorf("empty level: %d", level)
 	}
 
-	// Collect all SSTable root hashes in this layer
-	sstRoots := make([]merkle.Hash, 0, len(tables))
+	// Find the index of our target table
 	targetIndex := -1
-
 	for i, t := range tables {
-		root, err := v.s.tops.getMerkleRoot(t)
-		if err != nil {
-			// If we can't get the Merkle root, use a zero hash
-			root = merkle.Hash{}
-		}
-		sstRoots = append(sstRoots, root)
-
-		// Find the index of our target table
 		if t == targetTable {
 			targetIndex = i
+			break
 		}
 	}
 
@@ -508,8 +635,12 @@ func (v *version) generateLayerProof(level int, targetTable *tFile) (*merkle.Mer
 		return nil, fmt.Errorf("target table not found in level %d", level)
 	}
 
-	// Build Merkle tree from SSTable roots
-	layerTree := merkle.NewMerkleTree(sstRoots)
+	// Build Merkle tree from the layer leaves
+	leaves, err := v.layerLeaves(level)
+	if err != nil && strict {
+		return nil, err
+	}
+	layerTree := merkle.NewMerkleTreeWithPool(leaves, v.s.merklePool)
 
 	// Generate proof for the target SSTable
 	layerProof, err := layerTree.GenerateProof(targetIndex)
@@ -527,7 +658,7 @@ func (v *version) getVersionHistory(aux tFiles, key []byte, minVersion, maxVersi
 	}
 
 	// Use a temporary internal key for iteration
-	ikey := dbkey.MakeInternalKeyWithVersion(nil, key, dbkey.LastestVersion, dbkey.KeyMaxSeq, dbkey.KeyTypeSeek)
+	ikey := v.s.icmp.kf.MakeInternalKeyWithVersion(nil, key, dbkey.LastestVersion, dbkey.KeyMaxSeq, dbkey.KeyTypeSeek)
 	sampleSeeks := !v.s.o.GetDisableSeeksCompaction()
 
 	var (
@@ -539,7 +670,11 @@ func (v *version) getVersionHistory(aux tFiles, key []byte, minVersion, maxVersi
 	err = ErrNotFound
 
 	// Walk through all levels and collect all matching versions
-	v.walkOverlapping(aux, ikey, func(level int, t *tFile) bool {
+	windowMax := maxVersion
+	if windowMax == 0 {
+		windowMax = dbkey.LastestVersion
+	}
+	v.walkOverlappingVersions(aux, ikey, minVersion, windowMax, func(level int, t *tFile) bool {
 		if sampleSeeks && level >= 0 && !tseek {
 			if tset == nil {
 				tset = &tSet{level, t}
@@ -548,12 +683,17 @@ func (v *version) getVersionHistory(aux tFiles, key []byte, minVersion, maxVersi
 			}
 		}
 
+		// Skip the tables the filter tells don't hold the key.
+		if !v.s.tops.mayContain(t, key) {
+			return true
+		}
+
 		// Use an iterator to scan all entries in this table
 		iter := v.s.tops.newIterator(t, nil, ro)
 		defer iter.Release()
 
 		// Seek to the first possible version of this key
-		seekKey := dbkey.MakeInternalKeyWithVersion(nil, key, dbkey.LastestVersion, dbkey.KeyMaxSeq, dbkey.KeyTypeSeek)
+		seekKey := v.s.icmp.kf.MakeInternalKeyWithVersion(nil, key, dbkey.LastestVersion, dbkey.KeyMaxSeq, dbkey.KeyTypeSeek)
 		if !iter.Seek(seekKey) {
 			return true
 		}
@@ -563,7 +703,7 @@ func (v *version) getVersionHistory(aux tFiles, key []byte, minVersion, maxVersi
 			fikey := iter.Key()
 
 			// Parse as versioned key (all keys must be versioned)
-			fukey, fversion, _, fkt, fkerr := dbkey.ParseInternalKeyWithVersion(fikey)
+			fukey, fversion, _, fkt, fkerr := v.s.icmp.kf.ParseInternalKeyWithVersion(fikey)
 			if fkerr != nil {
 				break
 			}
@@ -642,7 +782,7 @@ func (v *version) getIterators(slice *util.Range, ro *opt.ReadOptions) (its []it
 				its = append(its, v.s.tops.newIterator(t, slice, ro))
 			}
 		} else if len(tables) != 0 {
-			its = append(its, iterator.NewIndexedIterator(tables.newIndexIterator(v.s.tops, v.s.icmp, slice, ro), strict))
+			its = append(its, iterator.NewIndexedIterator(tables.newIndexIterator(v.s.tops, v.s.icmp, slice, ro, false), strict))
 		}
 	}
 	return
@@ -728,6 +868,21 @@ func (v *version) pickMemdbLevel(umin, umax []byte, maxLevel int) (level int) {
 	return
 }
 
+// tableVersions returns the highest version of the tables, and whether
+// one of them lacks a version range, as written by older releases.
+func (v *version) tableVersions() (maxVersion uint64, unversioned bool) {
+	for _, tables := range v.levels {
+		for _, t := range tables {
+			if !t.hasVersions {
+				unversioned = true
+			} else if t.versions.MaxVersion > maxVersion {
+				maxVersion = t.versions.MaxVersion
+			}
+		}
+	}
+	return
+}
+
 func (v *version) computeCompaction() {
 	// Precomputed best level for next compaction
 	bestLevel := int(-1)